@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gdamore/tcell"
@@ -10,40 +11,82 @@ import (
 	"github.com/rivo/tview"
 )
 
-// ChatGUI contains the widgets/state for the chat room view
+// chatTab contains the widgets of a single chat room in the chat view. The lines shown in msgView
+// are kept in lines, so that older chat messages can be added before them
+type chatTab struct {
+	userList *tview.TextView
+	msgView  *tview.TextView
+	lines    [][]byte
+	loading  bool
+}
+
+// write adds a line to the end of the chat message view
+func (tab *chatTab) write(line []byte) {
+	tab.lines = append(tab.lines, line)
+	tab.msgView.Write(line)
+}
+
+// prepend adds lines to the beginning of the chat message view, and scrolls to the top
+func (tab *chatTab) prepend(lines [][]byte) {
+	tab.lines = append(lines, tab.lines...)
+	tab.msgView.Clear()
+	for _, line := range tab.lines {
+		tab.msgView.Write(line)
+	}
+	tab.msgView.ScrollToBeginning()
+}
+
+// clear removes all lines from the chat message view
+func (tab *chatTab) clear() {
+	tab.lines = nil
+	tab.msgView.Clear()
+}
+
+// ChatGUI contains the widgets/state for the chat room view. Every chat room the user
+// is in has its own tab, and only the active tab is shown
 type ChatGUI struct {
 	*GUI
-	SendChatMessageHandler func(message string)
-	LeaveChatHandler       func()
+	SendChatMessageHandler func(chatName, message string) error
+	ChatCommandHandler     func(chatName, command string) error
+	LoadHistoryHandler     func(chatName string) ([]*DecryptedMessage, error)
+	LeaveChatHandler       func(chatName string)
 
-	layout   *tview.Grid
-	userList *tview.TextView
-	msgView  *tview.TextView
-	msgInput *tview.InputField
+	layout    *tview.Grid
+	tabBar    *tview.TextView
+	msgPages  *tview.Pages
+	userPages *tview.Pages
+	msgInput  *tview.InputField
+
+	tabs      map[string]*chatTab
+	tabOrder  []string
+	activeTab string
 }
 
 // Create initializes the widgets in the chat GUI
 func (gui *ChatGUI) Create() {
-	gui.userList = tview.NewTextView()
-	gui.userList.SetDynamicColors(true).
-		SetBorder(true).
-		SetTitle("Users")
+	gui.tabs = make(map[string]*chatTab)
 
-	gui.msgView = tview.NewTextView()
-	gui.msgView.SetDynamicColors(true).
-		SetBorder(true).
-		SetTitle("Chat")
+	gui.tabBar = tview.NewTextView().
+		SetDynamicColors(true)
+
+	gui.msgPages = tview.NewPages()
+	gui.userPages = tview.NewPages()
 
 	sendBtn := tview.NewButton("(Enter) Send")
 	exitBtn := tview.NewButton("(Esc) Leave")
+	tabsBtn := tview.NewButton("(Ctrl-N/P) Tabs")
+	roomsBtn := tview.NewButton("(Ctrl-L) Rooms")
 
 	gui.layout = tview.NewGrid()
-	gui.layout.SetRows(0, 3, 1).
-		SetColumns(20, 1, 20, 0, 30).
-		AddItem(gui.msgView, 0, 0, 1, 4, 0, 0, false).
-		AddItem(gui.userList, 0, 4, 2, 1, 0, 0, false).
-		AddItem(sendBtn, 2, 0, 1, 1, 0, 0, false).
-		AddItem(exitBtn, 2, 2, 1, 1, 0, 0, false)
+	gui.layout.SetRows(1, 0, 3, 1).
+		SetColumns(20, 1, 20, 1, 20, 1, 20, 0, 30).
+		AddItem(gui.tabBar, 0, 0, 1, 9, 0, 0, false).
+		AddItem(gui.msgPages, 1, 0, 1, 8, 0, 0, false).
+		AddItem(gui.userPages, 1, 8, 2, 1, 0, 0, false).
+		AddItem(sendBtn, 3, 0, 1, 1, 0, 0, false).
+		AddItem(exitBtn, 3, 2, 1, 1, 0, 0, false).
+		AddItem(tabsBtn, 3, 4, 1, 1, 0, 0, false).
+		AddItem(roomsBtn, 3, 6, 1, 1, 0, 0, false)
 
 	gui.AddMsgInput()
 }
@@ -57,45 +100,221 @@ func (gui *ChatGUI) AddMsgInput() {
 		SetTitle("Message").
 		SetTitleAlign(tview.AlignLeft)
 
-	gui.layout.AddItem(gui.msgInput, 1, 0, 1, 4, 0, 0, true)
+	gui.layout.AddItem(gui.msgInput, 2, 0, 1, 8, 0, 0, true)
 	gui.app.SetFocus(gui.layout)
 }
 
-// FormatChatMessage formats a chat message to human readable format
-func formatChatMessage(sender string, message []byte, timestamp int64) []byte {
+// AddTab adds a tab for a chat room the user has joined
+func (gui *ChatGUI) AddTab(chatName string) {
+	if _, ok := gui.tabs[chatName]; ok {
+		return
+	}
+
+	tab := &chatTab{
+		userList: tview.NewTextView(),
+		msgView:  tview.NewTextView()}
+	tab.userList.SetDynamicColors(true).
+		SetBorder(true).
+		SetTitle("Users")
+	tab.msgView.SetDynamicColors(true).
+		SetBorder(true).
+		SetTitle(chatName)
+
+	gui.tabs[chatName] = tab
+	gui.tabOrder = append(gui.tabOrder, chatName)
+	gui.msgPages.AddPage(chatName, tab.msgView, true, false)
+	gui.userPages.AddPage(chatName, tab.userList, true, false)
+	gui.writeTabBar()
+}
+
+// RemoveTab removes the tab of a chat room the user has left, and switches to another tab
+func (gui *ChatGUI) RemoveTab(chatName string) {
+	if _, ok := gui.tabs[chatName]; !ok {
+		return
+	}
+
+	delete(gui.tabs, chatName)
+	for i, name := range gui.tabOrder {
+		if name == chatName {
+			gui.tabOrder = append(gui.tabOrder[:i], gui.tabOrder[i+1:]...)
+			break
+		}
+	}
+	gui.msgPages.RemovePage(chatName)
+	gui.userPages.RemovePage(chatName)
+
+	if gui.activeTab == chatName {
+		gui.activeTab = ""
+		if len(gui.tabOrder) != 0 {
+			gui.SwitchTab(gui.tabOrder[0])
+		}
+	}
+	gui.writeTabBar()
+}
+
+// RenameTab changes the chat room name of a tab, when the chat room has been renamed
+func (gui *ChatGUI) RenameTab(oldName, newName string) {
+	tab, ok := gui.tabs[oldName]
+	if !ok {
+		return
+	}
+
+	delete(gui.tabs, oldName)
+	gui.tabs[newName] = tab
+	for i, name := range gui.tabOrder {
+		if name == oldName {
+			gui.tabOrder[i] = newName
+		}
+	}
+
+	// Pages can not be renamed, so add them again with the new name
+	gui.msgPages.RemovePage(oldName)
+	gui.userPages.RemovePage(oldName)
+	gui.msgPages.AddPage(newName, tab.msgView, true, false)
+	gui.userPages.AddPage(newName, tab.userList, true, false)
+	tab.msgView.SetTitle(newName)
+
+	if gui.activeTab == oldName {
+		gui.SwitchTab(newName)
+	}
+	gui.writeTabBar()
+}
+
+// SwitchTab shows the tab of the given chat room
+func (gui *ChatGUI) SwitchTab(chatName string) {
+	if _, ok := gui.tabs[chatName]; !ok {
+		return
+	}
+
+	gui.activeTab = chatName
+	gui.msgPages.SwitchToPage(chatName)
+	gui.userPages.SwitchToPage(chatName)
+	gui.writeTabBar()
+}
+
+// cycleTab switches to the next (or previous, if offset is negative) tab
+func (gui *ChatGUI) cycleTab(offset int) {
+	if len(gui.tabOrder) == 0 {
+		return
+	}
+	for i, name := range gui.tabOrder {
+		if name == gui.activeTab {
+			next := (i + offset + len(gui.tabOrder)) % len(gui.tabOrder)
+			gui.SwitchTab(gui.tabOrder[next])
+			return
+		}
+	}
+}
+
+// HasTabs checks if the user is in any chat rooms
+func (gui *ChatGUI) HasTabs() bool {
+	return len(gui.tabOrder) != 0
+}
+
+// writeTabBar writes the names of the chat rooms the user is in to the tab bar, the active tab is highlighted
+func (gui *ChatGUI) writeTabBar() {
 	var buf bytes.Buffer
+	for _, name := range gui.tabOrder {
+		if name == gui.activeTab {
+			buf.WriteString("[black:white] " + name + " [-:-] ")
+		} else {
+			buf.WriteString("[white] " + name + " ")
+		}
+	}
+	gui.tabBar.Clear()
+	gui.tabBar.Write(buf.Bytes())
+}
 
-	tm := time.Unix(timestamp/1000, 0)
+// FormatChatMessage formats a chat message to human readable format. Messages which are not
+// signed, or where the signature could not be verified, are marked
+func formatChatMessage(msg *DecryptedMessage) []byte {
+	var buf bytes.Buffer
+
+	tm := time.Unix(msg.Timestamp/1000, 0)
 	buf.WriteString(fmt.Sprintf("[dimgray]%02d-%02d %02d:%02d[white]", tm.Day(), tm.Month(), tm.Hour(), tm.Minute()))
+
+	switch msg.Signature {
+	case SignatureMissing:
+		buf.WriteString(" [yellow](unsigned)")
+	case SignatureUnknownSender:
+		buf.WriteString(" [yellow](unverified sender)")
+	case SignatureRevokedDevice:
+		buf.WriteString(" [yellow](signed by a device that was later revoked)")
+	case SignatureOtherRoom:
+		buf.WriteString(fmt.Sprintf(" [yellow](signed in room %s)", msg.ChatName))
+	case SignatureInvalid:
+		buf.WriteString(" [red](INVALID SIGNATURE)")
+	}
+
 	buf.WriteString(" [blue]<")
-	buf.WriteString(string(sender))
+	buf.WriteString(msg.Sender)
 	buf.WriteString("> [white]")
-	buf.WriteString(string(message))
+	if msg.Unavailable {
+		buf.WriteString("[dimgray](this message can no longer be decrypted)[white]")
+	}
+	buf.Write(msg.Message)
 	buf.WriteRune('\n')
 
 	return buf.Bytes()
 }
 
-// MsgInputHandler is the key handler for the chat message input field
+// MsgInputHandler is the key handler for the chat message input field, the message is sent to the active tab.
+// Messages starting with a slash are commands, such as /kick <user>
 func (gui *ChatGUI) MsgInputHandler(key tcell.Key) {
 	if key == tcell.KeyEnter {
-		gui.SendChatMessageHandler(gui.msgInput.GetText())
+		message := gui.msgInput.GetText()
+		chatName := gui.activeTab
 		gui.layout.RemoveItem(gui.msgInput)
 		gui.AddMsgInput()
+
+		if strings.TrimSpace(message) == "" || chatName == "" {
+			return
+		}
+
+		// Encrypting the message for every member can take a while, so do not block the interface
+		go func() {
+			send := gui.SendChatMessageHandler
+			if strings.HasPrefix(message, "/") {
+				send = gui.ChatCommandHandler
+			}
+			if err := send(chatName, message); err != nil {
+				gui.app.QueueUpdate(func() {
+					gui.ShowDialog(err.Error(), nil)
+					gui.app.Draw()
+				})
+			}
+		}()
+	}
+}
+
+// WriteUserList adds the members of the chat room to the list of users, online users are listed first
+func (gui *ChatGUI) WriteUserList(tab *chatTab, cs *ChatSession) {
+	users := cs.Users()
+
+	tab.userList.Clear()
+	for _, user := range users {
+		if user.Online {
+			tab.userList.Write([]byte("[white]" + user.Username + formatRole(cs.Role(user.Username)) + "\n"))
+		}
+	}
+	for _, user := range users {
+		if !user.Online {
+			tab.userList.Write([]byte("[dimgray]" + user.Username + formatRole(cs.Role(user.Username)) + " (offline)\n"))
+		}
 	}
 }
 
-// WriteUserList adds the currently connected users to the list of users
-func (gui *ChatGUI) WriteUserList(cs *ChatSession) {
-	gui.userList.Clear()
-	for _, user := range cs.users {
-		gui.userList.Write([]byte(user.Username + "\n"))
+// formatRole formats the role of a member of a chat room for the list of users
+func formatRole(role string) string {
+	if role == "" {
+		return ""
 	}
+	return " (" + role + ")"
 }
 
 // OnChatInfo is called whenver a ChatInfo message is received from the server. It is responsible for
 // displaying all chat messages and users from the chat room in the interface
-func (gui *ChatGUI) OnChatInfo(err error, cs *ChatSession, chatInfo *websock.ChatInfoMessage) {
+func (gui *ChatGUI) OnChatInfo(err error, cs *ChatSession, messages []*DecryptedMessage) {
 	gui.app.QueueUpdate(func() {
 		if err != nil {
 			gui.ShowDialog(err.Error(), nil)
@@ -103,21 +322,53 @@ func (gui *ChatGUI) OnChatInfo(err error, cs *ChatSession, chatInfo *websock.Cha
 			return
 		}
 
-		gui.msgView.Clear()
-		gui.WriteUserList(cs)
+		tab, ok := gui.tabs[cs.Name()]
+		if !ok {
+			return
+		}
+
+		tab.clear()
+		gui.WriteUserList(tab, cs)
+
+		for _, msg := range messages {
+			tab.write(formatChatMessage(msg))
+		}
+		tab.msgView.ScrollToEnd()
+		gui.app.Draw()
+	})
+}
+
+// OnResumed is called when the chat info of a chat room is received after the session was resumed. The chat
+// messages the client missed are added to the chat message view, and a notice is shown if missedMore is true,
+// because not every missed message was sent by the server
+func (gui *ChatGUI) OnResumed(err error, cs *ChatSession, messages []*DecryptedMessage, missedMore bool) {
+	gui.app.QueueUpdate(func() {
+		if err != nil {
+			gui.ShowDialog(err.Error(), nil)
+			gui.app.Draw()
+			return
+		}
+
+		tab, ok := gui.tabs[cs.Name()]
+		if !ok {
+			return
+		}
 
-		for _, msg := range chatInfo.Messages {
-			fmtMsg := formatChatMessage(msg.Sender, msg.Message, msg.Timestamp)
-			gui.msgView.Write(fmtMsg)
-			gui.msgView.ScrollToEnd()
+		gui.WriteUserList(tab, cs)
+		if missedMore {
+			tab.write([]byte("[yellow]Some messages sent while you were disconnected are not shown\n"))
 		}
+		for _, msg := range messages {
+			tab.write(formatChatMessage(msg))
+		}
+		tab.msgView.ScrollToEnd()
 		gui.app.Draw()
 	})
 }
 
 // OnChatMessage is called whenver a chat message is received from the server. It is responsible for
 // displaying the new chat message in the chat message view
-func (gui *ChatGUI) OnChatMessage(err error, cs *ChatSession, chatMessage *websock.ChatMessage) {
+func (gui *ChatGUI) OnChatMessage(err error, cs *ChatSession, chatMessage *DecryptedMessage) {
 	gui.app.QueueUpdate(func() {
 		if err != nil {
 			gui.ShowDialog(err.Error(), nil)
@@ -125,8 +376,25 @@ func (gui *ChatGUI) OnChatMessage(err error, cs *ChatSession, chatMessage *webso
 			return
 		}
 
-		fmtMsg := formatChatMessage(chatMessage.Sender, chatMessage.Message, chatMessage.Timestamp)
-		gui.msgView.Write(fmtMsg)
+		tab, ok := gui.tabs[cs.Name()]
+		if !ok {
+			return
+		}
+
+		tab.write(formatChatMessage(chatMessage))
+		gui.app.Draw()
+	})
+}
+
+// OnNotice shows a notice from the client in the tab of a chat room, such as an invite the user has created
+func (gui *ChatGUI) OnNotice(chatName, notice string) {
+	gui.app.QueueUpdate(func() {
+		tab, ok := gui.tabs[chatName]
+		if !ok {
+			return
+		}
+
+		tab.write([]byte("[yellow]" + notice + "\n"))
 		gui.app.Draw()
 	})
 }
@@ -141,34 +409,171 @@ func (gui *ChatGUI) OnUserJoined(err error, cs *ChatSession, user *websock.User)
 			return
 		}
 
-		gui.WriteUserList(cs)
+		tab, ok := gui.tabs[cs.Name()]
+		if !ok {
+			return
+		}
+
+		gui.WriteUserList(tab, cs)
 		var buf bytes.Buffer
 		buf.WriteString("[dimgray]")
 		buf.WriteString(user.Username)
 		buf.WriteString(" connected\n")
-		gui.msgView.Write(buf.Bytes())
+		tab.write(buf.Bytes())
+		gui.app.Draw()
+	})
+}
+
+// OnKeyChanged is called when a member of the chat room has changed the key of a device. If the new key was not
+// signed by the old key the client knew, the new key is not used, and the user is warned
+func (gui *ChatGUI) OnKeyChanged(cs *ChatSession, username string, signed bool) {
+	notice := username + "'s key changed"
+	if !signed {
+		notice = "WARNING: " + username + "'s key was changed, but the new key was not signed by the old key. " +
+			"The old key is kept, someone may be trying to read the messages"
+	}
+	gui.OnNotice(cs.Name(), notice)
+}
+
+// OnKeyMismatch is called when the key of a member of the chat room does not match the pinned key. The user is
+// warned, as the server may be trying to read the messages, and messages are not encrypted for the member until
+// the new key is accepted
+func (gui *ChatGUI) OnKeyMismatch(cs *ChatSession, username string) {
+	warning := "WARNING: The key of " + username + " does not match the key seen before. Someone may be trying to " +
+		"read your messages. Compare the safety numbers with /fingerprint " + username + ", and accept the new key " +
+		"with /trust " + username + " only if they match. Until then, messages are not encrypted for " + username + "."
+	gui.app.QueueUpdate(func() {
+		if tab, ok := gui.tabs[cs.Name()]; ok {
+			tab.write([]byte("[red]" + warning + "\n"))
+		}
+		gui.ShowDialog(warning, nil)
 		gui.app.Draw()
 	})
 }
 
 // OnUserLeft is called when the server notifies that a user has left the chat room. It is responsible for
-// removing the user from the displayed list of online users
+// showing the user as offline in the displayed list of users
 func (gui *ChatGUI) OnUserLeft(cs *ChatSession, username string) {
 	gui.app.QueueUpdate(func() {
-		gui.WriteUserList(cs)
+		tab, ok := gui.tabs[cs.Name()]
+		if !ok {
+			return
+		}
+
+		gui.WriteUserList(tab, cs)
 		var buf bytes.Buffer
 		buf.WriteString("[dimgray]")
 		buf.WriteString(username)
 		buf.WriteString(" disconnected\n")
-		gui.msgView.Write(buf.Bytes())
+		tab.write(buf.Bytes())
 		gui.app.Draw()
 	})
 }
 
+// OnLeft is called when the user has left a chat room. The tab of the chat room is removed, and
+// if the user is not in any other chat rooms, the chat rooms interface is shown
+func (gui *ChatGUI) OnLeft(cs *ChatSession) {
+	gui.app.QueueUpdate(func() {
+		gui.RemoveTab(cs.Name())
+		if !gui.HasTabs() {
+			gui.ShowChatRoomGUI(gui.client)
+		}
+		gui.app.Draw()
+	})
+}
+
+// OnRemoved is called when the user has been kicked or banned from a chat room, or the chat room was deleted.
+// The chat session and the tab of the chat room are removed, and the reason is shown to the user
+func (gui *ChatGUI) OnRemoved(cs *ChatSession, reason string) {
+	gui.client.RemoveChatSession(cs.Name())
+	gui.app.QueueUpdate(func() {
+		gui.RemoveTab(cs.Name())
+		if !gui.HasTabs() {
+			gui.ShowChatRoomGUI(gui.client)
+		}
+		gui.ShowDialog(reason, nil)
+		gui.app.Draw()
+	})
+}
+
+// OnRenamed is called when a chat room the user is in has been renamed, the chat session and the tab
+// of the chat room are renamed
+func (gui *ChatGUI) OnRenamed(cs *ChatSession, oldName string) {
+	newName := cs.Name()
+	gui.client.RenameChatSession(oldName, newName)
+	gui.app.QueueUpdate(func() {
+		gui.RenameTab(oldName, newName)
+		if tab, ok := gui.tabs[newName]; ok {
+			tab.write([]byte("[dimgray]The chat room was renamed to " + newName + "\n"))
+		}
+		gui.app.Draw()
+	})
+}
+
+// scrollMessages scrolls the chat message view of the active tab by the given number of lines. When scrolling
+// up at the top of the chat message view, older chat messages are retrieved from the server
+func (gui *ChatGUI) scrollMessages(lines int) {
+	tab, ok := gui.tabs[gui.activeTab]
+	if !ok {
+		return
+	}
+
+	row, _ := tab.msgView.GetScrollOffset()
+	if lines > 0 || row > 0 {
+		row += lines
+		if row < 0 {
+			row = 0
+		}
+		tab.msgView.ScrollTo(row, 0)
+		return
+	}
+
+	if tab.loading {
+		return
+	}
+	tab.loading = true
+	chatName := gui.activeTab
+
+	go func() {
+		messages, err := gui.LoadHistoryHandler(chatName)
+		gui.app.QueueUpdate(func() {
+			tab.loading = false
+			if err != nil {
+				gui.ShowDialog(err.Error(), nil)
+			} else if len(messages) != 0 {
+				lines := make([][]byte, 0, len(messages))
+				for _, msg := range messages {
+					lines = append(lines, formatChatMessage(msg))
+				}
+				tab.prepend(lines)
+			}
+			gui.app.Draw()
+		})
+	}()
+}
+
 // KeyHandler is the keyboard input handler for the chat rooms interface
 func (gui *ChatGUI) KeyHandler(key *tcell.EventKey) *tcell.EventKey {
-	if key.Key() == tcell.KeyEsc {
-		gui.LeaveChatHandler()
+	switch key.Key() {
+	case tcell.KeyEsc:
+		if gui.activeTab != "" {
+			gui.LeaveChatHandler(gui.activeTab)
+		}
+	case tcell.KeyCtrlN:
+		gui.cycleTab(1)
+		return nil
+	case tcell.KeyCtrlP:
+		gui.cycleTab(-1)
+		return nil
+	case tcell.KeyCtrlL:
+		gui.ShowChatRoomGUI(gui.client)
+		return nil
+	case tcell.KeyPgUp:
+		gui.scrollMessages(-10)
+		return nil
+	case tcell.KeyPgDn:
+		gui.scrollMessages(10)
+		return nil
 	}
 	return key
 }
@@ -1,124 +1,732 @@
 package main
 
 import (
-	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
-	"golang.org/x/net/websocket"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
 )
 
-// ChatSession contains the context and callback methods of a chat session
+// SignatureStatus is the result of verifying the signature of a chat message
+type SignatureStatus int
+
+const (
+	// SignatureValid means that the message was signed by the sender
+	SignatureValid SignatureStatus = iota
+	// SignatureMissing means that the message was not signed
+	SignatureMissing
+	// SignatureInvalid means that the signature did not match the message and the senders public key
+	SignatureInvalid
+	// SignatureUnknownSender means that the public key of the sender is not known, so the signature could not be checked
+	SignatureUnknownSender
+	// SignatureRevokedDevice means that the message was signed by a device of the sender which has since been revoked
+	SignatureRevokedDevice
+	// SignatureOtherRoom means that the message was signed in a chat room with the name the server sent, which
+	// is not a name the client knows the chat room had
+	SignatureOtherRoom
+)
+
+// DecryptedMessage is a chat message which has been decrypted and had its signature checked. Unavailable is true
+// if the message could not be decrypted, such as when it was encrypted with a sender key which the client no
+// longer has, then Message is empty.
+// ChatName is the name of the chat room the server says the message was signed in
+type DecryptedMessage struct {
+	Sender      string
+	Timestamp   int64
+	ChatName    string
+	Message     []byte
+	Signature   SignatureStatus
+	Unavailable bool
+}
+
+// ChatSession contains the context and callback methods of the chat session of a single chat room
 type ChatSession struct {
-	DisconnectFunc func()
-	OnChatInfo     func(error, *ChatSession, *websock.ChatInfoMessage)
-	OnChatMessage  func(error, *ChatSession, *websock.ChatMessage)
-	OnUserJoined   func(error, *ChatSession, *websock.User)
-	OnUserLeft     func(*ChatSession, string)
-	Reader         *WSReader
-	Socket         *websocket.Conn
-	PrivateKey     *rsa.PrivateKey
-	AuthKey        []byte
-
-	username string
-	users    map[string]*websock.User
-}
-
-// StartChatSession runs in a separate goroutine and listens for new chat messages and users when a user is in a chat session
-func (cs *ChatSession) StartChatSession() {
-	cs.users = make(map[string]*websock.User, 0)
-
-Loop:
-	for {
-		msg, err := cs.Reader.GetNext()
-		if err != nil {
-			log.Println(err)
-			break
-		}
+	OnLeft        func(*ChatSession)
+	OnChatInfo    func(error, *ChatSession, []*DecryptedMessage)
+	OnResumed     func(error, *ChatSession, []*DecryptedMessage, bool)
+	OnChatMessage func(error, *ChatSession, *DecryptedMessage)
+	OnUserJoined  func(error, *ChatSession, *websock.User)
+	OnUserLeft    func(*ChatSession, string)
+	OnRemoved     func(*ChatSession, string)
+	OnRenamed     func(*ChatSession, string)
+	OnKeyChanged  func(*ChatSession, string, bool)
+	OnKeyMismatch func(*ChatSession, string)
+	Reader        *WSReader
+	KnownKeys     *KnownKeys
 
-		switch msg.Type {
-		case websock.ChatInfo:
-			chatInfo := msg.Message.(*websock.ChatInfoMessage)
-			cs.username = chatInfo.MyUsername
+	// The mutex must be held when accessing name, privateKeys, username, session, users, owner, moderators,
+	// oldest, newest, hasMoreHistory, senderKey and senderKeys (and their chains), and previousNames. name is the
+	// name of the chat room, which changes when it is renamed. session is the session of the client, the user can
+	// be logged in with other sessions as well. privateKeys are the private keys of the device, the current key
+	// first, the previous keys are only used to decrypt the messages sent before the key was changed
+	lock        sync.Mutex
+	name        string
+	privateKeys []*rsa.PrivateKey
+	username    string
+	session     string
+	users       map[string]*websock.User
+	owner       string
+	moderators  map[string]bool
 
-			// Decrypt chat messages
-			err = cs.DecryptChatMessages(chatInfo.Messages...)
+	// previousNames are the names the chat room had before it was renamed while the client was in it, or before
+	// renames signed by the owner, which the chat messages sent before it was renamed are signed with
+	previousNames []string
 
-			// Add users to the user list
-			for i := range chatInfo.Users {
-				cs.users[chatInfo.Users[i].Username] = &chatInfo.Users[i]
-			}
-			cs.OnChatInfo(err, cs, chatInfo)
+	// oldest is the cursor of the oldest chat message the client has received, and
+	// hasMoreHistory is true if there are older messages which can be retrieved
+	oldest         *websock.HistoryCursor
+	hasMoreHistory bool
 
-		case websock.ChatMessageReceived:
-			chatMessage := msg.Message.(*websock.ChatMessage)
-			cs.DecryptChatMessages(chatMessage)
-			cs.OnChatMessage(err, cs, chatMessage)
+	// newest is the cursor of the newest chat message the client has received, the messages after it
+	// are sent by the server when the client resumes its session
+	newest *websock.HistoryCursor
 
-		case websock.UserJoined:
-			user := msg.Message.(*websock.User)
-			cs.users[user.Username] = user
-			cs.OnUserJoined(err, cs, user)
+	// senderKey is the sender key the client encrypts its chat messages with, and senderKeys are the sender
+	// keys chat messages are decrypted with by key ID, including the sender keys of the client
+	senderKey  *ownSenderKey
+	senderKeys map[string]*receivedSenderKey
+}
 
-		case websock.UserLeft:
-			// Remove user from the user list
-			username := msg.Message.(string)
+// HandleMessage is called for every chat event which belongs to the chat room of the chat session
+func (cs *ChatSession) HandleMessage(msg *websock.Message) {
+	switch msg.Type {
+	case websock.ChatInfo:
+		chatInfo := msg.Message.(*websock.ChatInfoMessage)
 
-			// If the user who left is me, quit the chat
-			if username == cs.username {
-				break Loop
+		// Add users to the user list, their public keys are needed to verify the messages
+		cs.lock.Lock()
+		cs.username = chatInfo.MyUsername
+		cs.session = chatInfo.MySession
+		cs.users = make(map[string]*websock.User, len(chatInfo.Users))
+		mismatches := make([]string, 0)
+		for i := range chatInfo.Users {
+			cs.KnownKeys.VerifyDevices(&chatInfo.Users[i])
+			cs.users[chatInfo.Users[i].Username] = &chatInfo.Users[i]
+			if !cs.KnownKeys.Verify(chatInfo.Users[i]) {
+				mismatches = append(mismatches, chatInfo.Users[i].Username)
 			}
+		}
+		cs.owner = chatInfo.Owner
+		cs.moderators = make(map[string]bool, len(chatInfo.Moderators))
+		for _, moderator := range chatInfo.Moderators {
+			cs.moderators[moderator] = true
+		}
+		cs.addPreviousNames(chatInfo.Name, chatInfo.Renames)
+		// When the session is resumed, the messages are the ones the client missed, which follow the messages
+		// it already has. If the client missed more messages than were sent, some messages are not shown
+		missedMore := false
+		if !chatInfo.Resumed || cs.oldest == nil {
+			cs.oldest = nil
+			cs.hasMoreHistory = chatInfo.HasMoreHistory
+			cs.updateOldest(chatInfo.Messages)
+		} else {
+			missedMore = chatInfo.HasMoreHistory
+		}
+		cs.updateNewest(chatInfo.Messages)
+		cs.lock.Unlock()
+
+		// Decrypt chat messages, with the sender keys distributed while the client was not in the chat room
+		cs.addSenderKeys(chatInfo.SenderKeys)
+		messages, err := cs.DecryptChatMessages(chatInfo.Messages...)
+		if !chatInfo.Resumed {
+			cs.stopAtUnavailable(chatInfo.Messages, messages)
+		}
+		if chatInfo.Resumed {
+			cs.OnResumed(err, cs, messages, missedMore)
+		} else {
+			cs.OnChatInfo(err, cs, messages)
+		}
+		for _, username := range mismatches {
+			cs.OnKeyMismatch(cs, username)
+		}
+
+	case websock.ChatMessageReceived:
+		cs.lock.Lock()
+		cs.updateOldest([]*websock.ChatMessage{msg.Message.(*websock.ChatMessage)})
+		cs.updateNewest([]*websock.ChatMessage{msg.Message.(*websock.ChatMessage)})
+		cs.lock.Unlock()
+
+		messages, err := cs.DecryptChatMessages(msg.Message.(*websock.ChatMessage))
+		if err != nil {
+			cs.OnChatMessage(err, cs, nil)
+		} else {
+			cs.OnChatMessage(nil, cs, messages[0])
+		}
+
+	case websock.UserJoined:
+		userJoined := msg.Message.(*websock.UserJoinedMessage)
+		user := userJoined.User
+		cs.KnownKeys.VerifyDevices(&user)
 
+		// Another session of a user who is online does not change the members of the chat room
+		cs.lock.Lock()
+		wasOnline := false
+		if existing, ok := cs.users[user.Username]; ok {
+			wasOnline = existing.Online
+			user.Sessions = addSession(existing.Sessions, userJoined.Session)
+		}
+		cs.users[user.Username] = &user
+		cs.lock.Unlock()
+		go cs.rekey()
+		if !wasOnline {
+			cs.OnUserJoined(nil, cs, &user)
+		}
+		if !cs.KnownKeys.Verify(user) {
+			cs.OnKeyMismatch(cs, user.Username)
+		}
+
+	case websock.UserLeft:
+		userLeft := msg.Message.(*websock.UserLeftMessage)
+		username := userLeft.Username
+
+		// If the session which left is mine, quit the chat. Older servers do not send the session
+		cs.lock.Lock()
+		mine := username == cs.username && (userLeft.Session == "" || userLeft.Session == cs.session)
+		cs.lock.Unlock()
+		if mine {
+			cs.OnLeft(cs)
+			return
+		}
+
+		// A user who left is still a member of the chat room, so keep encrypting messages for him,
+		// unless he was kicked or banned. He is offline when his last session has left
+		cs.lock.Lock()
+		online := false
+		if userLeft.Removed {
 			delete(cs.users, username)
+			delete(cs.moderators, username)
+		} else if user, ok := cs.users[username]; ok {
+			user.Sessions = removeSession(user.Sessions, userLeft.Session)
+			user.Online = len(user.Sessions) > 0
+			online = user.Online
+		}
+		cs.lock.Unlock()
+		if userLeft.Removed {
+			go cs.rekey()
+		}
+		if !online {
 			cs.OnUserLeft(cs, username)
 		}
+
+	case websock.SenderKeyReceived:
+		cs.addSenderKeys([]*websock.SenderKeyMessage{msg.Message.(*websock.SenderKeyMessage)})
+
+	case websock.RemovedFromChat:
+		cs.OnRemoved(cs, msg.Message.(*websock.RemovedFromChatMessage).Reason)
+
+	case websock.ChatRoomRenamed:
+		cs.lock.Lock()
+		oldName := cs.name
+		cs.previousNames = append(cs.previousNames, oldName)
+		cs.name = msg.Message.(*websock.RenameChatRoomMessage).NewName
+		cs.lock.Unlock()
+		cs.OnRenamed(cs, oldName)
+
+	case websock.KeyChanged:
+		keyChanged := msg.Message.(*websock.KeyChangedMessage)
+		signed, trusted := cs.changeKey(keyChanged)
+		cs.OnKeyChanged(cs, keyChanged.Username, signed)
+		if !trusted {
+			cs.OnKeyMismatch(cs, keyChanged.Username)
+		}
+	}
+}
+
+// changeKey replaces the key of a device of a member of the chat room. Returns true if the new key was signed
+// by the old key of the device, and whether the keys of the user are still trusted. A new key which was not
+// signed by the old key is not used, as the server could have made it up. If the old key was pinned and has
+// signed the new key, the new key is pinned instead
+func (cs *ChatSession) changeKey(keyChanged *websock.KeyChangedMessage) (bool, bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	user, ok := cs.users[keyChanged.Username]
+	if !ok {
+		return false, true
+	}
+
+	trusted := cs.KnownKeys.Verify(*user)
+	signed := false
+	if oldKey, ok := deviceKey(*user, keyChanged.Device); ok {
+		pubKey, err := util.UnmarshalPublic(oldKey)
+		signed = err == nil && util.VerifyKeyChange(pubKey, keyChanged.Username, keyChanged.PublicKey, keyChanged.Signature) == nil
+	}
+	if !signed {
+		log.Printf("The new key of %s was not signed by the old key, keeping the old key", keyChanged.Username)
+		return false, trusted
+	}
+
+	// The devices are copied, as copies of the user returned by user share them
+	devices := make([]websock.Device, len(user.Devices))
+	copy(devices, user.Devices)
+	for i := range devices {
+		if devices[i].ID == keyChanged.Device {
+			changes := append([]websock.KeyChange(nil), devices[i].KeyChanges...)
+			devices[i].KeyChanges = append(changes, websock.KeyChange{
+				OldKey:    devices[i].PublicKey,
+				NewKey:    keyChanged.PublicKey,
+				Signature: keyChanged.Signature,
+				Timestamp: util.NowMillis()})
+			devices[i].PublicKey = keyChanged.PublicKey
+		}
+	}
+	user.Devices = devices
+	if keyChanged.Device == "" {
+		user.PublicKey = keyChanged.PublicKey
 	}
 
-	cs.DisconnectFunc()
+	if trusted && signed {
+		cs.KnownKeys.Pin(keyChanged.Username, keyChanged.Device, keyChanged.PublicKey)
+	}
+	return signed, cs.KnownKeys.Verify(*user)
 }
 
-// DecryptChatMessages decrypts chat messages using an RSA private key
-func (cs *ChatSession) DecryptChatMessages(chatMessages ...*websock.ChatMessage) error {
-	for i := range chatMessages {
-		decMsg, err := rsa.DecryptPKCS1v15(rand.Reader, cs.PrivateKey, chatMessages[i].Message)
-		if err != nil {
-			return err
+// privateKey gets the current private key of the device
+func (cs *ChatSession) privateKey() *rsa.PrivateKey {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.privateKeys[0]
+}
+
+// SetPrivateKey changes the private key of the device, after the key has been changed. The previous key is
+// kept to decrypt the messages sent before the key was changed
+func (cs *ChatSession) SetPrivateKey(privKey *rsa.PrivateKey) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.privateKeys = append([]*rsa.PrivateKey{privKey}, cs.privateKeys...)
+}
+
+// decryptWith tries to decrypt a chat message with every private key of the device, the current key first
+func (cs *ChatSession) decryptWith(decrypt func(*rsa.PrivateKey) ([]byte, error)) ([]byte, error) {
+	cs.lock.Lock()
+	privateKeys := cs.privateKeys
+	cs.lock.Unlock()
+
+	var err error
+	for _, privKey := range privateKeys {
+		var decMsg []byte
+		if decMsg, err = decrypt(privKey); err == nil {
+			return decMsg, nil
 		}
-		chatMessages[i].Message = decMsg
 	}
+	return nil, err
+}
 
-	return nil
+// addSession adds a session to the sessions of a user, if it is not already there
+func addSession(sessions []string, session string) []string {
+	for _, s := range sessions {
+		if s == session {
+			return sessions
+		}
+	}
+	return append(sessions, session)
 }
 
-// SendChatMessage sends a chat message in the chat room of the chat session
-// The message is encrypted with every participants public key, and sent to the server
-func (cs *ChatSession) SendChatMessage(message string) {
-	req := &websock.SendChatMessage{
-		EncryptedContent: make(map[string][]byte)}
+// removeSession removes a session from the sessions of a user
+func removeSession(sessions []string, session string) []string {
+	remaining := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		if s != session {
+			remaining = append(remaining, s)
+		}
+	}
+	return remaining
+}
+
+// Name gets the name of the chat room
+func (cs *ChatSession) Name() string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.name
+}
+
+// Username gets the username of the user of the chat session
+func (cs *ChatSession) Username() string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.username
+}
 
-	// For every user in the chat, encrypt the message with their public key
+// Users gets a copy of the members of the chat room, sorted by username
+func (cs *ChatSession) Users() []websock.User {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	users := make([]websock.User, 0, len(cs.users))
 	for _, user := range cs.users {
-		pubKey, err := util.UnmarshalPublic(user.PublicKey)
-		if err != nil {
-			log.Println(err)
-			continue
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Role gets the role of a member of the chat room, which is "owner", "moderator" or an empty string
+func (cs *ChatSession) Role(username string) string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if username == cs.owner {
+		return "owner"
+	} else if cs.moderators[username] {
+		return "moderator"
+	}
+	return ""
+}
+
+// user gets the member of the chat room with the given username
+func (cs *ChatSession) user(username string) (websock.User, bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	user, ok := cs.users[username]
+	if !ok {
+		return websock.User{}, false
+	}
+	return *user, true
+}
+
+// addPreviousNames adds the names the chat room had before the renames which were signed by the owner to the
+// previous names, going back from the current name until a rename which was not signed by the owner. The
+// mutex must be held
+func (cs *ChatSession) addPreviousNames(name string, renames []websock.ChatRename) {
+	owner, ok := cs.users[cs.owner]
+	if !ok {
+		return
+	}
+
+	for i := len(renames) - 1; i >= 0 && renames[i].NewName == name; i-- {
+		rename := renames[i]
+		publicKey, revoked, ok := signingKey(*owner, rename.Device, rename.Timestamp)
+		if !ok || revoked {
+			return
+		}
+		pubKey, err := util.UnmarshalPublic(publicKey)
+		if err != nil || util.VerifyChatRename(pubKey, cs.owner, rename.Name, rename.NewName, rename.Signature) != nil {
+			log.Printf("The rename of %s to %s was not signed by the owner", rename.Name, rename.NewName)
+			return
+		}
+
+		name = rename.Name
+		known := false
+		for _, previous := range cs.previousNames {
+			known = known || previous == name
+		}
+		if !known {
+			cs.previousNames = append(cs.previousNames, name)
+		}
+	}
+}
+
+// updateOldest updates the cursor of the oldest chat message the client has received, the messages must be ordered
+// by timestamp. The mutex must be held
+func (cs *ChatSession) updateOldest(messages []*websock.ChatMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	first := messages[0]
+	if cs.oldest == nil || first.Timestamp < cs.oldest.Timestamp ||
+		(first.Timestamp == cs.oldest.Timestamp && first.ID < cs.oldest.ID) {
+		cs.oldest = &websock.HistoryCursor{Timestamp: first.Timestamp, ID: first.ID}
+	}
+}
+
+// updateNewest updates the cursor of the newest chat message the client has received, the messages must be ordered
+// by timestamp. The mutex must be held
+func (cs *ChatSession) updateNewest(messages []*websock.ChatMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	last := messages[len(messages)-1]
+	if cs.newest == nil || last.Timestamp > cs.newest.Timestamp ||
+		(last.Timestamp == cs.newest.Timestamp && last.ID > cs.newest.ID) {
+		cs.newest = &websock.HistoryCursor{Timestamp: last.Timestamp, ID: last.ID}
+	}
+}
+
+// Newest gets the cursor of the newest chat message the client has received, or nil if it has not received any
+func (cs *ChatSession) Newest() *websock.HistoryCursor {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.newest
+}
+
+// HasMoreHistory checks if there are older chat messages in the chat room, which can be retrieved with LoadHistory
+func (cs *ChatSession) HasMoreHistory() bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.hasMoreHistory
+}
+
+// LoadHistory retrieves the chat messages before the oldest chat message the client has received, ordered by timestamp
+func (cs *ChatSession) LoadHistory() ([]*DecryptedMessage, error) {
+	cs.lock.Lock()
+	req := &websock.GetHistoryMessage{
+		ChatName: cs.name,
+		Before:   cs.oldest}
+	hasMore := cs.hasMoreHistory
+	cs.lock.Unlock()
+
+	if !hasMore {
+		return nil, nil
+	}
+
+	res, err := cs.Reader.Request(&websock.Message{Type: websock.GetHistory, Message: req})
+	if err != nil {
+		return nil, err
+	}
+	history, ok := res.Message.(*websock.HistoryMessage)
+	if !ok {
+		return nil, errors.New("Unexpected response to chat history request")
+	}
+
+	cs.lock.Lock()
+	cs.hasMoreHistory = history.HasMore
+	cs.updateOldest(history.Messages)
+	cs.lock.Unlock()
+
+	messages, err := cs.DecryptChatMessages(history.Messages...)
+	cs.stopAtUnavailable(history.Messages, messages)
+	return messages, err
+}
+
+// stopAtUnavailable stops loading the chat history if the oldest chat message of a page of the history was
+// encrypted with a sender key the client does not have. The client only has the sender keys it received since it
+// joined the chat room, so the older messages encrypted with sender keys can not be decrypted either
+func (cs *ChatSession) stopAtUnavailable(chatMessages []*websock.ChatMessage, decrypted []*DecryptedMessage) {
+	if len(chatMessages) == 0 || len(decrypted) == 0 {
+		return
+	}
+	if chatMessages[0].Version == websock.MessageVersionSenderKey && decrypted[0].Unavailable {
+		cs.lock.Lock()
+		cs.hasMoreHistory = false
+		cs.lock.Unlock()
+	}
+}
+
+// DecryptChatMessages decrypts chat messages using the RSA private keys of the device. Messages in the hybrid formats
+// are decrypted with the message key, which is first decrypted with the private key. The older formats
+// can only be found in the chat history, as the server no longer accepts new messages in these formats, and
+// messages encrypted with RSA only are unavailable.
+// Messages encrypted with a sender key are decrypted with a message key derived from the sender key, and are
+// unavailable if the client no longer has the message key. Any other message which cannot be decrypted is
+// unavailable as well. The signature of every message is checked using the public key of the sender
+func (cs *ChatSession) DecryptChatMessages(chatMessages ...*websock.ChatMessage) ([]*DecryptedMessage, error) {
+	decrypted := make([]*DecryptedMessage, 0, len(chatMessages))
+
+	for _, chatMessage := range chatMessages {
+		var decMsg []byte
+		var err error
+		unavailable := false
+
+		switch chatMessage.Version {
+		case 0, websock.MessageVersionRSA:
+			// Messages encrypted with RSA PKCS #1 v1.5 are not decrypted, as the errors of decrypting ciphertexts
+			// sent by the server would tell it whether their padding is valid
+			log.Printf("Not decrypting message %s, which was encrypted with RSA PKCS #1 v1.5", chatMessage.ID)
+			unavailable = true
+		case websock.MessageVersionHybrid:
+			var key []byte
+			if key, err = cs.decryptWith(func(privKey *rsa.PrivateKey) ([]byte, error) {
+				return util.UnwrapLegacyKey(privKey, chatMessage.Message)
+			}); err == nil {
+				decMsg, err = util.DecryptMessage(chatMessage.Ciphertext, key)
+			}
+		case websock.MessageVersionLabeled:
+			var key []byte
+			if key, err = cs.decryptWith(func(privKey *rsa.PrivateKey) ([]byte, error) {
+				return util.UnwrapKey(privKey, chatMessage.Message)
+			}); err == nil {
+				decMsg, err = util.DecryptMessage(chatMessage.Ciphertext, key)
+			}
+		case websock.MessageVersionSenderKey:
+			var key []byte
+			if key, err = cs.senderMessageKey(chatMessage); err == nil {
+				decMsg, err = util.DecryptMessage(chatMessage.Ciphertext, key)
+			}
+		default:
+			err = errors.New("Unsupported chat message version")
 		}
-		encMsg, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, []byte(message))
+		// A message which cannot be decrypted is shown as unavailable, the other messages are still shown
 		if err != nil {
-			log.Println(err)
+			log.Printf("Unable to decrypt message %s: %s", chatMessage.ID, err)
+			unavailable = true
+		}
+
+		decrypted = append(decrypted, &DecryptedMessage{
+			Sender:      chatMessage.Sender,
+			Timestamp:   chatMessage.Timestamp,
+			ChatName:    chatMessage.ChatName,
+			Message:     decMsg,
+			Signature:   cs.VerifySignature(chatMessage),
+			Unavailable: unavailable})
+	}
+
+	return decrypted, nil
+}
+
+// VerifySignature checks the signature of a chat message against the public key the device of the sender which
+// sent it had when the message was sent. The signature covers the name of the chat room, which must be the name
+// the client knows the chat room by, or a name it had before it was renamed while the client was in it or before
+// a rename signed by the owner. A message signed with another name the server sent is SignatureOtherRoom
+func (cs *ChatSession) VerifySignature(chatMessage *websock.ChatMessage) SignatureStatus {
+	if len(chatMessage.Signature) == 0 {
+		return SignatureMissing
+	}
+
+	sender, ok := cs.user(chatMessage.Sender)
+	if !ok {
+		return SignatureUnknownSender
+	}
+	publicKey, revoked, ok := signingKey(sender, chatMessage.SenderDevice, chatMessage.Timestamp)
+	if !ok {
+		return SignatureUnknownSender
+	}
+	pubKey, err := util.UnmarshalPublic(publicKey)
+	if err != nil {
+		log.Println(err)
+		return SignatureUnknownSender
+	}
+
+	cs.lock.Lock()
+	names := append([]string{cs.name}, cs.previousNames...)
+	cs.lock.Unlock()
+	for _, name := range names {
+		if util.VerifyChatMessage(pubKey, name, chatMessage.Sender,
+			chatMessage.Timestamp, chatMessage.Ciphertext, chatMessage.Signature) == nil {
+			if revoked {
+				return SignatureRevokedDevice
+			}
+			return SignatureValid
+		}
+	}
+
+	// The chat room may have been renamed without a rename signed by the owner, then the message is valid
+	// in the chat room the server says it was sent in, which the client can not check
+	if util.VerifyChatMessage(pubKey, chatMessage.ChatName, chatMessage.Sender,
+		chatMessage.Timestamp, chatMessage.Ciphertext, chatMessage.Signature) == nil {
+		return SignatureOtherRoom
+	}
+	log.Printf("Invalid signature of message %s from %s", chatMessage.ID, chatMessage.Sender)
+	return SignatureInvalid
+}
+
+// deviceKey gets the public key of a device of a user, an empty device ID is the device the user registered with.
+// Returns false if the device is not one of the devices of the user, or it is revoked
+func deviceKey(user websock.User, deviceID string) ([]byte, bool) {
+	if len(user.Devices) == 0 && deviceID == "" {
+		return user.PublicKey, true
+	}
+	for _, device := range user.Devices {
+		if device.ID == deviceID && !device.Revoked {
+			return device.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// signingKey gets the public key a device of a user had at the time in milliseconds, which is an older key if the
+// key has been changed since (see websock.KeyChange). revoked is true if the device has been revoked. Returns false
+// if the device is not one of the devices of the user
+func signingKey(user websock.User, deviceID string, timestamp int64) ([]byte, bool, bool) {
+	if len(user.Devices) == 0 && deviceID == "" {
+		return user.PublicKey, false, true
+	}
+	for _, device := range user.Devices {
+		if device.ID != deviceID {
 			continue
 		}
-		req.EncryptedContent[user.Username] = encMsg
+		// The key changes are oldest first, the first change after the time replaced the key the device had
+		for _, change := range device.KeyChanges {
+			if timestamp < change.Timestamp {
+				return change.OldKey, device.Revoked, true
+			}
+		}
+		return device.PublicKey, device.Revoked, true
+	}
+	return nil, false, false
+}
+
+// deviceKeys gets the public keys of every device of a user which is not revoked by recipient (see
+// websock.Recipient). A server which does not know about devices only sends the public key the user registered with
+func deviceKeys(user websock.User) map[string][]byte {
+	if len(user.Devices) == 0 {
+		return map[string][]byte{user.Username: user.PublicKey}
+	}
+	keys := make(map[string][]byte, len(user.Devices))
+	for _, device := range user.Devices {
+		if !device.Revoked {
+			keys[websock.Recipient(user.Username, device.ID)] = device.PublicKey
+		}
+	}
+	return keys
+}
+
+// SendChatMessage sends a chat message in the chat room of the chat session
+// The message is encrypted with the next message key of the sender key of the client, which has been distributed
+// to every device of every member of the chat room (also those who are offline). The message is not encrypted for
+// members whose keys do not match the pinned keys, then an error naming them is returned after the message has
+// been sent
+func (cs *ChatSession) SendChatMessage(message string) error {
+	recipients, untrusted := cs.recipients()
+	senderKey, err := cs.currentSenderKey(recipients)
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	key, iteration := senderKey.chain.Next()
+	cs.lock.Unlock()
+	ciphertext, err := util.EncryptMessageWithKey([]byte(message), key)
+	if err != nil {
+		return err
 	}
 
-	websock.Send(cs.Socket, &websock.Message{Type: websock.SendChat, Message: req})
+	// Sign the message, so the recipients can check that it was sent by this user
+	chatName := cs.Name()
+	timestamp := util.NowMillis()
+	signature, err := util.SignChatMessage(cs.privateKey(), chatName, cs.Username(), timestamp, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	req := &websock.SendChatMessage{
+		ChatName:         chatName,
+		Version:          websock.MessageVersionSenderKey,
+		Timestamp:        timestamp,
+		Ciphertext:       ciphertext,
+		EncryptedContent: make(map[string][]byte),
+		Signature:        signature,
+		SenderKeyID:      senderKey.id,
+		Iteration:        iteration}
+
+	// The message is stored for every recipient of the sender key, who can derive the message key
+	for recipient := range recipients {
+		req.EncryptedContent[recipient] = nil
+	}
+
+	// Messages in direct conversations are sent with SendDirect, so they are delivered when the other user is offline
+	msgType := websock.SendChat
+	if websock.IsDirectChatName(chatName) {
+		msgType = websock.SendDirect
+	}
+	if _, err = cs.Reader.Request(&websock.Message{Type: msgType, Message: req}); err != nil {
+		return err
+	}
+	if len(untrusted) > 0 {
+		return errors.New("The message was not encrypted for " + strings.Join(untrusted, ", ") + ", whose key has changed. " +
+			"Compare the safety numbers with /fingerprint <user>, and accept the new key with /trust <user>")
+	}
+	return nil
 }
 
 // LeaveChat is called when a user decides to leave a chat room. The client sends a message
 // notifying the server that the client has left the chat room.
 func (cs *ChatSession) LeaveChat() {
-	websock.Send(cs.Socket, &websock.Message{Type: websock.LeaveChat})
+	cs.Reader.Send(&websock.Message{Type: websock.LeaveChat, Message: cs.Name()})
 }
@@ -12,10 +12,18 @@ import (
 type GUIConfig struct {
 	DefaultServerText     string
 	ChatRoomsPollInterval int
-	CreateUserHandler     func(server string, username string)
-	LoginUserHandler      func(server string, username string)
+	CreateUserHandler     func(server, username, passphrase string)
+	LoginUserHandler      func(server, username, passphrase string)
+	NewDeviceHandler      func(username, passphrase string)
+	RotateKeyHandler      func(passphrase string)
 	CreateRoomHandler     func(name, password string, isHidden bool)
 	JoinChatHandler       func(name, password string)
+	JoinInviteHandler     func(token string)
+	OpenDirectHandler     func(username string)
+	SendChatHandler       func(chatName, message string) error
+	ChatCommandHandler    func(chatName, command string) error
+	LoadHistoryHandler    func(chatName string) ([]*DecryptedMessage, error)
+	LeaveChatHandler      func(chatName string)
 }
 
 // GUI contains the widgets/state of the user interface
@@ -26,6 +34,7 @@ type GUI struct {
 	loginGUI              *LoginGUI
 	roomsGUI              *RoomsGUI
 	chatGUI               *ChatGUI
+	client                *Client
 }
 
 // NewGUI creates a new instance of the GUI using a GUIConfig object
@@ -38,16 +47,25 @@ func NewGUI(config *GUIConfig) *GUI {
 		GUI:               g,
 		DefaultServerText: config.DefaultServerText,
 		CreateUserHandler: config.CreateUserHandler,
-		LoginUserHandler:  config.LoginUserHandler}
+		LoginUserHandler:  config.LoginUserHandler,
+		NewDeviceHandler:  config.NewDeviceHandler}
 	g.loginGUI.Create()
 
 	g.roomsGUI = &RoomsGUI{
 		GUI:               g,
 		CreateRoomHandler: config.CreateRoomHandler,
-		JoinChatHandler:   config.JoinChatHandler}
+		JoinChatHandler:   config.JoinChatHandler,
+		JoinInviteHandler: config.JoinInviteHandler,
+		OpenDirectHandler: config.OpenDirectHandler,
+		RotateKeyHandler:  config.RotateKeyHandler}
 	g.roomsGUI.Create()
 
-	g.chatGUI = &ChatGUI{GUI: g}
+	g.chatGUI = &ChatGUI{
+		GUI:                    g,
+		SendChatMessageHandler: config.SendChatHandler,
+		ChatCommandHandler:     config.ChatCommandHandler,
+		LoadHistoryHandler:     config.LoadHistoryHandler,
+		LeaveChatHandler:       config.LeaveChatHandler}
 	g.chatGUI.Create()
 
 	g.pages = tview.NewPages().
@@ -86,38 +104,47 @@ func (g *GUI) ShowDialog(message string, onDismiss func()) {
 
 // ShowChatRoomGUI switches to the chat rooms interface
 func (g *GUI) ShowChatRoomGUI(client *Client) {
+	g.client = client
 	g.pages.SwitchToPage("rooms")
 	g.app.SetInputCapture(g.roomsGUI.KeyHandler)
 
 	g.roomsGUI.ServerAddress = g.loginGUI.serverInput.GetText()
 
 	// Start updater for the chat room list
+	if g.roomsGUI.ChatRoomsUpdater != nil {
+		g.roomsGUI.ChatRoomsUpdater.Stop()
+	}
 	g.roomsGUI.ChatRoomsUpdater = time.NewTicker(time.Duration(g.chatRoomsPollInterval) * time.Second)
-	go g.roomsGUI.updateChatRooms(client)
+	go g.roomsGUI.updateChatRooms(client, g.roomsGUI.ChatRoomsUpdater)
 }
 
-// ShowChatGUI switches to the chat interface
-func (g *GUI) ShowChatGUI(client *Client) {
-	g.roomsGUI.ChatRoomsUpdater.Stop()
+// ShowChatGUI switches to the chat interface, and shows the tab of the given chat room
+func (g *GUI) ShowChatGUI(chatName string) {
+	if g.roomsGUI.ChatRoomsUpdater != nil {
+		g.roomsGUI.ChatRoomsUpdater.Stop()
+	}
 
 	g.pages.SwitchToPage("chat")
 	g.app.SetInputCapture(g.chatGUI.KeyHandler)
+	g.chatGUI.SwitchTab(chatName)
+}
 
-	// Start chat session
-	client.chatSession = &ChatSession{
-		DisconnectFunc: func() { g.ShowChatRoomGUI(client) },
-		OnChatInfo:     g.chatGUI.OnChatInfo,
-		OnChatMessage:  g.chatGUI.OnChatMessage,
-		OnUserJoined:   g.chatGUI.OnUserJoined,
-		OnUserLeft:     g.chatGUI.OnUserLeft,
-		Reader:         client.wsReader,
-		Socket:         client.ws,
-		PrivateKey:     client.privateKey,
-		AuthKey:        client.authKey}
-
-	// Set handlers for chat gui
-	g.chatGUI.SendChatMessageHandler = client.chatSession.SendChatMessage
-	g.chatGUI.LeaveChatHandler = client.chatSession.LeaveChat
-
-	go client.chatSession.StartChatSession()
+// NewChatSession creates a chat session for a chat room, which updates the chat interface
+func (g *GUI) NewChatSession(client *Client, chatName string) *ChatSession {
+	return &ChatSession{
+		name:          chatName,
+		OnLeft:        func(cs *ChatSession) { client.RemoveChatSession(cs.Name()); g.chatGUI.OnLeft(cs) },
+		OnChatInfo:    g.chatGUI.OnChatInfo,
+		OnResumed:     g.chatGUI.OnResumed,
+		OnChatMessage: g.chatGUI.OnChatMessage,
+		OnUserJoined:  g.chatGUI.OnUserJoined,
+		OnUserLeft:    g.chatGUI.OnUserLeft,
+		OnRemoved:     g.chatGUI.OnRemoved,
+		OnRenamed:     g.chatGUI.OnRenamed,
+		OnKeyChanged:  g.chatGUI.OnKeyChanged,
+		OnKeyMismatch: g.chatGUI.OnKeyMismatch,
+		Reader:        client.wsReader,
+		KnownKeys:     client.knownKeys,
+		privateKeys:   client.privateKeys(),
+		senderKeys:    make(map[string]*receivedSenderKey)}
 }
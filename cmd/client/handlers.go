@@ -1,17 +1,30 @@
 package main
 
 import (
-	"crypto/rand"
 	"crypto/rsa"
-	"io/ioutil"
+	"encoding/base64"
+	"errors"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
 )
 
 // Called when user pressed the "create user" button
-func (c *Client) createUserHandler(server string, username string) {
+func (c *Client) createUserHandler(server, username, passphrase string) {
+	if passphrase == "" {
+		c.gui.ShowDialog("Enter a passphrase to protect the private key", nil)
+		return
+	}
+	// Do not overwrite the private key of an existing user
+	if hasPrivKey(username) {
+		c.gui.ShowDialog("A private key for this user already exists", nil)
+		return
+	}
 	if !c.Connect(server) {
 		return
 	}
@@ -24,73 +37,183 @@ func (c *Client) createUserHandler(server string, username string) {
 		Username:  username,
 		PublicKey: util.MarshalPublic(pubKey)}
 
-	websock.Send(c.ws, &websock.Message{Type: websock.RegisterUser, Message: regUserMsg})
-
-	_, err := c.wsReader.GetNext()
-	if err != nil {
-		c.gui.ShowDialog("Did not get a response from the server", nil)
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.RegisterUser, Message: regUserMsg}); err != nil {
+		c.gui.ShowDialog(err.Error(), nil)
 		return
 	}
 
-	// Save private key to file
-	savePrivKey(username, privKey)
+	// Save encrypted private key to file
+	if err := savePrivKey(username, passphrase, privKey); err != nil {
+		log.Println(err)
+		c.gui.ShowDialog("Error saving private key: "+err.Error(), nil)
+		return
+	}
 
 	c.gui.ShowDialog("User created. You can now log in.", nil)
 }
 
-// Called when the user pressed the "login user" button
-// TODO: Refactor the huge function
-func (c *Client) loginUserHandler(server string, username string) {
-	if !c.Connect(server) {
+// Called when the user pressed the "new device" button, a key pair is created for this device of an existing user.
+// The device code is shown, which is entered with /adddevice on a device the user is logged in from
+func (c *Client) newDeviceHandler(username, passphrase string) {
+	if passphrase == "" {
+		c.gui.ShowDialog("Enter a passphrase to protect the private key", nil)
 		return
 	}
-
-	// Read private key from file
-	pem, err := ioutil.ReadFile(username + ".pem")
-	if err != nil {
-		c.gui.ShowDialog("Error reading privatekey.pem file", nil)
+	// Do not overwrite the private key of an existing user
+	if hasPrivKey(username) {
+		c.gui.ShowDialog("A private key for this user already exists", nil)
 		return
 	}
 
-	privKey, err := util.UnmarshalPrivate(pem)
-	if err != nil {
-		c.gui.ShowDialog("Error parsing private key", nil)
+	privKey, pubKey := util.GenKeyPair()
+	if err := savePrivKey(username, passphrase, privKey); err != nil {
+		log.Println(err)
+		c.gui.ShowDialog("Error saving private key: "+err.Error(), nil)
 		return
 	}
 
-	// Send log in request to server
-	websock.Send(c.ws, &websock.Message{Type: websock.LoginUser, Message: username})
+	code := base64.RawURLEncoding.EncodeToString(util.MarshalPublic(pubKey))
+	c.gui.ShowDialog("Device key created. Log in on another device of the user, and enter /adddevice "+code+
+		" to add this device. You can then log in.", nil)
+}
 
-	// Receive auth challenge from server
-	res, err := c.wsReader.GetNext()
+// Called when the user pressed the "login user" button
+// TODO: Refactor the huge function
+func (c *Client) loginUserHandler(server, username, passphrase string) {
+	// Read and decrypt private key from file
+	privKey, imported, err := loadPrivKey(username, passphrase)
 	if err != nil {
 		c.gui.ShowDialog(err.Error(), nil)
 		return
 	}
+	if !c.Connect(server) {
+		return
+	}
+
+	// Send log in request to server. The response from the server is the auth challenge
+	res, err := c.wsReader.Request(c.loginRequest(username, privKey))
+	if errorCode(err) == websock.CodeDeviceNotFound {
+		// If the connection was lost while the key of the device was changed, the server may still have
+		// the previous key, which is then restored
+		if previous := loadPreviousKeys(username, passphrase); len(previous) > 0 {
+			if prevRes, prevErr := c.wsReader.Request(c.loginRequest(username, previous[0])); prevErr == nil {
+				log.Print("The server did not change the key of the device, restoring the previous key")
+				if err := savePrivKey(username, passphrase, previous[0]); err != nil {
+					log.Println(err)
+				}
+				res, err, privKey = prevRes, nil, previous[0]
+			}
+		}
+	}
+	if err != nil {
+		switch errorCode(err) {
+		case websock.CodeUserNotFound:
+			c.gui.ShowDialog("The user does not exist on this server, use Create User to register it", nil)
+		case websock.CodeDeviceNotFound:
+			c.gui.ShowDialog("This device has not been added to the user yet, enter /adddevice with its device code on another device of the user", nil)
+		default:
+			c.gui.ShowDialog(err.Error(), nil)
+		}
+		return
+	}
 	log.Println(res)
 
-	// Try to decrypt auth challenge
-	decKey, err := rsa.DecryptPKCS1v15(rand.Reader, privKey, res.Message.([]byte))
+	// Sign the auth challenge, together with the host name of the server the client connected to
+	signature, err := util.SignLogin(privKey, c.wsReader.Conn().Config().Location.Host, username, res.Message.([]byte))
 	if err != nil {
 		c.gui.ShowDialog("Invalid private key", nil)
 		return
 	}
-	log.Println(decKey)
-
-	// Send decrypted auth key to server
-	websock.Send(c.ws, &websock.Message{Type: websock.AuthChallengeResponse, Message: decKey})
 
-	// Check response from server
-	if res, err = c.wsReader.GetNext(); err != nil {
+	// Send signature to server, the response is the session the client resumes if the connection is lost
+	if res, err = c.wsReader.Request(&websock.Message{Type: websock.AuthChallengeResponse, Message: signature}); err != nil {
 		c.gui.ShowDialog("Invalid private key", nil)
 		return
 	}
 	log.Println(res)
 
 	// Login success, show the chat rooms GUI
+	c.session, _ = res.Message.(*websock.SessionMessage)
+	c.username = username
 	c.privateKey = privKey
-	c.authKey = decKey
+	c.previousKeys = loadPreviousKeys(username, passphrase)
+	if c.knownKeys, err = loadKnownKeys(username); err != nil {
+		// The keys seen in this session are still pinned, but they are not saved
+		log.Println(err)
+		c.gui.ShowDialog("Error reading the known keys: "+err.Error(), nil)
+		c.knownKeys = &KnownKeys{pins: make(map[string]map[string]string)}
+	}
 	c.gui.ShowChatRoomGUI(c)
+
+	if imported {
+		c.gui.ShowDialog("The private key in "+username+".pem was imported and encrypted with the passphrase. "+
+			"The unencrypted file can now be deleted.", nil)
+	}
+}
+
+// loginRequest creates the request to log in with a private key, the device is identified by its public key
+func (c *Client) loginRequest(username string, privKey *rsa.PrivateKey) *websock.Message {
+	return &websock.Message{Type: websock.LoginUser, Message: &websock.LoginUserMessage{
+		Username:    username,
+		AuthVersion: websock.AuthVersionSignature,
+		Resumable:   c.capabilities.Supports(websock.FeatureSessions),
+		Device:      util.KeyID(util.MarshalPublic(&privKey.PublicKey))}}
+}
+
+// Called when the user changes the key of the device. The new key is signed with the old key, and the old key is
+// kept to decrypt the messages sent before the key was changed
+func (c *Client) rotateKeyHandler(passphrase string) {
+	// Check the passphrase before anything is changed
+	if _, _, err := loadPrivKey(c.username, passphrase); err != nil {
+		c.gui.ShowDialog(err.Error(), nil)
+		return
+	}
+
+	privKey, pubKey := util.GenKeyPair()
+	publicKey := util.MarshalPublic(pubKey)
+	signature, err := util.SignKeyChange(c.privateKey, c.username, publicKey)
+	if err != nil {
+		c.gui.ShowDialog(err.Error(), nil)
+		return
+	}
+
+	// The new key is saved first, so it is not lost if the server has changed the key
+	if err := savePreviousKey(c.username, passphrase, c.privateKey); err != nil {
+		c.gui.ShowDialog("Error saving private key: "+err.Error(), nil)
+		return
+	}
+	if err := savePrivKey(c.username, passphrase, privKey); err != nil {
+		c.gui.ShowDialog("Error saving private key: "+err.Error(), nil)
+		return
+	}
+
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.RotateKey, Message: &websock.RotateKeyMessage{
+		PublicKey: publicKey,
+		Signature: signature}}); err != nil {
+		if _, ok := err.(*websock.ErrorMessage); !ok {
+			// The server may have changed the key before the connection was lost, so both keys are kept. The
+			// key the server has is found when logging in (see loginUserHandler)
+			c.gui.ShowDialog("The server did not confirm that the key was changed: "+err.Error()+
+				". Log in again to continue with the key the server has.", nil)
+			return
+		}
+		// Restore the old key, which is still the key of the device
+		if err := savePrivKey(c.username, passphrase, c.privateKey); err != nil {
+			log.Println(err)
+		}
+		c.gui.ShowDialog(err.Error(), nil)
+		return
+	}
+
+	c.previousKeys = append([]*rsa.PrivateKey{c.privateKey}, c.previousKeys...)
+	c.privateKey = privKey
+	c.chatSessionsLock.Lock()
+	for _, cs := range c.chatSessions {
+		cs.SetPrivateKey(privKey)
+	}
+	c.chatSessionsLock.Unlock()
+
+	c.gui.ShowDialog("The key of this device has been changed.", nil)
 }
 
 func (c *Client) createRoomHandler(name, password string, isHidden bool) {
@@ -100,19 +223,14 @@ func (c *Client) createRoomHandler(name, password string, isHidden bool) {
 		Password: password,
 		IsHidden: isHidden}
 
-	websock.Send(c.ws, &websock.Message{Type: websock.CreateChatRoom, Message: req})
-
-	if _, err := c.wsReader.GetNext(); err != nil {
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.CreateChatRoom, Message: req}); err != nil {
 		c.gui.ShowDialog(err.Error(), nil)
 	}
 }
 
 func (c *Client) getChatRooms() (*websock.GetChatRoomsResponseMessage, error) {
-	// Send request for chat rooms
-	websock.Send(c.ws, &websock.Message{Type: websock.GetChatRooms})
-
-	// Get chat rooms response from server
-	res, err := c.wsReader.GetNext()
+	// Send request for chat rooms, and wait for the response from the server
+	res, err := c.wsReader.Request(&websock.Message{Type: websock.GetChatRooms})
 	if err != nil {
 		return nil, err
 	}
@@ -121,18 +239,327 @@ func (c *Client) getChatRooms() (*websock.GetChatRoomsResponseMessage, error) {
 }
 
 func (c *Client) joinChatHandler(name, password string) {
-	// Send request to join chat room
-	req := &websock.JoinChatMessage{
+	c.joinChat(&websock.JoinChatMessage{
 		Name:     name,
-		Password: password}
+		Password: password})
+}
+
+// Called when the user joins a chat room with an invite token
+func (c *Client) joinInviteHandler(token string) {
+	// The server knows the current name of the chat room the invite is for, which may have been renamed
+	res, err := c.wsReader.Request(&websock.Message{Type: websock.GetInvite, Message: token})
+	if err != nil {
+		c.gui.ShowDialog(err.Error(), nil)
+		return
+	}
+	invite, ok := res.Message.(*websock.InviteMessage)
+	if !ok {
+		c.gui.ShowDialog("Unexpected response to invite request", nil)
+		return
+	}
+	c.joinChat(&websock.JoinChatMessage{
+		Name:   invite.ChatName,
+		Invite: token})
+}
 
-	websock.Send(c.ws, &websock.Message{Type: websock.JoinChat, Message: req})
+func (c *Client) joinChat(req *websock.JoinChatMessage) {
+	name := req.Name
 
-	if _, err := c.wsReader.GetNext(); err != nil {
+	// If the client is already in the chat room, just show it
+	if c.ChatSession(name) != nil {
+		c.gui.ShowChatGUI(name)
+		return
+	}
+
+	// The chat session must exist before the server sends the chat info
+	c.AddChatSession(c.gui.NewChatSession(c, name))
+
+	// Send request to join chat room
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.JoinChat, Message: req}); err != nil {
+		c.RemoveChatSession(name)
+		if errorCode(err) == websock.CodePasswordRequired {
+			// The chat room has been given a password since the list of chat rooms was retrieved
+			c.gui.roomsGUI.passwordPopup(func(password string) {
+				req.Password = password
+				c.joinChat(req)
+			})
+			return
+		}
 		c.gui.ShowDialog(err.Error(), nil)
 		return
 	}
 
 	// Show the chat interface
-	c.gui.ShowChatGUI(c)
+	c.gui.chatGUI.AddTab(name)
+	c.gui.ShowChatGUI(name)
+}
+
+func (c *Client) getDirects() (*websock.DirectsResponseMessage, error) {
+	// Send request for direct conversations
+	res, err := c.wsReader.Request(&websock.Message{Type: websock.GetDirects})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Message.(*websock.DirectsResponseMessage), nil
+}
+
+// Called when the user opens the direct conversation with another user
+func (c *Client) openDirectHandler(username string) {
+	// The conversation is shown in a tab like a chat room
+	name := websock.DirectChatName(c.username, username)
+	if c.ChatSession(name) != nil {
+		c.gui.ShowChatGUI(name)
+		return
+	}
+
+	// The chat session must exist before the server sends the chat info
+	c.AddChatSession(c.gui.NewChatSession(c, name))
+
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.OpenDirect, Message: username}); err != nil {
+		c.RemoveChatSession(name)
+		c.gui.ShowDialog(err.Error(), nil)
+		return
+	}
+
+	c.gui.chatGUI.AddTab(name)
+	c.gui.ShowChatGUI(name)
+}
+
+// Called when the user sends a chat message in a chat room
+func (c *Client) sendChatHandler(chatName, message string) error {
+	cs := c.ChatSession(chatName)
+	if cs == nil {
+		return errors.New("You are not in this chat room")
+	}
+	return cs.SendChatMessage(message)
+}
+
+// Called when the user scrolls to the top of a chat room, to retrieve older chat messages
+func (c *Client) loadHistoryHandler(chatName string) ([]*DecryptedMessage, error) {
+	cs := c.ChatSession(chatName)
+	if cs == nil {
+		return nil, errors.New("You are not in this chat room")
+	}
+	return cs.LoadHistory()
+}
+
+// chatCommands is the usage of the commands which can be used in a chat room
+const chatCommands = "Commands: /rename <name>, /delete, /password [password], /kick <user>, /ban <user>, " +
+	"/mod <user>, /unmod <user>, /retention <days> <messages>, /retention default, /invite [uses] [days], /revoke <invite>, " +
+	"/devices, /adddevice <code>, /revokedevice <device>, /fingerprint <user> or /trust <user>"
+
+// Called when the user types a command (a message starting with a slash) in a chat room
+func (c *Client) chatCommandHandler(chatName, command string) error {
+	args := strings.Fields(command)
+
+	var req *websock.Message
+	switch {
+	case args[0] == "/rename" && len(args) == 2:
+		return c.renameChat(chatName, args[1])
+	case args[0] == "/delete" && len(args) == 1:
+		req = &websock.Message{Type: websock.DeleteChatRoom, Message: chatName}
+	case args[0] == "/password" && len(args) <= 2:
+		// Without a password, the password of the chat room is removed
+		password := ""
+		if len(args) == 2 {
+			password = args[1]
+		}
+		req = &websock.Message{Type: websock.ChangeChatPassword, Message: &websock.ChangeChatPasswordMessage{Name: chatName, Password: password}}
+	case args[0] == "/kick" && len(args) == 2:
+		req = &websock.Message{Type: websock.KickUser, Message: &websock.ModerateUserMessage{ChatName: chatName, Username: args[1]}}
+	case args[0] == "/ban" && len(args) == 2:
+		req = &websock.Message{Type: websock.BanUser, Message: &websock.ModerateUserMessage{ChatName: chatName, Username: args[1]}}
+	case (args[0] == "/mod" || args[0] == "/unmod") && len(args) == 2:
+		req = &websock.Message{Type: websock.SetModerator, Message: &websock.SetModeratorMessage{
+			ChatName:    chatName,
+			Username:    args[1],
+			IsModerator: args[0] == "/mod"}}
+	case args[0] == "/retention" && len(args) == 2 && args[1] == "default":
+		req = &websock.Message{Type: websock.SetRetention, Message: &websock.SetRetentionMessage{ChatName: chatName, UseDefault: true}}
+	case args[0] == "/invite" && len(args) <= 3:
+		return c.createInvite(chatName, args[1:])
+	case args[0] == "/revoke" && len(args) == 2:
+		req = &websock.Message{Type: websock.RevokeInvite, Message: args[1]}
+	case args[0] == "/devices" && len(args) == 1:
+		return c.listDevices(chatName)
+	case args[0] == "/adddevice" && len(args) == 2:
+		return c.addDevice(chatName, args[1])
+	case args[0] == "/revokedevice" && len(args) == 2:
+		req = &websock.Message{Type: websock.RevokeDevice, Message: args[1]}
+	case args[0] == "/fingerprint" && len(args) == 2:
+		return c.showFingerprint(chatName, args[1])
+	case args[0] == "/trust" && len(args) == 2:
+		return c.trustUser(chatName, args[1])
+	case args[0] == "/retention" && len(args) == 3:
+		// Zero days or messages means no limit
+		days, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New(chatCommands)
+		}
+		maxMessages, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errors.New(chatCommands)
+		}
+		req = &websock.Message{Type: websock.SetRetention, Message: &websock.SetRetentionMessage{
+			ChatName:    chatName,
+			MaxAge:      time.Duration(days) * 24 * time.Hour,
+			MaxMessages: maxMessages}}
+	default:
+		return errors.New(chatCommands)
+	}
+
+	_, err := c.wsReader.Request(req)
+	return err
+}
+
+// renameChat renames a chat room. The old and new name are signed, so the clients which join the chat room later
+// can check that the chat messages signed with the old name were sent in the chat room
+func (c *Client) renameChat(chatName, newName string) error {
+	signature, err := util.SignChatRename(c.privateKey, c.username, chatName, newName)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.wsReader.Request(&websock.Message{Type: websock.RenameChatRoom, Message: &websock.RenameChatRoomMessage{
+		Name:      chatName,
+		NewName:   newName,
+		Signature: signature}})
+	return err
+}
+
+// createInvite creates an invite to a chat room, and shows the invite token in the chat room so the user can
+// copy it. The optional arguments are the number of times the invite can be used (once by default), and the
+// number of days it is valid (the server default if it is not given)
+func (c *Client) createInvite(chatName string, args []string) error {
+	req := &websock.CreateInviteMessage{ChatName: chatName, MaxUses: 1}
+
+	var err error
+	if len(args) > 0 {
+		if req.MaxUses, err = strconv.Atoi(args[0]); err != nil {
+			return errors.New(chatCommands)
+		}
+	}
+	if len(args) > 1 {
+		days, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New(chatCommands)
+		}
+		req.ValidFor = time.Duration(days) * 24 * time.Hour
+	}
+
+	res, err := c.wsReader.Request(&websock.Message{Type: websock.CreateInvite, Message: req})
+	if err != nil {
+		return err
+	}
+	invite, ok := res.Message.(*websock.InviteMessage)
+	if !ok {
+		return errors.New("Unexpected response to invite request")
+	}
+
+	expires := util.MillisToTime(invite.ExpiresAt).Format("2006-01-02 15:04")
+	c.gui.chatGUI.OnNotice(chatName, "Invite ("+strconv.Itoa(invite.MaxUses)+" uses, expires "+expires+"): "+invite.Token)
+	return nil
+}
+
+// addDevice adds the device of a device code to the user, by signing the public key of the device
+func (c *Client) addDevice(chatName, code string) error {
+	publicKey, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return errors.New("Invalid device code")
+	}
+	if _, err := util.UnmarshalPublic(publicKey); err != nil {
+		return errors.New("Invalid device code")
+	}
+
+	signature, err := util.SignDevice(c.privateKey, c.username, publicKey)
+	if err != nil {
+		return err
+	}
+	if _, err := c.wsReader.Request(&websock.Message{Type: websock.AddDevice, Message: &websock.AddDeviceMessage{
+		PublicKey: publicKey,
+		Signature: signature}}); err != nil {
+		return err
+	}
+	c.gui.chatGUI.OnNotice(chatName, "Device "+util.KeyID(publicKey)+" added, it can now log in")
+	return nil
+}
+
+// listDevices shows the devices of the user in the chat room, with the ID used to revoke a device
+func (c *Client) listDevices(chatName string) error {
+	res, err := c.wsReader.Request(&websock.Message{Type: websock.GetDevices})
+	if err != nil {
+		return err
+	}
+	devices, ok := res.Message.(*websock.DevicesResponseMessage)
+	if !ok {
+		return errors.New("Unexpected response to devices request")
+	}
+
+	myDevice := util.KeyID(util.MarshalPublic(&c.privateKey.PublicKey))
+	list := make([]string, 0, len(devices.Devices))
+	for _, device := range devices.Devices {
+		id := util.KeyID(device.PublicKey)
+		switch {
+		case id == myDevice:
+			id += " (this device)"
+		case device.Revoked:
+			id += " (revoked)"
+		}
+		if device.Timestamp != 0 {
+			id += " added " + util.MillisToTime(device.Timestamp).Format("2006-01-02 15:04")
+		}
+		list = append(list, id)
+	}
+	c.gui.chatGUI.OnNotice(chatName, "Devices: "+strings.Join(list, ", "))
+	return nil
+}
+
+// showFingerprint shows the safety number of the key of every device of a member of the chat room, which the
+// users can compare out of band (for example in person) to check that the server has not replaced the keys
+func (c *Client) showFingerprint(chatName, username string) error {
+	cs := c.ChatSession(chatName)
+	if cs == nil {
+		return errors.New("You are not in this chat room")
+	}
+	user, ok := cs.user(username)
+	if !ok {
+		return errors.New(username + " is not a member of this chat room")
+	}
+
+	myKey := util.MarshalPublic(&c.privateKey.PublicKey)
+	list := make([]string, 0)
+	for id, publicKey := range userKeys(user) {
+		entry := "device " + util.KeyID(publicKey) + ": " + util.SafetyNumber(myKey, publicKey)
+		if !c.knownKeys.Pinned(username, id, publicKey) {
+			entry += " (does not match the key seen before)"
+		}
+		list = append(list, entry)
+	}
+	sort.Strings(list)
+	c.gui.chatGUI.OnNotice(chatName, "Safety numbers of "+username+", "+strings.Join(list, ", "))
+	return nil
+}
+
+// trustUser accepts the current keys of a member of the chat room, after the keys did not match the pinned keys
+func (c *Client) trustUser(chatName, username string) error {
+	cs := c.ChatSession(chatName)
+	if cs == nil {
+		return errors.New("You are not in this chat room")
+	}
+	user, ok := cs.user(username)
+	if !ok {
+		return errors.New(username + " is not a member of this chat room")
+	}
+
+	c.knownKeys.Trust(user)
+	c.gui.chatGUI.OnNotice(chatName, "The current keys of "+username+" are now trusted")
+	return nil
+}
+
+// Called when the user leaves a chat room
+func (c *Client) leaveChatHandler(chatName string) {
+	if cs := c.ChatSession(chatName); cs != nil {
+		cs.LeaveChat()
+	}
 }
@@ -0,0 +1,183 @@
+package main
+
+/*
+	keystore.go contains the code for storing the private keys of users
+	The private keys are encrypted with a passphrase, and stored in the config directory of the user
+*/
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+)
+
+// keyDir gets the directory where private key files are stored, and creates it if it does not exist
+func keyDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(configDir, "go-e2ee-chat-engine", "keys")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// keyFilePath gets the path of a file of a user in the key directory, named by the username and the suffix.
+// Usernames which could refer to a file outside of the key directory are rejected
+func keyFilePath(username, suffix string) (string, error) {
+	if username == "" || strings.ContainsAny(username, `/\`) || strings.Contains(username, "..") {
+		return "", errors.New("The username can not contain path separators or ..")
+	}
+	dir, err := keyDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, username+suffix), nil
+}
+
+// keyPath gets the path of the private key file of a user
+func keyPath(username string) (string, error) {
+	return keyFilePath(username, ".key")
+}
+
+// hasPrivKey checks if there is a private key file for a user, either encrypted or an unencrypted file to import
+func hasPrivKey(username string) bool {
+	path, err := keyPath(username)
+	if err != nil {
+		return false
+	}
+	for _, file := range []string{path, username + ".pem"} {
+		if _, err := os.Stat(file); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// savePrivKey encrypts a private key with a passphrase, and saves it in the private key file of the user.
+// The file is only readable by the current user
+func savePrivKey(username, passphrase string, privKey *rsa.PrivateKey) error {
+	if passphrase == "" {
+		return errors.New("A passphrase is required to protect the private key")
+	}
+
+	keyFile, err := util.EncryptPrivateKey(privKey, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	path, err := keyPath(username)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, keyFile, 0600); err != nil {
+		return err
+	}
+	// WriteFile does not change the permissions of an existing file
+	return os.Chmod(path, 0600)
+}
+
+// loadPrivKey reads the private key file of a user, and decrypts it with the passphrase. If there is no private
+// key file, but an unencrypted <username>.pem file from an older version of the client in the working directory,
+// it is imported into an encrypted private key file. Returns true if a key was imported
+func loadPrivKey(username, passphrase string) (*rsa.PrivateKey, bool, error) {
+	if passphrase == "" {
+		return nil, false, errors.New("Enter the passphrase of the private key")
+	}
+
+	path, err := keyPath(username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keyFile, err := ioutil.ReadFile(path)
+	if err == nil {
+		privKey, err := util.DecryptPrivateKey(keyFile, []byte(passphrase))
+		return privKey, false, err
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	// Import an unencrypted private key file
+	pem, err := ioutil.ReadFile(username + ".pem")
+	if err != nil {
+		return nil, false, errors.New("Private key file of the user was not found")
+	}
+	privKey, err := util.UnmarshalPrivate(pem)
+	if err != nil {
+		return nil, false, errors.New("Error parsing private key")
+	}
+	if err := savePrivKey(username, passphrase, privKey); err != nil {
+		return nil, false, err
+	}
+	return privKey, true, nil
+}
+
+// previousKeyPath gets the path of the file of a previous private key of a user, named by the ID of its public key
+func previousKeyPath(username string, privKey *rsa.PrivateKey) (string, error) {
+	return keyFilePath(username, "."+util.KeyID(util.MarshalPublic(&privKey.PublicKey))+".key")
+}
+
+// savePreviousKey saves a private key which is being replaced by a new key, so the messages sent before the
+// key was changed can still be decrypted. It is encrypted with the passphrase like the private key file
+func savePreviousKey(username, passphrase string, privKey *rsa.PrivateKey) error {
+	keyFile, err := util.EncryptPrivateKey(privKey, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	path, err := previousKeyPath(username, privKey)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, keyFile, 0600)
+}
+
+// loadPreviousKeys reads and decrypts the previous private keys of a user, newest first. Keys which
+// can not be read are skipped
+func loadPreviousKeys(username, passphrase string) []*rsa.PrivateKey {
+	pattern, err := keyFilePath(username, ".*.key")
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	// The newest file first
+	modTime := make(map[string]int64, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTime[path] = info.ModTime().UnixNano()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTime[paths[i]] > modTime[paths[j]] })
+
+	keys := make([]*rsa.PrivateKey, 0, len(paths))
+	for _, path := range paths {
+		keyFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		privKey, err := util.DecryptPrivateKey(keyFile, []byte(passphrase))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		keys = append(keys, privKey)
+	}
+	return keys
+}
@@ -0,0 +1,257 @@
+package main
+
+/*
+	knownkeys.go contains the store of the keys of other users the client has seen
+	The fingerprint of the key of every device of a user is pinned the first time the user is seen,
+	and a key which does not match the pinned fingerprint is not trusted until the user accepts it
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+// KnownKeys is a threadsafe store of the pinned key fingerprints of users, by username and device ID,
+// which is saved in a file for every local user
+//
+// The mutex must be held when accessing the map
+type KnownKeys struct {
+	sync.Mutex
+	path string
+	pins map[string]map[string]string
+}
+
+// knownKeysPath gets the path of the known keys file of a local user
+func knownKeysPath(username string) (string, error) {
+	return keyFilePath(username, ".known")
+}
+
+// loadKnownKeys reads the known keys of a local user, there are no known keys if the file does not exist yet
+func loadKnownKeys(username string) (*KnownKeys, error) {
+	path, err := knownKeysPath(username)
+	if err != nil {
+		return nil, err
+	}
+	known := &KnownKeys{path: path, pins: make(map[string]map[string]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &known.pins); err != nil {
+		return nil, err
+	}
+	return known, nil
+}
+
+// save writes the known keys to the file. The mutex must be held
+func (known *KnownKeys) save() {
+	data, err := json.Marshal(known.pins)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ioutil.WriteFile(known.path, data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+// userKeys gets the public keys of the devices of a user which are not revoked by device ID. A server which does
+// not know about devices only sends the public key the user registered with
+func userKeys(user websock.User) map[string][]byte {
+	if len(user.Devices) == 0 {
+		return map[string][]byte{"": user.PublicKey}
+	}
+	keys := make(map[string][]byte, len(user.Devices))
+	for _, device := range user.Devices {
+		if !device.Revoked {
+			keys[device.ID] = device.PublicKey
+		}
+	}
+	return keys
+}
+
+// VerifyDevices removes the devices of a user which were not added by another device of the user, as the server
+// could have made them up. The device the user registered with and the devices whose keys are pinned are trusted,
+// another device is trusted if its first key was signed by a trusted key of the device which added it. The keys
+// of a device after a trusted key are trusted if every change was signed by the key before it
+func (known *KnownKeys) VerifyDevices(user *websock.User) {
+	known.Lock()
+	defer known.Unlock()
+
+	pins, seen := known.pins[user.Username]
+	chains := make(map[string][][]byte, len(user.Devices))
+	trusted := make(map[string]int, len(user.Devices))
+	for _, device := range user.Devices {
+		chain := keyChain(user.Username, device)
+		chains[device.ID] = chain
+		for i := len(chain) - 1; i >= 0; i-- {
+			if pins[device.ID] == util.Fingerprint(chain[i]) {
+				trusted[device.ID] = i
+				break
+			}
+		}
+		// Every key of a user who has not been seen before is pinned, otherwise only the current key is trusted
+		// until the user accepts it (see Verify)
+		if _, ok := trusted[device.ID]; !ok && device.ID == "" {
+			if seen {
+				trusted[device.ID] = len(chain) - 1
+			} else {
+				trusted[device.ID] = 0
+			}
+		}
+	}
+
+	// A device can be added by a device which was itself added by another device, so repeat until no more
+	// devices are trusted
+	for changed := true; changed; {
+		changed = false
+		for _, device := range user.Devices {
+			if _, ok := trusted[device.ID]; ok || device.SignedBy == device.ID || util.KeyID(chains[device.ID][0]) != device.ID {
+				continue
+			}
+			signer, ok := trusted[device.SignedBy]
+			if !ok {
+				continue
+			}
+			for _, signerKey := range chains[device.SignedBy][signer:] {
+				pubKey, err := util.UnmarshalPublic(signerKey)
+				if err == nil && util.VerifyDevice(pubKey, user.Username, chains[device.ID][0], device.Signature) == nil {
+					trusted[device.ID] = 0
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	devices := make([]websock.Device, 0, len(user.Devices))
+	for _, device := range user.Devices {
+		if first, ok := trusted[device.ID]; ok {
+			// Only the changes from the first trusted key are kept, which the signatures of chat messages
+			// sent before the key was changed are checked with
+			if len(chains[device.ID]) == len(device.KeyChanges)+1 {
+				device.KeyChanges = device.KeyChanges[first:]
+			} else {
+				device.KeyChanges = nil
+			}
+			devices = append(devices, device)
+		} else {
+			log.Printf("Device %s of %s was not added by another device of the user, ignoring it", device.ID, user.Username)
+		}
+	}
+	user.Devices = devices
+}
+
+// keyChain gets the keys of a device, from the key which was signed when the device was added to its current key.
+// If a change of the key was not signed by the key before it, only the current key is returned
+func keyChain(username string, device websock.Device) [][]byte {
+	if len(device.KeyChanges) == 0 {
+		return [][]byte{device.PublicKey}
+	}
+	chain := [][]byte{device.KeyChanges[0].OldKey}
+	for _, change := range device.KeyChanges {
+		oldKey := chain[len(chain)-1]
+		pubKey, err := util.UnmarshalPublic(oldKey)
+		if err != nil || !bytes.Equal(change.OldKey, oldKey) ||
+			util.VerifyKeyChange(pubKey, username, change.NewKey, change.Signature) != nil {
+			return [][]byte{device.PublicKey}
+		}
+		chain = append(chain, change.NewKey)
+	}
+	if !bytes.Equal(chain[len(chain)-1], device.PublicKey) {
+		return [][]byte{device.PublicKey}
+	}
+	return chain
+}
+
+// Verify checks the keys of a user against the pinned fingerprints. The keys of a user who has not been seen
+// before are pinned. A new device is pinned if it was added by a device which is pinned. Returns false if a key
+// does not match the pinned fingerprint, or a new device was not added by a pinned device
+func (known *KnownKeys) Verify(user websock.User) bool {
+	known.Lock()
+	defer known.Unlock()
+
+	keys := userKeys(user)
+	pins, ok := known.pins[user.Username]
+	if !ok {
+		known.pinAll(user.Username, keys)
+		return true
+	}
+
+	trusted := true
+	changed := false
+	for _, device := range user.Devices {
+		if _, ok := pins[device.ID]; !ok && known.signedByPinned(user.Username, keys, device) {
+			pins[device.ID] = util.Fingerprint(device.PublicKey)
+			changed = true
+		}
+	}
+	for id, publicKey := range keys {
+		if pins[id] != util.Fingerprint(publicKey) {
+			trusted = false
+		}
+	}
+	if changed {
+		known.save()
+	}
+	return trusted
+}
+
+// signedByPinned checks if a device was added by a device of the user whose key is pinned. The mutex must be held
+func (known *KnownKeys) signedByPinned(username string, keys map[string][]byte, device websock.Device) bool {
+	signer, ok := keys[device.SignedBy]
+	if !ok || device.SignedBy == device.ID || known.pins[username][device.SignedBy] != util.Fingerprint(signer) {
+		return false
+	}
+	pubKey, err := util.UnmarshalPublic(signer)
+	if err != nil {
+		return false
+	}
+	return util.VerifyDevice(pubKey, username, device.PublicKey, device.Signature) == nil
+}
+
+// Pinned checks if the key of a device of a user matches the pinned fingerprint
+func (known *KnownKeys) Pinned(username, deviceID string, publicKey []byte) bool {
+	known.Lock()
+	defer known.Unlock()
+	return known.pins[username][deviceID] == util.Fingerprint(publicKey)
+}
+
+// Pin pins the key of a device of a user, when the key has been changed by the owner of the pinned key
+func (known *KnownKeys) Pin(username, deviceID string, publicKey []byte) {
+	known.Lock()
+	defer known.Unlock()
+
+	if _, ok := known.pins[username]; !ok {
+		known.pins[username] = make(map[string]string)
+	}
+	known.pins[username][deviceID] = util.Fingerprint(publicKey)
+	known.save()
+}
+
+// Trust accepts the current keys of a user, and pins them instead of the keys which were pinned
+func (known *KnownKeys) Trust(user websock.User) {
+	known.Lock()
+	defer known.Unlock()
+	known.pinAll(user.Username, userKeys(user))
+}
+
+// pinAll pins the keys of every device of a user. The mutex must be held
+func (known *KnownKeys) pinAll(username string, keys map[string][]byte) {
+	pins := make(map[string]string, len(keys))
+	for id, publicKey := range keys {
+		pins[id] = util.Fingerprint(publicKey)
+	}
+	known.pins[username] = pins
+	known.save()
+}
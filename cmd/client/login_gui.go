@@ -14,15 +14,18 @@ import (
 type LoginGUI struct {
 	*GUI
 	DefaultServerText string
-	CreateUserHandler func(server string, username string)
-	LoginUserHandler  func(server string, username string)
+	CreateUserHandler func(server, username, passphrase string)
+	LoginUserHandler  func(server, username, passphrase string)
+	NewDeviceHandler  func(username, passphrase string)
 
-	layout        *tview.Grid
-	serverInput   *tview.InputField
-	usernameInput *tview.InputField
-	createBtn     *tview.Button
-	loginBtn      *tview.Button
-	statusText    *tview.TextView
+	layout          *tview.Grid
+	serverInput     *tview.InputField
+	usernameInput   *tview.InputField
+	passphraseInput *tview.InputField
+	createBtn       *tview.Button
+	loginBtn        *tview.Button
+	deviceBtn       *tview.Button
+	statusText      *tview.TextView
 
 	focusableElements []tview.Primitive
 	focusedIndex      int
@@ -31,36 +34,44 @@ type LoginGUI struct {
 // Create initializes the widgets in the login GUI
 func (gui *LoginGUI) Create() {
 	gui.serverInput = tview.NewInputField().
-		SetLabel("Server   ").
+		SetLabel("Server    ").
 		SetFieldWidth(60).
 		SetText(gui.DefaultServerText)
 
 	gui.usernameInput = tview.NewInputField().
-		SetLabel("Username ").
+		SetLabel("Username  ").
 		SetFieldWidth(60)
 
+	gui.passphraseInput = tview.NewInputField().
+		SetLabel("Passphrase").
+		SetFieldWidth(60).
+		SetMaskCharacter('*')
+
 	gui.createBtn = tview.NewButton("Create User")
 	gui.loginBtn = tview.NewButton("Log In")
+	gui.deviceBtn = tview.NewButton("New Device")
 
 	gui.statusText = tview.NewTextView().
 		SetTextColor(tcell.ColorLightBlue).
 		SetTextAlign(tview.AlignCenter)
-	gui.statusText.SetText("Welcome. Create a new user or log in using your private key file.")
+	gui.statusText.SetText("Welcome. Create a new user, or log in with the passphrase of your private key file.")
 
 	gui.layout = tview.NewGrid()
-	gui.layout.SetRows(0, 1, 1, 1, 1, 0, 2).
-		SetColumns(0, 30, 5, 30, 0).
-		AddItem(gui.serverInput, 1, 1, 1, 3, 0, 0, false).
-		AddItem(gui.usernameInput, 2, 1, 1, 3, 0, 0, true).
-		AddItem(gui.createBtn, 4, 1, 1, 1, 0, 0, false).
-		AddItem(gui.loginBtn, 4, 3, 1, 1, 0, 0, false).
-		AddItem(gui.statusText, 6, 0, 1, 5, 0, 0, false).
+	gui.layout.SetRows(0, 1, 1, 1, 1, 1, 0, 2).
+		SetColumns(0, 20, 3, 20, 3, 20, 0).
+		AddItem(gui.serverInput, 1, 1, 1, 5, 0, 0, false).
+		AddItem(gui.usernameInput, 2, 1, 1, 5, 0, 0, true).
+		AddItem(gui.passphraseInput, 3, 1, 1, 5, 0, 0, false).
+		AddItem(gui.createBtn, 5, 1, 1, 1, 0, 0, false).
+		AddItem(gui.loginBtn, 5, 3, 1, 1, 0, 0, false).
+		AddItem(gui.deviceBtn, 5, 5, 1, 1, 0, 0, false).
+		AddItem(gui.statusText, 7, 0, 1, 7, 0, 0, false).
 		SetBorder(true).
 		SetTitle("Chat Client")
 
 	gui.focusableElements = []tview.Primitive{
-		gui.serverInput, gui.usernameInput,
-		gui.createBtn, gui.loginBtn}
+		gui.serverInput, gui.usernameInput, gui.passphraseInput,
+		gui.createBtn, gui.loginBtn, gui.deviceBtn}
 	gui.focusedIndex = 1
 }
 
@@ -79,9 +90,11 @@ func (gui *LoginGUI) KeyHandler(ev *tcell.EventKey) *tcell.EventKey {
 		// Check if a button was pressed, and call its handler
 		switch gui.app.GetFocus() {
 		case gui.createBtn:
-			gui.CreateUserHandler(gui.serverInput.GetText(), gui.usernameInput.GetText())
+			gui.CreateUserHandler(gui.serverInput.GetText(), gui.usernameInput.GetText(), gui.passphraseInput.GetText())
 		case gui.loginBtn:
-			gui.LoginUserHandler(gui.serverInput.GetText(), gui.usernameInput.GetText())
+			gui.LoginUserHandler(gui.serverInput.GetText(), gui.usernameInput.GetText(), gui.passphraseInput.GetText())
+		case gui.deviceBtn:
+			gui.NewDeviceHandler(gui.usernameInput.GetText(), gui.passphraseInput.GetText())
 		}
 	}
 
@@ -3,78 +3,457 @@ package main
 import (
 	"crypto/rsa"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
-
-	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"golang.org/x/net/websocket"
 )
 
-// Result is used by WSReader to communicate the websocket messages between threads
+// Result is used by WSReader to pass the response to a request between threads
 type Result struct {
 	Message *websock.Message
 	Err     error
 }
 
-// WSReader reads messages from the websocket in the background
+var (
+	// errDisconnected is returned by Request when the connection to the server is lost
+	errDisconnected = errors.New("Not connected to the server")
+	// errTimeout is returned by Request when the server does not respond to a request in time
+	errTimeout = errors.New("The server did not respond in time")
+)
+
+const (
+	// reconnectDelay is the time to wait before the first attempt to reconnect, the delay is doubled
+	// after every failed attempt until it reaches maxReconnectDelay
+	reconnectDelay    = time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// requestTimeout is how long the client waits for the response to a request
+	requestTimeout = 30 * time.Second
+)
+
+// WSReader reads messages from the websocket in the background, and dispatches them
+// A request sent with Request gets a new request ID, and the first response with the ID is passed to the request.
+// Every other message, such as the chat events the server sends at any time while the client is in a chat room,
+// is sent to Events. OnLoggedOut is called with the reason when the server logs out the client, before it closes
+// the connection
 type WSReader struct {
+	// nextID is the ID of the previous request, it must be accessed atomically (and is the first
+	// field, so it is 64-bit aligned)
+	nextID uint64
+
 	OnDisconnect func()
-	Ws           *websocket.Conn
-	c            chan Result
+	OnLoggedOut  func(string)
+	Events       chan *websock.Message
+
+	// The mutex must be held when accessing ws, closed and pending. ws and closed are replaced when the client
+	// reconnects, closed is closed when the connection is lost. pending are the requests waiting for a response,
+	// by request ID
+	lock    sync.Mutex
+	ws      *websocket.Conn
+	closed  chan struct{}
+	pending map[string]chan Result
+}
+
+// NewWSReader creates a WSReader, the events are buffered until they are received from Events
+func NewWSReader(onDisconnect func(), onLoggedOut func(string)) *WSReader {
+	return &WSReader{
+		OnDisconnect: onDisconnect,
+		OnLoggedOut:  onLoggedOut,
+		Events:       make(chan *websock.Message, 100),
+		pending:      make(map[string]chan Result)}
+}
+
+// Conn gets the current websocket connection
+func (wr *WSReader) Conn() *websocket.Conn {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return wr.ws
+}
+
+// SetConn replaces the websocket connection, the requests sent on the old connection fail with errDisconnected
+func (wr *WSReader) SetConn(ws *websocket.Conn) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	wr.ws = ws
+	wr.closed = make(chan struct{})
+}
+
+// Send sends a message which the server does not respond to on the current websocket connection
+func (wr *WSReader) Send(msg *websock.Message) error {
+	return websock.Send(wr.Conn(), msg)
+}
+
+// Request sends a request on the current websocket connection, and waits for the response. Returns the error
+// if the server responds with an error (a *websock.ErrorMessage, see errorCode), errDisconnected if the connection
+// is lost before the response is received, or errTimeout if the server does not respond in time
+func (wr *WSReader) Request(msg *websock.Message) (*websock.Message, error) {
+	msg.ID = strconv.FormatUint(atomic.AddUint64(&wr.nextID, 1), 10)
+	response := make(chan Result, 1)
+
+	wr.lock.Lock()
+	ws, closed := wr.ws, wr.closed
+	wr.pending[msg.ID] = response
+	wr.lock.Unlock()
+
+	defer func() {
+		wr.lock.Lock()
+		delete(wr.pending, msg.ID)
+		wr.lock.Unlock()
+	}()
+
+	if err := websock.Send(ws, msg); err != nil {
+		log.Println(err)
+		return nil, errDisconnected
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+	select {
+	case result := <-response:
+		return result.Message, result.Err
+	case <-closed:
+		return nil, errDisconnected
+	case <-timeout.C:
+		return nil, errTimeout
+	}
 }
 
 // Reader runs in a separate goroutine and listens for messages on the websocket
-func (wr *WSReader) Reader() {
+func (wr *WSReader) Reader(ws *websocket.Conn) {
 	for {
 		msg := new(websock.Message)
-		err := websock.Receive(wr.Ws, msg)
+		err := websock.Receive(ws, msg)
 		if err != nil {
 			log.Println(err)
 			break
 		}
 
-		if msg.Type == websock.Ping {
-			websock.Send(wr.Ws, &websock.Message{Type: websock.Pong})
-		} else if msg.Type == websock.Error {
-			wr.c <- Result{Message: nil, Err: errors.New(msg.Message.(string))}
-		} else {
-			wr.c <- Result{Message: msg, Err: nil}
+		if wr.respond(msg) {
+			continue
+		}
+
+		switch msg.Type {
+		case websock.Ping:
+			websock.Send(ws, &websock.Message{Type: websock.Pong})
+		case websock.LoggedOut:
+			wr.OnLoggedOut(msg.Message.(string))
+		default:
+			wr.Events <- msg
 		}
 	}
 
+	// Release the requests waiting for a response
+	wr.lock.Lock()
+	close(wr.closed)
+	wr.lock.Unlock()
+
 	wr.OnDisconnect()
 }
 
-// GetNext retrieves the next websocket message from the message pool
-func (wr *WSReader) GetNext() (*websock.Message, error) {
-	result := <-wr.c
-	return result.Message, result.Err
+// respond passes a response to the request waiting for it, returns false if no request is waiting for the message.
+// Only the first response to a request is passed to it, the ones which follow (such as the chat info after joining
+// a chat room) are events
+func (wr *WSReader) respond(msg *websock.Message) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	wr.lock.Lock()
+	response, ok := wr.pending[msg.ID]
+	delete(wr.pending, msg.ID)
+	wr.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	if msg.Type == websock.Error {
+		response <- Result{Message: nil, Err: responseError(msg)}
+	} else {
+		response <- Result{Message: msg, Err: nil}
+	}
+	return true
+}
+
+// responseError gets the error in an Error message. The error is a string if the server does not support error codes,
+// which gets CodeUnknown
+func responseError(msg *websock.Message) *websock.ErrorMessage {
+	if errMsg, ok := msg.Message.(*websock.ErrorMessage); ok {
+		return errMsg
+	}
+	return &websock.ErrorMessage{Code: websock.CodeUnknown, Message: fmt.Sprint(msg.Message)}
+}
+
+// errorCode gets the code of an error returned by Request, CodeUnknown if the error was not sent by the server
+func errorCode(err error) websock.ErrorCode {
+	if errMsg, ok := err.(*websock.ErrorMessage); ok {
+		return errMsg.Code
+	}
+	return websock.CodeUnknown
 }
 
 // Client contains the state of the client
 type Client struct {
-	wsReader    *WSReader
-	ws          *websocket.Conn
-	privateKey  *rsa.PrivateKey
-	authKey     []byte
-	chatSession *ChatSession
-	gui         *GUI
+	wsReader   *WSReader
+	server     string
+	username   string
+	privateKey *rsa.PrivateKey
+	gui        *GUI
+
+	// previousKeys are the keys the device had before its key was changed, newest first, which
+	// are needed to decrypt the messages sent before the key was changed
+	previousKeys []*rsa.PrivateKey
+
+	// knownKeys are the pinned keys of the users the user has seen
+	knownKeys *KnownKeys
+
+	// capabilities is the response of the server to the hello message, with the cipher suites
+	// and features of the server the client can use
+	capabilities *websock.HelloMessage
+
+	// session is the resumable session of the logged in user, which is resumed when the connection is lost,
+	// unless the server logged out the client for loggedOut
+	session   *websock.SessionMessage
+	loggedOut string
+
+	// The chat sessions of the chat rooms the client is in, indexed by chat room name
+	chatSessions     map[string]*ChatSession
+	chatSessionsLock sync.Mutex
+}
+
+// privateKeys gets the private key of the device, followed by the previous keys
+func (c *Client) privateKeys() []*rsa.PrivateKey {
+	return append([]*rsa.PrivateKey{c.privateKey}, c.previousKeys...)
+}
+
+// ChatSession gets the chat session of a chat room, or nil if the client is not in the chat room
+func (c *Client) ChatSession(chatName string) *ChatSession {
+	c.chatSessionsLock.Lock()
+	defer c.chatSessionsLock.Unlock()
+	return c.chatSessions[chatName]
+}
+
+// AddChatSession adds the chat session of a chat room the client has joined
+func (c *Client) AddChatSession(cs *ChatSession) {
+	c.chatSessionsLock.Lock()
+	defer c.chatSessionsLock.Unlock()
+	c.chatSessions[cs.Name()] = cs
+}
+
+// RemoveChatSession removes the chat session of a chat room the client has left
+func (c *Client) RemoveChatSession(chatName string) {
+	c.chatSessionsLock.Lock()
+	defer c.chatSessionsLock.Unlock()
+	delete(c.chatSessions, chatName)
+}
+
+// RenameChatSession changes the chat room name a chat session is indexed by, when the chat room has been renamed
+func (c *Client) RenameChatSession(oldName, newName string) {
+	c.chatSessionsLock.Lock()
+	defer c.chatSessionsLock.Unlock()
+	if cs, ok := c.chatSessions[oldName]; ok {
+		delete(c.chatSessions, oldName)
+		c.chatSessions[newName] = cs
+	}
+}
+
+// HandleEvents receives the events of the WSReader, and handles them one at a time
+func (c *Client) HandleEvents() {
+	for msg := range c.wsReader.Events {
+		switch msg.Type {
+		case websock.ChatInfo, websock.ChatMessageReceived, websock.UserJoined, websock.UserLeft,
+			websock.RemovedFromChat, websock.ChatRoomRenamed, websock.KeyChanged, websock.SenderKeyReceived:
+			c.HandleChatEvent(msg)
+		case websock.Error:
+			log.Printf("Received error which is not a response to a request: %s", responseError(msg))
+		default:
+			log.Printf("Received unexpected %s message", msg.Type)
+		}
+	}
+}
+
+// HandleChatEvent is called when a chat event is received, and forwards
+// the event to the chat session of the chat room the event belongs to
+func (c *Client) HandleChatEvent(msg *websock.Message) {
+	var chatName string
+	switch msg.Type {
+	case websock.ChatInfo:
+		chatName = msg.Message.(*websock.ChatInfoMessage).Name
+	case websock.ChatMessageReceived:
+		chatName = msg.Message.(*websock.ChatMessage).ChatName
+	case websock.UserJoined:
+		chatName = msg.Message.(*websock.UserJoinedMessage).ChatName
+	case websock.UserLeft:
+		chatName = msg.Message.(*websock.UserLeftMessage).ChatName
+	case websock.RemovedFromChat:
+		chatName = msg.Message.(*websock.RemovedFromChatMessage).ChatName
+	case websock.ChatRoomRenamed:
+		chatName = msg.Message.(*websock.RenameChatRoomMessage).Name
+	case websock.KeyChanged:
+		chatName = msg.Message.(*websock.KeyChangedMessage).ChatName
+	case websock.SenderKeyReceived:
+		chatName = msg.Message.(*websock.SenderKeyMessage).ChatName
+	}
+
+	cs := c.ChatSession(chatName)
+	if cs == nil {
+		log.Printf("Received chat event for chat room %s which the client is not in", chatName)
+		return
+	}
+	cs.HandleMessage(msg)
 }
 
 // Disconnected is a callback function which should be called when the client loses connection from the server
-// It will show an alert to the user and exit the program.
+// If the user is logged in, the client reconnects and resumes the session. Otherwise, or if the session could
+// not be resumed, it will show an alert to the user and exit the program.
 func (c *Client) Disconnected() {
+	if c.session != nil && c.loggedOut == "" && c.reconnect() {
+		return
+	}
+
+	message := "Disconnected from server"
+	if c.loggedOut != "" {
+		message = "Logged out: " + c.loggedOut
+	}
 	c.gui.app.QueueUpdate(func() {
-		c.gui.ShowDialog("Disconnected from server", func() {
+		c.gui.ShowDialog(message, func() {
 			c.gui.app.Stop()
 		})
 		c.gui.app.Draw()
 	})
 }
 
+// LoggedOut is a callback function which should be called when the server logs out the client, because the user
+// logged in on another connection. The session is not resumed when the connection is closed
+func (c *Client) LoggedOut(reason string) {
+	c.loggedOut = reason
+}
+
+// reconnect tries to resume the session on a new connection, the delay between the attempts is doubled after every
+// failed attempt. Returns false if the server rejected the session, or the session expired before it was resumed
+func (c *Client) reconnect() bool {
+	c.notifyChatSessions("Connection lost, reconnecting...")
+
+	deadline := time.Now().Add(c.session.ExpiresIn)
+	for delay := reconnectDelay; time.Now().Add(delay).Before(deadline); delay *= 2 {
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		time.Sleep(delay)
+
+		ws, err := websocket.Dial(c.server, "", "http://")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if _, err := c.hello(ws); err != nil {
+			log.Println(err)
+			ws.Close()
+			continue
+		}
+		session, rejected, err := c.resumeSession(ws)
+		if err != nil {
+			log.Println(err)
+			ws.Close()
+			if rejected {
+				return false
+			}
+			continue
+		}
+
+		c.session = session
+		c.wsReader.SetConn(ws)
+		go c.wsReader.Reader(ws)
+		c.notifyChatSessions("Reconnected to the server")
+		return true
+	}
+	return false
+}
+
+// resumeSession sends a request to resume the session on a new connection, with the newest chat message received
+// in every chat room. The chat events which follow the response are read by the WSReader. rejected is true if
+// the server responded with an error
+func (c *Client) resumeSession(ws *websocket.Conn) (session *websock.SessionMessage, rejected bool, err error) {
+	req := &websock.ResumeSessionMessage{
+		Token:   c.session.Token,
+		Cursors: make(map[string]*websock.HistoryCursor)}
+	c.chatSessionsLock.Lock()
+	for chatName, cs := range c.chatSessions {
+		req.Cursors[chatName] = cs.Newest()
+	}
+	c.chatSessionsLock.Unlock()
+
+	if err := websock.Send(ws, &websock.Message{Type: websock.ResumeSession, Message: req}); err != nil {
+		return nil, false, err
+	}
+	for {
+		msg := new(websock.Message)
+		if err := websock.Receive(ws, msg); err != nil {
+			return nil, false, err
+		}
+
+		switch msg.Type {
+		case websock.Ping:
+			websock.Send(ws, &websock.Message{Type: websock.Pong})
+		case websock.Error:
+			return nil, true, responseError(msg)
+		case websock.SessionStarted:
+			return msg.Message.(*websock.SessionMessage), false, nil
+		}
+	}
+}
+
+// clientCipherSuites and clientFeatures are the cipher suites and features the client supports, see websock.HelloMessage
+var (
+	clientCipherSuites = []string{websock.CipherSuiteSenderKey}
+	clientFeatures     = []string{websock.FeatureSessions, websock.FeatureDevices, websock.FeatureDirects, websock.FeatureInvites}
+)
+
+// hello sends the hello message on a new connection, and returns the response of the server. Returns an error
+// with the reason if the server refused the client
+func (c *Client) hello(ws *websocket.Conn) (*websock.HelloMessage, error) {
+	req := &websock.HelloMessage{
+		Version:      websock.ProtocolVersion,
+		Codecs:       []string{websock.CodecGob},
+		CipherSuites: clientCipherSuites,
+		Features:     clientFeatures}
+	if err := websock.Send(ws, &websock.Message{Type: websock.Hello, Message: req}); err != nil {
+		return nil, err
+	}
+	for {
+		msg := new(websock.Message)
+		if err := websock.Receive(ws, msg); err != nil {
+			// Servers from before the handshake was added close the connection
+			log.Println(err)
+			return nil, errors.New("The server closed the connection, it may be too old for this version of the client")
+		}
+
+		switch msg.Type {
+		case websock.Ping:
+			websock.Send(ws, &websock.Message{Type: websock.Pong})
+		case websock.Error:
+			return nil, responseError(msg)
+		case websock.Hello:
+			return msg.Message.(*websock.HelloMessage), nil
+		}
+	}
+}
+
+// notifyChatSessions shows a notice in the tab of every chat room the client is in
+func (c *Client) notifyChatSessions(notice string) {
+	c.chatSessionsLock.Lock()
+	defer c.chatSessionsLock.Unlock()
+	for chatName := range c.chatSessions {
+		c.gui.chatGUI.OnNotice(chatName, notice)
+	}
+}
+
 // Connect connects to the websocket server
 func (c *Client) Connect(server string) bool {
 	if c.wsReader == nil {
@@ -83,37 +462,45 @@ func (c *Client) Connect(server string) bool {
 			c.gui.ShowDialog("Error connecting to server", nil)
 			return false
 		}
+		capabilities, err := c.hello(ws)
+		if err != nil {
+			log.Println(err)
+			ws.Close()
+			c.gui.ShowDialog("Error connecting to server: "+err.Error(), nil)
+			return false
+		}
 
-		c.ws = ws
-		c.wsReader = &WSReader{
-			OnDisconnect: c.Disconnected,
-			Ws:           ws,
-			c:            make(chan Result, 10)}
-		go c.wsReader.Reader()
+		c.server = server
+		c.capabilities = capabilities
+		c.wsReader = NewWSReader(c.Disconnected, c.LoggedOut)
+		c.wsReader.SetConn(ws)
+		go c.HandleEvents()
+		go c.wsReader.Reader(ws)
 	}
 	return true
 }
 
-func savePrivKey(username string, privKey *rsa.PrivateKey) {
-	pem := util.MarshalPrivate(privKey)
-	if err := ioutil.WriteFile(username+".pem", pem, 0644); err != nil {
-		log.Fatal(err)
-	}
-}
-
 func main() {
 	f, _ := os.OpenFile("client_log.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	defer f.Close()
 	log.SetOutput(f)
 
-	c := &Client{}
+	c := &Client{chatSessions: make(map[string]*ChatSession)}
 	guiConfig := &GUIConfig{
 		DefaultServerText:     "wss://go-e2ee-chat-engine.herokuapp.com/",
 		ChatRoomsPollInterval: 2,
 		CreateUserHandler:     c.createUserHandler,
 		LoginUserHandler:      c.loginUserHandler,
+		RotateKeyHandler:      c.rotateKeyHandler,
+		NewDeviceHandler:      c.newDeviceHandler,
 		CreateRoomHandler:     c.createRoomHandler,
-		JoinChatHandler:       c.joinChatHandler}
+		JoinChatHandler:       c.joinChatHandler,
+		JoinInviteHandler:     c.joinInviteHandler,
+		OpenDirectHandler:     c.openDirectHandler,
+		SendChatHandler:       c.sendChatHandler,
+		ChatCommandHandler:    c.chatCommandHandler,
+		LoadHistoryHandler:    c.loadHistoryHandler,
+		LeaveChatHandler:      c.leaveChatHandler}
 
 	c.gui = NewGUI(guiConfig)
 
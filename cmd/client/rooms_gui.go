@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
@@ -15,6 +16,9 @@ const (
 	newRoomPopup  = "createRoomPopup"
 	joinRoomPopup = "joinRoomPopup"
 	passwordPopup = "passwordPopup"
+	directPopup   = "directPopup"
+	invitePopup   = "invitePopup"
+	rotatePopup   = "rotatePopup"
 	labelName     = "Name "
 	labelPassword = "Password "
 )
@@ -24,13 +28,21 @@ type RoomsGUI struct {
 	*GUI
 	CreateRoomHandler func(name, password string, isHidden bool)
 	JoinChatHandler   func(name, password string)
+	JoinInviteHandler func(token string)
+	OpenDirectHandler func(username string)
+	RotateKeyHandler  func(passphrase string)
 	ChatRoomsUpdater  *time.Ticker
 	ServerAddress     string
 
 	layout        *tview.Pages
 	roomList      *tview.List
+	directList    *tview.List
 	createRoomBtn *tview.Button
 	joinRoomBtn   *tview.Button
+	joinInviteBtn *tview.Button
+	openChatsBtn  *tview.Button
+	newDirectBtn  *tview.Button
+	rotateKeyBtn  *tview.Button
 	serverStatus  *tview.TextView
 	chatRooms     map[string]*websock.Room
 }
@@ -46,20 +58,39 @@ func (gui *RoomsGUI) Create() {
 		SetTitle("Chat Rooms").
 		SetTitleAlign(tview.AlignLeft)
 
+	gui.directList = tview.NewList()
+	gui.directList.
+		SetSelectedFunc(gui.onDirectSelected).
+		SetBorder(true).
+		SetTitle("Direct Messages (Tab)").
+		SetTitleAlign(tview.AlignLeft)
+
 	gui.createRoomBtn = tview.NewButton("Create Room (C)")
 	gui.joinRoomBtn = tview.NewButton("Join Room (J)")
+	gui.joinInviteBtn = tview.NewButton("Join Invite (I)")
+	gui.openChatsBtn = tview.NewButton("Open Chats (T)")
+	gui.newDirectBtn = tview.NewButton("New Message (M)")
+	gui.rotateKeyBtn = tview.NewButton("Change Key (K)")
 
 	gui.serverStatus = tview.NewTextView().
 		SetTextAlign(tview.AlignCenter).
 		SetText("Connected to: ws://blahblah:1234\tConnected Users: 9000")
 
+	lists := tview.NewFlex().
+		AddItem(gui.roomList, 0, 2, true).
+		AddItem(gui.directList, 0, 1, false)
+
 	grid := tview.NewGrid()
 	grid.SetRows(1, 0, 1).
-		SetColumns(20, 2, 20, 0).
-		AddItem(gui.serverStatus, 0, 0, 1, 4, 0, 0, false).
-		AddItem(gui.roomList, 1, 0, 1, 4, 0, 0, true).
+		SetColumns(20, 2, 20, 2, 20, 2, 20, 2, 20, 2, 20, 0).
+		AddItem(gui.serverStatus, 0, 0, 1, 12, 0, 0, false).
+		AddItem(lists, 1, 0, 1, 12, 0, 0, true).
 		AddItem(gui.createRoomBtn, 2, 0, 1, 1, 0, 0, false).
-		AddItem(gui.joinRoomBtn, 2, 2, 1, 1, 0, 0, false)
+		AddItem(gui.joinRoomBtn, 2, 2, 1, 1, 0, 0, false).
+		AddItem(gui.joinInviteBtn, 2, 4, 1, 1, 0, 0, false).
+		AddItem(gui.openChatsBtn, 2, 6, 1, 1, 0, 0, false).
+		AddItem(gui.newDirectBtn, 2, 8, 1, 1, 0, 0, false).
+		AddItem(gui.rotateKeyBtn, 2, 10, 1, 1, 0, 0, false)
 
 	gui.layout = tview.NewPages().
 		AddPage("main", grid, true, true)
@@ -79,6 +110,11 @@ func (gui *RoomsGUI) onChatRoomSelected(index int, name, secText string, scut ru
 	}
 }
 
+// Called when a direct conversation is selected in the list, the main text of the item is the other user
+func (gui *RoomsGUI) onDirectSelected(index int, username, secText string, scut rune) {
+	gui.OpenDirectHandler(username)
+}
+
 // validateForm validates the chat room name and password input by the user when
 // trying to create a new chat room or joining a chat room
 func (gui *RoomsGUI) validateForm(form *tview.Form) (string, string, bool) {
@@ -202,6 +238,118 @@ func (gui *RoomsGUI) passwordPopup(onDone func(password string)) {
 	gui.layout.AddPage(passwordPopup, popup, true, true)
 }
 
+// invitePopup creates a popup window containing an input field for the user to enter
+// an invite token, which is used to join the chat room of the invite
+func (gui *RoomsGUI) invitePopup() {
+	tokenInput := tview.NewInputField()
+
+	handler := func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			token := strings.TrimSpace(tokenInput.GetText())
+			if token == "" {
+				return
+			}
+			gui.layout.RemovePage(invitePopup)
+			gui.JoinInviteHandler(token)
+		case tcell.KeyEsc:
+			gui.layout.RemovePage(invitePopup)
+		}
+	}
+
+	tokenInput.SetFieldWidth(0).
+		SetDoneFunc(handler)
+
+	box := tview.NewBox().SetBorder(true).SetTitle("Join by Invite")
+	popup := tview.NewGrid().
+		SetRows(0, 1, 1, 1, 0).
+		SetColumns(0, 1, 60, 1, 0).
+		AddItem(box, 1, 1, 3, 3, 0, 0, false).
+		AddItem(tokenInput, 2, 2, 1, 1, 0, 0, true)
+
+	gui.layout.AddPage(invitePopup, popup, true, true)
+}
+
+// rotatePopup creates a popup window containing an input field for the user to enter the passphrase
+// of the private key, which is needed to save the new key when the key is changed
+func (gui *RoomsGUI) rotatePopup() {
+	passphraseInput := tview.NewInputField()
+
+	handler := func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			passphrase := passphraseInput.GetText()
+			if passphrase == "" {
+				return
+			}
+			gui.layout.RemovePage(rotatePopup)
+			gui.RotateKeyHandler(passphrase)
+		case tcell.KeyEsc:
+			gui.layout.RemovePage(rotatePopup)
+		}
+	}
+
+	passphraseInput.SetFieldWidth(60).
+		SetDoneFunc(handler).
+		SetMaskCharacter('*')
+
+	box := tview.NewBox().SetBorder(true).SetTitle("Change Key: Passphrase")
+	popup := tview.NewGrid().
+		SetRows(0, 1, 1, 1, 0).
+		SetColumns(0, 1, 40, 1, 0).
+		AddItem(box, 1, 1, 3, 3, 0, 0, false).
+		AddItem(passphraseInput, 2, 2, 1, 1, 0, 0, true)
+
+	gui.layout.AddPage(rotatePopup, popup, true, true)
+}
+
+// directPopup creates a popup window containing an input field for the user to enter
+// the username of the user to send a direct message to
+func (gui *RoomsGUI) directPopup() {
+	usernameInput := tview.NewInputField()
+
+	handler := func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			username := usernameInput.GetText()
+			if len(username) < 3 {
+				gui.ShowDialog("Username must be 3 characters or longer", nil)
+				return
+			}
+			gui.layout.RemovePage(directPopup)
+			gui.OpenDirectHandler(username)
+		case tcell.KeyEsc:
+			gui.layout.RemovePage(directPopup)
+		}
+	}
+
+	usernameInput.SetFieldWidth(20).
+		SetDoneFunc(handler)
+
+	box := tview.NewBox().SetBorder(true).SetTitle("New Message To")
+	popup := tview.NewGrid().
+		SetRows(0, 1, 1, 1, 0).
+		SetColumns(0, 1, 40, 1, 0).
+		AddItem(box, 1, 1, 3, 3, 0, 0, false).
+		AddItem(usernameInput, 2, 2, 1, 1, 0, 0, true)
+
+	gui.layout.AddPage(directPopup, popup, true, true)
+}
+
+// setDirects replaces the direct conversations in the list, keeping the selected item
+func (gui *RoomsGUI) setDirects(directs []websock.Conversation) {
+	current := gui.directList.GetCurrentItem()
+	gui.directList.Clear()
+	for _, conv := range directs {
+		gui.directList.AddItem(conv.Peer,
+			"[Unread: "+strconv.Itoa(conv.Unread)+"] [Online: "+strconv.FormatBool(conv.Online)+"]",
+			0, nil)
+	}
+	if current < gui.directList.GetItemCount() {
+		gui.directList.SetCurrentItem(current)
+	}
+}
+
 // addChatRoom adds the given chat room to the map of chat rooms, and adds it
 // to the list if it is not already added
 func (gui *RoomsGUI) addChatRoom(room *websock.Room) {
@@ -215,12 +363,22 @@ func (gui *RoomsGUI) addChatRoom(room *websock.Room) {
 }
 
 // This function runs in a separate goroutine and updates the chat rooms list on a regular interval
-func (gui *RoomsGUI) updateChatRooms(client *Client) {
+func (gui *RoomsGUI) updateChatRooms(client *Client, updater *time.Ticker) {
 	update := func() {
 		chatRooms, err := client.getChatRooms()
 		log.Println(chatRooms)
+		var directs *websock.DirectsResponseMessage
+		if err == nil {
+			directs, err = client.getDirects()
+		}
 
 		gui.app.QueueUpdate(func() {
+			// The client is reconnecting to the server
+			if err == errDisconnected {
+				gui.serverStatus.SetText("Reconnecting to: " + gui.ServerAddress)
+				gui.app.Draw()
+				return
+			}
 			if err != nil {
 				gui.ShowDialog(err.Error(), nil)
 				gui.app.Draw()
@@ -234,13 +392,14 @@ func (gui *RoomsGUI) updateChatRooms(client *Client) {
 			for i := range chatRooms.Rooms {
 				gui.addChatRoom(&chatRooms.Rooms[i])
 			}
+			gui.setDirects(directs.Conversations)
 			gui.app.Draw()
 		})
 	}
 
 	update()
 	// Update the chat rooms on every timer fire
-	for range gui.ChatRoomsUpdater.C {
+	for range updater.C {
 		update()
 	}
 }
@@ -251,15 +410,39 @@ func (gui *RoomsGUI) KeyHandler(ev *tcell.EventKey) *tcell.EventKey {
 	hasPopup := func() bool {
 		return gui.layout.HasPage(newRoomPopup) ||
 			gui.layout.HasPage(joinRoomPopup) ||
-			gui.layout.HasPage(passwordPopup)
+			gui.layout.HasPage(passwordPopup) ||
+			gui.layout.HasPage(directPopup) ||
+			gui.layout.HasPage(invitePopup) ||
+			gui.layout.HasPage(rotatePopup)
 	}
 
 	if !hasPopup() {
+		// Tab moves the focus between the chat rooms and the direct conversations
+		if ev.Key() == tcell.KeyTab {
+			if gui.roomList.HasFocus() {
+				gui.app.SetFocus(gui.directList)
+			} else {
+				gui.app.SetFocus(gui.roomList)
+			}
+			return nil
+		}
+
 		switch ev.Rune() {
 		case 'c':
 			gui.newRoomPopup()
 		case 'j':
 			gui.joinRoomPopup()
+		case 'i':
+			gui.invitePopup()
+		case 'm':
+			gui.directPopup()
+		case 'k':
+			gui.rotatePopup()
+		case 't':
+			// Go back to the chat rooms the user is already in
+			if gui.chatGUI.HasTabs() {
+				gui.ShowChatGUI(gui.chatGUI.activeTab)
+			}
 		}
 	}
 	return ev
@@ -0,0 +1,202 @@
+package main
+
+/*
+	senderkeys.go contains the sender keys of a chat session
+	The client encrypts its chat messages with a sender key, a hash ratchet which derives a new message key for
+	every message. The sender key is distributed to every device of every member of the chat room, encrypted with
+	the public key of the device, and a new sender key is created when the members, their devices or their keys
+	change. The sender keys of the other members are only kept in memory, and the server deletes them once they
+	have been received, so the messages can not be decrypted with a private key which is leaked later. Every message
+	key can only be derived once, so a message can only be decrypted when it is first received. The messages in
+	the chat history which the client received before it was restarted, or which were sent before the user became
+	a member, are unavailable, and the chat history is only loaded until the first of them
+*/
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"log"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+// ownSenderKey is the sender key the client encrypts its chat messages with. recipients are the IDs of the public
+// keys it was distributed to by recipient (see websock.Recipient)
+type ownSenderKey struct {
+	id         string
+	chain      *util.SenderChain
+	recipients map[string]string
+	created    time.Time
+}
+
+// receivedSenderKey is a sender key of a member of the chat room, which the chat messages of the member are
+// decrypted with
+type receivedSenderKey struct {
+	sender string
+	chain  *util.SenderChain
+}
+
+// sameRecipients checks if a sender key was distributed to the public keys of the recipients
+func (key *ownSenderKey) sameRecipients(recipients map[string][]byte) bool {
+	if len(key.recipients) != len(recipients) {
+		return false
+	}
+	for recipient, publicKey := range recipients {
+		if key.recipients[recipient] != util.KeyID(publicKey) {
+			return false
+		}
+	}
+	return true
+}
+
+// recipients gets the public keys of every device of every member of the chat room whose keys are trusted, by
+// recipient, and the usernames of the members whose keys do not match the pinned keys
+func (cs *ChatSession) recipients() (map[string][]byte, []string) {
+	recipients := make(map[string][]byte)
+	untrusted := make([]string, 0)
+	for _, user := range cs.Users() {
+		if !cs.KnownKeys.Verify(user) {
+			untrusted = append(untrusted, user.Username)
+			continue
+		}
+		for recipient, publicKey := range deviceKeys(user) {
+			recipients[recipient] = publicKey
+		}
+	}
+	return recipients, untrusted
+}
+
+// currentSenderKey gets the sender key to encrypt the next chat message with. A new sender key is distributed if
+// the recipients have changed since the current sender key was distributed, or it is older than the lifetime
+func (cs *ChatSession) currentSenderKey(recipients map[string][]byte) (*ownSenderKey, error) {
+	cs.lock.Lock()
+	key := cs.senderKey
+	cs.lock.Unlock()
+
+	if key != nil && time.Since(key.created) < websock.SenderKeyLifetime && key.sameRecipients(recipients) {
+		return key, nil
+	}
+	return cs.distributeSenderKey(recipients)
+}
+
+// rekey distributes a new sender key when the members of the chat room or their devices have changed, so a member
+// who was removed can not decrypt the next chat messages. Nothing is done before the client has sent a chat message
+func (cs *ChatSession) rekey() {
+	cs.lock.Lock()
+	key := cs.senderKey
+	cs.lock.Unlock()
+
+	if key == nil {
+		return
+	}
+	recipients, _ := cs.recipients()
+	if key.sameRecipients(recipients) {
+		return
+	}
+	if _, err := cs.distributeSenderKey(recipients); err != nil {
+		log.Printf("Unable to distribute a new sender key: %s", err)
+	}
+}
+
+// distributeSenderKey creates a new sender key, and sends it to the server encrypted with the public key of every
+// recipient. The device of the client does not need the key from the server, it decrypts its own messages with
+// a copy of the new sender key
+func (cs *ChatSession) distributeSenderKey(recipients map[string][]byte) (*ownSenderKey, error) {
+	id, err := util.NewSenderKeyID()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := util.NewSenderChain()
+	if err != nil {
+		return nil, err
+	}
+	received, err := util.SenderChainFromKey(chain.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ownSenderKey{id: id, chain: chain, recipients: make(map[string]string), created: time.Now()}
+	req := &websock.SendSenderKeyMessage{ChatName: cs.Name(), KeyID: id, EncryptedKeys: make(map[string][]byte)}
+	myKey := util.MarshalPublic(&cs.privateKey().PublicKey)
+	for recipient, publicKey := range recipients {
+		key.recipients[recipient] = util.KeyID(publicKey)
+		if bytes.Equal(publicKey, myKey) {
+			continue
+		}
+
+		pubKey, err := util.UnmarshalPublic(publicKey)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		encKey, err := util.WrapKey(pubKey, chain.Key())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		req.EncryptedKeys[recipient] = encKey
+	}
+
+	// There is no one to send the key to when the user is alone in the chat room with a single device
+	if len(req.EncryptedKeys) > 0 {
+		if _, err := cs.Reader.Request(&websock.Message{Type: websock.SendSenderKey, Message: req}); err != nil {
+			return nil, err
+		}
+	}
+
+	cs.lock.Lock()
+	cs.senderKey = key
+	cs.senderKeys[id] = &receivedSenderKey{sender: cs.username, chain: received}
+	cs.lock.Unlock()
+	return key, nil
+}
+
+// addSenderKeys decrypts the sender keys distributed to the device, and acknowledges them so the server deletes
+// them. Keys which cannot be decrypted are acknowledged as well, as they will never be useful
+func (cs *ChatSession) addSenderKeys(keys []*websock.SenderKeyMessage) {
+	if len(keys) == 0 {
+		return
+	}
+
+	ack := &websock.AckSenderKeysMessage{ChatName: cs.Name(), KeyIDs: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		ack.KeyIDs = append(ack.KeyIDs, key.KeyID)
+
+		chainKey, err := cs.decryptWith(func(privKey *rsa.PrivateKey) ([]byte, error) {
+			return util.UnwrapKey(privKey, key.Key)
+		})
+		if err != nil {
+			log.Printf("Unable to decrypt sender key %s of %s: %s", key.KeyID, key.Sender, err)
+			continue
+		}
+		chain, err := util.SenderChainFromKey(chainKey)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		// A key which has already been received has been used to decrypt messages, and must not be reset
+		cs.lock.Lock()
+		if _, ok := cs.senderKeys[key.KeyID]; !ok {
+			cs.senderKeys[key.KeyID] = &receivedSenderKey{sender: key.Sender, chain: chain}
+		}
+		cs.lock.Unlock()
+	}
+
+	cs.Reader.Send(&websock.Message{Type: websock.AckSenderKeys, Message: ack})
+}
+
+// senderMessageKey gets the message key of a chat message encrypted with a sender key. Every message key can only
+// be retrieved once
+func (cs *ChatSession) senderMessageKey(chatMessage *websock.ChatMessage) ([]byte, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	key, ok := cs.senderKeys[chatMessage.SenderKeyID]
+	if !ok || key.sender != chatMessage.Sender {
+		return nil, util.ErrMessageKeyUnavailable
+	}
+	return key.chain.MessageKey(chatMessage.Iteration)
+}
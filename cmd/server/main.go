@@ -3,18 +3,18 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"net/http"
 
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/server"
-	"golang.org/x/net/websocket"
 )
 
 var envVars = map[string]string{
-	"PORT":         "",
-	"MONGODB_URI":  "",
-	"MONGODB_NAME": "",
-	"FORCE_TLS":    ""}
+	"PORT":      "",
+	"FORCE_TLS": ""}
 
 func checkEnvVars() {
 	for k := range envVars {
@@ -26,6 +26,89 @@ func checkEnvVars() {
 	}
 }
 
+// openStore connects to the mongoDB database given by MONGODB_URI and MONGODB_NAME.
+// If STORE is memory, an in-memory store is used instead
+func openStore() mdb.Store {
+	if os.Getenv("STORE") == "memory" {
+		log.Print("STORE is memory, using in-memory store (data will not be persisted)")
+		return mdb.NewMemoryStore()
+	}
+
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		log.Fatal("Error: environment variable MONGODB_URI is not set")
+	}
+
+	dbName := os.Getenv("MONGODB_NAME")
+	if dbName == "" {
+		log.Fatal("Error: environment variable MONGODB_NAME is not set")
+	}
+
+	db, err := mdb.CreateConnection(mongoURI, dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// retentionConfig reads the retention policy of chat messages from the optional environment variables
+// MESSAGE_MAX_AGE (a duration such as 720h), MESSAGE_MAX_COUNT (the number of messages kept in each chat room),
+// RETENTION_INTERVAL (seconds between purging old messages, defaults to an hour) and RETENTION_TTL (yes
+// to let mongoDB delete old messages by itself)
+func retentionConfig(config *server.Config) {
+	var err error
+	if val := os.Getenv("MESSAGE_MAX_AGE"); val != "" {
+		if config.Retention.MaxAge, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("Error: invalid MESSAGE_MAX_AGE: %s", err)
+		}
+	}
+	if val := os.Getenv("MESSAGE_MAX_COUNT"); val != "" {
+		if config.Retention.MaxMessages, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("Error: invalid MESSAGE_MAX_COUNT: %s", err)
+		}
+	}
+
+	config.RetentionInterval = 3600
+	if val := os.Getenv("RETENTION_INTERVAL"); val != "" {
+		if config.RetentionInterval, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("Error: invalid RETENTION_INTERVAL: %s", err)
+		}
+	}
+	config.RetentionTTL = os.Getenv("RETENTION_TTL") == "yes"
+}
+
+// loginPolicy reads the policy for users who log in while they are already logged in from the optional
+// environment variable LOGIN_POLICY, which is allow (the default), reject or kick
+func loginPolicy() server.LoginPolicy {
+	switch val := os.Getenv("LOGIN_POLICY"); val {
+	case "", "allow":
+		return server.LoginAllowMultiple
+	case "reject":
+		return server.LoginRejectNew
+	case "kick":
+		return server.LoginKickOld
+	default:
+		log.Fatalf("Error: invalid LOGIN_POLICY: %s", val)
+		return server.LoginAllowMultiple
+	}
+}
+
+// rateLimits reads the optional environment variable RATE_LIMITS, which is on (the default) to limit the messages
+// clients can send with the default limits, or off. When the server is behind a proxy (FORCE_TLS), the IP address
+// of a client is read from the X-Forwarded-For header the proxy adds
+func rateLimits() server.RateLimits {
+	var limits server.RateLimits
+	switch val := os.Getenv("RATE_LIMITS"); val {
+	case "", "on":
+		limits = server.DefaultRateLimits()
+	case "off":
+	default:
+		log.Fatalf("Error: invalid RATE_LIMITS: %s", val)
+	}
+	limits.ForwardedFor = envVars["FORCE_TLS"] == "yes"
+	return limits
+}
+
 // Wrapper that forces every request to use TLS
 func forceTLS(server *server.Server) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -35,27 +118,32 @@ func forceTLS(server *server.Server) func(w http.ResponseWriter, r *http.Request
 			return
 		}
 
-		wsHandler := websocket.Handler(server.WebsockHandler)
-		wsHandler.ServeHTTP(w, r)
+		server.Handler().ServeHTTP(w, r)
 	}
 }
 
 func main() {
 	checkEnvVars()
 
+	// SERVER_HOST is only needed if the Host header is changed by a proxy in front of the server,
+	// and INVITE_SECRET keeps invites valid when the server is restarted
 	serverConfig := server.Config{
-		DBName:    envVars["MONGODB_NAME"],
-		MongoURL:  envVars["MONGODB_URI"],
-		Keepalive: 15}
+		Keepalive:    15,
+		Host:         os.Getenv("SERVER_HOST"),
+		InviteSecret: []byte(os.Getenv("INVITE_SECRET")),
+		LoginPolicy:  loginPolicy(),
+		RateLimits:   rateLimits()}
+	retentionConfig(&serverConfig)
 
-	server := server.CreateServer(serverConfig)
+	server := server.CreateServer(serverConfig, openStore())
+	server.StartRetention()
 
 	log.Printf("Listening on port: %s\n", envVars["PORT"])
 
 	if envVars["FORCE_TLS"] == "yes" {
 		http.HandleFunc("/", forceTLS(server))
 	} else {
-		http.Handle("/", websocket.Handler(server.WebsockHandler))
+		http.Handle("/", server.Handler())
 	}
 	err := http.ListenAndServe(":"+envVars["PORT"], nil)
 	log.Printf("Error occurred in http listener: %s\n", err)
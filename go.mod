@@ -1,15 +1,21 @@
 module github.com/haakonleg/go-e2ee-chat-engine
 
+go 1.27.1
+
 // +heroku goVersion go1.11
 // +heroku install ./cmd/...
 
 require (
-	github.com/gdamore/encoding v0.0.0-20151215212835-b23993cbb635 // indirect
 	github.com/gdamore/tcell v1.1.0
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
+	github.com/rivo/tview v0.0.0-20181029163058-60a1c63fa9ae
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+)
+
+require (
+	github.com/gdamore/encoding v0.0.0-20151215212835-b23993cbb635 // indirect
 	github.com/lucasb-eyer/go-colorful v0.0.0-20181028223441-12d3b2882a08 // indirect
 	github.com/mattn/go-runewidth v0.0.3 // indirect
-	github.com/rivo/tview v0.0.0-20181029163058-60a1c63fa9ae
-	golang.org/x/net v0.0.0-20181102091132-c10e9556a7bc
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
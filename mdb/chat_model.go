@@ -2,49 +2,150 @@ package mdb
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 
 	"github.com/globalsign/mgo/bson"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 )
 
 // Chat is the model of the chat object stored in the mongoDB database
+// Owner is the user who created the chat room, Moderators are users the owner has
+// allowed to kick and ban users, and Banned are users who are not allowed to join.
+// Retention is the retention policy set by the owner, nil means the server default is used.
+// Password is the salted hash of the password, nil if the chat room has no password. Chat rooms
+// created by older versions of the server have an unsalted SHA-256 hash in PasswordHash instead,
+// which is replaced by Password when a user joins with the correct password. Renames are the
+// renames of the chat room, oldest first
 type Chat struct {
-	ID           bson.ObjectId `bson:"_id"`
-	Timestamp    int64         `bson:"timestamp"`
-	Name         string        `bson:"name"`
-	PasswordHash []byte        `bson:"password_hash"`
-	IsHidden     bool          `bson:"is_hidden"`
+	ID           bson.ObjectId    `bson:"_id"`
+	Timestamp    int64            `bson:"timestamp"`
+	Name         string           `bson:"name"`
+	Password     *PasswordHash    `bson:"password,omitempty"`
+	PasswordHash []byte           `bson:"password_hash,omitempty"`
+	IsHidden     bool             `bson:"is_hidden"`
+	Owner        string           `bson:"owner"`
+	Moderators   []string         `bson:"moderators"`
+	Banned       []string         `bson:"banned"`
+	Retention    *RetentionPolicy `bson:"retention,omitempty"`
+	Renames      []ChatRename     `bson:"renames,omitempty"`
 }
 
-// ValidPassword compares the checksum of a plaintext password to the checksum
-// stored in the Chat object.
+// ChatRename is a rename of a chat room, Signature is the signature of the owner over the old and new
+// name made with the key of Device (see util.SignChatRename)
+type ChatRename struct {
+	Name      string `bson:"name"`
+	NewName   string `bson:"new_name"`
+	Device    string `bson:"device,omitempty"`
+	Signature []byte `bson:"signature,omitempty"`
+	Timestamp int64  `bson:"timestamp"`
+}
+
+// contains checks if a username is in a list of usernames
+func contains(usernames []string, username string) bool {
+	for _, u := range usernames {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes a username from a list of usernames
+func remove(usernames []string, username string) []string {
+	result := make([]string, 0, len(usernames))
+	for _, u := range usernames {
+		if u != username {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// IsOwner checks if the user is the owner of the chat room
+func (c *Chat) IsOwner(username string) bool {
+	return c.Owner != "" && c.Owner == username
+}
+
+// IsModerator checks if the user is a moderator of the chat room, the owner is always a moderator
+func (c *Chat) IsModerator(username string) bool {
+	return c.IsOwner(username) || contains(c.Moderators, username)
+}
+
+// SetModerator adds or removes a user from the moderators of the chat room
+func (c *Chat) SetModerator(username string, isModerator bool) {
+	c.Moderators = remove(c.Moderators, username)
+	if isModerator {
+		c.Moderators = append(c.Moderators, username)
+	}
+}
+
+// IsBanned checks if the user is banned from the chat room
+func (c *Chat) IsBanned(username string) bool {
+	return contains(c.Banned, username)
+}
+
+// Ban bans a user from the chat room, a banned user is no longer a moderator
+func (c *Chat) Ban(username string) {
+	c.Moderators = remove(c.Moderators, username)
+	if !c.IsBanned(username) {
+		c.Banned = append(c.Banned, username)
+	}
+}
+
+// HasPassword checks if the chat room has a password
+func (c *Chat) HasPassword() bool {
+	return c.Password != nil || len(c.PasswordHash) != 0
+}
+
+// ValidPassword checks a plaintext password against the hash of the password of the chat room.
+// Any password is valid if the chat room has no password
 func (c *Chat) ValidPassword(password string) bool {
-	if len(c.PasswordHash) == 0 {
+	if c.Password != nil {
+		return c.Password.Verify(password)
+	} else if len(c.PasswordHash) == 0 {
 		return true
 	}
 
 	passwordHash := sha256.Sum256([]byte(password))
-	for i := 0; i < sha256.Size; i++ {
-		if c.PasswordHash[i] != passwordHash[i] {
-			return false
+	return subtle.ConstantTimeCompare(c.PasswordHash, passwordHash[:]) == 1
+}
+
+// NeedsRehash checks if the password of the chat room should be hashed again, because it is
+// an unsalted SHA-256 hash, or the hash is outdated
+func (c *Chat) NeedsRehash() bool {
+	if c.Password != nil {
+		return c.Password.Outdated()
+	}
+	return len(c.PasswordHash) != 0
+}
+
+// SetPassword replaces the password of the chat room, an empty password removes the password
+func (c *Chat) SetPassword(password string) error {
+	c.Password = nil
+	c.PasswordHash = nil
+	if password != "" {
+		hash, err := NewPasswordHash(password)
+		if err != nil {
+			return err
 		}
+		c.Password = hash
 	}
-	return true
+	return nil
 }
 
 // NewChat creates a new instance of the Chat object. It takes a plaintext password
-// as input, and returns a new Chat object containing the hashed checksum of that password.
-func NewChat(name, password string, isHidden bool) *Chat {
-	passwordHash := make([]byte, 0)
-	if len(password) > 1 {
-		hash := sha256.Sum256([]byte(password))
-		passwordHash = hash[:]
-	}
-
-	return &Chat{
-		ID:           bson.NewObjectId(),
-		Timestamp:    util.NowMillis(),
-		Name:         name,
-		IsHidden:     isHidden,
-		PasswordHash: passwordHash}
+// as input, and returns a new Chat object containing the salted hash of that password.
+func NewChat(name, password string, isHidden bool, owner string) (*Chat, error) {
+	chat := &Chat{
+		ID:         bson.NewObjectId(),
+		Timestamp:  util.NowMillis(),
+		Name:       name,
+		IsHidden:   isHidden,
+		Owner:      owner,
+		Moderators: make([]string, 0),
+		Banned:     make([]string, 0)}
+	if err := chat.SetPassword(password); err != nil {
+		return nil, err
+	}
+	return chat, nil
 }
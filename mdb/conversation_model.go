@@ -0,0 +1,55 @@
+package mdb
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+)
+
+// Conversation is the model of a direct conversation between two users stored in the database.
+// Name is the name of the conversation (see websock.DirectChatName), which its messages use as the
+// chat room name. LastMessage is the timestamp of the newest message in the conversation
+type Conversation struct {
+	ID           bson.ObjectId `bson:"_id"`
+	Name         string        `bson:"name"`
+	Participants []Participant `bson:"participants"`
+	Timestamp    int64         `bson:"timestamp"`
+	LastMessage  int64         `bson:"last_message"`
+}
+
+// Participant is one of the two users in a direct conversation. LastRead is the timestamp of the
+// newest message the user has read, newer messages sent by the other user are unread
+type Participant struct {
+	Username string `bson:"username"`
+	LastRead int64  `bson:"last_read"`
+}
+
+// Participant gets a user in the conversation, or nil if the user is not in the conversation
+func (c *Conversation) Participant(username string) *Participant {
+	for i := range c.Participants {
+		if c.Participants[i].Username == username {
+			return &c.Participants[i]
+		}
+	}
+	return nil
+}
+
+// Peer gets the other user in the conversation
+func (c *Conversation) Peer(username string) string {
+	for _, participant := range c.Participants {
+		if participant.Username != username {
+			return participant.Username
+		}
+	}
+	return username
+}
+
+// NewConversation creates a new instance of the Conversation object
+func NewConversation(name, username, otherUsername string) *Conversation {
+	return &Conversation{
+		ID:   bson.NewObjectId(),
+		Name: name,
+		Participants: []Participant{
+			{Username: username},
+			{Username: otherUsername}},
+		Timestamp: util.NowMillis()}
+}
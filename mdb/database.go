@@ -1,10 +1,12 @@
 package mdb
 
 import (
-	"errors"
 	"log"
+	"time"
 
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
 )
 
 // DatabaseCollection is used to refer to allowed database collections in functions
@@ -17,8 +19,19 @@ const (
 	ChatRooms
 	// Messages is the collection containing chat messages
 	Messages
+	// Memberships is the collection containing the members of chat rooms
+	Memberships
+	// Conversations is the collection containing direct conversations
+	Conversations
+	// Invites is the collection containing invites to chat rooms
+	Invites
+	// SenderKeys is the collection containing the sender keys which have not been received by their recipients
+	SenderKeys
 )
 
+// collections contains every collection used by the database
+var collections = []DatabaseCollection{Users, ChatRooms, Messages, Memberships, Conversations, Invites, SenderKeys}
+
 func (c DatabaseCollection) String() string {
 	switch c {
 	case Users:
@@ -27,6 +40,14 @@ func (c DatabaseCollection) String() string {
 		return "chat_rooms"
 	case Messages:
 		return "messages"
+	case Memberships:
+		return "memberships"
+	case Conversations:
+		return "conversations"
+	case Invites:
+		return "invites"
+	case SenderKeys:
+		return "sender_keys"
 	}
 	return ""
 }
@@ -55,24 +76,11 @@ func CreateConnection(mongoURL, dbName string) (*Database, error) {
 // DeleteAll removes all data inside all collections, but not the information about the
 // collections themselves
 func (db *Database) DeleteAll() {
-	var err error
-
-	c := db.session.DB(db.dbName).C(Users.String())
-	err = c.DropCollection()
-	if err != nil {
-		log.Printf("Unable to drop collection (%s): %s\n", Users.String(), err)
-	}
-
-	c = db.session.DB(db.dbName).C(ChatRooms.String())
-	err = c.DropCollection()
-	if err != nil {
-		log.Printf("Unable to drop collection (%s): %s\n", ChatRooms.String(), err)
-	}
-
-	c = db.session.DB(db.dbName).C(Messages.String())
-	err = c.DropCollection()
-	if err != nil {
-		log.Printf("Unable to drop collection (%s): %s\n", Messages.String(), err)
+	for _, collection := range collections {
+		c := db.session.DB(db.dbName).C(collection.String())
+		if err := c.DropCollection(); err != nil {
+			log.Printf("Unable to drop collection (%s): %s\n", collection.String(), err)
+		}
 	}
 }
 
@@ -92,9 +100,36 @@ func (db *Database) MakeIndexes() {
 
 	// Indexes for messages
 	c = db.session.DB(db.dbName).C(Messages.String())
+	c.EnsureIndex(mgo.Index{
+		Key:    []string{"chat_name", "timestamp", "_id"},
+		Unique: false})
+
+	// Indexes for memberships
+	c = db.session.DB(db.dbName).C(Memberships.String())
+	c.EnsureIndex(mgo.Index{
+		Key:    []string{"chat_name", "username"},
+		Unique: true})
+
+	// Indexes for direct conversations
+	c = db.session.DB(db.dbName).C(Conversations.String())
+	c.EnsureIndex(mgo.Index{
+		Key:    []string{"name"},
+		Unique: true})
+	c.EnsureIndex(mgo.Index{
+		Key:    []string{"participants.username"},
+		Unique: false})
+
+	// Indexes for invites
+	c = db.session.DB(db.dbName).C(Invites.String())
 	c.EnsureIndex(mgo.Index{
 		Key:    []string{"chat_name"},
 		Unique: false})
+
+	// Indexes for sender keys
+	c = db.session.DB(db.dbName).C(SenderKeys.String())
+	c.EnsureIndex(mgo.Index{
+		Key:    []string{"chat_name", "recipient", "timestamp"},
+		Unique: false})
 }
 
 // Insert inserts one or more objects into the database, creates a temporary copy of the session for better concurrency performance
@@ -143,7 +178,7 @@ func (db *Database) FindOne(collection DatabaseCollection, query interface{}, se
 		log.Println(err)
 		return err
 	} else if cnt == 0 {
-		return errors.New("Got 0 results")
+		return ErrNotFound
 	}
 
 	if err := q.One(result); err != nil {
@@ -153,3 +188,477 @@ func (db *Database) FindOne(collection DatabaseCollection, query interface{}, se
 
 	return nil
 }
+
+// insertUnique inserts an object and translates unique constraint violations to ErrDuplicate
+func (db *Database) insertUnique(collection DatabaseCollection, object interface{}) error {
+	if err := db.Insert(collection, object); err != nil {
+		if mgo.IsDup(err) {
+			return ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// InsertUser adds a new user to the users collection
+func (db *Database) InsertUser(user *User) error {
+	return db.insertUnique(Users, user)
+}
+
+// FindUser finds the user with the given username
+func (db *Database) FindUser(username string) (*User, error) {
+	user := new(User)
+	if err := db.FindOne(Users, bson.M{"username": username}, nil, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUser replaces a stored user with the given user with the same ID
+func (db *Database) UpdateUser(user *User) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	if err := sessionCpy.DB(db.dbName).C(Users.String()).UpdateId(user.ID, user); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// InsertChat adds a new chat room to the chat rooms collection
+func (db *Database) InsertChat(chat *Chat) error {
+	return db.insertUnique(ChatRooms, chat)
+}
+
+// FindChat finds the chat room with the given name
+func (db *Database) FindChat(name string) (*Chat, error) {
+	chat := new(Chat)
+	if err := db.FindOne(ChatRooms, bson.M{"name": name}, nil, chat); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
+// FindVisibleChats finds all chat rooms which are not hidden
+func (db *Database) FindVisibleChats() ([]*Chat, error) {
+	results := make([]*Chat, 0)
+	if err := db.FindAll(ChatRooms, bson.M{"is_hidden": false}, nil, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FindAllChats finds all chat rooms, also those which are hidden
+func (db *Database) FindAllChats() ([]*Chat, error) {
+	results := make([]*Chat, 0)
+	if err := db.FindAll(ChatRooms, bson.M{}, nil, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// UpdateChat replaces a stored chat room with the given chat room with the same ID
+func (db *Database) UpdateChat(chat *Chat) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	if err := sessionCpy.DB(db.dbName).C(ChatRooms.String()).UpdateId(chat.ID, chat); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// RenameChat renames a chat room, and updates the chat room name of its messages, memberships and invites
+func (db *Database) RenameChat(rename *ChatRename) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	name, newName := rename.Name, rename.NewName
+	err := sessionCpy.DB(db.dbName).C(ChatRooms.String()).
+		Update(bson.M{"name": name}, bson.M{"$set": bson.M{"name": newName}, "$push": bson.M{"renames": rename}})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		} else if mgo.IsDup(err) {
+			return ErrDuplicate
+		}
+		log.Println(err)
+		return err
+	}
+
+	// The signatures of the messages cover the chat room name, so remember the name they were sent with
+	_, err = sessionCpy.DB(db.dbName).C(Messages.String()).UpdateAll(
+		bson.M{"chat_name": name, "signed_chat_name": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"signed_chat_name": name}})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	for _, collection := range []DatabaseCollection{Messages, Memberships, Invites, SenderKeys} {
+		_, err := sessionCpy.DB(db.dbName).C(collection.String()).
+			UpdateAll(bson.M{"chat_name": name}, bson.M{"$set": bson.M{"chat_name": newName}})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteChat deletes a chat room, and all of its messages, memberships, invites and sender keys
+func (db *Database) DeleteChat(name string) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	if err := sessionCpy.DB(db.dbName).C(ChatRooms.String()).Remove(bson.M{"name": name}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		log.Println(err)
+		return err
+	}
+
+	for _, collection := range []DatabaseCollection{Messages, Memberships, Invites, SenderKeys} {
+		if _, err := sessionCpy.DB(db.dbName).C(collection.String()).RemoveAll(bson.M{"chat_name": name}); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertMembership adds a user as a member of a chat room
+func (db *Database) InsertMembership(membership *Membership) error {
+	return db.insertUnique(Memberships, membership)
+}
+
+// FindMemberships finds all members of a chat room
+func (db *Database) FindMemberships(chatName string) ([]*Membership, error) {
+	results := make([]*Membership, 0)
+	if err := db.FindAll(Memberships, bson.M{"chat_name": chatName}, nil, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// DeleteMembership removes a user from the members of a chat room
+func (db *Database) DeleteMembership(chatName, username string) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	err := sessionCpy.DB(db.dbName).C(Memberships.String()).
+		Remove(bson.M{"chat_name": chatName, "username": username})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertMessage adds a new chat message to the messages collection
+func (db *Database) InsertMessage(msg *Message) error {
+	return db.Insert(Messages, msg)
+}
+
+// FindMessagesForUser finds the chat messages with a specific recipient in a specific chat room, ordered by
+// timestamp. Only messages before the cursor are included (if it is not nil), and if limit is not zero, only the
+// newest limit messages
+func (db *Database) FindMessagesForUser(recipient, chatName string, before *MessageCursor, limit int) ([]*Message, error) {
+	query := bson.M{
+		"chat_name":                 chatName,
+		"message_content.recipient": recipient}
+	if before != nil {
+		query["$or"] = []bson.M{
+			{"timestamp": bson.M{"$lt": before.Timestamp}},
+			{"timestamp": before.Timestamp, "_id": bson.M{"$lt": before.ID}}}
+	}
+
+	selector := bson.M{
+		"chat_name":        1,
+		"timestamp":        1,
+		"signed_chat_name": 1,
+		"sender":           1,
+		"sender_device":    1,
+		"version":          1,
+		"ciphertext":       1,
+		"signature":        1,
+		"sender_key_id":    1,
+		"iteration":        1,
+		"message_content": bson.M{
+			"$elemMatch": bson.M{"recipient": recipient}},
+	}
+
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	// Get the newest messages first, so that the limit applies to the newest messages
+	results := make([]*Message, 0)
+	err := sessionCpy.DB(db.dbName).C(Messages.String()).
+		Find(query).
+		Select(selector).
+		Sort("-timestamp", "-_id").
+		Limit(limit).
+		All(&results)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results, nil
+}
+
+// DeleteMessagesBefore deletes the chat messages in a chat room which are older than the timestamp
+func (db *Database) DeleteMessagesBefore(chatName string, timestamp int64) (int, error) {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	info, err := sessionCpy.DB(db.dbName).C(Messages.String()).
+		RemoveAll(bson.M{"chat_name": chatName, "timestamp": bson.M{"$lt": timestamp}})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// DeleteOldestMessages deletes the oldest chat messages in a chat room, so that at most keep messages are left
+func (db *Database) DeleteOldestMessages(chatName string, keep int) (int, error) {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+	c := sessionCpy.DB(db.dbName).C(Messages.String())
+
+	// Find the messages after the newest messages which should be kept
+	var old []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err := c.Find(bson.M{"chat_name": chatName}).
+		Sort("-timestamp", "-_id").
+		Skip(keep).
+		Select(bson.M{"_id": 1}).
+		All(&old)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]bson.ObjectId, 0, len(old))
+	for _, msg := range old {
+		ids = append(ids, msg.ID)
+	}
+	info, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// InsertSenderKeys adds sender keys to the sender keys collection
+func (db *Database) InsertSenderKeys(keys ...*SenderKey) error {
+	objects := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, key)
+	}
+	return db.Insert(SenderKeys, objects...)
+}
+
+// FindSenderKeys finds the sender keys in a chat room distributed to the recipient, ordered by timestamp
+func (db *Database) FindSenderKeys(recipient, chatName string) ([]*SenderKey, error) {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	results := make([]*SenderKey, 0)
+	err := sessionCpy.DB(db.dbName).C(SenderKeys.String()).
+		Find(bson.M{"chat_name": chatName, "recipient": recipient}).
+		Sort("timestamp").
+		All(&results)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// DeleteSenderKeys deletes the sender keys in a chat room with the given key IDs, which were distributed to the recipient
+func (db *Database) DeleteSenderKeys(recipient, chatName string, keyIDs []string) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	_, err := sessionCpy.DB(db.dbName).C(SenderKeys.String()).
+		RemoveAll(bson.M{"chat_name": chatName, "recipient": recipient, "key_id": bson.M{"$in": keyIDs}})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// DeleteSenderKeysBefore deletes the sender keys in a chat room which were distributed before the timestamp
+func (db *Database) DeleteSenderKeysBefore(chatName string, timestamp int64) (int, error) {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	info, err := sessionCpy.DB(db.dbName).C(SenderKeys.String()).
+		RemoveAll(bson.M{"chat_name": chatName, "timestamp": bson.M{"$lt": timestamp}})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// InsertConversation adds a new direct conversation to the conversations collection
+func (db *Database) InsertConversation(conv *Conversation) error {
+	return db.insertUnique(Conversations, conv)
+}
+
+// FindConversation finds the direct conversation with the given name
+func (db *Database) FindConversation(name string) (*Conversation, error) {
+	conv := new(Conversation)
+	if err := db.FindOne(Conversations, bson.M{"name": name}, nil, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// FindConversations finds the direct conversations the user is in
+func (db *Database) FindConversations(username string) ([]*Conversation, error) {
+	results := make([]*Conversation, 0)
+	if err := db.FindAll(Conversations, bson.M{"participants.username": username}, nil, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FindAllConversations finds all direct conversations
+func (db *Database) FindAllConversations() ([]*Conversation, error) {
+	results := make([]*Conversation, 0)
+	if err := db.FindAll(Conversations, bson.M{}, nil, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// UpdateConversation replaces a stored direct conversation with the given conversation with the same ID
+func (db *Database) UpdateConversation(conv *Conversation) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	if err := sessionCpy.DB(db.dbName).C(Conversations.String()).UpdateId(conv.ID, conv); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// CountUnreadMessages counts the chat messages in a chat room which are newer than the timestamp, and were not sent by the user
+func (db *Database) CountUnreadMessages(chatName, username string, after int64) (int, error) {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	n, err := sessionCpy.DB(db.dbName).C(Messages.String()).Find(bson.M{
+		"chat_name": chatName,
+		"timestamp": bson.M{"$gt": after},
+		"sender":    bson.M{"$ne": username}}).Count()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// EnsureMessageExpiry creates a TTL index, so that mongoDB deletes chat messages when their ExpiresAt time has passed
+func (db *Database) EnsureMessageExpiry() error {
+	// The smallest expiry mgo supports is a second, messages are deleted at most a second late
+	return db.session.DB(db.dbName).C(Messages.String()).EnsureIndex(mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second})
+}
+
+// UpdateMessageExpiry sets the ExpiresAt time of the chat messages in a chat room to their timestamp plus maxAge,
+// or removes it if maxAge is zero
+func (db *Database) UpdateMessageExpiry(chatName string, maxAge time.Duration) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+	c := sessionCpy.DB(db.dbName).C(Messages.String())
+
+	if maxAge == 0 {
+		if _, err := c.UpdateAll(bson.M{"chat_name": chatName}, bson.M{"$unset": bson.M{"expires_at": ""}}); err != nil {
+			log.Println(err)
+			return err
+		}
+		return nil
+	}
+
+	// The expiry depends on the timestamp of each message, so every message is updated by itself
+	var messages []struct {
+		ID        bson.ObjectId `bson:"_id"`
+		Timestamp int64         `bson:"timestamp"`
+	}
+	if err := c.Find(bson.M{"chat_name": chatName}).Select(bson.M{"_id": 1, "timestamp": 1}).All(&messages); err != nil {
+		log.Println(err)
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for _, msg := range messages {
+		bulk.Update(bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"expires_at": util.MillisToTime(msg.Timestamp).Add(maxAge)}})
+	}
+	if _, err := bulk.Run(); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// InsertInvite adds a new invite to the invites collection
+func (db *Database) InsertInvite(invite *Invite) error {
+	return db.Insert(Invites, invite)
+}
+
+// FindInvite finds the invite with the given ID
+func (db *Database) FindInvite(id string) (*Invite, error) {
+	if !ValidID(id) {
+		return nil, ErrNotFound
+	}
+	invite := new(Invite)
+	if err := db.FindOne(Invites, bson.M{"_id": bson.ObjectIdHex(id)}, nil, invite); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// UpdateInvite replaces a stored invite with the given invite with the same ID
+func (db *Database) UpdateInvite(invite *Invite) error {
+	sessionCpy := db.session.Copy()
+	defer sessionCpy.Close()
+
+	if err := sessionCpy.DB(db.dbName).C(Invites.String()).UpdateId(invite.ID, invite); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
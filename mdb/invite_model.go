@@ -0,0 +1,36 @@
+package mdb
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+)
+
+// Invite is the model of an invite to a chat room stored in the database. The invite token given to users
+// is signed by the server and refers to the invite by ID, the stored invite keeps track of how many times
+// it has been used, and whether it has been revoked. ExpiresAt is a timestamp in milliseconds
+type Invite struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Timestamp int64         `bson:"timestamp"`
+	ChatName  string        `bson:"chat_name"`
+	Creator   string        `bson:"creator"`
+	ExpiresAt int64         `bson:"expires_at"`
+	MaxUses   int           `bson:"max_uses"`
+	Uses      int           `bson:"uses"`
+	Revoked   bool          `bson:"revoked"`
+}
+
+// Valid checks if the invite can be used to join the chat room at the given time
+func (i *Invite) Valid(now int64) bool {
+	return !i.Revoked && now < i.ExpiresAt && i.Uses < i.MaxUses
+}
+
+// NewInvite creates a new instance of the Invite object
+func NewInvite(chatName, creator string, expiresAt int64, maxUses int) *Invite {
+	return &Invite{
+		ID:        bson.NewObjectId(),
+		Timestamp: util.NowMillis(),
+		ChatName:  chatName,
+		Creator:   creator,
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses}
+}
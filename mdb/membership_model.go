@@ -0,0 +1,27 @@
+package mdb
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+)
+
+// Membership is the model of a users membership in a chat room stored in the database.
+// A user becomes a member the first time he joins a chat room, and stays a member when he
+// is offline, so other members can encrypt chat messages for him.
+type Membership struct {
+	ID        bson.ObjectId `bson:"_id"`
+	ChatName  string        `bson:"chat_name"`
+	Username  string        `bson:"username"`
+	PublicKey []byte        `bson:"public_key"`
+	Timestamp int64         `bson:"timestamp"`
+}
+
+// NewMembership creates a new instance of the Membership object
+func NewMembership(chatName, username string, publicKey []byte) *Membership {
+	return &Membership{
+		ID:        bson.NewObjectId(),
+		ChatName:  chatName,
+		Username:  username,
+		PublicKey: publicKey,
+		Timestamp: util.NowMillis()}
+}
@@ -0,0 +1,589 @@
+package mdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// MemoryStore is a Store which keeps all data in memory. Nothing is persisted, so it
+// is mainly useful for tests and local demos where a mongoDB database is not available.
+type MemoryStore struct {
+	sync.RWMutex
+	users       map[string]*User
+	chats       map[string]*Chat
+	messages    []*Message
+	memberships map[string][]*Membership
+	convs       map[string]*Conversation
+	invites     map[bson.ObjectId]*Invite
+	senderKeys  []*SenderKey
+}
+
+// NewMemoryStore creates a new, empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[string]*User),
+		chats:       make(map[string]*Chat),
+		messages:    make([]*Message, 0),
+		memberships: make(map[string][]*Membership),
+		convs:       make(map[string]*Conversation),
+		invites:     make(map[bson.ObjectId]*Invite),
+		senderKeys:  make([]*SenderKey, 0)}
+}
+
+// InsertUser adds a new user to the store
+func (ms *MemoryStore) InsertUser(user *User) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, exists := ms.users[user.Username]; exists {
+		return ErrDuplicate
+	}
+	ms.users[user.Username] = copyUser(user)
+	return nil
+}
+
+// copyUser copies a user, including the devices and the key history
+func copyUser(user *User) *User {
+	cpy := *user
+	cpy.Devices = append([]Device(nil), user.Devices...)
+	cpy.KeyHistory = append([]KeyChange(nil), user.KeyHistory...)
+	return &cpy
+}
+
+// FindUser finds the user with the given username
+func (ms *MemoryStore) FindUser(username string) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	user, ok := ms.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyUser(user), nil
+}
+
+// UpdateUser replaces a stored user with the given user with the same ID
+func (ms *MemoryStore) UpdateUser(user *User) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored, ok := ms.users[user.Username]
+	if !ok || stored.ID != user.ID {
+		return ErrNotFound
+	}
+	ms.users[user.Username] = copyUser(user)
+	return nil
+}
+
+// InsertChat adds a new chat room to the store
+func (ms *MemoryStore) InsertChat(chat *Chat) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, exists := ms.chats[chat.Name]; exists {
+		return ErrDuplicate
+	}
+	ms.chats[chat.Name] = copyChat(chat)
+	return nil
+}
+
+// copyChat copies a chat room, including the lists of users, so the stored
+// chat room is not modified when the copy is modified
+func copyChat(chat *Chat) *Chat {
+	cpy := *chat
+	cpy.Moderators = append([]string(nil), chat.Moderators...)
+	cpy.Banned = append([]string(nil), chat.Banned...)
+	cpy.Renames = append([]ChatRename(nil), chat.Renames...)
+	if chat.Retention != nil {
+		retention := *chat.Retention
+		cpy.Retention = &retention
+	}
+	if chat.Password != nil {
+		password := *chat.Password
+		cpy.Password = &password
+	}
+	return &cpy
+}
+
+// FindChat finds the chat room with the given name
+func (ms *MemoryStore) FindChat(name string) (*Chat, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	chat, ok := ms.chats[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyChat(chat), nil
+}
+
+// FindVisibleChats finds all chat rooms which are not hidden
+func (ms *MemoryStore) FindVisibleChats() ([]*Chat, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Chat, 0, len(ms.chats))
+	for _, chat := range ms.chats {
+		if chat.IsHidden {
+			continue
+		}
+		results = append(results, copyChat(chat))
+	}
+	return results, nil
+}
+
+// FindAllChats finds all chat rooms, also those which are hidden
+func (ms *MemoryStore) FindAllChats() ([]*Chat, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Chat, 0, len(ms.chats))
+	for _, chat := range ms.chats {
+		results = append(results, copyChat(chat))
+	}
+	return results, nil
+}
+
+// UpdateChat replaces a stored chat room with the given chat room with the same ID
+func (ms *MemoryStore) UpdateChat(chat *Chat) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for name, stored := range ms.chats {
+		if stored.ID == chat.ID {
+			if name != chat.Name {
+				if _, exists := ms.chats[chat.Name]; exists {
+					return ErrDuplicate
+				}
+				delete(ms.chats, name)
+			}
+			ms.chats[chat.Name] = copyChat(chat)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RenameChat renames a chat room, and updates the chat room name of its messages, memberships, invites and sender keys
+func (ms *MemoryStore) RenameChat(rename *ChatRename) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	name, newName := rename.Name, rename.NewName
+	chat, ok := ms.chats[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, exists := ms.chats[newName]; exists {
+		return ErrDuplicate
+	}
+
+	delete(ms.chats, name)
+	chat.Name = newName
+	chat.Renames = append(chat.Renames, *rename)
+	ms.chats[newName] = chat
+
+	for _, msg := range ms.messages {
+		if msg.ChatName == name {
+			if msg.SignedChatName == "" {
+				msg.SignedChatName = name
+			}
+			msg.ChatName = newName
+		}
+	}
+	for _, member := range ms.memberships[name] {
+		member.ChatName = newName
+	}
+	if members, ok := ms.memberships[name]; ok {
+		delete(ms.memberships, name)
+		ms.memberships[newName] = members
+	}
+	for _, invite := range ms.invites {
+		if invite.ChatName == name {
+			invite.ChatName = newName
+		}
+	}
+	for _, key := range ms.senderKeys {
+		if key.ChatName == name {
+			key.ChatName = newName
+		}
+	}
+	return nil
+}
+
+// DeleteChat deletes a chat room, and all of its messages, memberships, invites and sender keys
+func (ms *MemoryStore) DeleteChat(name string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.chats[name]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.chats, name)
+	delete(ms.memberships, name)
+	for id, invite := range ms.invites {
+		if invite.ChatName == name {
+			delete(ms.invites, id)
+		}
+	}
+	ms.deleteMessages(func(msg *Message) bool { return msg.ChatName == name })
+	ms.deleteSenderKeys(func(key *SenderKey) bool { return key.ChatName == name })
+	return nil
+}
+
+// InsertMembership adds a user as a member of a chat room
+func (ms *MemoryStore) InsertMembership(membership *Membership) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, member := range ms.memberships[membership.ChatName] {
+		if member.Username == membership.Username {
+			return ErrDuplicate
+		}
+	}
+	cpy := *membership
+	ms.memberships[membership.ChatName] = append(ms.memberships[membership.ChatName], &cpy)
+	return nil
+}
+
+// FindMemberships finds all members of a chat room
+func (ms *MemoryStore) FindMemberships(chatName string) ([]*Membership, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Membership, 0, len(ms.memberships[chatName]))
+	for _, member := range ms.memberships[chatName] {
+		cpy := *member
+		results = append(results, &cpy)
+	}
+	return results, nil
+}
+
+// DeleteMembership removes a user from the members of a chat room
+func (ms *MemoryStore) DeleteMembership(chatName, username string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for i, member := range ms.memberships[chatName] {
+		if member.Username == username {
+			members := ms.memberships[chatName]
+			ms.memberships[chatName] = append(members[:i:i], members[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// InsertMessage adds a new chat message to the store
+func (ms *MemoryStore) InsertMessage(msg *Message) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	cpy := *msg
+	cpy.MessageContent = append([]MessageContent(nil), msg.MessageContent...)
+	ms.messages = append(ms.messages, &cpy)
+	return nil
+}
+
+// FindMessagesForUser finds the chat messages with a specific recipient in a specific chat room, ordered by
+// timestamp. Only messages before the cursor are included (if it is not nil), and if limit is not zero, only the
+// newest limit messages
+func (ms *MemoryStore) FindMessagesForUser(recipient, chatName string, before *MessageCursor, limit int) ([]*Message, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Message, 0)
+	for _, msg := range ms.messages {
+		if msg.ChatName != chatName || (before != nil && !before.Before(msg)) {
+			continue
+		}
+
+		// Only include the content addressed to the recipient, like $elemMatch does in mongoDB. Messages which
+		// are not addressed to the recipient are skipped, so they do not count toward the limit
+		cpy := *msg
+		cpy.MessageContent = make([]MessageContent, 0, 1)
+		for _, content := range msg.MessageContent {
+			if content.Recipient == recipient {
+				cpy.MessageContent = append(cpy.MessageContent, content)
+				break
+			}
+		}
+		if len(cpy.MessageContent) == 0 {
+			continue
+		}
+		results = append(results, &cpy)
+	}
+
+	sortMessages(results)
+	if limit != 0 && len(results) > limit {
+		results = results[len(results)-limit:]
+	}
+	return results, nil
+}
+
+// sortMessages sorts chat messages by timestamp, and by ID if the timestamps are equal
+func sortMessages(messages []*Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Timestamp != messages[j].Timestamp {
+			return messages[i].Timestamp < messages[j].Timestamp
+		}
+		return messages[i].ID < messages[j].ID
+	})
+}
+
+// DeleteMessagesBefore deletes the chat messages in a chat room which are older than the timestamp
+func (ms *MemoryStore) DeleteMessagesBefore(chatName string, timestamp int64) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	return ms.deleteMessages(func(msg *Message) bool {
+		return msg.ChatName == chatName && msg.Timestamp < timestamp
+	}), nil
+}
+
+// DeleteOldestMessages deletes the oldest chat messages in a chat room, so that at most keep messages are left
+func (ms *MemoryStore) DeleteOldestMessages(chatName string, keep int) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	inChat := make([]*Message, 0)
+	for _, msg := range ms.messages {
+		if msg.ChatName == chatName {
+			inChat = append(inChat, msg)
+		}
+	}
+	if len(inChat) <= keep {
+		return 0, nil
+	}
+
+	sortMessages(inChat)
+	old := make(map[*Message]bool, len(inChat)-keep)
+	for _, msg := range inChat[:len(inChat)-keep] {
+		old[msg] = true
+	}
+
+	return ms.deleteMessages(func(msg *Message) bool { return old[msg] }), nil
+}
+
+// deleteMessages deletes the messages matching filter, the mutex must be held
+func (ms *MemoryStore) deleteMessages(filter func(*Message) bool) int {
+	messages := make([]*Message, 0, len(ms.messages))
+	for _, msg := range ms.messages {
+		if !filter(msg) {
+			messages = append(messages, msg)
+		}
+	}
+	deleted := len(ms.messages) - len(messages)
+	ms.messages = messages
+	return deleted
+}
+
+// InsertSenderKeys adds sender keys to the store
+func (ms *MemoryStore) InsertSenderKeys(keys ...*SenderKey) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, key := range keys {
+		cpy := *key
+		ms.senderKeys = append(ms.senderKeys, &cpy)
+	}
+	return nil
+}
+
+// FindSenderKeys finds the sender keys in a chat room distributed to the recipient, ordered by timestamp
+func (ms *MemoryStore) FindSenderKeys(recipient, chatName string) ([]*SenderKey, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*SenderKey, 0)
+	for _, key := range ms.senderKeys {
+		if key.ChatName == chatName && key.Recipient == recipient {
+			cpy := *key
+			results = append(results, &cpy)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp < results[j].Timestamp
+	})
+	return results, nil
+}
+
+// DeleteSenderKeys deletes the sender keys in a chat room with the given key IDs, which were distributed to the recipient
+func (ms *MemoryStore) DeleteSenderKeys(recipient, chatName string, keyIDs []string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ids := make(map[string]bool, len(keyIDs))
+	for _, id := range keyIDs {
+		ids[id] = true
+	}
+	ms.deleteSenderKeys(func(key *SenderKey) bool {
+		return key.ChatName == chatName && key.Recipient == recipient && ids[key.KeyID]
+	})
+	return nil
+}
+
+// DeleteSenderKeysBefore deletes the sender keys in a chat room which were distributed before the timestamp
+func (ms *MemoryStore) DeleteSenderKeysBefore(chatName string, timestamp int64) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	return ms.deleteSenderKeys(func(key *SenderKey) bool {
+		return key.ChatName == chatName && key.Timestamp < timestamp
+	}), nil
+}
+
+// deleteSenderKeys deletes the sender keys matching filter, the mutex must be held
+func (ms *MemoryStore) deleteSenderKeys(filter func(*SenderKey) bool) int {
+	remaining := make([]*SenderKey, 0, len(ms.senderKeys))
+	for _, key := range ms.senderKeys {
+		if !filter(key) {
+			remaining = append(remaining, key)
+		}
+	}
+	deleted := len(ms.senderKeys) - len(remaining)
+	ms.senderKeys = remaining
+	return deleted
+}
+
+// InsertConversation adds a new direct conversation to the store
+func (ms *MemoryStore) InsertConversation(conv *Conversation) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, exists := ms.convs[conv.Name]; exists {
+		return ErrDuplicate
+	}
+	ms.convs[conv.Name] = copyConversation(conv)
+	return nil
+}
+
+// copyConversation copies a direct conversation, including the participants
+func copyConversation(conv *Conversation) *Conversation {
+	cpy := *conv
+	cpy.Participants = append([]Participant(nil), conv.Participants...)
+	return &cpy
+}
+
+// FindConversation finds the direct conversation with the given name
+func (ms *MemoryStore) FindConversation(name string) (*Conversation, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	conv, ok := ms.convs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyConversation(conv), nil
+}
+
+// FindConversations finds the direct conversations the user is in
+func (ms *MemoryStore) FindConversations(username string) ([]*Conversation, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Conversation, 0)
+	for _, conv := range ms.convs {
+		if conv.Participant(username) != nil {
+			results = append(results, copyConversation(conv))
+		}
+	}
+	return results, nil
+}
+
+// FindAllConversations finds all direct conversations
+func (ms *MemoryStore) FindAllConversations() ([]*Conversation, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	results := make([]*Conversation, 0, len(ms.convs))
+	for _, conv := range ms.convs {
+		results = append(results, copyConversation(conv))
+	}
+	return results, nil
+}
+
+// UpdateConversation replaces a stored direct conversation with the given conversation with the same ID
+func (ms *MemoryStore) UpdateConversation(conv *Conversation) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored, ok := ms.convs[conv.Name]
+	if !ok || stored.ID != conv.ID {
+		return ErrNotFound
+	}
+	ms.convs[conv.Name] = copyConversation(conv)
+	return nil
+}
+
+// CountUnreadMessages counts the chat messages in a chat room which are newer than the timestamp, and were not sent by the user
+func (ms *MemoryStore) CountUnreadMessages(chatName, username string, after int64) (int, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	n := 0
+	for _, msg := range ms.messages {
+		if msg.ChatName == chatName && msg.Timestamp > after && msg.Sender != username {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// InsertInvite adds a new invite to a chat room to the store
+func (ms *MemoryStore) InsertInvite(invite *Invite) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, exists := ms.invites[invite.ID]; exists {
+		return ErrDuplicate
+	}
+	cpy := *invite
+	ms.invites[invite.ID] = &cpy
+	return nil
+}
+
+// FindInvite finds the invite with the given ID
+func (ms *MemoryStore) FindInvite(id string) (*Invite, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	if !ValidID(id) {
+		return nil, ErrNotFound
+	}
+	invite, ok := ms.invites[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cpy := *invite
+	return &cpy, nil
+}
+
+// UpdateInvite replaces a stored invite with the given invite with the same ID
+func (ms *MemoryStore) UpdateInvite(invite *Invite) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.invites[invite.ID]; !ok {
+		return ErrNotFound
+	}
+	cpy := *invite
+	ms.invites[invite.ID] = &cpy
+	return nil
+}
+
+// DeleteAll removes all data from the store
+func (ms *MemoryStore) DeleteAll() {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.users = make(map[string]*User)
+	ms.chats = make(map[string]*Chat)
+	ms.messages = make([]*Message, 0)
+	ms.memberships = make(map[string][]*Membership)
+	ms.convs = make(map[string]*Conversation)
+	ms.invites = make(map[bson.ObjectId]*Invite)
+	ms.senderKeys = make([]*SenderKey, 0)
+}
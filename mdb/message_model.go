@@ -1,31 +1,75 @@
 package mdb
 
 import (
+	"time"
+
 	"github.com/globalsign/mgo/bson"
 )
 
 // Message is the model of chat messages stored in the database
+// Version is the format of the ciphertext (one of the websock.MessageVersion constants).
+// Ciphertext is only set for the hybrid formats, where it contains the message encrypted with the message key.
+// Signature is the senders signature over the message, if it was signed, made with the key of SenderDevice.
+// SenderKeyID and Iteration are only set for messages encrypted with a sender key, they identify the message key.
+// If the chat room has been renamed since the message was sent, SignedChatName is the name of the
+// chat room when the message was sent, which is the name covered by the signature.
+// If ExpiresAt is set, a store which implements MessageExpirer deletes the message at that time
 type Message struct {
 	ID             bson.ObjectId    `bson:"_id"`
 	ChatName       string           `bson:"chat_name"`
+	SignedChatName string           `bson:"signed_chat_name,omitempty"`
 	Timestamp      int64            `bson:"timestamp"`
 	Sender         string           `bson:"sender"`
+	SenderDevice   string           `bson:"sender_device,omitempty"`
+	Version        int              `bson:"version"`
+	Ciphertext     []byte           `bson:"ciphertext,omitempty"`
+	Signature      []byte           `bson:"signature,omitempty"`
+	SenderKeyID    string           `bson:"sender_key_id,omitempty"`
+	Iteration      uint32           `bson:"iteration,omitempty"`
 	MessageContent []MessageContent `bson:"message_content"`
+	ExpiresAt      time.Time        `bson:"expires_at,omitempty"`
 }
 
-// MessageContent contains the ciphertext of a chat message addressed to a specific user
-// There should be an entry for each recipient in the chat room when the chat message was sent.
+// MessageContent contains the ciphertext of a chat message (or the message key) addressed to a specific user, or a
+// device of a user (see websock.Recipient). There should be an entry for each recipient in the chat room when the
+// chat message was sent. Content is empty for messages encrypted with a sender key
 type MessageContent struct {
 	Recipient string `bson:"recipient"`
 	Content   []byte `bson:"content"`
 }
 
 // NewMessage creates a new instance of the Message object
-func NewMessage(chatName string, timestamp int64, sender string) *Message {
+func NewMessage(chatName string, timestamp int64, sender string, version int, ciphertext, signature []byte) *Message {
 	return &Message{
 		ID:             bson.NewObjectId(),
 		ChatName:       chatName,
 		Timestamp:      timestamp,
 		Sender:         sender,
+		Version:        version,
+		Ciphertext:     ciphertext,
+		Signature:      signature,
 		MessageContent: make([]MessageContent, 0)}
 }
+
+// MessageCursor is the position of a chat message in a chat room, where the chat messages are ordered
+// by timestamp, and by ID if the timestamps are equal
+type MessageCursor struct {
+	Timestamp int64
+	ID        bson.ObjectId
+}
+
+// NewMessageCursor creates a cursor at the chat message with the timestamp and ID, which must be a valid ID
+// (see ValidID)
+func NewMessageCursor(timestamp int64, id string) *MessageCursor {
+	return &MessageCursor{Timestamp: timestamp, ID: bson.ObjectIdHex(id)}
+}
+
+// ValidID checks if an ID sent by a client is in the format of the IDs of stored documents
+func ValidID(id string) bool {
+	return bson.IsObjectIdHex(id)
+}
+
+// Before checks if the chat message is before the cursor
+func (c *MessageCursor) Before(msg *Message) bool {
+	return msg.Timestamp < c.Timestamp || (msg.Timestamp == c.Timestamp && msg.ID < c.ID)
+}
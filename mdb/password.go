@@ -0,0 +1,76 @@
+package mdb
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The format and scrypt parameters of new password hashes, the recommended parameters for interactive logins.
+// A hash with an older version or other parameters is replaced when a user joins with the correct password
+const (
+	passwordVersionScrypt = 1
+	passwordSaltLen       = 16
+	passwordHashLen       = 32
+	passwordLogN          = 15
+	passwordR             = 8
+	passwordP             = 1
+
+	// maxPasswordLogN, maxPasswordR, maxPasswordP and maxPasswordHashLen limit the cost of verifying a stored hash
+	maxPasswordLogN    = 20
+	maxPasswordR       = 16
+	maxPasswordP       = 4
+	maxPasswordHashLen = 64
+)
+
+// PasswordHash is a salted scrypt hash of a chat room password, stored together with the
+// version of the format and the scrypt parameters (log2 N, r and p) it was computed with
+type PasswordHash struct {
+	Version int    `bson:"version"`
+	LogN    uint8  `bson:"log_n"`
+	R       int    `bson:"r"`
+	P       int    `bson:"p"`
+	Salt    []byte `bson:"salt"`
+	Hash    []byte `bson:"hash"`
+}
+
+// NewPasswordHash hashes a password with a new random salt
+func NewPasswordHash(password string) (*PasswordHash, error) {
+	ph := &PasswordHash{
+		Version: passwordVersionScrypt,
+		LogN:    passwordLogN,
+		R:       passwordR,
+		P:       passwordP,
+		Salt:    make([]byte, passwordSaltLen)}
+	if _, err := rand.Read(ph.Salt); err != nil {
+		return nil, err
+	}
+
+	hash, err := scrypt.Key([]byte(password), ph.Salt, 1<<ph.LogN, ph.R, ph.P, passwordHashLen)
+	if err != nil {
+		return nil, err
+	}
+	ph.Hash = hash
+	return ph, nil
+}
+
+// Verify checks if the password matches the hash, the hashes are compared in constant time
+func (ph *PasswordHash) Verify(password string) bool {
+	if ph.Version != passwordVersionScrypt || ph.LogN > maxPasswordLogN || ph.R < 1 || ph.R > maxPasswordR ||
+		ph.P < 1 || ph.P > maxPasswordP || len(ph.Hash) == 0 || len(ph.Hash) > maxPasswordHashLen {
+		return false
+	}
+
+	hash, err := scrypt.Key([]byte(password), ph.Salt, 1<<ph.LogN, ph.R, ph.P, len(ph.Hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, ph.Hash) == 1
+}
+
+// Outdated checks if the hash was computed with an older format or other parameters than new hashes
+func (ph *PasswordHash) Outdated() bool {
+	return ph.Version != passwordVersionScrypt || ph.LogN != passwordLogN || ph.R != passwordR ||
+		ph.P != passwordP || len(ph.Salt) != passwordSaltLen || len(ph.Hash) != passwordHashLen
+}
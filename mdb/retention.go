@@ -0,0 +1,46 @@
+package mdb
+
+import "time"
+
+// RetentionPolicy decides how long chat messages are kept. Messages older than MaxAge are purged,
+// and only the MaxMessages newest messages of a chat room are kept. Zero means no limit
+type RetentionPolicy struct {
+	MaxAge      time.Duration `bson:"max_age"`
+	MaxMessages int           `bson:"max_messages"`
+}
+
+// Override applies the policy of a chat room (which may be nil) to the policy. The chat room
+// can only make the limits stricter, limits which are not stricter are ignored
+func (p RetentionPolicy) Override(room *RetentionPolicy) RetentionPolicy {
+	if room == nil {
+		return p
+	}
+	if room.MaxAge > 0 && (p.MaxAge == 0 || room.MaxAge < p.MaxAge) {
+		p.MaxAge = room.MaxAge
+	}
+	if room.MaxMessages > 0 && (p.MaxMessages == 0 || room.MaxMessages < p.MaxMessages) {
+		p.MaxMessages = room.MaxMessages
+	}
+	return p
+}
+
+// Allows checks that a policy does not keep messages for longer, or keep more messages, than the policy p allows
+func (p RetentionPolicy) Allows(other RetentionPolicy) bool {
+	if p.MaxAge > 0 && (other.MaxAge == 0 || other.MaxAge > p.MaxAge) {
+		return false
+	}
+	if p.MaxMessages > 0 && (other.MaxMessages == 0 || other.MaxMessages > p.MaxMessages) {
+		return false
+	}
+	return true
+}
+
+// MessageExpirer is implemented by stores which can delete chat messages by themselves when
+// their ExpiresAt time has passed, such as a mongoDB TTL index
+type MessageExpirer interface {
+	// EnsureMessageExpiry makes the store delete chat messages when they expire
+	EnsureMessageExpiry() error
+	// UpdateMessageExpiry sets the ExpiresAt time of the chat messages in a chat room to their timestamp
+	// plus maxAge, or removes it if maxAge is zero, when the retention policy of the chat room has changed
+	UpdateMessageExpiry(chatName string, maxAge time.Duration) error
+}
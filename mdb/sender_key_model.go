@@ -0,0 +1,33 @@
+package mdb
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+)
+
+// SenderKey is the model of a sender key distributed to a recipient (a user, or a device of a user, see
+// websock.Recipient) stored in the database. Key is the chain key of the sender key encrypted for the recipient,
+// it is only kept until the recipient has received it, so it can not be decrypted with a key leaked later
+type SenderKey struct {
+	ID           bson.ObjectId `bson:"_id"`
+	ChatName     string        `bson:"chat_name"`
+	Sender       string        `bson:"sender"`
+	SenderDevice string        `bson:"sender_device,omitempty"`
+	KeyID        string        `bson:"key_id"`
+	Recipient    string        `bson:"recipient"`
+	Key          []byte        `bson:"key"`
+	Timestamp    int64         `bson:"timestamp"`
+}
+
+// NewSenderKey creates a new instance of the SenderKey object
+func NewSenderKey(chatName, sender, senderDevice, keyID, recipient string, key []byte) *SenderKey {
+	return &SenderKey{
+		ID:           bson.NewObjectId(),
+		ChatName:     chatName,
+		Sender:       sender,
+		SenderDevice: senderDevice,
+		KeyID:        keyID,
+		Recipient:    recipient,
+		Key:          key,
+		Timestamp:    util.NowMillis()}
+}
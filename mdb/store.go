@@ -0,0 +1,97 @@
+package mdb
+
+import "errors"
+
+var (
+	// ErrNotFound is returned by a Store when a query matched no documents
+	ErrNotFound = errors.New("Got 0 results")
+	// ErrDuplicate is returned by a Store when an insert would violate a unique constraint
+	ErrDuplicate = errors.New("Duplicate key")
+)
+
+// Store is the storage backend used by the server. It is implemented by Database,
+// which is backed by mongoDB, and by MemoryStore which keeps everything in memory.
+type Store interface {
+	// InsertUser adds a new user, usernames must be unique
+	InsertUser(user *User) error
+	// FindUser finds the user with the given username
+	FindUser(username string) (*User, error)
+	// UpdateUser replaces a stored user with the given user with the same ID
+	UpdateUser(user *User) error
+
+	// InsertChat adds a new chat room, chat room names must be unique
+	InsertChat(chat *Chat) error
+	// FindChat finds the chat room with the given name
+	FindChat(name string) (*Chat, error)
+	// FindVisibleChats finds all chat rooms which are not hidden
+	FindVisibleChats() ([]*Chat, error)
+	// FindAllChats finds all chat rooms, also those which are hidden
+	FindAllChats() ([]*Chat, error)
+	// UpdateChat replaces a stored chat room with the given chat room with the same ID
+	UpdateChat(chat *Chat) error
+	// RenameChat renames a chat room from rename.Name to rename.NewName, also in its messages, memberships,
+	// invites and sender keys, and adds the rename to the renames of the chat room. Returns ErrDuplicate if a
+	// chat room with the new name exists
+	RenameChat(rename *ChatRename) error
+	// DeleteChat deletes a chat room, and all of its messages, memberships, invites and sender keys
+	DeleteChat(name string) error
+
+	// InsertMembership adds a user as a member of a chat room, returns ErrDuplicate if the
+	// user is already a member
+	InsertMembership(membership *Membership) error
+	// FindMemberships finds all members of a chat room
+	FindMemberships(chatName string) ([]*Membership, error)
+	// DeleteMembership removes a user from the members of a chat room
+	DeleteMembership(chatName, username string) error
+
+	// InsertMessage adds a new chat message
+	InsertMessage(msg *Message) error
+	// FindMessagesForUser finds the chat messages in a chat room addressed to the given recipient (a user,
+	// or a device of a user) ordered by timestamp and ID, where MessageContent only contains the entry
+	// addressed to the recipient. Only messages before the cursor are included (if it is not nil), and if
+	// limit is not zero, only the newest limit messages
+	FindMessagesForUser(recipient, chatName string, before *MessageCursor, limit int) ([]*Message, error)
+	// DeleteMessagesBefore deletes the chat messages in a chat room which are older than the
+	// timestamp, returns the number of deleted messages
+	DeleteMessagesBefore(chatName string, timestamp int64) (int, error)
+	// DeleteOldestMessages deletes the oldest chat messages in a chat room, so that at most keep
+	// messages are left, returns the number of deleted messages
+	DeleteOldestMessages(chatName string, keep int) (int, error)
+
+	// InsertSenderKeys adds sender keys distributed to recipients
+	InsertSenderKeys(keys ...*SenderKey) error
+	// FindSenderKeys finds the sender keys in a chat room distributed to the given recipient (a user, or
+	// a device of a user), ordered by timestamp
+	FindSenderKeys(recipient, chatName string) ([]*SenderKey, error)
+	// DeleteSenderKeys deletes the sender keys in a chat room with the given key IDs, which were distributed
+	// to the recipient
+	DeleteSenderKeys(recipient, chatName string, keyIDs []string) error
+	// DeleteSenderKeysBefore deletes the sender keys in a chat room which were distributed before the
+	// timestamp, returns the number of deleted sender keys
+	DeleteSenderKeysBefore(chatName string, timestamp int64) (int, error)
+
+	// InsertConversation adds a new direct conversation, returns ErrDuplicate if a conversation
+	// with the same name exists
+	InsertConversation(conv *Conversation) error
+	// FindConversation finds the direct conversation with the given name
+	FindConversation(name string) (*Conversation, error)
+	// FindConversations finds the direct conversations the user is in
+	FindConversations(username string) ([]*Conversation, error)
+	// FindAllConversations finds all direct conversations
+	FindAllConversations() ([]*Conversation, error)
+	// UpdateConversation replaces a stored direct conversation with the given conversation with the same ID
+	UpdateConversation(conv *Conversation) error
+	// CountUnreadMessages counts the chat messages in a chat room which are newer than the timestamp,
+	// and were not sent by the given user
+	CountUnreadMessages(chatName, username string, after int64) (int, error)
+
+	// InsertInvite adds a new invite to a chat room
+	InsertInvite(invite *Invite) error
+	// FindInvite finds the invite with the given ID (see ValidID), returns ErrNotFound if the ID is not valid
+	FindInvite(id string) (*Invite, error)
+	// UpdateInvite replaces a stored invite with the given invite with the same ID
+	UpdateInvite(invite *Invite) error
+
+	// DeleteAll removes all stored data
+	DeleteAll()
+}
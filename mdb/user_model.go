@@ -2,13 +2,74 @@ package mdb
 
 import (
 	"github.com/globalsign/mgo/bson"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
 )
 
-// User is the model of a user stored in the database
+// User is the model of a user stored in the database. PublicKey is the current key of the device the user
+// registered with. Devices are the devices the user logs in from, each with its own key pair, the first device
+// is the device the user registered with. Users registered before devices were added have no Devices.
+// KeyHistory contains every change of the key of a device, oldest first
 type User struct {
-	ID        bson.ObjectId `bson:"_id"`
-	Username  string        `bson:"username"`
-	PublicKey []byte        `bson:"public_key"`
+	ID         bson.ObjectId `bson:"_id"`
+	Username   string        `bson:"username"`
+	PublicKey  []byte        `bson:"public_key"`
+	Devices    []Device      `bson:"devices,omitempty"`
+	KeyHistory []KeyChange   `bson:"key_history,omitempty"`
+}
+
+// Device is a device of a user with its own key pair. The device the user registered with has an empty ID,
+// the other devices were added by signing their public key with the key of an existing device (SignedBy),
+// and their ID is the ID of their public key (see util.KeyID). A revoked device can no longer log in
+type Device struct {
+	ID        string `bson:"id"`
+	PublicKey []byte `bson:"public_key"`
+	Timestamp int64  `bson:"timestamp"`
+	SignedBy  string `bson:"signed_by,omitempty"`
+	Signature []byte `bson:"signature,omitempty"`
+	Revoked   bool   `bson:"revoked,omitempty"`
+}
+
+// KeyChange is a change of the key of a device of a user. Signature is the signature of OldKey over
+// NewKey (see util.SignKeyChange). OldKey is revoked, and can no longer be used to log in
+type KeyChange struct {
+	Device    string `bson:"device"`
+	OldKey    []byte `bson:"old_key"`
+	NewKey    []byte `bson:"new_key"`
+	Signature []byte `bson:"signature"`
+	Timestamp int64  `bson:"timestamp"`
+}
+
+// KeyRevoked checks if a key ID (see util.KeyID) is the ID of a key which has been replaced by a new key
+func (u *User) KeyRevoked(keyID string) bool {
+	for _, change := range u.KeyHistory {
+		if util.KeyID(change.OldKey) == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// AllDevices gets every device of the user, also those which are revoked
+func (u *User) AllDevices() []Device {
+	if len(u.Devices) == 0 {
+		return []Device{{PublicKey: u.PublicKey}}
+	}
+	return u.Devices
+}
+
+// Device finds a device of the user by its ID, or by the ID of its public key. An empty ID is the device the user
+// registered with. Returns nil if the user has no such device. The device can be modified, a user registered
+// before devices were added is given the device it registered with in Devices
+func (u *User) Device(id string) *Device {
+	if len(u.Devices) == 0 {
+		u.Devices = u.AllDevices()
+	}
+	for i := range u.Devices {
+		if u.Devices[i].ID == id || util.KeyID(u.Devices[i].PublicKey) == id {
+			return &u.Devices[i]
+		}
+	}
+	return nil
 }
 
 // NewUser creates a new instance of the user object
@@ -16,5 +77,6 @@ func NewUser(username string, publicKey []byte) *User {
 	return &User{
 		ID:        bson.NewObjectId(),
 		Username:  username,
-		PublicKey: publicKey}
+		PublicKey: publicKey,
+		Devices:   []Device{{PublicKey: publicKey, Timestamp: util.NowMillis()}}}
 }
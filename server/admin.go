@@ -0,0 +1,263 @@
+package server
+
+import (
+	"log"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// chatForAdmin retrieves a chat room from the database, and checks that the user is allowed to administrate
+// it. If ownerOnly is true the user must be the owner of the chat room, otherwise being a moderator is enough.
+// An error is sent to the client if the chat room does not exist or the user is not allowed
+func (s *Server) chatForAdmin(ws *websocket.Conn, user *User, chatName string, ownerOnly bool) (*mdb.Chat, bool) {
+	chat, err := s.Db.FindChat(chatName)
+	if err != nil {
+		s.replyError(ws, websock.CodeChatNotFound, "This chat room does not exist")
+		return nil, false
+	}
+
+	if ownerOnly && !chat.IsOwner(user.Username) {
+		s.replyError(ws, websock.CodeForbidden, "Only the owner of the chat room can do this")
+		return nil, false
+	} else if !chat.IsModerator(user.Username) {
+		s.replyError(ws, websock.CodeForbidden, "Only moderators of the chat room can do this")
+		return nil, false
+	}
+	return chat, true
+}
+
+// RenameChatRoom renames a chat room, the clients in the chat room are notified about the new name
+func (s *Server) RenameChatRoom(ws *websocket.Conn, msg *websock.RenameChatRoomMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	if _, ok := s.chatForAdmin(ws, user, msg.Name, true); !ok {
+		return
+	}
+
+	// The signature is kept, so clients which join later can check the names of the chat room the
+	// chat messages were signed with
+	msg.Device = user.DeviceID
+	rename := &mdb.ChatRename{
+		Name:      msg.Name,
+		NewName:   msg.NewName,
+		Device:    msg.Device,
+		Signature: msg.Signature,
+		Timestamp: util.NowMillis()}
+	if err := s.Db.RenameChat(rename); err != nil {
+		if err == mdb.ErrDuplicate {
+			s.replyError(ws, websock.CodeChatExists, "A chat room with this name already exists")
+		} else {
+			log.Println(err)
+			s.replyError(ws, websock.CodeInternal, "Error renaming chat room")
+		}
+		return
+	}
+
+	clients := s.Users.RenameChat(msg.Name, msg.NewName)
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Chat room renamed"})
+
+	for _, client := range clients {
+		go websock.Send(client, &websock.Message{Type: websock.ChatRoomRenamed, Message: msg})
+	}
+}
+
+// DeleteChatRoom deletes a chat room with all of its messages, the clients in the chat room are removed from it
+func (s *Server) DeleteChatRoom(ws *websocket.Conn, chatName string) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	if _, ok := s.chatForAdmin(ws, user, chatName, true); !ok {
+		return
+	}
+
+	if err := s.Db.DeleteChat(chatName); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error deleting chat room")
+		return
+	}
+
+	clients := s.Users.RemoveChat(chatName)
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Chat room deleted"})
+
+	removed := &websock.RemovedFromChatMessage{
+		ChatName: chatName,
+		Reason:   "The chat room was deleted"}
+	for _, client := range clients {
+		go websock.Send(client, &websock.Message{Type: websock.RemovedFromChat, Message: removed})
+	}
+}
+
+// ChangeChatPassword changes or removes the password of a chat room
+func (s *Server) ChangeChatPassword(ws *websocket.Conn, msg *websock.ChangeChatPasswordMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	chat, ok := s.chatForAdmin(ws, user, msg.Name, true)
+	if !ok {
+		return
+	}
+
+	if err := chat.SetPassword(msg.Password); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing password")
+		return
+	}
+	if err := s.Db.UpdateChat(chat); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing password")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Password changed"})
+}
+
+// SetModerator adds or removes a moderator of a chat room, only members of the chat room can become moderators
+func (s *Server) SetModerator(ws *websocket.Conn, msg *websock.SetModeratorMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	chat, ok := s.chatForAdmin(ws, user, msg.ChatName, true)
+	if !ok {
+		return
+	}
+
+	if chat.IsOwner(msg.Username) {
+		s.replyError(ws, websock.CodeForbidden, "The owner is always a moderator")
+		return
+	}
+
+	if msg.IsModerator {
+		members, err := s.Db.FindMemberships(msg.ChatName)
+		if err != nil {
+			log.Println(err)
+		}
+		isMember := false
+		for _, member := range members {
+			if member.Username == msg.Username {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			s.replyError(ws, websock.CodeNotMember, "User is not a member of this chat room")
+			return
+		}
+	}
+
+	chat.SetModerator(msg.Username, msg.IsModerator)
+	if err := s.Db.UpdateChat(chat); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing moderators")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Moderators changed"})
+}
+
+// RemoveUserFromChat kicks a user from a chat room, and if ban is true, also bans the user from joining it again.
+// The user is no longer a member of the chat room, and every connection of the user in the chat room is removed from it.
+// Moderators can remove users, but only the owner can remove moderators, and the owner cannot be removed
+func (s *Server) RemoveUserFromChat(ws *websocket.Conn, msg *websock.ModerateUserMessage, ban bool) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	chat, ok := s.chatForAdmin(ws, user, msg.ChatName, false)
+	if !ok {
+		return
+	}
+
+	if msg.Username == user.Username {
+		s.replyError(ws, websock.CodeForbidden, "You cannot remove yourself from the chat room")
+		return
+	} else if chat.IsOwner(msg.Username) {
+		s.replyError(ws, websock.CodeForbidden, "The owner cannot be removed from the chat room")
+		return
+	} else if chat.IsModerator(msg.Username) && !chat.IsOwner(user.Username) {
+		s.replyError(ws, websock.CodeForbidden, "Only the owner can remove a moderator")
+		return
+	}
+
+	// The ban is stored with the chat room, so it also applies when the user connects again
+	if ban {
+		if _, err := s.Db.FindUser(msg.Username); err != nil {
+			s.replyError(ws, websock.CodeUserNotFound, "User does not exist")
+			return
+		}
+		chat.Ban(msg.Username)
+		if err := s.Db.UpdateChat(chat); err != nil {
+			log.Println(err)
+			s.replyError(ws, websock.CodeInternal, "Error banning user")
+			return
+		}
+	}
+
+	// Remove the membership, so that messages are no longer encrypted for the user
+	err := s.Db.DeleteMembership(msg.ChatName, msg.Username)
+	if err != nil && err != mdb.ErrNotFound {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error removing user from chat room")
+		return
+	}
+	wasMember := err == nil
+
+	clients := s.Users.RemoveUserFromChat(msg.ChatName, msg.Username)
+	if !ban && !wasMember && len(clients) == 0 {
+		s.replyError(ws, websock.CodeNotMember, "User is not a member of this chat room")
+		return
+	}
+
+	removed := &websock.RemovedFromChatMessage{
+		ChatName: msg.ChatName,
+		Reason:   "You were kicked from the chat room",
+		Banned:   ban}
+	if ban {
+		removed.Reason = "You were banned from the chat room"
+		s.reply(ws, &websock.Message{Type: websock.OK, Message: "User banned"})
+	} else {
+		s.reply(ws, &websock.Message{Type: websock.OK, Message: "User kicked"})
+	}
+
+	for _, client := range clients {
+		go websock.Send(client, &websock.Message{Type: websock.RemovedFromChat, Message: removed})
+	}
+	go s.NotifyUserLeft(msg.Username, "", msg.ChatName, true)
+}
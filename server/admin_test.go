@@ -0,0 +1,267 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// setupTestRoom creates a chat room owned by the first user, which the second user joins
+func setupTestRoom(t *testing.T, room, owner, member string) (ownerWs, memberWs *websocket.Conn) {
+	ownerWs, err := setupTestUser(owner, pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatInfo, err := joinTestRoom(ownerWs, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chatInfo.Owner != owner {
+		t.Fatalf("Expected %s to be the owner of the chat room, got %s", owner, chatInfo.Owner)
+	}
+
+	memberWs, err = setupTestUser(member, spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinExistingRoom(memberWs, room); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ownerWs, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestKickUser(t *testing.T) {
+	owner, member := setupTestRoom(t, "kickroom", "kickowner", "kickmember")
+	defer owner.Close()
+	defer member.Close()
+
+	// A member who is not a moderator cannot kick the owner
+	if err := websock.Send(member, &websock.Message{
+		Type:    websock.KickUser,
+		Message: &websock.ModerateUserMessage{ChatName: "kickroom", Username: "kickowner"}}); err != nil {
+		t.Fatalf("Unable to send kick request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a member kicks the owner: %s", err)
+	}
+
+	if err := websock.Send(owner, &websock.Message{
+		Type:    websock.KickUser,
+		Message: &websock.ModerateUserMessage{ChatName: "kickroom", Username: "kickmember"}}); err != nil {
+		t.Fatalf("Unable to send kick request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := receiveMessage(member, websock.RemovedFromChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := msg.Message.(*websock.RemovedFromChatMessage); removed.ChatName != "kickroom" || removed.Banned {
+		t.Fatalf("Expected to be kicked from kickroom without a ban")
+	}
+
+	msg, err = receiveMessage(owner, websock.UserLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userLeft := msg.Message.(*websock.UserLeftMessage); userLeft.Username != "kickmember" || !userLeft.Removed {
+		t.Fatalf("Expected kickmember to be removed from the chat room")
+	}
+
+	// A kicked user can join again
+	chatInfo, err := joinExistingRoom(member, "kickroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatInfo.Users) != 2 {
+		t.Fatalf("Expected 2 members in the chat room, got %d", len(chatInfo.Users))
+	}
+}
+
+func TestBanUser(t *testing.T) {
+	owner, member := setupTestRoom(t, "banroom", "banowner", "banmember")
+	defer owner.Close()
+
+	if err := websock.Send(owner, &websock.Message{
+		Type:    websock.BanUser,
+		Message: &websock.ModerateUserMessage{ChatName: "banroom", Username: "banmember"}}); err != nil {
+		t.Fatalf("Unable to send ban request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := receiveMessage(member, websock.RemovedFromChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Message.(*websock.RemovedFromChatMessage).Banned {
+		t.Fatalf("Expected to be banned from the chat room")
+	}
+	member.Close()
+
+	// The ban still applies after logging in again
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+	if err := loginUser(ws, "banmember", sprikey); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "banroom"}}); err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a banned user joins the chat room: %s", err)
+	}
+}
+
+func TestModeratorPermissions(t *testing.T) {
+	owner, member := setupTestRoom(t, "modroom", "modowner", "modmember")
+	defer owner.Close()
+	defer member.Close()
+
+	// Only the owner can rename the chat room, or add moderators
+	if err := websock.Send(member, &websock.Message{
+		Type:    websock.RenameChatRoom,
+		Message: &websock.RenameChatRoomMessage{Name: "modroom", NewName: "modroomB"}}); err != nil {
+		t.Fatalf("Unable to send rename request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a member renames the chat room: %s", err)
+	}
+	if err := websock.Send(member, &websock.Message{
+		Type:    websock.SetModerator,
+		Message: &websock.SetModeratorMessage{ChatName: "modroom", Username: "modmember", IsModerator: true}}); err != nil {
+		t.Fatalf("Unable to send set moderator request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a member makes himself moderator: %s", err)
+	}
+
+	if err := websock.Send(owner, &websock.Message{
+		Type:    websock.SetModerator,
+		Message: &websock.SetModeratorMessage{ChatName: "modroom", Username: "modmember", IsModerator: true}}); err != nil {
+		t.Fatalf("Unable to send set moderator request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	// A moderator can not delete the chat room, or kick the owner
+	if err := websock.Send(member, &websock.Message{Type: websock.DeleteChatRoom, Message: "modroom"}); err != nil {
+		t.Fatalf("Unable to send delete request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a moderator deletes the chat room: %s", err)
+	}
+	if err := websock.Send(member, &websock.Message{
+		Type:    websock.KickUser,
+		Message: &websock.ModerateUserMessage{ChatName: "modroom", Username: "modowner"}}); err != nil {
+		t.Fatalf("Unable to send kick request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a moderator kicks the owner: %s", err)
+	}
+
+	// Deleting the chat room removes everyone from it
+	if err := websock.Send(owner, &websock.Message{Type: websock.DeleteChatRoom, Message: "modroom"}); err != nil {
+		t.Fatalf("Unable to send delete request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(member, websock.RemovedFromChat); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testserver.Db.FindChat("modroom"); err == nil {
+		t.Fatalf("Expected the chat room to be deleted")
+	}
+}
+
+func TestRenameChatRoom(t *testing.T) {
+	ws, err := setupTestUser("renameowner", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	chatInfo, err := joinTestRoom(ws, "renameroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := encryptTestMessage(chatInfo.Users, "before rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ChatName = "renameroom"
+	req.Timestamp = util.NowMillis()
+	if req.Signature, err = util.SignChatMessage(prikey, "renameroom", "renameowner", req.Timestamp, req.Ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := util.SignChatRename(prikey, "renameowner", "renameroom", "renamedroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{
+		Type:    websock.RenameChatRoom,
+		Message: &websock.RenameChatRoomMessage{Name: "renameroom", NewName: "renamedroom", Signature: signature}}); err != nil {
+		t.Fatalf("Unable to send rename request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.ChatRoomRenamed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave and join the chat room with the new name, the message must still be verifiable
+	if err := websock.Send(ws, &websock.Message{Type: websock.LeaveChat, Message: "renamedroom"}); err != nil {
+		t.Fatalf("Unable to send leave chat request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.UserLeft); err != nil {
+		t.Fatal(err)
+	}
+	if chatInfo, err = joinExistingRoom(ws, "renamedroom"); err != nil {
+		t.Fatal(err)
+	}
+	if len(chatInfo.Messages) != 1 {
+		t.Fatalf("Expected 1 message in the chat history, got %d", len(chatInfo.Messages))
+	}
+	message := chatInfo.Messages[0]
+	if err := util.VerifyChatMessage(pubkey, message.ChatName, message.Sender,
+		message.Timestamp, message.Ciphertext, message.Signature); err != nil {
+		t.Fatalf("Unable to verify signature of message sent before the rename: %s", err)
+	}
+
+	// The signed rename is kept, so clients which join later know the old name
+	if len(chatInfo.Renames) != 1 {
+		t.Fatalf("Expected 1 rename in the chat info, got %d", len(chatInfo.Renames))
+	}
+	rename := chatInfo.Renames[0]
+	if err := util.VerifyChatRename(pubkey, chatInfo.Owner, rename.Name, rename.NewName, rename.Signature); err != nil ||
+		rename.Name != "renameroom" || rename.NewName != "renamedroom" {
+		t.Fatalf("Expected the rename to be signed by the owner")
+	}
+}
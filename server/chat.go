@@ -2,10 +2,11 @@ package server
 
 import (
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 
-	"github.com/globalsign/mgo/bson"
 	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
@@ -23,20 +24,30 @@ func (s *Server) CreateChatRoom(ws *websocket.Conn, msg *websock.CreateChatRoomM
 	defer user.Unlock()
 
 	// Add the chat room to the database
-	chat := mdb.NewChat(msg.Name, msg.Password, msg.IsHidden)
-	if err := s.Db.Insert(mdb.ChatRooms, chat); err != nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Error creating chat room"})
+	// The user who creates the chat room is the owner
+	chat, err := mdb.NewChat(msg.Name, msg.Password, msg.IsHidden, user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error creating chat room")
+		return
+	}
+	if err := s.Db.InsertChat(chat); err != nil {
+		s.replyError(ws, websock.CodeInternal, "Error creating chat room")
 		return
 	}
 
-	websock.Send(ws, &websock.Message{Type: websock.OK, Message: "Chat room created"})
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Chat room created"})
 }
 
+// historyPageSize is the number of chat messages sent when a client joins a chat room, or retrieves
+// older messages without a limit
+const historyPageSize = 50
+
 // GetChatRooms returns all non-hidden chat rooms to the websocket client
 func (s *Server) GetChatRooms(ws *websocket.Conn) {
 	// Get chat rooms from the database (which are not hidden), and add it to the struct
-	results := make([]*mdb.Chat, 0)
-	if err := s.Db.FindAll(mdb.ChatRooms, bson.M{"is_hidden": false}, nil, &results); err != nil {
+	results, err := s.Db.FindVisibleChats()
+	if err != nil {
 		log.Println(err)
 		return
 	}
@@ -48,96 +59,233 @@ func (s *Server) GetChatRooms(ws *websocket.Conn) {
 	for _, room := range results {
 		response.Rooms = append(response.Rooms, websock.Room{
 			Name:        room.Name,
-			HasPassword: len(room.PasswordHash) != 0,
+			HasPassword: room.HasPassword(),
 			OnlineUsers: s.Users.LenInChat(room.Name)})
 	}
 
-	websock.Send(ws, &websock.Message{Type: websock.GetChatRoomsResponse, Message: response})
+	s.reply(ws, &websock.Message{Type: websock.GetChatRoomsResponse, Message: response})
 }
 
-// JoinChat assigns a client to a chat room
+// JoinChat assigns a client to a chat room, a client can be in several chat rooms at once
 func (s *Server) JoinChat(ws *websocket.Conn, msg *websock.JoinChatMessage) {
 	// Check that user is logged in
 	user, ok := s.Users.Get(ws)
 	if !ok || user == nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Not logged in"})
+		s.replyError(ws, websock.CodeNotLoggedIn, "Not logged in")
 		return
 	}
 	user.Lock()
 	defer user.Unlock()
 
-	// Check that user is not already in a chat room
-	if user.ChatRoom != "" {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "You are already in a chat room"})
+	// Check that user is not already in this chat room
+	if s.Users.InChat(ws, msg.Name) {
+		s.replyError(ws, websock.CodeAlreadyInChat, "You are already in this chat room")
 		return
 	}
 
 	// Retrieve the chat room from database
-	chat := new(mdb.Chat)
-	if err := s.Db.FindOne(mdb.ChatRooms, bson.M{"name": msg.Name}, nil, chat); err != nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "This chat room does not exist"})
+	chat, err := s.Db.FindChat(msg.Name)
+	if err != nil {
+		s.replyError(ws, websock.CodeChatNotFound, "This chat room does not exist")
 		return
 	}
 
-	// Verify password (if necessary)
-	if len(chat.PasswordHash) != 0 && !chat.ValidPassword(msg.Password) {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Invalid password"})
+	if chat.IsBanned(user.Username) {
+		s.replyError(ws, websock.CodeBanned, "You are banned from this chat room")
 		return
 	}
 
+	if msg.Invite != "" {
+		// An invite is used instead of the password
+		if !s.joinWithInvite(ws, user, chat.Name, msg.Invite) {
+			return
+		}
+	} else {
+		// Hidden chat rooms can only be joined with an invite, except by the owner and the members
+		if chat.IsHidden && !chat.IsOwner(user.Username) && !s.isMember(chat.Name, user.Username) {
+			s.replyError(ws, websock.CodeChatNotFound, "This chat room does not exist")
+			return
+		}
+
+		// Verify password (if necessary)
+		if chat.HasPassword() && !s.checkPassword(ws, chat, msg.Password) {
+			return
+		}
+
+		if !s.addToChat(ws, user, chat.Name) {
+			return
+		}
+	}
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Joined chat"})
+
+	s.ClientJoinedChat(ws, user, chat)
+}
+
+// addToChat makes a user a member of a chat room, and adds the client to the chat room. If the user could not
+// join, the client is sent an error and false is returned
+func (s *Server) addToChat(ws *websocket.Conn, user *User, chatName string) bool {
+	// Make the user a member of the chat room, so he will receive messages sent while he is offline
+	membership := mdb.NewMembership(chatName, user.Username, util.MarshalPublic(user.PublicKey))
+	if err := s.Db.InsertMembership(membership); err != nil && err != mdb.ErrDuplicate {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error joining chat room")
+		return false
+	}
+
 	// Add user to chat room
-	user.ChatRoom = msg.Name
-	websock.Send(ws, &websock.Message{Type: websock.OK, Message: "Joined chat"})
+	if !s.Users.JoinChat(ws, chatName) {
+		s.replyError(ws, websock.CodeAlreadyInChat, "You are already in this chat room")
+		return false
+	}
+	return true
+}
+
+// checkPassword checks the password a user entered to join a chat room. The number of failed attempts from
+// the IP address of the client for each chat room is limited, and a password hash which is outdated is
+// replaced. If the password is not valid, the client is sent an error and false is returned
+func (s *Server) checkPassword(ws *websocket.Conn, chat *mdb.Chat, password string) bool {
+	if !s.passwordThrottle.Allowed(chat.Name, s.clientIP(ws), time.Now()) {
+		s.replyErrorDetails(ws, websock.CodeTooManyAttempts, "Too many failed password attempts, try again later",
+			map[string]string{"retryAfter": strconv.Itoa(int(passwordFailureWindow / time.Second))})
+		return false
+	}
+	if password == "" {
+		s.replyError(ws, websock.CodePasswordRequired, "This chat room requires a password")
+		return false
+	}
+	if !chat.ValidPassword(password) {
+		s.passwordThrottle.Failed(chat.Name, s.clientIP(ws), time.Now())
+		s.replyError(ws, websock.CodeInvalidPassword, "Invalid password")
+		return false
+	}
 
-	s.ClientJoinedChat(ws, user, msg.Name)
+	if chat.NeedsRehash() {
+		s.rehashPassword(chat.Name, password)
+	}
+	return true
 }
 
-// ClientJoinedChat is called when a client joins a chat room, it adds the username of the client
-// to the map of chat rooms and the chat room name to the User object, to be able to keep track of this
-// Then info about the chat room, and messages for this user is sent to the client
-func (s *Server) ClientJoinedChat(ws *websocket.Conn, user *User, chatName string) {
-	// Create response object, send the client list of users, and messages sent that this user can decrypt
-	chatInfo := &websock.ChatInfoMessage{
-		MyUsername: user.Username,
-		Users: []websock.User{{
-			Username:  user.Username,
-			PublicKey: util.MarshalPublic(user.PublicKey)}},
-		Messages: make([]*websock.ChatMessage, 0)}
+// rehashPassword replaces the outdated password hash of a chat room, with a hash of the password
+// the user joined with. The chat room is read again, in case the password has been changed
+func (s *Server) rehashPassword(chatName, password string) {
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
 
-	s.Users.ForEachInChat(chatName, func(client *websocket.Conn, otherUser *User) {
-		if otherUser == user {
-			return
-		}
-		otherUser.Lock()
-		defer otherUser.Unlock()
-		chatInfo.Users = append(chatInfo.Users, websock.User{
-			Username:  otherUser.Username,
-			PublicKey: util.MarshalPublic(otherUser.PublicKey)})
-	})
+	chat, err := s.Db.FindChat(chatName)
+	if err != nil || !chat.NeedsRehash() || !chat.ValidPassword(password) {
+		return
+	}
+	if err := chat.SetPassword(password); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := s.Db.UpdateChat(chat); err != nil {
+		log.Println(err)
+	}
+}
 
-	// Add the chat messages addressed to this user
-	for _, message := range s.FindMessagesForUser(user.Username, chatName) {
-		// Check if the message actually has the encrypted message
-		if len(message.MessageContent) == 0 {
-			continue
+// isMember checks if a user is a member of a chat room
+func (s *Server) isMember(chatName, username string) bool {
+	members, err := s.Db.FindMemberships(chatName)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	for _, member := range members {
+		if member.Username == username {
+			return true
 		}
+	}
+	return false
+}
+
+// ClientJoinedChat is called when a client has joined a chat room. Info about the chat room, the members of the
+// chat room and messages for this user is sent to the client, and the other clients in the chat room are notified
+func (s *Server) ClientJoinedChat(ws *websocket.Conn, user *User, chat *mdb.Chat) {
+	chatInfo := s.newChatInfo(user, chat)
 
-		chatInfo.Messages = append(chatInfo.Messages, &websock.ChatMessage{
-			Sender:    message.Sender,
-			Timestamp: message.Timestamp,
-			Message:   message.MessageContent[0].Content})
+	// Add the newest chat messages addressed to this user, older messages are retrieved with GetHistory
+	var err error
+	chatInfo.Messages, chatInfo.HasMoreHistory, err = s.FindHistory(user.Recipient(), chat.Name, nil, historyPageSize)
+	if err != nil {
+		log.Println(err)
 	}
 
 	go websock.Send(ws, &websock.Message{Type: websock.ChatInfo, Message: chatInfo})
 
 	// Notify other clients in the chat that a new user has joined
-	s.NotifyUserJoined(user, chatName)
+	s.NotifyUserJoined(user, chat.Name)
+}
+
+// newChatInfo creates the chat info of a chat room without chat messages, with the members of the chat room
+func (s *Server) newChatInfo(user *User, chat *mdb.Chat) *websock.ChatInfoMessage {
+	chatName := chat.Name
+
+	chatInfo := &websock.ChatInfoMessage{
+		Name:       chatName,
+		MyUsername: user.Username,
+		MySession:  user.SessionID,
+		Owner:      chat.Owner,
+		Moderators: chat.Moderators,
+		Users:      make([]websock.User, 0),
+		Messages:   make([]*websock.ChatMessage, 0),
+		SenderKeys: s.pendingSenderKeys(user, chatName)}
+	for _, rename := range chat.Renames {
+		chatInfo.Renames = append(chatInfo.Renames, websock.ChatRename{
+			Name:      rename.Name,
+			NewName:   rename.NewName,
+			Device:    rename.Device,
+			Signature: rename.Signature,
+			Timestamp: rename.Timestamp})
+	}
+
+	sessions := s.chatSessions(user, chatName)
+
+	// Every member is included, also those who are offline, so that messages are encrypted for them as well
+	members, err := s.Db.FindMemberships(chatName)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, member := range members {
+		publicKey, devices := s.userDevices(member.Username, member.PublicKey)
+		chatInfo.Users = append(chatInfo.Users, websock.User{
+			Username:  member.Username,
+			PublicKey: publicKey,
+			Online:    len(sessions[member.Username]) > 0,
+			Sessions:  sessions[member.Username],
+			Devices:   devices})
+	}
+	return chatInfo
+}
+
+// userDevices gets the public key a user registered with and the devices of the user (see memberDevices).
+// If the user cannot be found, publicKey is returned as the key of the only device of the user
+func (s *Server) userDevices(username string, publicKey []byte) ([]byte, []websock.Device) {
+	user, err := s.Db.FindUser(username)
+	if err != nil {
+		log.Println(err)
+		return publicKey, []websock.Device{{PublicKey: publicKey}}
+	}
+	return user.PublicKey, memberDevices(user)
+}
+
+// chatSessions gets the sessions of every user in a chat room by username, with the session of the user
+// who is joining the chat room
+func (s *Server) chatSessions(user *User, chatName string) map[string][]string {
+	sessions := map[string][]string{user.Username: {user.SessionID}}
+	s.Users.ForEachInChat(chatName, func(client *websocket.Conn, otherUser *User) {
+		if otherUser == user {
+			return
+		}
+		sessions[otherUser.Username] = append(sessions[otherUser.Username], otherUser.SessionID)
+	})
+	return sessions
 }
 
-// ClientLeftChat is called when a client leaves a chat room, it removes the username of the client
-// from the map of chat rooms and the chat room name from the User object. Other clients in the chat
-// will be notfied that this user left the chat as well
-func (s *Server) ClientLeftChat(ws *websocket.Conn) {
+// ClientLeftChat is called when a client leaves a chat room, it removes the chat room from the set of chat rooms
+// the client is in. The user stays a member of the chat room, other clients in the chat will be notfied that this
+// user is offline
+func (s *Server) ClientLeftChat(ws *websocket.Conn, chatName string) {
 	user, ok := s.Users.Get(ws)
 	if !ok || user == nil {
 		log.Print("Websocket was not associated with a user")
@@ -146,37 +294,62 @@ func (s *Server) ClientLeftChat(ws *websocket.Conn) {
 	user.Lock()
 	defer user.Unlock()
 
-	chatName := user.ChatRoom
-	username := user.Username
-	user.ChatRoom = ""
+	if !s.Users.LeaveChat(ws, chatName) {
+		s.replyError(ws, websock.CodeNotInChat, "You are not in this chat room")
+		return
+	}
+
+	msg := &websock.UserLeftMessage{
+		ChatName: chatName,
+		Username: user.Username,
+		Session:  user.SessionID}
 
-	go websock.Send(ws, &websock.Message{Type: websock.UserLeft, Message: username})
+	go websock.Send(ws, &websock.Message{Type: websock.UserLeft, Message: msg})
 	// Notify clients that this user left the chat
-	go s.NotifyUserLeft(username, chatName)
+	go s.NotifyUserLeft(user.Username, user.SessionID, chatName, false)
 }
 
-// FindMessagesForUser finds all chat messages with a specific user as recipient in a specific chat room
-func (s *Server) FindMessagesForUser(username, chatName string) []*mdb.Message {
-	query := bson.M{
-		"chat_name": chatName}
+// ReceiveChatMessage is called when the server receives a chat message from a client that is in a chat room
+func (s *Server) ReceiveChatMessage(ws *websocket.Conn, msg *websock.SendChatMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
 
-	selector := bson.M{
-		"timestamp": 1,
-		"sender":    1,
-		"message_content": bson.M{
-			"$elemMatch": bson.M{"recipient": username}},
+	// Older clients do not name the chat room, which is only allowed when the client is in a single chat room
+	if msg.ChatName == "" {
+		if chatRooms := s.Users.ChatRooms(ws); len(chatRooms) == 1 {
+			msg.ChatName = chatRooms[0]
+		}
 	}
 
-	result := make([]*mdb.Message, 0)
-	if err := s.Db.FindAll(mdb.Messages, query, selector, &result); err != nil {
-		return nil
+	// Check that the client is actually in the chat room
+	if !s.Users.InChat(ws, msg.ChatName) {
+		s.replyError(ws, websock.CodeNotInChat, "You are not in this chat room")
+		return
+	} else if websock.IsDirectChatName(msg.ChatName) {
+		s.replyError(ws, websock.CodeInvalidMessage, "Direct messages must be sent with SendDirect")
+		return
 	}
 
-	return result
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Message sent"})
+
+	// Notify everyone in the chat room about the new chat message, and store the message in the database
+	// A signed message uses the timestamp chosen by the client, because the timestamp is part of the signature
+	timestamp := util.NowMillis()
+	if len(msg.Signature) != 0 {
+		timestamp = msg.Timestamp
+	}
+	chatMessage := s.NewChatMessage(user, msg.ChatName, timestamp, msg)
+	go s.NotifyChatMessage(chatMessage, msg.EncryptedContent)
+	go s.AddMessageToDB(chatMessage)
 }
 
-// ReceiveChatMessage is called when the server receives a chat message from a client that is in a chat room
-func (s *Server) ReceiveChatMessage(ws *websocket.Conn, msg *websock.SendChatMessage) {
+// GetHistory sends chat messages in a chat room the client is in, which are older than the cursor in the request
+func (s *Server) GetHistory(ws *websocket.Conn, msg *websock.GetHistoryMessage) {
 	user, ok := s.Users.Get(ws)
 	if !ok || user == nil {
 		log.Print("Websocket was not associated with a user")
@@ -185,41 +358,107 @@ func (s *Server) ReceiveChatMessage(ws *websocket.Conn, msg *websock.SendChatMes
 	user.Lock()
 	defer user.Unlock()
 
-	// Check that the client is actually in a chat room
-	if user.ChatRoom == "" {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "You are not in a chat room"})
+	if !s.Users.InChat(ws, msg.ChatName) {
+		s.replyError(ws, websock.CodeNotInChat, "You are not in this chat room")
 		return
 	}
 
-	websock.Send(ws, &websock.Message{Type: websock.OK, Message: "Message sent"})
+	var before *mdb.MessageCursor
+	if msg.Before != nil {
+		before = mdb.NewMessageCursor(msg.Before.Timestamp, msg.Before.ID)
+	}
+	limit := msg.Limit
+	if limit == 0 {
+		limit = historyPageSize
+	}
 
-	// Notify everyone in the chat room about the new chat message, and store the message in the database
-	timestamp := util.NowMillis()
-	go s.NotifyChatMessage(user.Username, user.ChatRoom, timestamp, msg.EncryptedContent)
-	go s.AddMessageToDB(user.Username, user.ChatRoom, timestamp, msg.EncryptedContent)
+	res := &websock.HistoryMessage{ChatName: msg.ChatName}
+	var err error
+	if res.Messages, res.HasMore, err = s.FindHistory(user.Recipient(), msg.ChatName, before, limit); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error retrieving chat messages")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.History, Message: res})
+}
+
+// FindHistory finds the newest limit chat messages before the cursor (or the newest messages if the cursor is nil),
+// which are addressed to the recipient (see User.Recipient). Returns the messages ordered by timestamp, and whether
+// there are older messages
+func (s *Server) FindHistory(recipient, chatName string, before *mdb.MessageCursor, limit int) ([]*websock.ChatMessage, bool, error) {
+	// Retrieve one more message than needed, to check if there are older messages
+	messages, err := s.Db.FindMessagesForUser(recipient, chatName, before, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[1:]
+	}
+
+	history := make([]*websock.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		// Check if the message actually has the encrypted message
+		if len(message.MessageContent) == 0 {
+			continue
+		}
+		history = append(history, toChatMessage(message, message.MessageContent[0].Content))
+	}
+	return history, hasMore, nil
 }
 
-// NotifyChatMessage notifies all clients in a chat room about a new chat message
-func (s *Server) NotifyChatMessage(sender string, chatName string, timestamp int64, encryptedContent map[string][]byte) {
+// toChatMessage converts a stored chat message to the chat message sent to a client, content is the
+// part of the message addressed to the client
+func toChatMessage(message *mdb.Message, content []byte) *websock.ChatMessage {
+	// The signature covers the name the chat room had when the message was sent
+	chatName := message.ChatName
+	if message.SignedChatName != "" {
+		chatName = message.SignedChatName
+	}
+
+	return &websock.ChatMessage{
+		ID:           message.ID.Hex(),
+		Version:      message.Version,
+		ChatName:     chatName,
+		Sender:       message.Sender,
+		SenderDevice: message.SenderDevice,
+		Timestamp:    message.Timestamp,
+		Message:      content,
+		Ciphertext:   message.Ciphertext,
+		Signature:    message.Signature,
+		SenderKeyID:  message.SenderKeyID,
+		Iteration:    message.Iteration}
+}
+
+// NotifyChatMessage notifies all clients in a chat room about a new chat message, encryptedContent
+// contains the part of the message addressed to each recipient, every client gets the part addressed
+// to the device it is logged in from
+func (s *Server) NotifyChatMessage(chatMessage *mdb.Message, encryptedContent map[string][]byte) {
 
 	// Notify the clients in the chat room
-	s.Users.ForEachInChat(chatName, func(client *websocket.Conn, recipent *User) {
+	s.Users.ForEachInChat(chatMessage.ChatName, func(client *websocket.Conn, recipent *User) {
 		recipent.Lock()
 		defer recipent.Unlock()
-		msg := &websock.ChatMessage{
-			Sender:    sender,
-			Timestamp: timestamp,
-			Message:   encryptedContent[recipent.Username]}
+		msg := toChatMessage(chatMessage, encryptedContent[recipent.Recipient()])
 
 		go websock.Send(client, &websock.Message{Type: websock.ChatMessageReceived, Message: msg})
 	})
 }
 
-// NotifyUserJoined notifies all clients in a chat room that a new user has joined the chat room
+// NotifyUserJoined notifies all clients in a chat room that a session of a user has joined the chat room,
+// with every device of the user
 func (s *Server) NotifyUserJoined(user *User, chatName string) {
-	msg := &websock.User{
-		Username:  user.Username,
-		PublicKey: util.MarshalPublic(user.PublicKey)}
+	publicKey, devices := s.userDevices(user.Username, util.MarshalPublic(user.PublicKey))
+	msg := &websock.UserJoinedMessage{
+		ChatName: chatName,
+		User: websock.User{
+			Username:  user.Username,
+			PublicKey: publicKey,
+			Online:    true,
+			Sessions:  []string{user.SessionID},
+			Devices:   devices},
+		Session: user.SessionID}
 
 	go s.Users.ForEachInChat(chatName, func(client *websocket.Conn, otherUser *User) {
 		if otherUser == user {
@@ -231,26 +470,87 @@ func (s *Server) NotifyUserJoined(user *User, chatName string) {
 	})
 }
 
-// NotifyUserLeft notifies all clients in a chat room that a user left the chat room
-func (s *Server) NotifyUserLeft(username, chatName string) {
+// NotifyUserLeft notifies all clients in a chat room that a session of a user left the chat room, removed
+// is true if the user was kicked or banned, and is no longer a member of the chat room, then the session is
+// empty because every session of the user has left
+func (s *Server) NotifyUserLeft(username, sessionID, chatName string, removed bool) {
 	// Get all clients in the chat room
+	msg := &websock.UserLeftMessage{
+		ChatName: chatName,
+		Username: username,
+		Session:  sessionID,
+		Removed:  removed}
+
 	s.Users.ForEachInChat(chatName, func(client *websocket.Conn, _ *User) {
-		go websock.Send(client, &websock.Message{Type: websock.UserLeft, Message: username})
+		go websock.Send(client, &websock.Message{Type: websock.UserLeft, Message: msg})
 	})
 }
 
-// AddMessageToDB inserts a chat message into the database
-func (s *Server) AddMessageToDB(username, chatName string, timestamp int64, encryptedContent map[string][]byte) {
-	chatMessage := mdb.NewMessage(chatName, timestamp, username)
+// NotifyKeyChanged notifies the clients in every chat room and direct conversation the user is a member of,
+// that the user has changed the key of a device
+func (s *Server) NotifyKeyChanged(user *User, change *mdb.KeyChange) {
+	for _, chatName := range s.memberChats(user.Username) {
+		msg := &websock.KeyChangedMessage{
+			ChatName:  chatName,
+			Username:  user.Username,
+			Device:    change.Device,
+			PublicKey: change.NewKey,
+			Signature: change.Signature}
+
+		go s.Users.ForEachInChat(chatName, func(client *websocket.Conn, otherUser *User) {
+			if otherUser == user {
+				return
+			}
+			go websock.Send(client, &websock.Message{Type: websock.KeyChanged, Message: msg})
+		})
+	}
+}
 
-	for recipient, encryptedMessage := range encryptedContent {
+// memberChats gets the chat rooms and direct conversations a user is a member of, which a client is in
+func (s *Server) memberChats(username string) []string {
+	open := make(map[string]bool)
+	s.Users.ForEach(func(_ *websocket.Conn, user *User) {
+		if user == nil {
+			return
+		}
+		for chatName := range user.chatRooms {
+			open[chatName] = true
+		}
+	})
+
+	chats := make([]string, 0, len(open))
+	for chatName := range open {
+		if websock.IsDirectChatName(chatName) {
+			if conv, err := s.Db.FindConversation(chatName); err == nil && conv.Participant(username) != nil {
+				chats = append(chats, chatName)
+			}
+		} else if s.isMember(chatName, username) {
+			chats = append(chats, chatName)
+		}
+	}
+	return chats
+}
+
+// NewChatMessage creates the chat message which is stored in the database, from a chat message sent by a client
+func (s *Server) NewChatMessage(sender *User, chatName string, timestamp int64, chatMsg *websock.SendChatMessage) *mdb.Message {
+	chatMessage := mdb.NewMessage(chatName, timestamp, sender.Username, chatMsg.Version, chatMsg.Ciphertext, chatMsg.Signature)
+	chatMessage.SenderDevice = sender.DeviceID
+	chatMessage.SenderKeyID = chatMsg.SenderKeyID
+	chatMessage.Iteration = chatMsg.Iteration
+	chatMessage.ExpiresAt = s.messageExpiresAt(chatName, timestamp)
+
+	for recipient, encryptedMessage := range chatMsg.EncryptedContent {
 		msg := mdb.MessageContent{
 			Recipient: recipient,
 			Content:   encryptedMessage}
 		chatMessage.MessageContent = append(chatMessage.MessageContent, msg)
 	}
+	return chatMessage
+}
 
-	if err := s.Db.Insert(mdb.Messages, chatMessage); err != nil {
+// AddMessageToDB inserts a chat message into the database
+func (s *Server) AddMessageToDB(chatMessage *mdb.Message) {
+	if err := s.Db.InsertMessage(chatMessage); err != nil {
 		log.Println(err)
 		return
 	}
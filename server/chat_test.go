@@ -3,10 +3,16 @@ package server
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
 )
 
 func TestCreateChatRoom(t *testing.T) {
@@ -35,7 +41,7 @@ func TestCreateChatRoom(t *testing.T) {
 	switch msg.Type {
 	case websock.OK:
 	case websock.Error:
-		t.Fatalf("Response of create room was an error: %s", msg.Message.(string))
+		t.Fatalf("Response of create room was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response of create room was non-ok type (%d)", msg.Type)
 	}
@@ -67,7 +73,7 @@ func TestJoinChatRoom(t *testing.T) {
 	switch msg.Type {
 	case websock.OK:
 	case websock.Error:
-		t.Fatalf("Response of create room was an error: %s", msg.Message.(string))
+		t.Fatalf("Response of create room was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response of create room was non-ok type (%d)", msg.Type)
 	}
@@ -90,7 +96,7 @@ func TestJoinChatRoom(t *testing.T) {
 	switch msg.Type {
 	case websock.OK:
 	case websock.Error:
-		t.Fatalf("Response of join room was an error: %s", msg.Message.(string))
+		t.Fatalf("Response of join room was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response of join room was non-ok type (%d)", msg.Type)
 	}
@@ -122,7 +128,7 @@ func TestSendChatMessage(t *testing.T) {
 	switch msg.Type {
 	case websock.OK:
 	case websock.Error:
-		t.Fatalf("Response of create room was an error: %s", msg.Message.(string))
+		t.Fatalf("Response of create room was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response of create room was non-ok type (%d)", msg.Type)
 	}
@@ -145,7 +151,7 @@ func TestSendChatMessage(t *testing.T) {
 	switch msg.Type {
 	case websock.OK:
 	case websock.Error:
-		t.Fatalf("Response of join room was an error: %s", msg.Message.(string))
+		t.Fatalf("Response of join room was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response of join room was non-ok type (%d)", msg.Type)
 	}
@@ -157,7 +163,7 @@ func TestSendChatMessage(t *testing.T) {
 	switch msg.Type {
 	case websock.ChatInfo:
 	case websock.Error:
-		t.Fatalf("Response was an error: %s", msg.Message.(string))
+		t.Fatalf("Response was an error: %s", msg.Message)
 	default:
 		t.Fatalf("Response was non-chat info type (%d)", msg.Type)
 	}
@@ -187,4 +193,613 @@ func TestSendChatMessage(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unable to send chat message request: %s", err)
 	}
+
+	// Messages encrypted with PKCS#1 v1.5 are no longer accepted
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error when sending a message in the original format: %s", err)
+	}
+}
+
+// joinTestRoom creates a chat room with the given name and joins it, returns the chat info sent by the server
+func joinTestRoom(ws *websocket.Conn, name string) (*websock.ChatInfoMessage, error) {
+	err := websock.Send(ws, &websock.Message{
+		Type: websock.CreateChatRoom,
+		Message: &websock.CreateChatRoomMessage{
+			Name: name,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to send create room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		return nil, err
+	}
+
+	err = websock.Send(ws, &websock.Message{
+		Type: websock.JoinChat,
+		Message: &websock.JoinChatMessage{
+			Name: name,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		return nil, err
+	}
+
+	msg, err := receiveMessage(ws, websock.ChatInfo)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Message.(*websock.ChatInfoMessage), nil
+}
+
+// joinExistingRoom joins a chat room which already exists, returns the chat info sent by the server
+func joinExistingRoom(ws *websocket.Conn, name string) (*websock.ChatInfoMessage, error) {
+	err := websock.Send(ws, &websock.Message{
+		Type: websock.JoinChat,
+		Message: &websock.JoinChatMessage{
+			Name: name,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		return nil, err
+	}
+
+	msg, err := receiveMessage(ws, websock.ChatInfo)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Message.(*websock.ChatInfoMessage), nil
+}
+
+// receiveMessage receives the next message from the server, and checks that it is of the expected type
+func receiveMessage(ws *websocket.Conn, msgType websock.MessageType) (*websock.Message, error) {
+	msg := new(websock.Message)
+	if err := websock.Receive(ws, msg); err != nil {
+		return nil, fmt.Errorf("Error when receiving message from server: %s", err)
+	}
+	switch msg.Type {
+	case msgType:
+		return msg, nil
+	case websock.Error:
+		return nil, fmt.Errorf("Response was an error: %s", msg.Message)
+	default:
+		return nil, fmt.Errorf("Expected response type (%d), got (%d)", msgType, msg.Type)
+	}
+}
+
+// encryptTestMessage encrypts a chat message in the labeled hybrid format for all of the given users
+func encryptTestMessage(users []websock.User, plaintext string) (*websock.SendChatMessage, error) {
+	ciphertext, key, err := util.EncryptMessage([]byte(plaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &websock.SendChatMessage{
+		Version:          websock.MessageVersionLabeled,
+		Ciphertext:       ciphertext,
+		EncryptedContent: make(map[string][]byte)}
+
+	for _, user := range users {
+		pubKey, err := util.UnmarshalPublic(user.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if req.EncryptedContent[user.Username], err = util.WrapKey(pubKey, key); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func TestSendHybridChatMessage(t *testing.T) {
+	ws, err := setupTestUser("sendhybrid", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	chatInfo, err := joinTestRoom(ws, "sendhybrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A message this long could not be encrypted directly with RSA
+	plaintext := strings.Repeat("hybrid", 100)
+	req, err := encryptTestMessage(chatInfo.Users, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := receiveMessage(ws, websock.ChatMessageReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatMessage := msg.Message.(*websock.ChatMessage)
+	if chatMessage.Version != websock.MessageVersionLabeled {
+		t.Fatalf("Expected message version %d, got %d", websock.MessageVersionLabeled, chatMessage.Version)
+	}
+
+	decKey, err := util.UnwrapKey(prikey, chatMessage.Message)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message key: %s", err)
+	}
+	decMsg, err := util.DecryptMessage(chatMessage.Ciphertext, decKey)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message: %s", err)
+	}
+	if string(decMsg) != plaintext {
+		t.Fatalf("Decrypted message does not match the original message")
+	}
+}
+
+func TestSendSignedChatMessage(t *testing.T) {
+	ws, err := setupTestUser("sendsigned", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	chatInfo, err := joinTestRoom(ws, "sendsigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := encryptTestMessage(chatInfo.Users, "signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A timestamp far from the server time must be rejected
+	req.Timestamp = util.NowMillis() - int64(time.Hour/time.Millisecond)
+	if req.Signature, err = util.SignChatMessage(prikey, "sendsigned", "sendsigned", req.Timestamp, req.Ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error for a stale timestamp: %s", err)
+	}
+
+	req.Timestamp = util.NowMillis()
+	if req.Signature, err = util.SignChatMessage(prikey, "sendsigned", "sendsigned", req.Timestamp, req.Ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := receiveMessage(ws, websock.ChatMessageReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatMessage := msg.Message.(*websock.ChatMessage)
+	if chatMessage.Timestamp != req.Timestamp {
+		t.Fatalf("Expected the timestamp of the signed message to be kept")
+	}
+	if err := util.VerifyChatMessage(pubkey, chatMessage.ChatName, chatMessage.Sender,
+		chatMessage.Timestamp, chatMessage.Ciphertext, chatMessage.Signature); err != nil {
+		t.Fatalf("Unable to verify signature of received message: %s", err)
+	}
+
+	// The signature must not verify if the server claims another sender
+	if err := util.VerifyChatMessage(pubkey, chatMessage.ChatName, "someoneelse",
+		chatMessage.Timestamp, chatMessage.Ciphertext, chatMessage.Signature); err == nil {
+		t.Fatalf("Signature verified for the wrong sender")
+	}
+}
+
+func TestReceiveMessageWhileOffline(t *testing.T) {
+	// The first user joins the chat room, and leaves it again
+	offline, err := setupTestUser("offlineuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinTestRoom(offline, "offlineroom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(offline, &websock.Message{Type: websock.LeaveChat, Message: "offlineroom"}); err != nil {
+		t.Fatalf("Unable to send leave chat request: %s", err)
+	}
+	if _, err := receiveMessage(offline, websock.UserLeft); err != nil {
+		t.Fatal(err)
+	}
+	offline.Close()
+
+	// The second user joins, and sends a message to every member of the chat room
+	sender, err := setupTestUser("offlinesender", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	if err := websock.Send(sender, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "offlineroom"}}); err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(sender, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiveMessage(sender, websock.ChatInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatInfo := msg.Message.(*websock.ChatInfoMessage)
+	if len(chatInfo.Users) != 2 {
+		t.Fatalf("Expected 2 members in the chat room, got %d", len(chatInfo.Users))
+	}
+	for _, user := range chatInfo.Users {
+		if user.Username == "offlineuser" && user.Online {
+			t.Fatalf("Expected offlineuser to be listed as offline")
+		}
+	}
+
+	req, err := encryptTestMessage(chatInfo.Users, "while you were away")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ChatName = "offlineroom"
+	if err := websock.Send(sender, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(sender, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(sender, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first user logs in again, and should be able to decrypt the message
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+	if err := loginUser(ws, "offlineuser", prikey); err != nil {
+		t.Fatal(err)
+	}
+	if err := websock.Send(ws, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "offlineroom"}}); err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = receiveMessage(ws, websock.ChatInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := msg.Message.(*websock.ChatInfoMessage).Messages
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message in the chat history, got %d", len(messages))
+	}
+	key, err := util.UnwrapKey(prikey, messages[0].Message)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message key: %s", err)
+	}
+	decMsg, err := util.DecryptMessage(messages[0].Ciphertext, key)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message: %s", err)
+	}
+	if string(decMsg) != "while you were away" {
+		t.Fatalf("Decrypted message does not match the original message")
+	}
+}
+
+func TestJoinMultipleChatRooms(t *testing.T) {
+	ws, err := setupTestUser("multiroom", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if _, err := joinTestRoom(ws, "multiroomA"); err != nil {
+		t.Fatal(err)
+	}
+	chatInfo, err := joinTestRoom(ws, "multiroomB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Joining a chat room the user is already in is an error
+	if err := websock.Send(ws, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "multiroomA"}}); err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error when joining the same chat room twice: %s", err)
+	}
+
+	// Leave the first chat room
+	if err := websock.Send(ws, &websock.Message{Type: websock.LeaveChat, Message: "multiroomA"}); err != nil {
+		t.Fatalf("Unable to send leave chat request: %s", err)
+	}
+	msg, err := receiveMessage(ws, websock.UserLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userLeft := msg.Message.(*websock.UserLeftMessage); userLeft.ChatName != "multiroomA" {
+		t.Fatalf("Expected to leave multiroomA, left %s", userLeft.ChatName)
+	}
+
+	// The user should still be in the second chat room
+	req, err := encryptTestMessage(chatInfo.Users, "still here")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ChatName = "multiroomB"
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = receiveMessage(ws, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+	if chatMessage := msg.Message.(*websock.ChatMessage); chatMessage.ChatName != "multiroomB" {
+		t.Fatalf("Expected message in multiroomB, got message in %s", chatMessage.ChatName)
+	}
+
+	// Sending to the chat room which the user left is an error
+	req.ChatName = "multiroomA"
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error when sending to a chat room the user left: %s", err)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	ws, err := setupTestUser("historyuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if _, err := joinTestRoom(ws, "historyroom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store messages out of order, two of them with the same timestamp
+	timestamps := []int64{1000, 5000, 3000, 3000, 2000}
+	for _, timestamp := range timestamps {
+		msg := mdb.NewMessage("historyroom", timestamp, "historyuser", websock.MessageVersionHybrid, []byte("ciphertext"), nil)
+		msg.MessageContent = append(msg.MessageContent, mdb.MessageContent{Recipient: "historyuser", Content: []byte("key")})
+		if err := testserver.Db.InsertMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var history []*websock.ChatMessage
+	var before *websock.HistoryCursor
+	for page := 0; ; page++ {
+		err := websock.Send(ws, &websock.Message{
+			Type:    websock.GetHistory,
+			Message: &websock.GetHistoryMessage{ChatName: "historyroom", Before: before, Limit: 2}})
+		if err != nil {
+			t.Fatalf("Unable to send get history request: %s", err)
+		}
+		msg, err := receiveMessage(ws, websock.History)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := msg.Message.(*websock.HistoryMessage)
+		history = append(res.Messages, history...)
+		if !res.HasMore {
+			break
+		} else if page > len(timestamps) {
+			t.Fatalf("Expected the chat history to end")
+		}
+		before = &websock.HistoryCursor{Timestamp: res.Messages[0].Timestamp, ID: res.Messages[0].ID}
+	}
+
+	if len(history) != len(timestamps) {
+		t.Fatalf("Expected %d messages in the chat history, got %d", len(timestamps), len(history))
+	}
+	for i := 1; i < len(history); i++ {
+		prev, cur := history[i-1], history[i]
+		if prev.Timestamp > cur.Timestamp || (prev.Timestamp == cur.Timestamp && prev.ID >= cur.ID) {
+			t.Fatalf("Chat history is not ordered by timestamp")
+		}
+	}
+
+	// The cursor must be a message ID
+	err = websock.Send(ws, &websock.Message{
+		Type: websock.GetHistory,
+		Message: &websock.GetHistoryMessage{
+			ChatName: "historyroom",
+			Before:   &websock.HistoryCursor{Timestamp: 1000, ID: "invalid"}}})
+	if err != nil {
+		t.Fatalf("Unable to send get history request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatalf("Expected an error for an invalid cursor: %s", err)
+	}
+}
+
+func TestHistoryBeforeJoining(t *testing.T) {
+	ws, err := setupTestUser("latejoiner", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if _, err := joinTestRoom(ws, "lateroom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages sent before the user joined are not addressed to it, and do not count toward the limit
+	for timestamp := int64(1000); timestamp < 4000; timestamp += 1000 {
+		msg := mdb.NewMessage("lateroom", timestamp, "earlyuser", websock.MessageVersionHybrid, []byte("ciphertext"), nil)
+		msg.MessageContent = append(msg.MessageContent, mdb.MessageContent{Recipient: "earlyuser", Content: []byte("key")})
+		if err := testserver.Db.InsertMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := mdb.NewMessage("lateroom", 5000, "earlyuser", websock.MessageVersionHybrid, []byte("ciphertext"), nil)
+	msg.MessageContent = append(msg.MessageContent,
+		mdb.MessageContent{Recipient: "earlyuser", Content: []byte("key")},
+		mdb.MessageContent{Recipient: "latejoiner", Content: []byte("key")})
+	if err := testserver.Db.InsertMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	err = websock.Send(ws, &websock.Message{
+		Type:    websock.GetHistory,
+		Message: &websock.GetHistoryMessage{ChatName: "lateroom", Limit: 2}})
+	if err != nil {
+		t.Fatalf("Unable to send get history request: %s", err)
+	}
+	res, err := receiveMessage(ws, websock.History)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := res.Message.(*websock.HistoryMessage)
+	if len(history.Messages) != 1 || history.HasMore {
+		t.Fatalf("Expected only the message addressed to the user, got %d messages (more: %t)",
+			len(history.Messages), history.HasMore)
+	}
+}
+
+// joinWithPassword sends a request to join a chat room with a password, returns the response from the server
+func joinWithPassword(t *testing.T, ws *websocket.Conn, name, password string) *websock.Message {
+	err := websock.Send(ws, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: name, Password: password}})
+	if err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	msg := new(websock.Message)
+	if err := websock.Receive(ws, msg); err != nil {
+		t.Fatalf("Error when receiving message from server: %s", err)
+	}
+	return msg
+}
+
+func TestRehashLegacyPassword(t *testing.T) {
+	// A chat room created by an older version of the server, with an unsalted SHA-256 hash of the password
+	chat, err := mdb.NewChat("legacypassword", "", false, "legacyowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("oldpassword"))
+	chat.PasswordHash = hash[:]
+	if err := testserver.Db.InsertChat(chat); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := setupTestUser("legacyjoin", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if msg := joinWithPassword(t, ws, "legacypassword", "wrongpassword"); msg.Type != websock.Error {
+		t.Fatalf("Expected an error when joining with the wrong password")
+	}
+	if msg := joinWithPassword(t, ws, "legacypassword", "oldpassword"); msg.Type != websock.OK {
+		t.Fatalf("Expected to join with the correct password, got %v", msg.Message)
+	}
+
+	// The password is hashed again with a salt when a user joins with the correct password
+	chat, err = testserver.Db.FindChat("legacypassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Password == nil || len(chat.PasswordHash) != 0 || chat.NeedsRehash() {
+		t.Fatalf("Expected the password to be hashed again")
+	}
+	if !chat.ValidPassword("oldpassword") || chat.ValidPassword("wrongpassword") {
+		t.Fatalf("Expected the new hash to match the same password")
+	}
+}
+
+func TestPasswordHashCost(t *testing.T) {
+	chat, err := mdb.NewChat("costlypassword", "password", false, "costowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chat.ValidPassword("password") {
+		t.Fatalf("Expected the password to match the hash")
+	}
+
+	// A stored hash which would be too costly to verify is rejected without computing it
+	hash := *chat.Password
+	for _, costly := range []mdb.PasswordHash{
+		{LogN: 30, R: hash.R, P: hash.P},
+		{LogN: hash.LogN, R: 1 << 20, P: hash.P},
+		{LogN: hash.LogN, R: hash.R, P: 1 << 20},
+	} {
+		costly.Version, costly.Salt, costly.Hash = hash.Version, hash.Salt, hash.Hash
+		chat.Password = &costly
+		if chat.ValidPassword("password") {
+			t.Fatalf("Expected the hash with log N %d, r %d and p %d to be rejected", costly.LogN, costly.R, costly.P)
+		}
+	}
+}
+
+func TestPasswordThrottle(t *testing.T) {
+	ws, err := setupTestUser("throttleuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	err = websock.Send(ws, &websock.Message{
+		Type:    websock.CreateChatRoom,
+		Message: &websock.CreateChatRoomMessage{Name: "throttleroom", Password: "rightpassword"}})
+	if err != nil {
+		t.Fatalf("Unable to send create room request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxPasswordFailures; i++ {
+		msg := joinWithPassword(t, ws, "throttleroom", "wrongpassword")
+		if msg.Type != websock.Error || msg.Message.(*websock.ErrorMessage).Code != websock.CodeInvalidPassword {
+			t.Fatalf("Expected an invalid password error, got %v", msg.Message)
+		}
+	}
+
+	// After too many failed attempts, even the correct password is refused for a while
+	msg := joinWithPassword(t, ws, "throttleroom", "rightpassword")
+	if msg.Type != websock.Error || msg.Message.(*websock.ErrorMessage).Code != websock.CodeTooManyAttempts {
+		t.Fatalf("Expected the password attempts to be throttled, got %v", msg.Message)
+	}
+	if retryAfter := msg.Message.(*websock.ErrorMessage).Details["retryAfter"]; retryAfter == "" {
+		t.Fatalf("Expected the error to say when to try again")
+	}
+
+	// Clients from other IP addresses can still join
+	throttle := newPasswordThrottle()
+	now := time.Now()
+	for i := 0; i < maxPasswordFailures; i++ {
+		throttle.Failed("throttleroom", "10.0.0.1", now)
+	}
+	if throttle.Allowed("throttleroom", "10.0.0.1", now) || !throttle.Allowed("throttleroom", "10.0.0.2", now) {
+		t.Fatalf("Expected the password attempts to be throttled for the IP address only")
+	}
 }
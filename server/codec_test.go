@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+func TestJSONCodec(t *testing.T) {
+	ws, err := websocket.Dial(wsserver.URL, websock.Subprotocol(websock.CodecJSON), "http://")
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+	if websock.Codec(ws) != websock.CodecJSON {
+		t.Fatalf("Expected the server to choose the subprotocol of the json codec")
+	}
+
+	// receiveJSON receives a message as a JSON object
+	receiveJSON := func() (msgType websock.MessageType, content json.RawMessage) {
+		var data string
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			Type    websock.MessageType `json:"type"`
+			Message json.RawMessage     `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Fatalf("Expected a JSON message, got %q: %s", data, err)
+		}
+		return msg.Type, msg.Message
+	}
+
+	// A client which is not written in Go sends and receives JSON text
+	websocket.Message.Send(ws, `{"type":48,"message":{"Version":2,"Codecs":["json"],"CipherSuites":["`+websock.CipherSuiteSenderKey+`"]}}`)
+	msgType, content := receiveJSON()
+	var hello websock.HelloMessage
+	if err := json.Unmarshal(content, &hello); msgType != websock.Hello || err != nil {
+		t.Fatalf("Expected hello, got %s: %s", msgType, content)
+	}
+	if len(hello.Codecs) != 1 || hello.Codecs[0] != websock.CodecJSON {
+		t.Fatalf("Expected the json codec in hello, got %v", hello.Codecs)
+	}
+
+	publicKey := base64.StdEncoding.EncodeToString(util.MarshalPublic(pubkey))
+	websocket.Message.Send(ws, `{"type":2,"message":{"Username":"jsonuser","PublicKey":"`+publicKey+`"}}`)
+	if msgType, content = receiveJSON(); msgType != websock.OK {
+		t.Fatalf("Expected OK when registering user, got %s: %s", msgType, content)
+	}
+
+	// The messages of the connection are encoded with the json codec, so websock can be used as well
+	if err := loginUser(ws, "jsonuser", prikey); err != nil {
+		t.Fatal(err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.GetChatRooms})
+	if _, err := receiveMessage(ws, websock.GetChatRoomsResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages with content of the wrong type are rejected like with gob
+	websocket.Message.Send(ws, `{"type":7,"message":"not nil"}`)
+	if msg := new(websock.Message); websock.Receive(ws, msg) == nil {
+		t.Fatalf("Expected the connection to be closed, got %s", msg.Type)
+	}
+}
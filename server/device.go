@@ -0,0 +1,230 @@
+package server
+
+import (
+	"log"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// AddDevice adds a new device to the user, which can then log in with its own key pair. The public key of the new
+// device must be signed by the device the client is logged in from
+func (s *Server) AddDevice(ws *websocket.Conn, msg *websock.AddDeviceMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	if err := util.VerifyDevice(user.PublicKey, user.Username, msg.PublicKey, msg.Signature); err != nil {
+		s.replyError(ws, websock.CodeInvalidSignature, "Invalid device signature")
+		return
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	storedUser, err := s.Db.FindUser(user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error adding device")
+		return
+	}
+	deviceID := util.KeyID(msg.PublicKey)
+	if storedUser.Device(deviceID) != nil {
+		s.replyError(ws, websock.CodeConflict, "This device has already been added")
+		return
+	}
+
+	storedUser.Devices = append(storedUser.Devices, mdb.Device{
+		ID:        deviceID,
+		PublicKey: msg.PublicKey,
+		Timestamp: util.NowMillis(),
+		SignedBy:  user.DeviceID,
+		Signature: msg.Signature})
+	if err := s.Db.UpdateUser(storedUser); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error adding device")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Device added"})
+}
+
+// GetDevices sends every device of the user to the client, also those which are revoked
+func (s *Server) GetDevices(ws *websocket.Conn) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	storedUser, err := s.Db.FindUser(user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error retrieving devices")
+		return
+	}
+
+	res := &websock.DevicesResponseMessage{Devices: make([]websock.Device, 0)}
+	for _, device := range storedUser.AllDevices() {
+		res.Devices = append(res.Devices, toDevice(device))
+	}
+	s.reply(ws, &websock.Message{Type: websock.DevicesResponse, Message: res})
+}
+
+// RevokeDevice revokes a device of the user, so it can no longer log in. The device is found by its ID, or the
+// ID of its public key. The clients logged in from the device are logged out, and the device the client is
+// logged in from cannot be revoked
+func (s *Server) RevokeDevice(ws *websocket.Conn, deviceID string) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	storedUser, err := s.Db.FindUser(user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error revoking device")
+		return
+	}
+	device := storedUser.Device(deviceID)
+	if device == nil || deviceID == "" {
+		s.replyError(ws, websock.CodeDeviceNotFound, "This device does not exist")
+		return
+	} else if device.ID == user.DeviceID {
+		s.replyError(ws, websock.CodeForbidden, "You cannot revoke the device you are logged in from")
+		return
+	} else if device.Revoked {
+		s.replyError(ws, websock.CodeConflict, "This device has already been revoked")
+		return
+	}
+
+	device.Revoked = true
+	if err := s.Db.UpdateUser(storedUser); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error revoking device")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Device revoked"})
+
+	for _, client := range s.Users.Connections(user.Username) {
+		if other, ok := s.Users.Get(client); ok && other.DeviceID == device.ID {
+			s.logout(client, "This device has been revoked")
+		}
+	}
+}
+
+// RotateKey replaces the key of the device the client is logged in from, with a new key signed by the old key.
+// The change is added to the key history of the user, and the old key can no longer be used to log in, so the
+// other clients logged in with it are logged out. The clients in the chat rooms the user is a member of are notified
+func (s *Server) RotateKey(ws *websocket.Conn, msg *websock.RotateKeyMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	if err := util.VerifyKeyChange(user.PublicKey, user.Username, msg.PublicKey, msg.Signature); err != nil {
+		s.replyError(ws, websock.CodeInvalidSignature, "Invalid key signature")
+		return
+	}
+	pubKey, err := util.UnmarshalPublic(msg.PublicKey)
+	if err != nil {
+		s.replyError(ws, websock.CodeInvalidMessage, "Invalid public key")
+		return
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	storedUser, err := s.Db.FindUser(user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing key")
+		return
+	}
+	keyID := util.KeyID(msg.PublicKey)
+	if storedUser.KeyRevoked(keyID) || storedUser.Device(keyID) != nil {
+		s.replyError(ws, websock.CodeConflict, "This key has already been used")
+		return
+	}
+	device := storedUser.Device(user.DeviceID)
+	if device == nil || device.Revoked {
+		s.replyError(ws, websock.CodeDeviceRevoked, "This device has been revoked")
+		return
+	}
+
+	change := mdb.KeyChange{
+		Device:    device.ID,
+		OldKey:    device.PublicKey,
+		NewKey:    msg.PublicKey,
+		Signature: msg.Signature,
+		Timestamp: util.NowMillis()}
+	storedUser.KeyHistory = append(storedUser.KeyHistory, change)
+	device.PublicKey = msg.PublicKey
+	if device.ID == "" {
+		storedUser.PublicKey = msg.PublicKey
+	}
+	if err := s.Db.UpdateUser(storedUser); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing key")
+		return
+	}
+
+	user.PublicKey = pubKey
+	s.Sessions.KeyChanged(ws, keyID)
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Key changed"})
+
+	for _, client := range s.Users.Connections(user.Username) {
+		if other, ok := s.Users.Get(client); ok && client != ws && other.DeviceID == device.ID {
+			s.logout(client, "The key of this device has been changed")
+		}
+	}
+	s.NotifyKeyChanged(user, &change)
+}
+
+// memberDevices gets every device of a user with the changes of its key, also the revoked devices, so the clients
+// can check that each device was added by another device of the user
+func memberDevices(user *mdb.User) []websock.Device {
+	devices := make([]websock.Device, 0)
+	for _, device := range user.AllDevices() {
+		member := toDevice(device)
+		for _, change := range user.KeyHistory {
+			if change.Device == device.ID {
+				member.KeyChanges = append(member.KeyChanges, websock.KeyChange{
+					OldKey:    change.OldKey,
+					NewKey:    change.NewKey,
+					Signature: change.Signature,
+					Timestamp: change.Timestamp})
+			}
+		}
+		devices = append(devices, member)
+	}
+	return devices
+}
+
+// toDevice converts a stored device to the device sent to a client
+func toDevice(device mdb.Device) websock.Device {
+	return websock.Device{
+		ID:        device.ID,
+		PublicKey: device.PublicKey,
+		Timestamp: device.Timestamp,
+		SignedBy:  device.SignedBy,
+		Signature: device.Signature,
+		Revoked:   device.Revoked}
+}
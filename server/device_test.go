@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+func TestDevices(t *testing.T) {
+	ws, err := setupTestUser("deviceuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	devicePEM := util.MarshalPublic(spubkey)
+	deviceID := util.KeyID(devicePEM)
+
+	// The new device must be signed by the device the client is logged in from
+	signature, err := util.SignDevice(sprikey, "deviceuser", devicePEM)
+	if err != nil {
+		t.Fatalf("Unable to sign device: %s", err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.AddDevice, Message: &websock.AddDeviceMessage{PublicKey: devicePEM, Signature: signature}})
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+
+	if signature, err = util.SignDevice(prikey, "deviceuser", devicePEM); err != nil {
+		t.Fatalf("Unable to sign device: %s", err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.AddDevice, Message: &websock.AddDeviceMessage{PublicKey: devicePEM, Signature: signature}})
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chat info lists every device of the user
+	chatInfo, err := joinTestRoom(ws, "deviceroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatInfo.Users) != 1 || len(chatInfo.Users[0].Devices) != 2 {
+		t.Fatalf("Expected the user to have 2 devices in the chat info")
+	}
+
+	// The new device logs in with its own key, and receives the messages encrypted for it
+	device, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer device.Close()
+	if err := loginDevice(device, "deviceuser", deviceID, sprikey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinExistingRoom(device, "deviceroom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, key, err := util.EncryptMessage([]byte("to every device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &websock.SendChatMessage{
+		ChatName:         "deviceroom",
+		Version:          websock.MessageVersionLabeled,
+		Ciphertext:       ciphertext,
+		EncryptedContent: make(map[string][]byte)}
+	if req.EncryptedContent["deviceuser"], err = util.WrapKey(pubkey, key); err != nil {
+		t.Fatal(err)
+	}
+	if req.EncryptedContent[websock.Recipient("deviceuser", deviceID)], err = util.WrapKey(spubkey, key); err != nil {
+		t.Fatal(err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: req})
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiveMessage(device, websock.ChatMessageReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := util.UnwrapKey(sprikey, msg.Message.(*websock.ChatMessage).Message); err != nil {
+		t.Fatalf("Unable to decrypt message key with the key of the device: %s", err)
+	}
+
+	// The device the client is logged in from cannot be revoked
+	websock.Send(ws, &websock.Message{Type: websock.RevokeDevice, Message: util.KeyID(util.MarshalPublic(pubkey))})
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+
+	// A revoked device is logged out, and can no longer log in
+	websock.Send(ws, &websock.Message{Type: websock.RevokeDevice, Message: deviceID})
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(device, websock.LoggedOut); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.UserLeft); err != nil {
+		t.Fatal(err)
+	}
+
+	websock.Send(ws, &websock.Message{Type: websock.GetDevices})
+	if msg, err = receiveMessage(ws, websock.DevicesResponse); err != nil {
+		t.Fatal(err)
+	}
+	devices := msg.Message.(*websock.DevicesResponseMessage).Devices
+	if len(devices) != 2 || devices[1].ID != deviceID || !devices[1].Revoked {
+		t.Fatalf("Expected the added device to be revoked")
+	}
+
+	revoked, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer revoked.Close()
+	if err := loginDevice(revoked, "deviceuser", deviceID, sprikey); err == nil {
+		t.Fatalf("Expected a revoked device to be unable to log in")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	ws, err := setupTestUser("rotateuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, err := joinTestRoom(ws, "rotateroom"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := setupTestUser("rotateother", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := joinExistingRoom(other, "rotateroom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	newPrikey, newPubkey := setupTestKeys(2048)
+	newPEM := util.MarshalPublic(newPubkey)
+
+	// The new key must be signed by the old key
+	signature, err := util.SignKeyChange(newPrikey, "rotateuser", newPEM)
+	if err != nil {
+		t.Fatalf("Unable to sign key change: %s", err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.RotateKey, Message: &websock.RotateKeyMessage{PublicKey: newPEM, Signature: signature}})
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+
+	if signature, err = util.SignKeyChange(prikey, "rotateuser", newPEM); err != nil {
+		t.Fatalf("Unable to sign key change: %s", err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.RotateKey, Message: &websock.RotateKeyMessage{PublicKey: newPEM, Signature: signature}})
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other members are notified, and can check the new key with the old key
+	msg, err := receiveMessage(other, websock.KeyChanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyChanged := msg.Message.(*websock.KeyChangedMessage)
+	if keyChanged.ChatName != "rotateroom" || keyChanged.Username != "rotateuser" {
+		t.Fatalf("Expected the key change of rotateuser in rotateroom")
+	}
+	if err := util.VerifyKeyChange(pubkey, keyChanged.Username, keyChanged.PublicKey, keyChanged.Signature); err != nil {
+		t.Fatalf("Expected the new key to be signed by the old key: %s", err)
+	}
+
+	// The old key can no longer be used to log in
+	old, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer old.Close()
+	if err := loginDevice(old, "rotateuser", util.KeyID(util.MarshalPublic(pubkey)), prikey); err == nil {
+		t.Fatalf("Expected the old key to be unable to log in")
+	}
+
+	rotated, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer rotated.Close()
+	if err := loginDevice(rotated, "rotateuser", util.KeyID(newPEM), newPrikey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chat info lists the change of the key, so clients which have not seen it can check the new key
+	chatInfo, err := joinExistingRoom(rotated, "rotateroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range chatInfo.Users {
+		if user.Username != "rotateuser" {
+			continue
+		}
+		changes := user.Devices[0].KeyChanges
+		if len(changes) != 1 || !bytes.Equal(changes[0].OldKey, util.MarshalPublic(pubkey)) || !bytes.Equal(changes[0].NewKey, newPEM) {
+			t.Fatalf("Expected the chat info to list the change of the key")
+		}
+		if changes[0].Timestamp == 0 {
+			t.Fatalf("Expected the change of the key to have a timestamp")
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"log"
+	"sort"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// OpenDirect opens the direct conversation between the user and another user, the conversation is created if
+// it does not exist. The client is in the conversation like in a chat room until it leaves, and receives the
+// messages sent in the conversation. Opening the conversation marks its messages as read
+func (s *Server) OpenDirect(ws *websocket.Conn, peer string) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	if peer == user.Username {
+		s.replyError(ws, websock.CodeInvalidMessage, "You cannot send direct messages to yourself")
+		return
+	}
+	peerUser, err := s.Db.FindUser(peer)
+	if err != nil {
+		s.replyError(ws, websock.CodeUserNotFound, "User does not exist")
+		return
+	}
+
+	chatName := websock.DirectChatName(user.Username, peer)
+	if s.Users.InChat(ws, chatName) {
+		s.replyError(ws, websock.CodeAlreadyInChat, "This conversation is already open")
+		return
+	}
+
+	s.chatLock.Lock()
+	conv, err := s.Db.FindConversation(chatName)
+	if err == mdb.ErrNotFound {
+		conv = mdb.NewConversation(chatName, user.Username, peer)
+		err = s.Db.InsertConversation(conv)
+	}
+	if err == nil {
+		conv.Participant(user.Username).LastRead = conv.LastMessage
+		err = s.Db.UpdateConversation(conv)
+	}
+	s.chatLock.Unlock()
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error opening conversation")
+		return
+	}
+
+	if !s.Users.JoinChat(ws, chatName) {
+		s.replyError(ws, websock.CodeAlreadyInChat, "This conversation is already open")
+		return
+	}
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Conversation opened"})
+
+	chatInfo := s.newDirectInfo(user, chatName, peerUser)
+	if chatInfo.Messages, chatInfo.HasMoreHistory, err = s.FindHistory(user.Recipient(), chatName, nil, historyPageSize); err != nil {
+		log.Println(err)
+	}
+
+	go websock.Send(ws, &websock.Message{Type: websock.ChatInfo, Message: chatInfo})
+
+	s.NotifyUserJoined(user, chatName)
+}
+
+// newDirectInfo creates the chat info of a direct conversation without chat messages
+func (s *Server) newDirectInfo(user *User, chatName string, peer *mdb.User) *websock.ChatInfoMessage {
+	// The other user is online in the conversation if he has it open
+	sessions := s.chatSessions(user, chatName)
+	publicKey, devices := s.userDevices(user.Username, util.MarshalPublic(user.PublicKey))
+
+	return &websock.ChatInfoMessage{
+		Name:       chatName,
+		MyUsername: user.Username,
+		MySession:  user.SessionID,
+		Moderators: make([]string, 0),
+		Users: []websock.User{
+			{Username: user.Username, PublicKey: publicKey, Online: true, Sessions: sessions[user.Username], Devices: devices},
+			{Username: peer.Username, PublicKey: peer.PublicKey, Online: len(sessions[peer.Username]) > 0, Sessions: sessions[peer.Username],
+				Devices: memberDevices(peer)}},
+		Direct:     true,
+		SenderKeys: s.pendingSenderKeys(user, chatName)}
+}
+
+// GetDirects sends the direct conversations of the user to the client, with the number of unread messages
+func (s *Server) GetDirects(ws *websocket.Conn) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	convs, err := s.Db.FindConversations(user.Username)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error retrieving conversations")
+		return
+	}
+
+	response := &websock.DirectsResponseMessage{Conversations: make([]websock.Conversation, 0, len(convs))}
+	for _, conv := range convs {
+		unread, err := s.Db.CountUnreadMessages(conv.Name, user.Username, conv.Participant(user.Username).LastRead)
+		if err != nil {
+			log.Println(err)
+		}
+		peer := conv.Peer(user.Username)
+		response.Conversations = append(response.Conversations, websock.Conversation{
+			Name:        conv.Name,
+			Peer:        peer,
+			Online:      s.Users.IsOnline(peer),
+			Unread:      unread,
+			LastMessage: conv.LastMessage})
+	}
+
+	// The conversations with the newest messages are listed first
+	sort.Slice(response.Conversations, func(i, j int) bool {
+		return response.Conversations[i].LastMessage > response.Conversations[j].LastMessage
+	})
+
+	s.reply(ws, &websock.Message{Type: websock.DirectsResponse, Message: response})
+}
+
+// SendDirect is called when the server receives a chat message in a direct conversation. The user does not need
+// to have the conversation open, and the message is stored for both users, so it is delivered when they open it
+func (s *Server) SendDirect(ws *websocket.Conn, msg *websock.SendChatMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	conv, err := s.Db.FindConversation(msg.ChatName)
+	if err != nil || conv.Participant(user.Username) == nil {
+		s.replyError(ws, websock.CodeNotInChat, "You are not in this conversation")
+		return
+	}
+
+	// The message can only be addressed to the users in the conversation
+	for recipient := range msg.EncryptedContent {
+		if conv.Participant(websock.RecipientUsername(recipient)) == nil {
+			delete(msg.EncryptedContent, recipient)
+		}
+	}
+
+	// A signed message uses the timestamp chosen by the client, because the timestamp is part of the signature
+	timestamp := util.NowMillis()
+	if len(msg.Signature) != 0 {
+		timestamp = msg.Timestamp
+	}
+
+	// The message is stored before the conversation is updated, so it is counted as unread as soon as the
+	// sender is told that it was sent
+	chatMessage := s.NewChatMessage(user, conv.Name, timestamp, msg)
+	if err := s.Db.InsertMessage(chatMessage); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error sending message")
+		return
+	}
+
+	// The message is read by the sender, and by the other user if he has the conversation open
+	if timestamp > conv.LastMessage {
+		conv.LastMessage = timestamp
+	}
+	s.Users.ForEachInChat(conv.Name, func(_ *websocket.Conn, otherUser *User) {
+		if participant := conv.Participant(otherUser.Username); participant != nil && participant.LastRead < timestamp {
+			participant.LastRead = timestamp
+		}
+	})
+	if participant := conv.Participant(user.Username); participant.LastRead < timestamp {
+		participant.LastRead = timestamp
+	}
+	if err := s.Db.UpdateConversation(conv); err != nil {
+		log.Println(err)
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Message sent"})
+
+	go s.NotifyChatMessage(chatMessage, msg.EncryptedContent)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// openDirect opens the direct conversation with another user, returns the chat info sent by the server
+func openDirect(t *testing.T, ws *websocket.Conn, peer string) *websock.ChatInfoMessage {
+	if err := websock.Send(ws, &websock.Message{Type: websock.OpenDirect, Message: peer}); err != nil {
+		t.Fatalf("Unable to send open direct request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiveMessage(ws, websock.ChatInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Message.(*websock.ChatInfoMessage)
+}
+
+// getDirects retrieves the direct conversations of the user
+func getDirects(t *testing.T, ws *websocket.Conn) []websock.Conversation {
+	if err := websock.Send(ws, &websock.Message{Type: websock.GetDirects}); err != nil {
+		t.Fatalf("Unable to send get directs request: %s", err)
+	}
+	msg, err := receiveMessage(ws, websock.DirectsResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Message.(*websock.DirectsResponseMessage).Conversations
+}
+
+func TestDirectMessages(t *testing.T) {
+	alice, err := setupTestUser("directalice", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := setupTestUser("directbob", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// The first user opens the conversation and sends a message, while the other user does not have it open
+	chatInfo := openDirect(t, alice, "directbob")
+	chatName := websock.DirectChatName("directalice", "directbob")
+	if chatInfo.Name != chatName || !chatInfo.Direct {
+		t.Fatalf("Expected the direct conversation %s, got %s", chatName, chatInfo.Name)
+	}
+	if len(chatInfo.Users) != 2 {
+		t.Fatalf("Expected 2 users in the conversation, got %d", len(chatInfo.Users))
+	}
+
+	req, err := encryptTestMessage(chatInfo.Users, "just between us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ChatName = chatName
+	if err := websock.Send(alice, &websock.Message{Type: websock.SendDirect, Message: req}); err != nil {
+		t.Fatalf("Unable to send direct message request: %s", err)
+	}
+	if _, err := receiveMessage(alice, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(alice, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other user sees the conversation with one unread message
+	convs := getDirects(t, bob)
+	if len(convs) != 1 {
+		t.Fatalf("Expected 1 conversation, got %d", len(convs))
+	}
+	if convs[0].Name != chatName || convs[0].Peer != "directalice" || !convs[0].Online {
+		t.Fatalf("Unexpected conversation: %+v", convs[0])
+	}
+	if convs[0].Unread != 1 {
+		t.Fatalf("Expected 1 unread message, got %d", convs[0].Unread)
+	}
+	if convs := getDirects(t, alice); len(convs) != 1 || convs[0].Unread != 0 {
+		t.Fatalf("Expected the sender to have no unread messages, got %+v", convs)
+	}
+
+	// Opening the conversation delivers the message, and marks it as read
+	chatInfo = openDirect(t, bob, "directalice")
+	if len(chatInfo.Messages) != 1 {
+		t.Fatalf("Expected 1 message in the conversation, got %d", len(chatInfo.Messages))
+	}
+	key, err := util.UnwrapKey(sprikey, chatInfo.Messages[0].Message)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message key: %s", err)
+	}
+	decMsg, err := util.DecryptMessage(chatInfo.Messages[0].Ciphertext, key)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message: %s", err)
+	}
+	if string(decMsg) != "just between us" {
+		t.Fatalf("Decrypted message does not match the original message")
+	}
+	if _, err := receiveMessage(alice, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+	if convs := getDirects(t, bob); len(convs) != 1 || convs[0].Unread != 0 {
+		t.Fatalf("Expected no unread messages after opening the conversation, got %+v", convs)
+	}
+
+	// Direct messages cannot be sent as chat room messages
+	if err := websock.Send(bob, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+		t.Fatalf("Unable to send chat message request: %s", err)
+	}
+	if _, err := receiveMessage(bob, websock.OK); err == nil {
+		t.Fatalf("Expected an error when sending a direct message with SendChat")
+	}
+}
+
+func TestDirectMessagesNotParticipant(t *testing.T) {
+	ws, err := setupTestUser("directeve", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	other, err := setupTestUser("directother", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	openDirect(t, other, "directeve")
+
+	// A user cannot send messages in a conversation between two other users
+	req, err := encryptTestMessage([]websock.User{{Username: "directeve", PublicKey: util.MarshalPublic(pubkey)}}, "intrusion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ChatName = websock.DirectChatName("directother", "directnobody")
+	if err := websock.Send(ws, &websock.Message{Type: websock.SendDirect, Message: req}); err != nil {
+		t.Fatalf("Unable to send direct message request: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err == nil {
+		t.Fatalf("Expected an error when sending in a conversation the user is not part of")
+	}
+
+	// Conversations can only be opened with other existing users
+	for _, peer := range []string{"directeve", "directnobody"} {
+		if err := websock.Send(ws, &websock.Message{Type: websock.OpenDirect, Message: peer}); err != nil {
+			t.Fatalf("Unable to send open direct request: %s", err)
+		}
+		if _, err := receiveMessage(ws, websock.OK); err == nil {
+			t.Fatalf("Expected an error when opening a conversation with %s", peer)
+		}
+	}
+}
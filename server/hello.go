@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// The codecs, cipher suites and features supported by the server, see websock.HelloMessage
+var (
+	supportedCodecs       = []string{websock.CodecGob, websock.CodecJSON}
+	supportedCipherSuites = []string{websock.CipherSuiteSenderKey, websock.CipherSuiteLabeled}
+	supportedFeatures     = []string{websock.FeatureSessions, websock.FeatureDevices, websock.FeatureDirects, websock.FeatureInvites}
+)
+
+// HelloHandler handles the Hello message a client sends when it connects, before any other message.
+// This function returns true if the client is compatible with the server, otherwise it sends an error
+// to the client and returns false
+func (s *Server) HelloHandler(ws *websocket.Conn, pongCount *int64) bool {
+	for {
+		msg := new(websock.Message)
+		if err := websock.Receive(ws, msg); err != nil {
+			log.Println(err)
+			return false
+		}
+		s.Requests.Start(ws, msg)
+
+		switch msg.Type {
+		case websock.Hello:
+			return s.Hello(ws, msg.Message.(*websock.HelloMessage))
+		case websock.Pong:
+			log.Printf("Receive pong from %s", ws.Request().RemoteAddr)
+			atomic.AddInt64(pongCount, 1)
+		default:
+			// Clients from before the handshake was added start with another message, and do not support error codes
+			log.Printf("Client %s did not start with hello", ws.Request().RemoteAddr)
+			s.reply(ws, &websock.Message{
+				Type:    websock.Error,
+				Message: "The client is too old to connect to this server, please update the client"})
+			return false
+		}
+	}
+}
+
+// Hello checks that the client supports a version of the wire protocol the server supports, and that they have a
+// codec and a cipher suite in common, and responds with the codec, cipher suites and features which are used
+func (s *Server) Hello(ws *websocket.Conn, hello *websock.HelloMessage) bool {
+	refuse := func(reason string) bool {
+		log.Printf("Refused client %s: %s", ws.Request().RemoteAddr, reason)
+		s.replyError(ws, websock.CodeUnsupported, reason)
+		return false
+	}
+
+	if hello.Version < websock.MinProtocolVersion {
+		// Clients of older versions do not support error codes, so the error is sent as a string
+		reason := fmt.Sprintf("The client uses protocol version %d, but the server requires version %d or newer, please update the client",
+			hello.Version, websock.MinProtocolVersion)
+		log.Printf("Refused client %s: %s", ws.Request().RemoteAddr, reason)
+		s.reply(ws, &websock.Message{Type: websock.Error, Message: reason})
+		return false
+	}
+	if hello.Version > websock.ProtocolVersion {
+		return refuse(fmt.Sprintf("The client uses protocol version %d, but the server only supports version %d or older, the server must be updated",
+			hello.Version, websock.ProtocolVersion))
+	}
+
+	// The codec is chosen by the websocket subprotocol, the client must support it
+	codec := websock.Codec(ws)
+	if len(intersect(hello.Codecs, []string{codec})) == 0 {
+		return refuse(fmt.Sprintf("The connection uses the %s codec, which the client does not support. Request the subprotocol of "+
+			"one of the codecs the server supports when connecting: %v", codec, supportedCodecs))
+	}
+	cipherSuites := intersect(hello.CipherSuites, supportedCipherSuites)
+	if len(cipherSuites) == 0 {
+		return refuse(fmt.Sprintf("The server does not support any of the cipher suites of the client, the server supports: %v", supportedCipherSuites))
+	}
+
+	return s.reply(ws, &websock.Message{Type: websock.Hello, Message: &websock.HelloMessage{
+		Version:      websock.ProtocolVersion,
+		Codecs:       []string{codec},
+		CipherSuites: cipherSuites,
+		Features:     intersect(hello.Features, supportedFeatures)}}) == nil
+}
+
+// intersect gets the values which are in both a and b, in the order of a
+func intersect(a, b []string) []string {
+	result := make([]string, 0)
+	for _, value := range a {
+		for _, other := range b {
+			if value == other {
+				result = append(result, value)
+				break
+			}
+		}
+	}
+	return result
+}
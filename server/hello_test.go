@@ -0,0 +1,80 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+func TestHello(t *testing.T) {
+	ws, err := websocket.Dial(wsserver.URL, "", "http://")
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+
+	msg, err := hello(ws, &websock.HelloMessage{
+		Version:      websock.ProtocolVersion,
+		Codecs:       []string{"unknown", websock.CodecGob},
+		CipherSuites: []string{"unknown", websock.CipherSuiteLabeled, websock.CipherSuiteSenderKey},
+		Features:     []string{"unknown", websock.FeatureSessions}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != websock.Hello {
+		t.Fatalf("Expected hello, got %s: %v", msg.Type, msg.Message)
+	}
+	response := msg.Message.(*websock.HelloMessage)
+	if response.Version != websock.ProtocolVersion || len(response.Codecs) != 1 || response.Codecs[0] != websock.CodecGob {
+		t.Fatalf("Expected protocol version %d with the gob codec", websock.ProtocolVersion)
+	}
+	if len(response.CipherSuites) != 2 || response.CipherSuites[0] != websock.CipherSuiteLabeled {
+		t.Fatalf("Expected the cipher suites of the client which the server supports, in the order of the client")
+	}
+	if !response.Supports(websock.FeatureSessions) || response.Supports("unknown") || response.Supports(websock.FeatureDevices) {
+		t.Fatalf("Expected the features both the client and server supports")
+	}
+}
+
+func TestHelloIncompatible(t *testing.T) {
+	refused := []*websock.HelloMessage{
+		{Version: websock.ProtocolVersion + 1, Codecs: []string{websock.CodecGob}, CipherSuites: []string{websock.CipherSuiteSenderKey}},
+		{Version: websock.MinProtocolVersion - 1, Codecs: []string{websock.CodecGob}, CipherSuites: []string{websock.CipherSuiteSenderKey}},
+		{Version: websock.ProtocolVersion, Codecs: []string{"unknown"}, CipherSuites: []string{websock.CipherSuiteSenderKey}},
+		{Version: websock.ProtocolVersion, Codecs: []string{websock.CodecGob}, CipherSuites: []string{"unknown"}},
+	}
+	for _, helloMsg := range refused {
+		ws, err := websocket.Dial(wsserver.URL, "", "http://")
+		if err != nil {
+			t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+		}
+		msg, err := hello(ws, helloMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != websock.Error {
+			t.Fatalf("Expected the incompatible client to be refused: %+v", helloMsg)
+		}
+		// Clients which are too old to support error codes get the error as a string
+		if _, ok := msg.Message.(string); ok != (helloMsg.Version < websock.MinProtocolVersion) {
+			t.Fatalf("Expected an error code only for clients which support them, got %v", msg.Message)
+		}
+		// The server closes the connection
+		if err := websock.Receive(ws, msg); err == nil {
+			t.Fatalf("Expected the connection to be closed")
+		}
+		ws.Close()
+	}
+
+	// Clients which do not send hello are refused
+	ws, err := websocket.Dial(wsserver.URL, "", "http://")
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+	websock.Send(ws, &websock.Message{Type: websock.LoginUser, Message: "olduser"})
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// inviteSecretLen is the size in bytes of the random invite secret used when none is configured
+const inviteSecretLen = 32
+
+// CreateInvite creates an invite to a chat room the user is in, and sends the signed invite token to the client
+func (s *Server) CreateInvite(ws *websocket.Conn, msg *websock.CreateInviteMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	if !s.Users.InChat(ws, msg.ChatName) {
+		s.replyError(ws, websock.CodeNotInChat, "You are not in this chat room")
+		return
+	}
+	chat, err := s.Db.FindChat(msg.ChatName)
+	if err != nil {
+		s.replyError(ws, websock.CodeChatNotFound, "This chat room does not exist")
+		return
+	}
+
+	expiresAt := util.NowMillis() + int64(msg.ValidFor/time.Millisecond)
+	invite := mdb.NewInvite(chat.Name, user.Username, expiresAt, msg.MaxUses)
+	if err := s.Db.InsertInvite(invite); err != nil {
+		s.replyError(ws, websock.CodeInternal, "Error creating invite")
+		return
+	}
+
+	token, err := util.SignInvite(s.InviteSecret, &util.InviteToken{
+		ID:        invite.ID.Hex(),
+		ExpiresAt: expiresAt})
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error creating invite")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.InviteCreated, Message: &websock.InviteMessage{
+		ChatName:  chat.Name,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		MaxUses:   msg.MaxUses}})
+}
+
+// RevokeInvite revokes an invite, so it can no longer be used to join the chat room. An invite can be
+// revoked by the user who created it, and by the moderators of the chat room
+func (s *Server) RevokeInvite(ws *websocket.Conn, token string) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	invite, ok := s.findInvite(ws, token)
+	if !ok {
+		return
+	}
+	if invite.Creator != user.Username {
+		if chat, err := s.Db.FindChat(invite.ChatName); err != nil || !chat.IsModerator(user.Username) {
+			s.replyError(ws, websock.CodeForbidden, "Only the creator of the invite or a moderator can revoke it")
+			return
+		}
+	}
+
+	invite.Revoked = true
+	if err := s.Db.UpdateInvite(invite); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error revoking invite")
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Invite revoked"})
+}
+
+// GetInvite sends the chat room an invite token is for to the client. The chat room is read from the stored
+// invite, so the invite can still be used after the chat room has been renamed
+func (s *Server) GetInvite(ws *websocket.Conn, token string) {
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	invite, ok := s.findValidInvite(ws, token)
+	if !ok {
+		return
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.InviteInfo, Message: &websock.InviteMessage{
+		ChatName:  invite.ChatName,
+		Token:     token,
+		ExpiresAt: invite.ExpiresAt,
+		MaxUses:   invite.MaxUses}})
+}
+
+// joinWithInvite adds a user to a chat room with an invite token instead of the password. The invite is only
+// counted as used when the user has joined, and the chatLock is held meanwhile, so an invite can not be used
+// more times than it allows. If the user could not join, the client is sent an error and false is returned
+func (s *Server) joinWithInvite(ws *websocket.Conn, user *User, chatName, token string) bool {
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	invite, ok := s.findValidInvite(ws, token)
+	if !ok {
+		return false
+	}
+	if invite.ChatName != chatName {
+		s.replyError(ws, websock.CodeInvalidInvite, "This invite is for another chat room")
+		return false
+	}
+	if !s.addToChat(ws, user, chatName) {
+		return false
+	}
+
+	// The user has joined, so the chat room is not left if the invite can not be updated
+	invite.Uses++
+	if err := s.Db.UpdateInvite(invite); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// findValidInvite finds the invite an invite token refers to, and checks that it can be used. The chatLock must
+// be held
+func (s *Server) findValidInvite(ws *websocket.Conn, token string) (*mdb.Invite, bool) {
+	invite, ok := s.findInvite(ws, token)
+	if !ok {
+		return nil, false
+	}
+	if !invite.Valid(util.NowMillis()) {
+		s.replyError(ws, websock.CodeInvalidInvite, "This invite has expired, been revoked or used up")
+		return nil, false
+	}
+	return invite, true
+}
+
+// findInvite checks the signature of an invite token, and finds the invite it refers to. The chatLock must be held
+func (s *Server) findInvite(ws *websocket.Conn, token string) (*mdb.Invite, bool) {
+	claims, err := util.VerifyInvite(s.InviteSecret, token)
+	if err != nil {
+		s.replyError(ws, websock.CodeInvalidInvite, "Invalid invite")
+		return nil, false
+	}
+
+	invite, err := s.Db.FindInvite(claims.ID)
+	if err != nil {
+		s.replyError(ws, websock.CodeInvalidInvite, "Invalid invite")
+		return nil, false
+	}
+	return invite, true
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// createInvite creates an invite to a chat room, returns the invite token
+func createInvite(t *testing.T, ws *websocket.Conn, chatName string, maxUses int) string {
+	err := websock.Send(ws, &websock.Message{
+		Type:    websock.CreateInvite,
+		Message: &websock.CreateInviteMessage{ChatName: chatName, MaxUses: maxUses}})
+	if err != nil {
+		t.Fatalf("Unable to send create invite request: %s", err)
+	}
+	msg, err := receiveMessage(ws, websock.InviteCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Message.(*websock.InviteMessage).Token
+}
+
+// joinWithInvite sends a request to join a chat room with an invite, returns the response from the server
+func joinWithInvite(t *testing.T, ws *websocket.Conn, chatName, token string) *websock.Message {
+	err := websock.Send(ws, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: chatName, Invite: token}})
+	if err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	msg := new(websock.Message)
+	if err := websock.Receive(ws, msg); err != nil {
+		t.Fatalf("Error when receiving message from server: %s", err)
+	}
+	return msg
+}
+
+func TestJoinHiddenRoomWithInvite(t *testing.T) {
+	owner, err := setupTestUser("inviteowner", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	err = websock.Send(owner, &websock.Message{
+		Type:    websock.CreateChatRoom,
+		Message: &websock.CreateChatRoomMessage{Name: "inviteroom", Password: "secretpassword", IsHidden: true}})
+	if err != nil {
+		t.Fatalf("Unable to send create room request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	err = websock.Send(owner, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "inviteroom", Password: "secretpassword"}})
+	if err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(owner, websock.ChatInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	guest, err := setupTestUser("inviteguest", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+
+	// Without an invite, the hidden chat room cannot be joined even with the password
+	err = websock.Send(guest, &websock.Message{
+		Type:    websock.JoinChat,
+		Message: &websock.JoinChatMessage{Name: "inviteroom", Password: "secretpassword"}})
+	if err != nil {
+		t.Fatalf("Unable to send join room request: %s", err)
+	}
+	if _, err := receiveMessage(guest, websock.OK); err == nil {
+		t.Fatalf("Expected an error when joining a hidden chat room without an invite")
+	}
+
+	// The invite is used instead of the password
+	token := createInvite(t, owner, "inviteroom", 1)
+	if msg := joinWithInvite(t, guest, "inviteroom", token); msg.Type != websock.OK {
+		t.Fatalf("Expected to join the chat room with the invite, got %v", msg.Message)
+	}
+	if _, err := receiveMessage(guest, websock.ChatInfo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(owner, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	// The invite can only be used once
+	other, err := setupTestUser("inviteother", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if msg := joinWithInvite(t, other, "inviteroom", token); msg.Type != websock.Error {
+		t.Fatalf("Expected an error when using an invite which is used up")
+	}
+
+	// A token which has been tampered with is rejected
+	tampered := createInvite(t, guest, "inviteroom", 5)
+	if msg := joinWithInvite(t, other, "inviteroom", tampered+"x"); msg.Type != websock.Error {
+		t.Fatalf("Expected an error when using an invalid invite")
+	}
+
+	// A revoked invite cannot be used, and only the creator or a moderator can revoke it
+	if err := websock.Send(other, &websock.Message{Type: websock.RevokeInvite, Message: tampered}); err != nil {
+		t.Fatalf("Unable to send revoke invite request: %s", err)
+	}
+	if _, err := receiveMessage(other, websock.OK); err == nil {
+		t.Fatalf("Expected an error when revoking an invite created by another user")
+	}
+	if err := websock.Send(owner, &websock.Message{Type: websock.RevokeInvite, Message: tampered}); err != nil {
+		t.Fatalf("Unable to send revoke invite request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg := joinWithInvite(t, other, "inviteroom", tampered); msg.Type != websock.Error {
+		t.Fatalf("Expected an error when using a revoked invite")
+	}
+}
+
+func TestCreateInvalidInvite(t *testing.T) {
+	ws, err := setupTestUser("invitecreator", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// Invites can only be created in chat rooms the user is in
+	for _, req := range []*websock.CreateInviteMessage{
+		{ChatName: "noinviteroom", MaxUses: 1},
+		{ChatName: "noinviteroom", MaxUses: 0},
+	} {
+		if err := websock.Send(ws, &websock.Message{Type: websock.CreateInvite, Message: req}); err != nil {
+			t.Fatalf("Unable to send create invite request: %s", err)
+		}
+		if _, err := receiveMessage(ws, websock.InviteCreated); err == nil {
+			t.Fatalf("Expected an error when creating the invite %+v", req)
+		}
+	}
+}
+
+func TestInviteAfterRename(t *testing.T) {
+	owner, err := setupTestUser("renameinviteowner", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	if _, err := joinTestRoom(owner, "inviterename"); err != nil {
+		t.Fatal(err)
+	}
+	token := createInvite(t, owner, "inviterename", 1)
+
+	if err := websock.Send(owner, &websock.Message{
+		Type:    websock.RenameChatRoom,
+		Message: &websock.RenameChatRoomMessage{Name: "inviterename", NewName: "inviterenamed"}}); err != nil {
+		t.Fatalf("Unable to send rename request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	guest, err := setupTestUser("renameinviteguest", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+
+	// The server reads the chat room from the stored invite, which has been renamed with the chat room
+	if err := websock.Send(guest, &websock.Message{Type: websock.GetInvite, Message: token}); err != nil {
+		t.Fatalf("Unable to send invite request: %s", err)
+	}
+	msg, err := receiveMessage(guest, websock.InviteInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite := msg.Message.(*websock.InviteMessage); invite.ChatName != "inviterenamed" || invite.MaxUses != 1 {
+		t.Fatalf("Expected the invite to be for the renamed chat room, got %+v", invite)
+	}
+
+	// A failed join does not use up the invite
+	if msg := joinWithInvite(t, guest, "inviterename", token); msg.Type != websock.Error {
+		t.Fatalf("Expected an error when joining the chat room with its old name")
+	}
+	if msg := joinWithInvite(t, guest, "inviterenamed", token); msg.Type != websock.OK {
+		t.Fatalf("Expected to join the renamed chat room with the invite, got %v", msg.Message)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// violationWindow is how long the messages a connection sent over its limits are counted
+	violationWindow = time.Minute
+	// pruneInterval is how often the buckets of users and IP addresses which are full again are removed
+	pruneInterval = 10 * time.Minute
+)
+
+// MessageClass is a class of messages which share a budget, see RateLimits
+type MessageClass int
+
+const (
+	// ClassAuth is registering users, logging in and resuming sessions
+	ClassAuth MessageClass = iota
+	// ClassChat is sending chat messages, direct messages and sender keys, which are sent on to other users
+	ClassChat
+	// ClassCreate is creating chat rooms, invites and conversations, and adding devices and keys, which are stored
+	ClassCreate
+	// ClassOther is every other message
+	ClassOther
+)
+
+// messageClass gets the class of a message type
+func messageClass(msgType websock.MessageType) MessageClass {
+	switch msgType {
+	case websock.RegisterUser, websock.LoginUser, websock.ResumeSession:
+		return ClassAuth
+	case websock.SendChat, websock.SendDirect, websock.SendSenderKey:
+		return ClassChat
+	case websock.CreateChatRoom, websock.CreateInvite, websock.OpenDirect, websock.AddDevice, websock.RotateKey:
+		return ClassCreate
+	default:
+		return ClassOther
+	}
+}
+
+// RateLimit is the limit of a token bucket: Burst messages can be sent at once, and the bucket is refilled
+// with Rate messages per second. A limit with a Burst or Rate of 0 does not limit anything
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateBudget is the limit of a class of messages for every connection, every user (across all of its
+// connections) and every IP address. The user is only known after the client has logged in
+type RateBudget struct {
+	Connection RateLimit
+	User       RateLimit
+	IP         RateLimit
+}
+
+// RateLimits are the limits of the messages clients can send. A message over the limits is not handled, the
+// client is sent a CodeRateLimited error instead, and a connection which sends more than MaxViolations messages
+// over the limits within violationWindow is disconnected. If ForwardedFor is set, the IP address of a client is
+// read from the X-Forwarded-For header, for servers behind a proxy. The zero value does not limit anything
+type RateLimits struct {
+	Auth          RateBudget
+	Chat          RateBudget
+	Create        RateBudget
+	Other         RateBudget
+	MaxViolations int
+	ForwardedFor  bool
+}
+
+// DefaultRateLimits gets limits which a client used by a person does not reach
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Auth: RateBudget{
+			Connection: RateLimit{Rate: 0.2, Burst: 5},
+			IP:         RateLimit{Rate: 1, Burst: 20}},
+		Chat: RateBudget{
+			Connection: RateLimit{Rate: 5, Burst: 20},
+			User:       RateLimit{Rate: 10, Burst: 40},
+			IP:         RateLimit{Rate: 20, Burst: 100}},
+		Create: RateBudget{
+			Connection: RateLimit{Rate: 0.2, Burst: 5},
+			User:       RateLimit{Rate: 0.5, Burst: 10},
+			IP:         RateLimit{Rate: 1, Burst: 20}},
+		Other: RateBudget{
+			Connection: RateLimit{Rate: 10, Burst: 50},
+			User:       RateLimit{Rate: 20, Burst: 100},
+			IP:         RateLimit{Rate: 50, Burst: 200}},
+		MaxViolations: 20}
+}
+
+// budget gets the budget of a class of messages
+func (rl *RateLimits) budget(class MessageClass) RateBudget {
+	switch class {
+	case ClassAuth:
+		return rl.Auth
+	case ClassChat:
+		return rl.Chat
+	case ClassCreate:
+		return rl.Create
+	default:
+		return rl.Other
+	}
+}
+
+// rateLimit checks that a message from a client is within the rate limits. If it is not, the client is sent a
+// CodeRateLimited error and false is returned, and the connection is closed if the client keeps going
+func (s *Server) rateLimit(ws *websocket.Conn, msgType websock.MessageType) bool {
+	// Pongs are responses to the pings of the server
+	if msgType == websock.Pong {
+		return true
+	}
+
+	var username string
+	if user, ok := s.Users.Get(ws); ok && user != nil {
+		user.Lock()
+		username = user.Username
+		user.Unlock()
+	}
+
+	ok, retryAfter, disconnect := s.rateLimiter.Allow(ws, s.clientIP(ws), username, messageClass(msgType), time.Now())
+	if ok {
+		return true
+	}
+	if disconnect {
+		log.Printf("Client %s sent too many messages over the rate limits, disconnecting", ws.Request().RemoteAddr)
+		s.replyError(ws, websock.CodeRateLimited, "Too many messages over the rate limits, disconnecting")
+		ws.Close()
+		return false
+	}
+	s.replyErrorDetails(ws, websock.CodeRateLimited, "Too many messages, slow down",
+		map[string]string{"retryAfter": strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))})
+	return false
+}
+
+// clientIP gets the IP address of a client. If RateLimits.ForwardedFor is set, it is the last address in the
+// X-Forwarded-For header, which is the address the proxy in front of the server received the request from
+func (s *Server) clientIP(ws *websocket.Conn) string {
+	req := ws.Request()
+	if s.RateLimits.ForwardedFor {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// tokenBucket contains the tokens left of a limit, the bucket is refilled when it is used
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens since the bucket was last used, and gets the number of tokens in the bucket
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) float64 {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	}
+	b.last = now
+	return b.tokens
+}
+
+// buckets are the token buckets of every class of messages for a connection, user or IP address
+type buckets map[MessageClass]*tokenBucket
+
+// get gets the bucket of a class of messages, and creates it if it does not exist
+func (b buckets) get(class MessageClass) *tokenBucket {
+	bucket, ok := b[class]
+	if !ok {
+		bucket = new(tokenBucket)
+		b[class] = bucket
+	}
+	return bucket
+}
+
+// connLimits are the token buckets of a connection, and the number of messages over the limits it sent
+// since the violation window started
+type connLimits struct {
+	buckets    buckets
+	violations int
+	since      time.Time
+}
+
+// rateLimiter keeps the token buckets of every connection, user and IP address, see RateLimits
+//
+// The mutex must be held when accessing the maps
+type rateLimiter struct {
+	sync.Mutex
+	limits    RateLimits
+	conns     map[*websocket.Conn]*connLimits
+	users     map[string]buckets
+	ips       map[string]buckets
+	lastPrune time.Time
+}
+
+// newRateLimiter creates a rateLimiter with the limits, and without any buckets
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits: limits,
+		conns:  make(map[*websocket.Conn]*connLimits),
+		users:  make(map[string]buckets),
+		ips:    make(map[string]buckets),
+	}
+}
+
+// Allow takes a token from the buckets of the connection, user and IP address for a class of messages. If
+// a bucket is empty, no tokens are taken, and retryAfter is how long it takes until the message can be sent.
+// disconnect is true if the connection has sent too many messages over the limits. The username is empty if
+// the client has not logged in
+func (rl *rateLimiter) Allow(ws *websocket.Conn, ip, username string, class MessageClass,
+	now time.Time) (ok bool, retryAfter time.Duration, disconnect bool) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	if now.Sub(rl.lastPrune) >= pruneInterval {
+		rl.prune(now)
+	}
+
+	conn, exists := rl.conns[ws]
+	if !exists {
+		conn = &connLimits{buckets: make(buckets)}
+		rl.conns[ws] = conn
+	}
+
+	budget := rl.limits.budget(class)
+	type limitedBucket struct {
+		bucket *tokenBucket
+		limit  RateLimit
+	}
+	limited := []limitedBucket{{conn.buckets.get(class), budget.Connection}}
+	if username != "" {
+		limited = append(limited, limitedBucket{bucketsOf(rl.users, username).get(class), budget.User})
+	}
+	limited = append(limited, limitedBucket{bucketsOf(rl.ips, ip).get(class), budget.IP})
+
+	// The tokens are only taken if every bucket has one, so a message which is refused does not use up the others
+	ok = true
+	for _, lb := range limited {
+		if lb.limit.Burst <= 0 || lb.limit.Rate <= 0 {
+			continue
+		}
+		if tokens := lb.bucket.refill(lb.limit, now); tokens < 1 {
+			ok = false
+			wait := time.Duration((1 - tokens) / lb.limit.Rate * float64(time.Second))
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if ok {
+		for _, lb := range limited {
+			if lb.limit.Burst > 0 && lb.limit.Rate > 0 {
+				lb.bucket.tokens--
+			}
+		}
+		return true, 0, false
+	}
+
+	if now.Sub(conn.since) >= violationWindow {
+		conn.violations = 0
+		conn.since = now
+	}
+	conn.violations++
+	return false, retryAfter, conn.violations > rl.limits.MaxViolations
+}
+
+// Disconnected removes the buckets of a connection when it is closed
+func (rl *rateLimiter) Disconnected(ws *websocket.Conn) {
+	rl.Lock()
+	defer rl.Unlock()
+	delete(rl.conns, ws)
+}
+
+// bucketsOf gets the buckets of a user or IP address, and creates them if they do not exist
+func bucketsOf(m map[string]buckets, key string) buckets {
+	b, ok := m[key]
+	if !ok {
+		b = make(buckets)
+		m[key] = b
+	}
+	return b
+}
+
+// prune removes the buckets of users and IP addresses which are full again, as they are the same as new buckets
+func (rl *rateLimiter) prune(now time.Time) {
+	rl.lastPrune = now
+	rl.pruneBuckets(rl.users, func(budget RateBudget) RateLimit { return budget.User }, now)
+	rl.pruneBuckets(rl.ips, func(budget RateBudget) RateLimit { return budget.IP }, now)
+}
+
+// pruneBuckets removes the full buckets in the map, limit gets the limit of the buckets from the budget of their class
+func (rl *rateLimiter) pruneBuckets(m map[string]buckets, limit func(RateBudget) RateLimit, now time.Time) {
+	for key, b := range m {
+		full := true
+		for class, bucket := range b {
+			classLimit := limit(rl.limits.budget(class))
+			if bucket.refill(classLimit, now) < float64(classLimit.Burst) {
+				full = false
+			}
+		}
+		if full {
+			delete(m, key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(RateLimits{
+		Other: RateBudget{
+			Connection: RateLimit{Rate: 1, Burst: 2},
+			IP:         RateLimit{Rate: 1, Burst: 3}},
+		MaxViolations: 1})
+	a, b, c := new(websocket.Conn), new(websocket.Conn), new(websocket.Conn)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := rl.Allow(a, "10.0.0.1", "", ClassOther, now); !ok {
+			t.Fatalf("Expected the burst of the connection to be allowed")
+		}
+	}
+	ok, retryAfter, disconnect := rl.Allow(a, "10.0.0.1", "", ClassOther, now)
+	if ok || disconnect {
+		t.Fatalf("Expected the connection to be limited without being disconnected")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("Expected to retry after a second, got %s", retryAfter)
+	}
+
+	// The refused message did not use up the budget of the IP address, which is shared by its connections
+	if ok, _, _ := rl.Allow(b, "10.0.0.1", "", ClassOther, now); !ok {
+		t.Fatalf("Expected another connection from the IP address to be allowed")
+	}
+	if ok, _, _ := rl.Allow(b, "10.0.0.1", "", ClassOther, now); ok {
+		t.Fatalf("Expected the budget of the IP address to be used up")
+	}
+	if ok, _, _ := rl.Allow(c, "10.0.0.2", "", ClassOther, now); !ok {
+		t.Fatalf("Expected another IP address to be allowed")
+	}
+	// Other classes of messages have their own budgets
+	if ok, _, _ := rl.Allow(a, "10.0.0.1", "", ClassChat, now); !ok {
+		t.Fatalf("Expected a class of messages without limits to be allowed")
+	}
+
+	// The buckets are refilled over time
+	now = now.Add(time.Second)
+	if ok, _, _ := rl.Allow(a, "10.0.0.1", "", ClassOther, now); !ok {
+		t.Fatalf("Expected the connection to be allowed after the bucket was refilled")
+	}
+	if _, _, disconnect := rl.Allow(a, "10.0.0.1", "", ClassOther, now); !disconnect {
+		t.Fatalf("Expected the connection to be disconnected after too many messages over the limits")
+	}
+}
+
+func TestRateLimitServer(t *testing.T) {
+	limitServer := CreateServer(Config{Keepalive: 100000, RateLimits: RateLimits{
+		Auth:          RateBudget{Connection: RateLimit{Rate: 0.01, Burst: 2}},
+		MaxViolations: 1}}, mdb.NewMemoryStore())
+	server := httptest.NewServer(limitServer.Handler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, err := dialServer(url)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", url, err)
+	}
+	defer ws.Close()
+
+	for _, username := range []string{"limituser", "limituser2"} {
+		if err := registerUser(ws, username, util.MarshalPublic(pubkey)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The client is told to slow down, and then disconnected if it does not
+	for _, details := range []bool{true, false} {
+		websock.Send(ws, &websock.Message{Type: websock.RegisterUser, Message: &websock.RegisterUserMessage{
+			Username:  "limituser3",
+			PublicKey: util.MarshalPublic(pubkey)}})
+		msg, err := receiveMessage(ws, websock.Error)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errMsg := msg.Message.(*websock.ErrorMessage)
+		if errMsg.Code != websock.CodeRateLimited {
+			t.Fatalf("Expected the client to be rate limited, got %s: %s", errMsg.Code, errMsg.Message)
+		}
+		if details && errMsg.Details["retryAfter"] != "100" {
+			t.Fatalf("Expected to retry after 100 seconds, got %v", errMsg.Details)
+		}
+	}
+	if msg := new(websock.Message); websock.Receive(ws, msg) == nil {
+		t.Fatalf("Expected the connection to be closed, got %s", msg.Type)
+	}
+}
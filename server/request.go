@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// Requests is a threadsafe map of the ID of the request every connection is handling. A connection handles the
+// messages it receives one at a time, so every response sent to it while a message is handled is a response to
+// that message
+type Requests struct {
+	sync.Mutex
+	ids map[*websocket.Conn]string
+}
+
+// Start is called when a connection receives a message, the responses sent with reply until the next
+// message is received get the ID of the message
+func (requests *Requests) Start(ws *websocket.Conn, msg *websock.Message) {
+	requests.Lock()
+	defer requests.Unlock()
+	if msg.ID == "" {
+		delete(requests.ids, ws)
+	} else {
+		requests.ids[ws] = msg.ID
+	}
+}
+
+// End is called when a connection is closed
+func (requests *Requests) End(ws *websocket.Conn) {
+	requests.Lock()
+	defer requests.Unlock()
+	delete(requests.ids, ws)
+}
+
+// ID gets the ID of the request a connection is handling, which is empty if the request has no ID
+func (requests *Requests) ID(ws *websocket.Conn) string {
+	requests.Lock()
+	defer requests.Unlock()
+	return requests.ids[ws]
+}
+
+// reply sends a response (such as OK or Error) to the message the connection is handling, with the ID of the
+// message, so the client can match the response with its request. Messages which are not responses, such as
+// chat events, are sent with websock.Send
+func (s *Server) reply(ws *websocket.Conn, msg *websock.Message) error {
+	msg.ID = s.Requests.ID(ws)
+	return websock.Send(ws, msg)
+}
+
+// replyError sends an error response with the code and message to the message the connection is handling, see reply
+func (s *Server) replyError(ws *websocket.Conn, code websock.ErrorCode, message string) error {
+	return s.replyErrorDetails(ws, code, message, nil)
+}
+
+// replyErrorDetails sends an error response with details about the error, see websock.ErrorMessage
+func (s *Server) replyErrorDetails(ws *websocket.Conn, code websock.ErrorCode, message string, details map[string]string) error {
+	return s.reply(ws, &websock.Message{Type: websock.Error, Message: &websock.ErrorMessage{
+		Code:    code,
+		Message: message,
+		Details: details}})
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+func TestRequestIDs(t *testing.T) {
+	ws, err := setupTestUser("requestuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// The responses to a request have the ID of the request
+	websock.Send(ws, &websock.Message{ID: "1", Type: websock.CreateChatRoom, Message: &websock.CreateChatRoomMessage{Name: "requestroom"}})
+	msg, err := receiveMessage(ws, websock.OK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "1" {
+		t.Fatalf("Expected the ID of the request on OK, got %q", msg.ID)
+	}
+
+	websock.Send(ws, &websock.Message{ID: "2", Type: websock.CreateChatRoom, Message: &websock.CreateChatRoomMessage{Name: "requestroom"}})
+	if msg, err = receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "2" {
+		t.Fatalf("Expected the ID of the request on Error, got %q", msg.ID)
+	}
+
+	websock.Send(ws, &websock.Message{ID: "3", Type: websock.GetChatRooms})
+	if msg, err = receiveMessage(ws, websock.GetChatRoomsResponse); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "3" {
+		t.Fatalf("Expected the ID of the request on the response, got %q", msg.ID)
+	}
+
+	// Chat events are not responses
+	websock.Send(ws, &websock.Message{ID: "4", Type: websock.JoinChat, Message: &websock.JoinChatMessage{Name: "requestroom"}})
+	if msg, err = receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "4" {
+		t.Fatalf("Expected the ID of the request on OK, got %q", msg.ID)
+	}
+	if msg, err = receiveMessage(ws, websock.ChatInfo); err != nil {
+		t.Fatal(err)
+	}
+	chatMsg, err := encryptTestMessage(msg.Message.(*websock.ChatInfoMessage).Users, "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatMsg.ChatName = "requestroom"
+	websock.Send(ws, &websock.Message{ID: "5", Type: websock.SendChat, Message: chatMsg})
+	if msg, err = receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "5" {
+		t.Fatalf("Expected the ID of the request on OK, got %q", msg.ID)
+	}
+	if msg, err = receiveMessage(ws, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "" {
+		t.Fatalf("Expected chat events to have no ID, got %q", msg.ID)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer ws.Close()
+
+	// expectError receives a response and checks that it is an error with the code
+	expectError := func(code websock.ErrorCode) *websock.ErrorMessage {
+		msg, err := receiveMessage(ws, websock.Error)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errMsg, ok := msg.Message.(*websock.ErrorMessage)
+		if !ok {
+			t.Fatalf("Expected the error to have a code, got %v", msg.Message)
+		}
+		if errMsg.Code != code {
+			t.Fatalf("Expected error code %s, got %s: %s", code, errMsg.Code, errMsg.Message)
+		}
+		return errMsg
+	}
+
+	websock.Send(ws, &websock.Message{Type: websock.LoginUser, Message: &websock.LoginUserMessage{
+		Username:    "nosuchuser",
+		AuthVersion: websock.AuthVersionSignature}})
+	expectError(websock.CodeUserNotFound)
+
+	websock.Send(ws, &websock.Message{Type: websock.RegisterUser, Message: &websock.RegisterUserMessage{
+		Username:  "a",
+		PublicKey: util.MarshalPublic(pubkey)}})
+	if errMsg := expectError(websock.CodeInvalidMessage); errMsg.Details["field"] != "Username" {
+		t.Fatalf("Expected the invalid field in the details, got %v", errMsg.Details)
+	}
+
+	if err := registerUser(ws, "errorcodeuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.RegisterUser, Message: &websock.RegisterUserMessage{
+		Username:  "errorcodeuser",
+		PublicKey: util.MarshalPublic(pubkey)}})
+	expectError(websock.CodeUserExists)
+}
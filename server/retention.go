@@ -0,0 +1,216 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// senderKeyMaxAge is how long a sender key which has not been received is kept when the chat messages are kept
+// longer, the device it was distributed to can not decrypt the messages encrypted with it after that
+const senderKeyMaxAge = 30 * 24 * time.Hour
+
+// StartRetention starts purging old chat messages every RetentionInterval seconds. If RetentionTTL is set,
+// the store is asked to delete messages by itself when they are too old, this requires a store which
+// implements mdb.MessageExpirer. The purging still runs, to enforce the maximum number of messages
+// and changes to the retention policies
+func (s *Server) StartRetention() *time.Ticker {
+	if s.RetentionTTL {
+		if expirer, ok := s.Db.(mdb.MessageExpirer); !ok {
+			log.Print("The store does not support expiring messages, old messages are only purged periodically")
+		} else if err := expirer.EnsureMessageExpiry(); err != nil {
+			log.Printf("Unable to enable expiring messages: %s", err)
+		} else {
+			s.messageExpiry = true
+			s.updateAllMessageExpiry()
+		}
+	}
+
+	if s.RetentionInterval <= 0 {
+		log.Print("Retention interval is not set, old messages will not be purged periodically")
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Duration(s.RetentionInterval) * time.Second)
+	go func() {
+		for range ticker.C {
+			s.PurgeMessages()
+		}
+	}()
+	return ticker
+}
+
+// retentionPolicy gets the retention policy of a chat room, the server default made stricter by the chat room
+func (s *Server) retentionPolicy(chat *mdb.Chat) mdb.RetentionPolicy {
+	return s.Retention.Override(chat.Retention)
+}
+
+// chatRetentionPolicy gets the retention policy of a chat room or direct conversation by name. Direct
+// conversations always use the server default
+func (s *Server) chatRetentionPolicy(chatName string) (mdb.RetentionPolicy, error) {
+	if websock.IsDirectChatName(chatName) {
+		return s.Retention, nil
+	}
+	chat, err := s.Db.FindChat(chatName)
+	if err != nil {
+		return mdb.RetentionPolicy{}, err
+	}
+	return s.retentionPolicy(chat), nil
+}
+
+// messageExpiresAt gets the time a new chat message should be deleted by the store, or the zero time if
+// the store does not delete messages by itself or the chat room has no maximum age
+func (s *Server) messageExpiresAt(chatName string, timestamp int64) time.Time {
+	if !s.messageExpiry {
+		return time.Time{}
+	}
+	policy, err := s.chatRetentionPolicy(chatName)
+	if err != nil {
+		log.Println(err)
+		return time.Time{}
+	}
+
+	if policy.MaxAge == 0 {
+		return time.Time{}
+	}
+	return util.MillisToTime(timestamp).Add(policy.MaxAge)
+}
+
+// updateMessageExpiry recomputes the time the store deletes the chat messages of a chat room or direct conversation
+// by itself, after the retention policy has changed
+func (s *Server) updateMessageExpiry(chatName string, policy mdb.RetentionPolicy) {
+	if !s.messageExpiry {
+		return
+	}
+	if err := s.Db.(mdb.MessageExpirer).UpdateMessageExpiry(chatName, policy.MaxAge); err != nil {
+		log.Println(err)
+	}
+}
+
+// updateAllMessageExpiry recomputes the time the store deletes the chat messages of every chat room and direct
+// conversation by itself, as the server default may have changed since the messages were stored
+func (s *Server) updateAllMessageExpiry() {
+	chats, err := s.Db.FindAllChats()
+	if err != nil {
+		log.Println(err)
+	}
+	convs, err := s.Db.FindAllConversations()
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, chat := range chats {
+		s.updateMessageExpiry(chat.Name, s.retentionPolicy(chat))
+	}
+	for _, conv := range convs {
+		s.updateMessageExpiry(conv.Name, s.Retention)
+	}
+}
+
+// PurgeMessages deletes the chat messages which are too old, or exceed the maximum number of messages,
+// according to the retention policy of every chat room and direct conversation. Returns the number of
+// deleted messages
+func (s *Server) PurgeMessages() int {
+	chats, err := s.Db.FindAllChats()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	convs, err := s.Db.FindAllConversations()
+	if err != nil {
+		log.Println(err)
+	}
+
+	total := 0
+	for _, chat := range chats {
+		total += s.purgeChat(chat.Name, s.retentionPolicy(chat))
+	}
+	for _, conv := range convs {
+		total += s.purgeChat(conv.Name, s.Retention)
+	}
+
+	if total != 0 {
+		log.Printf("Purged %d old messages from %d chat rooms and %d conversations", total, len(chats), len(convs))
+	}
+	return total
+}
+
+// purgeChat deletes the chat messages of a single chat room or direct conversation according to the
+// retention policy. Returns the number of deleted messages. The sender keys which have not been received are
+// deleted once every message they can have encrypted is too old, as a sender key is used for at most
+// websock.SenderKeyLifetime, and at the latest when they are older than senderKeyMaxAge
+func (s *Server) purgeChat(chatName string, policy mdb.RetentionPolicy) int {
+	deleted := 0
+	now := util.NowMillis()
+	keysBefore := now - int64(senderKeyMaxAge/time.Millisecond)
+
+	if policy.MaxAge > 0 {
+		before := now - int64(policy.MaxAge/time.Millisecond)
+		n, err := s.Db.DeleteMessagesBefore(chatName, before)
+		if err != nil {
+			log.Println(err)
+		}
+		deleted += n
+
+		if unused := before - int64(websock.SenderKeyLifetime/time.Millisecond); unused > keysBefore {
+			keysBefore = unused
+		}
+	}
+	if policy.MaxMessages > 0 {
+		n, err := s.Db.DeleteOldestMessages(chatName, policy.MaxMessages)
+		if err != nil {
+			log.Println(err)
+		}
+		deleted += n
+	}
+
+	if _, err := s.Db.DeleteSenderKeysBefore(chatName, keysBefore); err != nil {
+		log.Println(err)
+	}
+	return deleted
+}
+
+// SetRetention changes the retention policy of a chat room, the policy cannot be less strict than the server default
+func (s *Server) SetRetention(ws *websocket.Conn, msg *websock.SetRetentionMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+	s.chatLock.Lock()
+	defer s.chatLock.Unlock()
+
+	chat, ok := s.chatForAdmin(ws, user, msg.ChatName, true)
+	if !ok {
+		return
+	}
+
+	if msg.UseDefault {
+		chat.Retention = nil
+	} else {
+		policy := mdb.RetentionPolicy{MaxAge: msg.MaxAge, MaxMessages: msg.MaxMessages}
+		if policy.MaxAge < 0 || policy.MaxMessages < 0 {
+			s.replyError(ws, websock.CodeInvalidMessage, "Invalid retention policy")
+			return
+		} else if !s.Retention.Allows(policy) {
+			s.replyError(ws, websock.CodeInvalidMessage, "Messages cannot be kept longer than the server allows")
+			return
+		}
+		chat.Retention = &policy
+	}
+
+	if err := s.Db.UpdateChat(chat); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error changing retention policy")
+		return
+	}
+	s.updateMessageExpiry(chat.Name, s.retentionPolicy(chat))
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Retention policy changed"})
+}
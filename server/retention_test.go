@@ -0,0 +1,123 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+func TestPurgeMessages(t *testing.T) {
+	s := CreateServer(Config{Retention: mdb.RetentionPolicy{MaxAge: time.Hour}}, mdb.NewMemoryStore())
+
+	// The second chat room only keeps two messages
+	for _, name := range []string{"purgeA", "purgeB"} {
+		chat, err := mdb.NewChat(name, "", false, "purgeowner")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "purgeB" {
+			chat.Retention = &mdb.RetentionPolicy{MaxMessages: 2}
+		}
+		if err := s.Db.InsertChat(chat); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := util.NowMillis()
+	old := now - int64(2*time.Hour/time.Millisecond)
+	timestamps := map[string][]int64{
+		"purgeA": {old, now - 2, now - 1},
+		"purgeB": {old, now - 4, now - 3, now - 2, now - 1}}
+	for chatName, chatTimestamps := range timestamps {
+		for _, timestamp := range chatTimestamps {
+			msg := mdb.NewMessage(chatName, timestamp, "purgeowner", websock.MessageVersionHybrid, []byte("ciphertext"), nil)
+			msg.MessageContent = append(msg.MessageContent, mdb.MessageContent{Recipient: "purgeowner", Content: []byte("key")})
+			if err := s.Db.InsertMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if deleted := s.PurgeMessages(); deleted != 4 {
+		t.Fatalf("Expected 4 messages to be purged, purged %d", deleted)
+	}
+
+	for chatName, expected := range map[string][]int64{"purgeA": {now - 2, now - 1}, "purgeB": {now - 2, now - 1}} {
+		messages, err := s.Db.FindMessagesForUser("purgeowner", chatName, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != len(expected) {
+			t.Fatalf("Expected %d messages in %s, got %d", len(expected), chatName, len(messages))
+		}
+		for i, msg := range messages {
+			if msg.Timestamp != expected[i] {
+				t.Fatalf("Expected the newest messages to be kept in %s", chatName)
+			}
+		}
+	}
+}
+
+func TestSetRetention(t *testing.T) {
+	owner, member := setupTestRoom(t, "retentionroom", "retentionowner", "retentionmember")
+	defer owner.Close()
+	defer member.Close()
+
+	req := &websock.SetRetentionMessage{ChatName: "retentionroom", MaxAge: 24 * time.Hour, MaxMessages: 100}
+
+	// Only the owner can change the retention policy
+	if err := websock.Send(member, &websock.Message{Type: websock.SetRetention, Message: req}); err != nil {
+		t.Fatalf("Unable to send set retention request: %s", err)
+	}
+	if _, err := receiveMessage(member, websock.Error); err != nil {
+		t.Fatalf("Expected an error when a member changes the retention policy: %s", err)
+	}
+
+	if err := websock.Send(owner, &websock.Message{Type: websock.SetRetention, Message: req}); err != nil {
+		t.Fatalf("Unable to send set retention request: %s", err)
+	}
+	if _, err := receiveMessage(owner, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	chat, err := testserver.Db.FindChat("retentionroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Retention == nil || chat.Retention.MaxAge != req.MaxAge || chat.Retention.MaxMessages != req.MaxMessages {
+		t.Fatalf("Expected the retention policy of the chat room to be stored")
+	}
+}
+
+func TestPurgeSenderKeys(t *testing.T) {
+	// Messages are kept forever, but sender keys which are never received are still purged
+	s := CreateServer(Config{}, mdb.NewMemoryStore())
+
+	chat, err := mdb.NewChat("purgekeys", "", false, "purgeowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Db.InsertChat(chat); err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := mdb.NewSenderKey("purgekeys", "purgeowner", "", "oldkey", "purgemember", []byte("key"))
+	oldKey.Timestamp -= int64((senderKeyMaxAge + time.Hour) / time.Millisecond)
+	newKey := mdb.NewSenderKey("purgekeys", "purgeowner", "", "newkey", "purgemember", []byte("key"))
+	if err := s.Db.InsertSenderKeys(oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	s.PurgeMessages()
+
+	keys, err := s.Db.FindSenderKeys("purgemember", "purgekeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != "newkey" {
+		t.Fatalf("Expected only the old sender key to be purged")
+	}
+}
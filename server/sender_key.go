@@ -0,0 +1,122 @@
+package server
+
+import (
+	"log"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// SendSenderKey stores a sender key distributed by a client in a chat room or direct conversation, and sends it to
+// the clients in the chat room which are logged in from a device it was encrypted for. The key can only be distributed
+// to the members of the chat room, and is kept until each recipient has acknowledged it. The key is sent to the
+// clients before the client is answered, so they receive it before the chat messages encrypted with it
+func (s *Server) SendSenderKey(ws *websocket.Conn, msg *websock.SendSenderKeyMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	members := s.chatMembers(msg.ChatName)
+	if !members[user.Username] {
+		s.replyError(ws, websock.CodeNotMember, "You are not a member of this chat room")
+		return
+	}
+
+	keys := make([]*mdb.SenderKey, 0, len(msg.EncryptedKeys))
+	for recipient, key := range msg.EncryptedKeys {
+		if members[websock.RecipientUsername(recipient)] {
+			keys = append(keys, mdb.NewSenderKey(msg.ChatName, user.Username, user.DeviceID, msg.KeyID, recipient, key))
+		}
+	}
+	if len(keys) == 0 {
+		s.replyError(ws, websock.CodeInvalidMessage, "Sender key has no recipients in this chat room")
+		return
+	}
+	if err := s.Db.InsertSenderKeys(keys...); err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error storing sender key")
+		return
+	}
+
+	received := make(map[*websocket.Conn]*websock.SenderKeyMessage)
+	s.Users.ForEachInChat(msg.ChatName, func(client *websocket.Conn, recipient *User) {
+		if key, ok := msg.EncryptedKeys[recipient.Recipient()]; ok && client != ws {
+			received[client] = &websock.SenderKeyMessage{
+				ChatName:     msg.ChatName,
+				Sender:       user.Username,
+				SenderDevice: user.DeviceID,
+				KeyID:        msg.KeyID,
+				Key:          key}
+		}
+	})
+	for client, key := range received {
+		websock.Send(client, &websock.Message{Type: websock.SenderKeyReceived, Message: key})
+	}
+
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Sender key sent"})
+}
+
+// AckSenderKeys deletes the sender keys a client has received, so they can not be decrypted with a key leaked later.
+// The client is not answered
+func (s *Server) AckSenderKeys(ws *websocket.Conn, msg *websock.AckSenderKeysMessage) {
+	user, ok := s.Users.Get(ws)
+	if !ok || user == nil {
+		log.Print("Websocket was not associated with a user")
+		return
+	}
+	user.Lock()
+	defer user.Unlock()
+
+	if err := s.Db.DeleteSenderKeys(user.Recipient(), msg.ChatName, msg.KeyIDs); err != nil {
+		log.Println(err)
+	}
+}
+
+// pendingSenderKeys gets the sender keys in a chat room which have been distributed to the device of the user,
+// and which the user has not acknowledged
+func (s *Server) pendingSenderKeys(user *User, chatName string) []*websock.SenderKeyMessage {
+	keys, err := s.Db.FindSenderKeys(user.Recipient(), chatName)
+	if err != nil {
+		log.Println(err)
+	}
+
+	pending := make([]*websock.SenderKeyMessage, 0, len(keys))
+	for _, key := range keys {
+		pending = append(pending, &websock.SenderKeyMessage{
+			ChatName:     key.ChatName,
+			Sender:       key.Sender,
+			SenderDevice: key.SenderDevice,
+			KeyID:        key.KeyID,
+			Key:          key.Key})
+	}
+	return pending
+}
+
+// chatMembers gets the usernames of the members of a chat room, or the users in a direct conversation
+func (s *Server) chatMembers(chatName string) map[string]bool {
+	members := make(map[string]bool)
+	if websock.IsDirectChatName(chatName) {
+		conv, err := s.Db.FindConversation(chatName)
+		if err != nil {
+			return members
+		}
+		for _, participant := range conv.Participants {
+			members[participant.Username] = true
+		}
+		return members
+	}
+
+	memberships, err := s.Db.FindMemberships(chatName)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, member := range memberships {
+		members[member.Username] = true
+	}
+	return members
+}
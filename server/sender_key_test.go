@@ -0,0 +1,134 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+)
+
+func TestSenderKeys(t *testing.T) {
+	ws, err := setupTestUser("senderkeyuser", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, err := joinTestRoom(ws, "senderkeyroom"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := setupTestUser("senderkeyother", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := joinExistingRoom(other, "senderkeyroom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := util.NewSenderChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := util.NewSenderKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, err := util.WrapKey(spubkey, chain.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender key ID must be valid
+	websock.Send(ws, &websock.Message{Type: websock.SendSenderKey, Message: &websock.SendSenderKeyMessage{
+		ChatName:      "senderkeyroom",
+		KeyID:         "invalid",
+		EncryptedKeys: map[string][]byte{"senderkeyother": encKey}}})
+	if _, err := receiveMessage(ws, websock.Error); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is sent to the members in the chat room before the sender is answered
+	websock.Send(ws, &websock.Message{Type: websock.SendSenderKey, Message: &websock.SendSenderKeyMessage{
+		ChatName:      "senderkeyroom",
+		KeyID:         keyID,
+		EncryptedKeys: map[string][]byte{"senderkeyother": encKey, "notamember": encKey}}})
+	msg, err := receiveMessage(other, websock.SenderKeyReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderKey := msg.Message.(*websock.SenderKeyMessage)
+	if senderKey.Sender != "senderkeyuser" || senderKey.KeyID != keyID {
+		t.Fatalf("Expected the sender key %s of senderkeyuser", keyID)
+	}
+	chainKey, err := util.UnwrapKey(sprikey, senderKey.Key)
+	if err != nil {
+		t.Fatalf("Unable to decrypt sender key: %s", err)
+	}
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+
+	// A chat message is encrypted with the next message key of the sender key
+	messageKey, iteration := chain.Next()
+	ciphertext, err := util.EncryptMessageWithKey([]byte("ratcheted"), messageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	websock.Send(ws, &websock.Message{Type: websock.SendChat, Message: &websock.SendChatMessage{
+		ChatName:         "senderkeyroom",
+		Version:          websock.MessageVersionSenderKey,
+		Ciphertext:       ciphertext,
+		EncryptedContent: map[string][]byte{"senderkeyuser": nil, "senderkeyother": nil},
+		SenderKeyID:      keyID,
+		Iteration:        iteration}})
+	if _, err := receiveMessage(ws, websock.OK); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = receiveMessage(other, websock.ChatMessageReceived); err != nil {
+		t.Fatal(err)
+	}
+	chatMessage := msg.Message.(*websock.ChatMessage)
+	received, err := util.SenderChainFromKey(chainKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageKey, err = received.MessageKey(chatMessage.Iteration); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := util.DecryptMessage(chatMessage.Ciphertext, messageKey); err != nil || string(plaintext) != "ratcheted" {
+		t.Fatalf("Unable to decrypt the message with the sender key: %v", err)
+	}
+	if _, err := received.MessageKey(chatMessage.Iteration); err == nil {
+		t.Fatalf("Expected a message key to be usable only once")
+	}
+
+	// The sender key is kept until it has been acknowledged
+	rejoin := func() *websock.ChatInfoMessage {
+		websock.Send(other, &websock.Message{Type: websock.LeaveChat, Message: "senderkeyroom"})
+		if _, err := receiveMessage(other, websock.UserLeft); err != nil {
+			t.Fatal(err)
+		}
+		chatInfo, err := joinExistingRoom(other, "senderkeyroom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chatInfo
+	}
+	chatInfo := rejoin()
+	if len(chatInfo.SenderKeys) != 1 || chatInfo.SenderKeys[0].KeyID != keyID {
+		t.Fatalf("Expected the sender key in the chat info")
+	}
+	if len(chatInfo.Messages) != 1 || chatInfo.Messages[0].SenderKeyID != keyID {
+		t.Fatalf("Expected the chat message encrypted with the sender key in the chat info")
+	}
+
+	websock.Send(other, &websock.Message{Type: websock.AckSenderKeys, Message: &websock.AckSenderKeysMessage{
+		ChatName: "senderkeyroom",
+		KeyIDs:   []string{keyID}}})
+	if chatInfo = rejoin(); len(chatInfo.SenderKeys) != 0 {
+		t.Fatalf("Expected the acknowledged sender key to be deleted")
+	}
+}
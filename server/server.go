@@ -1,7 +1,10 @@
 package server
 
 import (
+	"crypto/rand"
 	"log"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -10,33 +13,90 @@ import (
 	"golang.org/x/net/websocket"
 )
 
-// Config describes the server configuration, where the listening port,
-// name of the mongoDB database used by the server, and the mongoDB address
+// Config describes the server configuration, such as the keepalive interval in seconds
+//
+// Retention is the default retention policy of chat messages, which chat rooms can make stricter.
+// RetentionInterval is how often (in seconds) old chat messages are purged. If RetentionTTL is set
+// and the store supports it, the store also deletes messages by itself as soon as they are too old.
+// Host is the host name clients use to connect to the server, which they sign when logging in.
+// If it is not set, the Host header of the websocket request is used. InviteSecret is the key
+// invite tokens are signed with, a random key is used if it is not set, so invites only work until
+// the server is restarted. LoginPolicy decides what happens when a user who is already logged in logs in again.
+// RateLimits limits the messages clients can send, the zero value does not limit anything
 type Config struct {
-	DBName    string
-	MongoURL  string
-	Keepalive int
+	Keepalive         int
+	Host              string
+	InviteSecret      []byte
+	LoginPolicy       LoginPolicy
+	Retention         mdb.RetentionPolicy
+	RetentionInterval int
+	RetentionTTL      bool
+	RateLimits        RateLimits
 }
 
+// LoginPolicy is the policy for users logging in while they are logged in on another connection
+type LoginPolicy int
+
+const (
+	// LoginAllowMultiple lets a user be logged in on several connections at once, every connection
+	// is a separate session of the user
+	LoginAllowMultiple LoginPolicy = iota
+	// LoginRejectNew refuses to log in a user who is already logged in
+	LoginRejectNew
+	// LoginKickOld logs out the other connections of a user who logs in
+	LoginKickOld
+)
+
 // Server contains the context of the chat engine server
 type Server struct {
 	Config
-	Db    *mdb.Database
-	Users Users
+	Db       mdb.Store
+	Users    Users
+	Sessions Sessions
+	Requests Requests
+
+	// chatLock is held while a chat room is read, modified and written back to
+	// the store, so concurrent changes to the same chat room are not lost
+	chatLock sync.Mutex
+
+	// loginLock is held while the login policy is checked and the client is added, so two
+	// connections logging in as the same user at once are handled one after the other
+	loginLock sync.Mutex
+
+	// userLock is held while a user is read, modified and written back to the store,
+	// so concurrent changes to the devices of a user are not lost
+	userLock sync.Mutex
+
+	// messageExpiry is set when the store deletes expired messages by itself
+	messageExpiry bool
+
+	// passwordThrottle limits the failed password attempts for every chat room from every IP address
+	passwordThrottle *passwordThrottle
+
+	// rateLimiter limits the messages of every connection, user and IP address
+	rateLimiter *rateLimiter
 }
 
-// CreateServer creates a new instance of the server using the config
-func CreateServer(config Config) *Server {
-	// Connect to the database
-	db, err := mdb.CreateConnection(config.MongoURL, config.DBName)
-	if err != nil {
-		log.Fatal(err)
+// CreateServer creates a new instance of the server using the config. The store can
+// either be a connection to mongoDB (mdb.Database) or an in-memory store (mdb.MemoryStore)
+func CreateServer(config Config, db mdb.Store) *Server {
+	s := &Server{
+		Config:   config,
+		Db:       db,
+		Users:    Users{data: make(map[*websocket.Conn]*User, 0)},
+		Sessions: Sessions{data: make(map[string]*session)},
+		Requests: Requests{ids: make(map[*websocket.Conn]string)},
+
+		passwordThrottle: newPasswordThrottle(),
+		rateLimiter:      newRateLimiter(config.RateLimits),
 	}
 
-	s := &Server{
-		Config: config,
-		Db:     db,
-		Users:  Users{data: make(map[*websocket.Conn]*User, 0)},
+	if len(s.InviteSecret) == 0 {
+		log.Print("Invite secret is not set, invites will not be valid after the server is restarted")
+		s.InviteSecret = make([]byte, inviteSecretLen)
+		if _, err := rand.Read(s.InviteSecret); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	return s
@@ -49,8 +109,10 @@ func (s *Server) AddClient(ws *websocket.Conn, user *User) {
 	}
 }
 
-// RemoveClient removes a client from the ConnectedClients map
+// RemoveClient removes a client from the ConnectedClients map, and notifies the chat rooms the client was in
 func (s *Server) RemoveClient(ws *websocket.Conn) {
+	chatRooms := s.Users.ChatRooms(ws)
+
 	user, ok := s.Users.Remove(ws)
 	if !ok {
 		log.Print("Websocket was not in users-map")
@@ -58,17 +120,30 @@ func (s *Server) RemoveClient(ws *websocket.Conn) {
 	}
 	if user == nil {
 		log.Print("Websocket was not associated with a user")
-	} else {
-		user.Lock()
-		defer user.Unlock()
-		if user.ChatRoom != "" {
-			s.ClientLeftChat(ws)
-		} else {
-			log.Print("User was not associated with a chatroom")
-		}
+		return
+	}
+
+	// The session can be resumed on a new connection, if the client logged in with a resumable session
+	s.Sessions.Disconnected(ws, chatRooms, time.Now())
+
+	user.Lock()
+	username, sessionID := user.Username, user.SessionID
+	user.Unlock()
+
+	if len(chatRooms) == 0 {
+		log.Print("User was not associated with a chatroom")
+	}
+	for _, chatName := range chatRooms {
+		go s.NotifyUserLeft(username, sessionID, chatName, false)
 	}
 }
 
+// Handler gets the HTTP handler of the server websocket. The codec of every connection is chosen
+// from the websocket subprotocols the client requests
+func (s *Server) Handler() http.Handler {
+	return websocket.Server{Handshake: websock.Handshake, Handler: s.WebsockHandler}
+}
+
 // WebsockHandler is the handler for the server websocket when a client initially connects.
 // It handles messages from an unauthenticated client.
 func (s *Server) WebsockHandler(ws *websocket.Conn) {
@@ -77,8 +152,8 @@ func (s *Server) WebsockHandler(ws *websocket.Conn) {
 
 	pinger, pongCount := s.Pinger(ws)
 
-	// Enter unauthenticated message loop
-	if s.NoAuthHandler(ws, pongCount) {
+	// Check that the client is compatible, then enter unauthenticated message loop
+	if s.HelloHandler(ws, pongCount) && s.NoAuthHandler(ws, pongCount) {
 		// Enter authenticated message loop
 		s.AuthedHandler(ws, pongCount)
 	}
@@ -86,6 +161,8 @@ func (s *Server) WebsockHandler(ws *websocket.Conn) {
 	pinger.Stop()
 	ws.Close()
 	s.RemoveClient(ws)
+	s.Requests.End(ws)
+	s.rateLimiter.Disconnected(ws)
 	log.Printf("Client disconnected: %s. Total connected: %d\n", ws.Request().RemoteAddr, s.Users.Len())
 }
 
@@ -100,15 +177,28 @@ func (s *Server) NoAuthHandler(ws *websocket.Conn, pongCount *int64) bool {
 			log.Println(err)
 			return false
 		}
+		s.Requests.Start(ws, msg)
+		if !s.rateLimit(ws, msg.Type) {
+			continue
+		}
 
 		// Check message type and forward to appropriate handlers
 		switch msg.Type {
 		case websock.RegisterUser:
-			if ValidateRegisterUser(ws, msg.Message.(*websock.RegisterUserMessage)) {
+			if s.ValidateRegisterUser(ws, msg.Message.(*websock.RegisterUserMessage)) {
 				s.RegisterUser(ws, msg.Message.(*websock.RegisterUserMessage))
 			}
 		case websock.LoginUser:
-			if s.LoginUser(ws, msg.Message.(string)) {
+			// Older clients send the username as a string, and only support the PKCS#1 v1.5 auth challenge
+			loginMsg, ok := msg.Message.(*websock.LoginUserMessage)
+			if !ok {
+				loginMsg = &websock.LoginUserMessage{Username: msg.Message.(string), AuthVersion: websock.AuthVersionPKCS1}
+			}
+			if s.LoginUser(ws, loginMsg) {
+				return true
+			}
+		case websock.ResumeSession:
+			if s.ResumeSession(ws, msg.Message.(*websock.ResumeSessionMessage)) {
 				return true
 			}
 		case websock.Pong:
@@ -127,10 +217,14 @@ func (s *Server) AuthedHandler(ws *websocket.Conn, pongCount *int64) {
 			log.Println(err)
 			break
 		}
+		s.Requests.Start(ws, msg)
+		if !s.rateLimit(ws, msg.Type) {
+			continue
+		}
 
 		switch msg.Type {
 		case websock.CreateChatRoom:
-			if ValidateCreateChatRoom(ws, msg.Message.(*websock.CreateChatRoomMessage)) {
+			if s.ValidateCreateChatRoom(ws, msg.Message.(*websock.CreateChatRoomMessage)) {
 				s.CreateChatRoom(ws, msg.Message.(*websock.CreateChatRoomMessage))
 			}
 		case websock.GetChatRooms:
@@ -138,9 +232,74 @@ func (s *Server) AuthedHandler(ws *websocket.Conn, pongCount *int64) {
 		case websock.JoinChat:
 			s.JoinChat(ws, msg.Message.(*websock.JoinChatMessage))
 		case websock.SendChat:
-			s.ReceiveChatMessage(ws, msg.Message.(*websock.SendChatMessage))
+			if s.ValidateSendChatMessage(ws, msg.Message.(*websock.SendChatMessage)) {
+				s.ReceiveChatMessage(ws, msg.Message.(*websock.SendChatMessage))
+			}
 		case websock.LeaveChat:
-			s.ClientLeftChat(ws)
+			// Older clients do not name the chat room, which means leaving every chat room
+			if chatName, ok := msg.Message.(string); ok {
+				s.ClientLeftChat(ws, chatName)
+			} else {
+				for _, chatName := range s.Users.ChatRooms(ws) {
+					s.ClientLeftChat(ws, chatName)
+				}
+			}
+		case websock.RenameChatRoom:
+			if s.ValidateRenameChatRoom(ws, msg.Message.(*websock.RenameChatRoomMessage)) {
+				s.RenameChatRoom(ws, msg.Message.(*websock.RenameChatRoomMessage))
+			}
+		case websock.DeleteChatRoom:
+			s.DeleteChatRoom(ws, msg.Message.(string))
+		case websock.ChangeChatPassword:
+			if s.ValidateChangeChatPassword(ws, msg.Message.(*websock.ChangeChatPasswordMessage)) {
+				s.ChangeChatPassword(ws, msg.Message.(*websock.ChangeChatPasswordMessage))
+			}
+		case websock.SetModerator:
+			s.SetModerator(ws, msg.Message.(*websock.SetModeratorMessage))
+		case websock.KickUser:
+			s.RemoveUserFromChat(ws, msg.Message.(*websock.ModerateUserMessage), false)
+		case websock.BanUser:
+			s.RemoveUserFromChat(ws, msg.Message.(*websock.ModerateUserMessage), true)
+		case websock.OpenDirect:
+			s.OpenDirect(ws, msg.Message.(string))
+		case websock.GetDirects:
+			s.GetDirects(ws)
+		case websock.SendDirect:
+			if s.ValidateSendChatMessage(ws, msg.Message.(*websock.SendChatMessage)) {
+				s.SendDirect(ws, msg.Message.(*websock.SendChatMessage))
+			}
+		case websock.CreateInvite:
+			if s.ValidateCreateInvite(ws, msg.Message.(*websock.CreateInviteMessage)) {
+				s.CreateInvite(ws, msg.Message.(*websock.CreateInviteMessage))
+			}
+		case websock.RevokeInvite:
+			s.RevokeInvite(ws, msg.Message.(string))
+		case websock.GetInvite:
+			s.GetInvite(ws, msg.Message.(string))
+		case websock.GetHistory:
+			if s.ValidateGetHistory(ws, msg.Message.(*websock.GetHistoryMessage)) {
+				s.GetHistory(ws, msg.Message.(*websock.GetHistoryMessage))
+			}
+		case websock.SetRetention:
+			s.SetRetention(ws, msg.Message.(*websock.SetRetentionMessage))
+		case websock.AddDevice:
+			if s.ValidateAddDevice(ws, msg.Message.(*websock.AddDeviceMessage)) {
+				s.AddDevice(ws, msg.Message.(*websock.AddDeviceMessage))
+			}
+		case websock.GetDevices:
+			s.GetDevices(ws)
+		case websock.RevokeDevice:
+			s.RevokeDevice(ws, msg.Message.(string))
+		case websock.RotateKey:
+			if s.ValidateRotateKey(ws, msg.Message.(*websock.RotateKeyMessage)) {
+				s.RotateKey(ws, msg.Message.(*websock.RotateKeyMessage))
+			}
+		case websock.SendSenderKey:
+			if s.ValidateSendSenderKey(ws, msg.Message.(*websock.SendSenderKeyMessage)) {
+				s.SendSenderKey(ws, msg.Message.(*websock.SendSenderKeyMessage))
+			}
+		case websock.AckSenderKeys:
+			s.AckSenderKeys(ws, msg.Message.(*websock.AckSenderKeysMessage))
 		case websock.Pong:
 			log.Printf("Receive pong from %s", ws.Request().RemoteAddr)
 			atomic.AddInt64(pongCount, 1)
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	resumeTokenLen = 32
+	// resumeTimeout is how long a session can be resumed after the connection is lost
+	resumeTimeout = 2 * time.Minute
+	// maxResumeMessages is the maximum number of missed chat messages sent for each chat room when a session is resumed
+	maxResumeMessages = maxHistoryPageSize
+)
+
+// session is a logged in user, which can be resumed on a new connection with the resume token of the session
+type session struct {
+	username string
+	id       string
+	// keyID is the ID of the key the client logged in with, which is changed when the client changes its key
+	keyID string
+	// ws is the connection of the session, or nil if the connection is lost
+	ws *websocket.Conn
+	// chatRooms are the chat rooms the user was in when the connection was lost
+	chatRooms []string
+	expires   time.Time
+}
+
+// Sessions is a threadsafe collection of resumable sessions indexed by resume token
+//
+// The mutex must be held when accessing or modifying the map
+type Sessions struct {
+	sync.Mutex
+	data map[string]*session
+}
+
+// Start starts a new session for a user logged in on a websocket connection, returns the resume token of the session
+func (sessions *Sessions) Start(ws *websocket.Conn, user *User) (string, error) {
+	buf := make([]byte, resumeTokenLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.data[token] = &session{username: user.Username, id: user.SessionID, keyID: user.KeyID(), ws: ws}
+	return token, nil
+}
+
+// KeyChanged changes the key of the session of a websocket connection, after the client has changed its key
+func (sessions *Sessions) KeyChanged(ws *websocket.Conn, keyID string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	for _, sess := range sessions.data {
+		if sess.ws == ws {
+			sess.keyID = keyID
+		}
+	}
+}
+
+// End removes the session of a websocket connection, so it cannot be resumed
+func (sessions *Sessions) End(ws *websocket.Conn) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	for token, sess := range sessions.data {
+		if sess.ws == ws {
+			delete(sessions.data, token)
+		}
+	}
+}
+
+// Disconnected is called when the connection of a session is lost, the session can then be resumed until
+// resumeTimeout has passed. Sessions which can no longer be resumed are removed
+func (sessions *Sessions) Disconnected(ws *websocket.Conn, chatRooms []string, now time.Time) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	for token, sess := range sessions.data {
+		if sess.ws == ws {
+			sess.ws = nil
+			sess.chatRooms = chatRooms
+			sess.expires = now.Add(resumeTimeout)
+		} else if sess.ws == nil && now.After(sess.expires) {
+			delete(sessions.data, token)
+		}
+	}
+}
+
+// Resume removes the session of a resume token, so the token can only be used once. The connection of the
+// session is not nil if the server has not noticed yet that it was lost
+//
+// Returns true on success and false if the token is not valid, or the session has expired
+func (sessions *Sessions) Resume(token string, now time.Time) (*session, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sess, ok := sessions.data[token]
+	if !ok {
+		return nil, false
+	}
+	delete(sessions.data, token)
+	if sess.ws == nil && now.After(sess.expires) {
+		return nil, false
+	}
+	return sess, true
+}
+
+// startSession starts a resumable session for a user who has logged in, and sends the resume token to the client
+func (s *Server) startSession(ws *websocket.Conn, user *User) bool {
+	token, err := s.Sessions.Start(ws, user)
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error starting session")
+		return false
+	}
+
+	s.reply(ws, &websock.Message{
+		Type:    websock.SessionStarted,
+		Message: &websock.SessionMessage{Token: token, ExpiresIn: resumeTimeout}})
+	return true
+}
+
+// ResumeSession logs in a client with the resume token of a session whose connection was lost, instead of
+// the auth challenge. The client is put back in the chat rooms it was in, and is sent the chat messages
+// it missed. This function returns true if the session was resumed
+func (s *Server) ResumeSession(ws *websocket.Conn, msg *websock.ResumeSessionMessage) bool {
+	sess, ok := s.Sessions.Resume(msg.Token, time.Now())
+	if !ok {
+		s.replyError(ws, websock.CodeSessionExpired, "Session has expired, please log in again")
+		return false
+	}
+
+	chatRooms := sess.chatRooms
+	if sess.ws != nil {
+		// The old connection is replaced, the other users are not notified that the user left
+		chatRooms = s.Users.ChatRooms(sess.ws)
+		s.Users.Remove(sess.ws)
+		sess.ws.Close()
+	}
+
+	user, err := NewUser(s.Db, sess.username, sess.keyID)
+	if err != nil {
+		code, message := loginError(err)
+		s.replyError(ws, code, message)
+		return false
+	}
+	// The other clients see the same session as before the connection was lost
+	user.SessionID = sess.id
+
+	log.Printf("Client %s resumed the session of user %s\n", ws.Request().RemoteAddr, user.Username)
+	if !s.loginClient(ws, user) {
+		return false
+	}
+	if !s.startSession(ws, user) {
+		return false
+	}
+
+	user.Lock()
+	defer user.Unlock()
+	for _, chatName := range chatRooms {
+		s.resumeChat(ws, user, chatName, msg.Cursors[chatName])
+	}
+	return true
+}
+
+// resumeChat puts a client which resumed its session back in a chat room it was in, and sends the chat info
+// with the messages after the cursor. If the user can no longer be in the chat room, the client is removed from it
+func (s *Server) resumeChat(ws *websocket.Conn, user *User, chatName string, cursor *websock.HistoryCursor) {
+	var chatInfo *websock.ChatInfoMessage
+	var reason string
+	if websock.IsDirectChatName(chatName) {
+		chatInfo, reason = s.resumedDirectInfo(user, chatName)
+	} else {
+		chatInfo, reason = s.resumedChatInfo(user, chatName)
+	}
+	if chatInfo == nil {
+		removed := &websock.RemovedFromChatMessage{ChatName: chatName, Reason: reason}
+		go websock.Send(ws, &websock.Message{Type: websock.RemovedFromChat, Message: removed})
+		return
+	}
+
+	if !s.Users.JoinChat(ws, chatName) {
+		return
+	}
+
+	messages, hasMore, err := s.FindHistory(user.Recipient(), chatName, nil, maxResumeMessages)
+	if err != nil {
+		log.Println(err)
+	}
+	chatInfo.Messages = missedMessages(messages, cursor)
+	// If every message sent is missed, there may be missed messages which are older
+	chatInfo.HasMoreHistory = hasMore && len(chatInfo.Messages) == len(messages)
+	chatInfo.Resumed = true
+
+	go websock.Send(ws, &websock.Message{Type: websock.ChatInfo, Message: chatInfo})
+
+	s.NotifyUserJoined(user, chatName)
+}
+
+// resumedChatInfo creates the chat info of a chat room, if the user is still a member of it. Otherwise the
+// reason the user can no longer be in the chat room is returned
+func (s *Server) resumedChatInfo(user *User, chatName string) (*websock.ChatInfoMessage, string) {
+	chat, err := s.Db.FindChat(chatName)
+	if err != nil {
+		return nil, "The chat room no longer exists"
+	}
+	if chat.IsBanned(user.Username) {
+		return nil, "You are banned from this chat room"
+	}
+	if !s.isMember(chatName, user.Username) {
+		return nil, "You are no longer a member of this chat room"
+	}
+	return s.newChatInfo(user, chat), ""
+}
+
+// resumedDirectInfo creates the chat info of a direct conversation, and marks its messages as read
+func (s *Server) resumedDirectInfo(user *User, chatName string) (*websock.ChatInfoMessage, string) {
+	s.chatLock.Lock()
+	conv, err := s.Db.FindConversation(chatName)
+	if err == nil && conv.Participant(user.Username) != nil {
+		conv.Participant(user.Username).LastRead = conv.LastMessage
+		err = s.Db.UpdateConversation(conv)
+	} else if err == nil {
+		err = mdb.ErrNotFound
+	}
+	s.chatLock.Unlock()
+	if err != nil {
+		log.Println(err)
+		return nil, "The conversation no longer exists"
+	}
+
+	peer, err := s.Db.FindUser(conv.Peer(user.Username))
+	if err != nil {
+		log.Println(err)
+		return nil, "The conversation no longer exists"
+	}
+	return s.newDirectInfo(user, chatName, peer), ""
+}
+
+// missedMessages gets the chat messages which are newer than the cursor, the messages must be ordered by timestamp
+func missedMessages(messages []*websock.ChatMessage, cursor *websock.HistoryCursor) []*websock.ChatMessage {
+	if cursor == nil {
+		return messages
+	}
+	for i, message := range messages {
+		if message.Timestamp > cursor.Timestamp || (message.Timestamp == cursor.Timestamp && message.ID > cursor.ID) {
+			return messages[i:]
+		}
+	}
+	return messages[:0]
+}
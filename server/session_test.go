@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/rsa"
+	"testing"
+
+	"github.com/haakonleg/go-e2ee-chat-engine/util"
+	"github.com/haakonleg/go-e2ee-chat-engine/websock"
+	"golang.org/x/net/websocket"
+)
+
+// loginResumable logs in with a resumable session, returns the session sent by the server
+func loginResumable(t *testing.T, ws *websocket.Conn, username string, pki *rsa.PrivateKey) *websock.SessionMessage {
+	err := websock.Send(ws, &websock.Message{
+		Type:    websock.LoginUser,
+		Message: &websock.LoginUserMessage{Username: username, AuthVersion: websock.AuthVersionSignature, Resumable: true}})
+	if err != nil {
+		t.Fatalf("Unable to send login request: %s", err)
+	}
+	msg, err := receiveMessage(ws, websock.AuthChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := util.SignLogin(pki, ws.Config().Location.Host, username, msg.Message.([]byte))
+	if err != nil {
+		t.Fatalf("Unable to sign auth challenge: %s", err)
+	}
+	if err := websock.Send(ws, &websock.Message{Type: websock.AuthChallengeResponse, Message: signature}); err != nil {
+		t.Fatalf("Unable to send auth challenge response: %s", err)
+	}
+	if msg, err = receiveMessage(ws, websock.SessionStarted); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Message.(*websock.SessionMessage)
+}
+
+// resumeSession resumes a session on a new connection, returns the connection and the response from the server
+func resumeSession(t *testing.T, req *websock.ResumeSessionMessage) (*websocket.Conn, *websock.Message) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	if err := websock.Send(ws, &websock.Message{Type: websock.ResumeSession, Message: req}); err != nil {
+		t.Fatalf("Unable to send resume session request: %s", err)
+	}
+	msg := new(websock.Message)
+	if err := websock.Receive(ws, msg); err != nil {
+		t.Fatalf("Error when receiving message from server: %s", err)
+	}
+	return ws, msg
+}
+
+func TestResumeSession(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	if err := registerUser(ws, "resumeuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+	session := loginResumable(t, ws, "resumeuser", prikey)
+	if _, err := joinTestRoom(ws, "resumeroom"); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := setupTestUser("resumeother", spubkey, sprikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	chatInfo, err := joinExistingRoom(other, "resumeroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(ws, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	sendMessage := func(plaintext string) {
+		req, err := encryptTestMessage(chatInfo.Users, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ChatName = "resumeroom"
+		if err := websock.Send(other, &websock.Message{Type: websock.SendChat, Message: req}); err != nil {
+			t.Fatalf("Unable to send chat message request: %s", err)
+		}
+		if _, err := receiveMessage(other, websock.OK); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := receiveMessage(other, websock.ChatMessageReceived); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The newest message the client received is the cursor when resuming the session
+	sendMessage("before the connection is lost")
+	msg, err := receiveMessage(ws, websock.ChatMessageReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := msg.Message.(*websock.ChatMessage)
+	cursor := &websock.HistoryCursor{Timestamp: received.Timestamp, ID: received.ID}
+
+	// The connection is lost, and a message is sent while the client is disconnected
+	ws.Close()
+	if _, err := receiveMessage(other, websock.UserLeft); err != nil {
+		t.Fatal(err)
+	}
+	sendMessage("while the connection is lost")
+
+	resumed, msg := resumeSession(t, &websock.ResumeSessionMessage{
+		Token:   session.Token,
+		Cursors: map[string]*websock.HistoryCursor{"resumeroom": cursor}})
+	defer resumed.Close()
+	if msg.Type != websock.SessionStarted {
+		t.Fatalf("Expected the session to be resumed, got %v", msg.Message)
+	}
+	if msg.Message.(*websock.SessionMessage).Token == session.Token {
+		t.Fatalf("Expected a new resume token when the session is resumed")
+	}
+
+	// The client is back in the chat room, and receives only the message it missed
+	if msg, err = receiveMessage(resumed, websock.ChatInfo); err != nil {
+		t.Fatal(err)
+	}
+	resumedInfo := msg.Message.(*websock.ChatInfoMessage)
+	if resumedInfo.Name != "resumeroom" || !resumedInfo.Resumed {
+		t.Fatalf("Expected the resumed chat info of resumeroom, got %s", resumedInfo.Name)
+	}
+	if len(resumedInfo.Messages) != 1 {
+		t.Fatalf("Expected 1 missed message, got %d", len(resumedInfo.Messages))
+	}
+	key, err := util.UnwrapKey(prikey, resumedInfo.Messages[0].Message)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message key: %s", err)
+	}
+	decMsg, err := util.DecryptMessage(resumedInfo.Messages[0].Ciphertext, key)
+	if err != nil {
+		t.Fatalf("Unable to decrypt message: %s", err)
+	}
+	if string(decMsg) != "while the connection is lost" {
+		t.Fatalf("Decrypted message does not match the missed message")
+	}
+	if _, err := receiveMessage(other, websock.UserJoined); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resume token can only be used once
+	reused, msg := resumeSession(t, &websock.ResumeSessionMessage{Token: session.Token})
+	defer reused.Close()
+	if msg.Type != websock.Error {
+		t.Fatalf("Expected an error when resuming a session with a used token")
+	}
+}
@@ -1,3 +1,5 @@
+//go:debug rsa1024min=0
+
 package server
 
 import (
@@ -10,6 +12,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
 )
@@ -40,32 +43,40 @@ func init() {
 	testserver, wsserver = setupTestServer()
 }
 
-// setupTestServer creates a test server using a httptest.Server
-//
-// WARNING: This function will flush the provided database to provide a clean
-// database for insertions
-func setupTestServer() (testserver *Server, wsserver *httptest.Server) {
+// setupTestStore connects to the mongoDB database given by MONGODB_URI and MONGODB_NAME,
+// or returns an in-memory store if MONGODB_URI is not set
+func setupTestStore() mdb.Store {
 	mongoURI := os.Getenv("MONGODB_URI")
 	if mongoURI == "" {
-		log.Fatal("Error: environment variable MONGODB_URI is not set")
+		return mdb.NewMemoryStore()
 	}
 	dbName := os.Getenv("MONGODB_NAME")
 	if dbName == "" {
 		log.Fatal("Error: environment variable MONGODB_NAME is not set")
 	}
 
+	db, err := mdb.CreateConnection(mongoURI, dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// setupTestServer creates a test server using a httptest.Server
+//
+// WARNING: This function will flush the provided database to provide a clean
+// database for insertions
+func setupTestServer() (testserver *Server, wsserver *httptest.Server) {
 	serverConfig := Config{
-		DBName:    dbName,
-		MongoURL:  mongoURI,
 		Keepalive: 100000,
 	}
 
-	testserver = CreateServer(serverConfig)
+	testserver = CreateServer(serverConfig, setupTestStore())
 
 	// Flush database
 	testserver.Db.DeleteAll()
 
-	wsserver = httptest.NewServer(websocket.Handler(testserver.WebsockHandler))
+	wsserver = httptest.NewServer(testserver.Handler())
 
 	// Change protocol from http to ws
 	wsserver.URL = "ws" + strings.TrimPrefix(wsserver.URL, "http")
@@ -85,8 +96,42 @@ func setupTestKeys(testKeySize int) (priKey *rsa.PrivateKey, pubKey *rsa.PublicK
 	return
 }
 
+// dialServer connects to the websocket server at the URL, and sends the hello message
+func dialServer(url string) (*websocket.Conn, error) {
+	ws, err := websocket.Dial(url, "", "http://")
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := hello(ws, &websock.HelloMessage{
+		Version:      websock.ProtocolVersion,
+		Codecs:       []string{websock.CodecGob},
+		CipherSuites: []string{websock.CipherSuiteSenderKey}})
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	if msg.Type != websock.Hello {
+		ws.Close()
+		return nil, fmt.Errorf("Response of hello was non-hello type (%d): %v", msg.Type, msg.Message)
+	}
+	return ws, nil
+}
+
+// hello sends the hello message, and receives the response of the server
+func hello(ws *websocket.Conn, hello *websock.HelloMessage) (*websock.Message, error) {
+	if err := websock.Send(ws, &websock.Message{Type: websock.Hello, Message: hello}); err != nil {
+		return nil, fmt.Errorf("Unable to send hello: %s", err)
+	}
+	msg := new(websock.Message)
+	if err := websock.Receive(ws, msg); err != nil {
+		return nil, fmt.Errorf("Error when receiving message from server: %s", err)
+	}
+	return msg, nil
+}
+
 func setupTestUser(username string, pk *rsa.PublicKey, pki *rsa.PrivateKey) (ws *websocket.Conn, err error) {
-	ws, err = websocket.Dial(wsserver.URL, "", "http://")
+	ws, err = dialServer(wsserver.URL)
 	if err != nil {
 		err = fmt.Errorf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
 		return
@@ -123,16 +168,21 @@ func registerUser(ws *websocket.Conn, username string, pubkey []byte) error {
 	case websock.OK:
 		return nil
 	case websock.Error:
-		return fmt.Errorf("Response of register user was an error: %s", msg.Message.(string))
+		return fmt.Errorf("Response of register user was an error: %s", msg.Message)
 	default:
 		return fmt.Errorf("Response of register user was non-ok type (%d)", msg.Type)
 	}
 }
 
 func loginUser(ws *websocket.Conn, username string, pki *rsa.PrivateKey) error {
+	return loginDevice(ws, username, "", pki)
+}
+
+// loginDevice logs in from a device of a user, an empty device is the device the user registered with
+func loginDevice(ws *websocket.Conn, username, device string, pki *rsa.PrivateKey) error {
 	err := websock.Send(ws, &websock.Message{
 		Type:    websock.LoginUser,
-		Message: username,
+		Message: &websock.LoginUserMessage{Username: username, AuthVersion: websock.AuthVersionSignature, Device: device},
 	})
 	if err != nil {
 		return fmt.Errorf("Unable to send register user request: %s", err)
@@ -146,21 +196,21 @@ func loginUser(ws *websocket.Conn, username string, pki *rsa.PrivateKey) error {
 	switch msg.Type {
 	case websock.AuthChallenge:
 	case websock.Error:
-		return fmt.Errorf("Response of login user was an error: %s", msg.Message.(string))
+		return fmt.Errorf("Response of login user was an error: %s", msg.Message)
 	default:
 		return fmt.Errorf("Response of login user was non-auth challenge type (%d)", msg.Type)
 	}
 
-	// Try to decrypt auth challenge
-	decKey, err := rsa.DecryptPKCS1v15(nil, pki, msg.Message.([]byte))
+	// Sign auth challenge
+	signature, err := util.SignLogin(pki, ws.Config().Location.Host, username, msg.Message.([]byte))
 	if err != nil {
-		return fmt.Errorf("Unable to decrypt auth challenge: %s", err)
+		return fmt.Errorf("Unable to sign auth challenge: %s", err)
 	}
 
-	// Send decrypted auth key to server
+	// Send signature to server
 	err = websock.Send(ws, &websock.Message{
 		Type:    websock.AuthChallengeResponse,
-		Message: decKey,
+		Message: signature,
 	})
 	if err != nil {
 		return fmt.Errorf("Error when receiving message from server: %s", err)
@@ -175,7 +225,7 @@ func loginUser(ws *websocket.Conn, username string, pki *rsa.PrivateKey) error {
 	case websock.OK:
 		return nil
 	case websock.Error:
-		return fmt.Errorf("Response of auth challenge response was an error: %s", msg.Message.(string))
+		return fmt.Errorf("Response of auth challenge response was an error: %s", msg.Message)
 	default:
 		return fmt.Errorf("Response of auth challenge response was non-ok type (%d)", msg.Type)
 	}
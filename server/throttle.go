@@ -0,0 +1,85 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxPasswordFailures is the number of wrong passwords allowed for a chat room from an IP address within
+	// passwordFailureWindow
+	maxPasswordFailures = 10
+	// passwordFailureWindow is how long failed password attempts are counted for a chat room
+	passwordFailureWindow = time.Minute
+)
+
+// passwordThrottle counts the failed password attempts for every chat room from every IP address, so that the
+// password of a chat room cannot be brute-forced. The attempts are counted per IP address and not per user or
+// connection, as an attacker can use any number of users, and not only per chat room, as anyone could then keep
+// the members from joining
+//
+// The mutex must be held when accessing the map
+type passwordThrottle struct {
+	sync.Mutex
+	failures  map[passwordClient]*passwordFailures
+	lastPrune time.Time
+}
+
+// passwordClient is an IP address trying passwords for a chat room
+type passwordClient struct {
+	chatName string
+	ip       string
+}
+
+// passwordFailures is the number of failed password attempts for a chat room since the window started
+type passwordFailures struct {
+	count int
+	since time.Time
+}
+
+// newPasswordThrottle creates a passwordThrottle without any failed attempts
+func newPasswordThrottle() *passwordThrottle {
+	return &passwordThrottle{failures: make(map[passwordClient]*passwordFailures)}
+}
+
+// Allowed checks if a password attempt for the chat room from the IP address is allowed, which is not the case
+// when there have been too many failed attempts within the current window
+func (pt *passwordThrottle) Allowed(chatName, ip string, now time.Time) bool {
+	pt.Lock()
+	defer pt.Unlock()
+
+	client := passwordClient{chatName, ip}
+	failures, ok := pt.failures[client]
+	if !ok {
+		return true
+	}
+	if now.Sub(failures.since) >= passwordFailureWindow {
+		delete(pt.failures, client)
+		return true
+	}
+	return failures.count < maxPasswordFailures
+}
+
+// Failed counts a failed password attempt for the chat room from the IP address
+func (pt *passwordThrottle) Failed(chatName, ip string, now time.Time) {
+	pt.Lock()
+	defer pt.Unlock()
+
+	// The failures of IP addresses which have not tried again since their window ended are removed
+	if now.Sub(pt.lastPrune) >= passwordFailureWindow {
+		pt.lastPrune = now
+		for client, failures := range pt.failures {
+			if now.Sub(failures.since) >= passwordFailureWindow {
+				delete(pt.failures, client)
+			}
+		}
+	}
+
+	client := passwordClient{chatName, ip}
+	failures, ok := pt.failures[client]
+	if !ok || now.Sub(failures.since) >= passwordFailureWindow {
+		failures = &passwordFailures{since: now}
+		pt.failures[client] = failures
+	}
+	failures.count++
+}
@@ -1,13 +1,13 @@
 package server
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/hex"
+	"errors"
 	"log"
 	"sync"
 
-	"github.com/globalsign/mgo/bson"
 	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
@@ -15,7 +15,17 @@ import (
 )
 
 const (
-	authKeyLen = 64
+	authNonceLen = 32
+	sessionIDLen = 8
+)
+
+var (
+	// errUnknownDevice is returned by NewUser when the user has no device with the ID
+	errUnknownDevice = errors.New("unknown device")
+	// errDeviceRevoked is returned by NewUser when the device has been revoked
+	errDeviceRevoked = errors.New("device revoked")
+	// errKeyRevoked is returned by NewUser when the key has been replaced by a new key
+	errKeyRevoked = errors.New("key revoked")
 )
 
 // Users is a threadsafe connection between a websocket connection and a user
@@ -85,7 +95,7 @@ func (users *Users) ForEachInChat(chatName string, f func(*websocket.Conn, *User
 		if user == nil {
 			continue
 		}
-		if user.ChatRoom == chatName {
+		if user.chatRooms[chatName] {
 			f(ws, user)
 		}
 	}
@@ -106,58 +116,216 @@ func (users *Users) LenInChat(chatName string) (amount int) {
 		if user == nil {
 			continue
 		}
-		user.Lock()
-		if user.ChatRoom == chatName {
+		if user.chatRooms[chatName] {
 			amount++
 		}
-		user.Unlock()
 	}
 	return
 }
 
+// IsOnline checks if a user is logged in on any websocket connection
+func (users *Users) IsOnline(username string) bool {
+	users.Lock()
+	defer users.Unlock()
+	for _, user := range users.data {
+		if user != nil && user.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinChat adds a chat room to the set of chat rooms the user of a websocket connection is in
+//
+// Returns true on success and false if the connection has no user, or is already in the chat room
+func (users *Users) JoinChat(ws *websocket.Conn, chatName string) bool {
+	users.Lock()
+	defer users.Unlock()
+
+	user, ok := users.data[ws]
+	if !ok || user == nil || user.chatRooms[chatName] {
+		return false
+	}
+	user.chatRooms[chatName] = true
+	return true
+}
+
+// LeaveChat removes a chat room from the set of chat rooms the user of a websocket connection is in
+//
+// Returns true on success and false if the connection was not in the chat room
+func (users *Users) LeaveChat(ws *websocket.Conn, chatName string) bool {
+	users.Lock()
+	defer users.Unlock()
+
+	user, ok := users.data[ws]
+	if !ok || user == nil || !user.chatRooms[chatName] {
+		return false
+	}
+	delete(user.chatRooms, chatName)
+	return true
+}
+
+// InChat checks if the user of a websocket connection is in the given chat room
+func (users *Users) InChat(ws *websocket.Conn, chatName string) bool {
+	users.Lock()
+	defer users.Unlock()
+
+	user, ok := users.data[ws]
+	return ok && user != nil && user.chatRooms[chatName]
+}
+
+// RenameChat renames a chat room in the set of chat rooms of every user in the chat room
+//
+// Returns the websocket connections of the users in the chat room
+func (users *Users) RenameChat(chatName, newName string) []*websocket.Conn {
+	users.Lock()
+	defer users.Unlock()
+
+	clients := make([]*websocket.Conn, 0)
+	for ws, user := range users.data {
+		if user == nil || !user.chatRooms[chatName] {
+			continue
+		}
+		delete(user.chatRooms, chatName)
+		user.chatRooms[newName] = true
+		clients = append(clients, ws)
+	}
+	return clients
+}
+
+// RemoveChat removes a chat room from the set of chat rooms of every user in the chat room
+//
+// Returns the websocket connections of the users which were in the chat room
+func (users *Users) RemoveChat(chatName string) []*websocket.Conn {
+	return users.removeFromChat(chatName, func(*User) bool { return true })
+}
+
+// RemoveUserFromChat removes a chat room from the set of chat rooms of every connection of a user
+//
+// Returns the websocket connections of the user which were in the chat room
+func (users *Users) RemoveUserFromChat(chatName, username string) []*websocket.Conn {
+	return users.removeFromChat(chatName, func(user *User) bool { return user.Username == username })
+}
+
+// removeFromChat removes a chat room from the set of chat rooms of the users in the chat room matching filter
+func (users *Users) removeFromChat(chatName string, filter func(*User) bool) []*websocket.Conn {
+	users.Lock()
+	defer users.Unlock()
+
+	clients := make([]*websocket.Conn, 0)
+	for ws, user := range users.data {
+		if user == nil || !user.chatRooms[chatName] || !filter(user) {
+			continue
+		}
+		delete(user.chatRooms, chatName)
+		clients = append(clients, ws)
+	}
+	return clients
+}
+
+// Connections gets the websocket connections a user is logged in on
+func (users *Users) Connections(username string) []*websocket.Conn {
+	users.Lock()
+	defer users.Unlock()
+
+	clients := make([]*websocket.Conn, 0)
+	for ws, user := range users.data {
+		if user != nil && user.Username == username {
+			clients = append(clients, ws)
+		}
+	}
+	return clients
+}
+
+// ChatRooms gets the names of the chat rooms the user of a websocket connection is in
+func (users *Users) ChatRooms(ws *websocket.Conn) []string {
+	users.Lock()
+	defer users.Unlock()
+
+	user, ok := users.data[ws]
+	if !ok || user == nil {
+		return nil
+	}
+	chatRooms := make([]string, 0, len(user.chatRooms))
+	for chatName := range user.chatRooms {
+		chatRooms = append(chatRooms, chatName)
+	}
+	return chatRooms
+}
+
 // User contains user data and a mutex to enable threadsafe access without
 // copying
 //
-// The mutex must be held when accessing or modifying fields
+// The mutex must be held when accessing or modifying fields, except chatRooms, which
+// is the set of chat rooms the user is in and is guarded by the mutex of Users, and
+// Username, SessionID and DeviceID, which are never modified after the user has logged in.
+// SessionID identifies the connection among the connections the user is logged in on, and
+// DeviceID is the device the user logged in from, PublicKey is the public key of the device
 type User struct {
 	sync.Mutex
 	Username  string
-	AuthKey   []byte
+	SessionID string
+	DeviceID  string
 	PublicKey *rsa.PublicKey
-	ChatRoom  string
+
+	chatRooms map[string]bool
+}
+
+// Recipient gets the recipient of the chat messages addressed to the device of the user
+func (user *User) Recipient() string {
+	return websock.Recipient(user.Username, user.DeviceID)
 }
 
-// KeyMatches checks that an authentication key matches the one for this user
-func (u *User) KeyMatches(authKey []byte) bool {
-	return bytes.Equal(u.AuthKey, authKey)
+// KeyID gets the ID of the public key of the device of the user (see util.KeyID)
+func (user *User) KeyID() string {
+	return util.KeyID(util.MarshalPublic(user.PublicKey))
 }
 
 // RegisterUser registers a new user, and adds it to the database
 func (s *Server) RegisterUser(ws *websocket.Conn, msg *websock.RegisterUserMessage) {
 	// Add new user to database
 	user := mdb.NewUser(msg.Username, msg.PublicKey)
-	if err := s.Db.Insert(mdb.Users, user); err != nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Error registering user"})
+	if err := s.Db.InsertUser(user); err != nil {
+		if err == mdb.ErrDuplicate {
+			s.replyError(ws, websock.CodeUserExists, "A user with this username already exists")
+		} else {
+			log.Println(err)
+			s.replyError(ws, websock.CodeInternal, "Error registering user")
+		}
 		return
 	}
 
-	websock.Send(ws, &websock.Message{Type: websock.OK, Message: "User registered"})
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "User registered"})
 }
 
-// LoginUser authenticates a user using a randomly generated authentication token
-// This token is encrypted with the public key of the username the client is trying to log in as
-// The client is then expected to respond with the correct decrypted token
-// TODO check if user is already logged in
-func (s *Server) LoginUser(ws *websocket.Conn, username string) bool {
+// LoginUser authenticates a user using a randomly generated nonce, which the client is expected to sign
+// with the private key of the username the client is trying to log in as. The signature also covers the
+// host name of the server and the username (see util.SignLogin). The nonce is only kept until the
+// client has responded, so it can not be used for any other connection. If the client asks for a resumable
+// session, it is sent a resume token instead of OK. If the user is already logged in, the login policy is followed.
+// The nonce is signed with the key of the device the client logs in from, a revoked device cannot log in
+func (s *Server) LoginUser(ws *websocket.Conn, msg *websock.LoginUserMessage) bool {
+	if msg.AuthVersion != websock.AuthVersionSignature {
+		s.replyError(ws, websock.CodeUnsupported, "Unsupported authentication version, please update the client")
+		return false
+	}
+
 	// Create new user object
-	newUser, encKey, err := NewUser(s.Db, username)
+	newUser, err := NewUser(s.Db, msg.Username, msg.Device)
 	if err != nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "User does not exist"})
+		code, message := loginError(err)
+		s.replyError(ws, code, message)
 		return false
 	}
 
 	// Send auth challenge
-	websock.Send(ws, &websock.Message{Type: websock.AuthChallenge, Message: encKey})
+	nonce, err := GenAuthChallenge()
+	if err != nil {
+		log.Println(err)
+		s.replyError(ws, websock.CodeInternal, "Error creating auth challenge")
+		return false
+	}
+	s.reply(ws, &websock.Message{Type: websock.AuthChallenge, Message: nonce})
 
 	// Receive auth challenge response
 	res := new(websock.Message)
@@ -165,53 +333,141 @@ func (s *Server) LoginUser(ws *websocket.Conn, username string) bool {
 		log.Println(err)
 		return false
 	}
+	s.Requests.Start(ws, res)
+	if res.Type != websock.AuthChallengeResponse {
+		s.replyError(ws, websock.CodeAuthFailed, "Expected auth challenge response")
+		return false
+	}
 
-	// Check that the received decrypted key matches the original auth key
-	if newUser.KeyMatches(res.Message.([]byte)) {
-		log.Printf("Client %s authenticated as user %s\n", ws.Request().RemoteAddr, newUser.Username)
-		s.AddClient(ws, newUser)
-		websock.Send(ws, &websock.Message{Type: websock.OK, Message: "Logged in"})
-		return true
+	// Check the signature over the nonce
+	if err := util.VerifyLogin(newUser.PublicKey, s.host(ws), newUser.Username, nonce, res.Message.([]byte)); err != nil {
+		s.replyError(ws, websock.CodeAuthFailed, "Invalid auth signature")
+		return false
 	}
 
-	websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Invalid auth key"})
-	return false
+	log.Printf("Client %s authenticated as user %s\n", ws.Request().RemoteAddr, newUser.Username)
+	if !s.loginClient(ws, newUser) {
+		return false
+	}
+	if msg.Resumable {
+		return s.startSession(ws, newUser)
+	}
+	s.reply(ws, &websock.Message{Type: websock.OK, Message: "Logged in"})
+	return true
 }
 
-// NewUser creates a new user object for a connected client, with the username, generated (temporary) authentication
-// key and the encrypted version of the key. A random byte slice is generated and encrypted with the users public key, the user
-// is expected to send in response the decrypted string
-func NewUser(db *mdb.Database, username string) (*User, []byte, error) {
-	// Retrieve user from DB
-	query := bson.M{"username": username}
+// loginClient adds a client which has authenticated as a user. If the user is already logged in on another
+// connection, the login is refused or the other connections are logged out, depending on the login policy.
+// Returns false if the login was refused
+func (s *Server) loginClient(ws *websocket.Conn, user *User) bool {
+	s.loginLock.Lock()
+	defer s.loginLock.Unlock()
+
+	if others := s.Users.Connections(user.Username); len(others) > 0 {
+		switch s.LoginPolicy {
+		case LoginRejectNew:
+			s.replyError(ws, websock.CodeAlreadyLoggedIn, "This user is already logged in")
+			return false
+		case LoginKickOld:
+			for _, other := range others {
+				s.logout(other, "You logged in on another connection")
+			}
+		}
+	}
 
-	user := new(mdb.User)
-	if err := db.FindOne(mdb.Users, query, nil, user); err != nil {
+	s.AddClient(ws, user)
+	return true
+}
+
+// logout closes the connection of a client, after telling it why it was logged out. The session of
+// the client cannot be resumed
+func (s *Server) logout(ws *websocket.Conn, reason string) {
+	s.Sessions.End(ws)
+	websock.Send(ws, &websock.Message{Type: websock.LoggedOut, Message: reason})
+	ws.Close()
+}
+
+// host gets the host name of the server which clients sign when logging in, Host from the
+// config, or the host name the client connected to if it is not set
+func (s *Server) host(ws *websocket.Conn) string {
+	if s.Host != "" {
+		return s.Host
+	}
+	return ws.Request().Host
+}
+
+// loginError gets the error code and message sent to a client which could not log in, from the error returned by NewUser
+func loginError(err error) (websock.ErrorCode, string) {
+	switch err {
+	case errUnknownDevice:
+		return websock.CodeDeviceNotFound, "This device has not been added to the user"
+	case errDeviceRevoked:
+		return websock.CodeDeviceRevoked, "This device has been revoked"
+	case errKeyRevoked:
+		return websock.CodeDeviceRevoked, "This key has been replaced by a new key, and can no longer be used"
+	default:
+		return websock.CodeUserNotFound, "User does not exist"
+	}
+}
+
+// NewUser creates a new user object for a connected client, with the username of the user, the ID and public key
+// of the device the client logs in from, and a new session ID. The device is found by its ID, or the ID of its
+// public key, and an empty ID is the device the user registered with. Returns errUnknownDevice if the user has no
+// such device, errDeviceRevoked if the device is revoked, and errKeyRevoked if the ID is the ID of a key which
+// has been replaced
+func NewUser(db mdb.Store, username, deviceID string) (*User, error) {
+	// Retrieve user from DB
+	user, err := db.FindUser(username)
+	if err != nil {
 		log.Println(err)
-		return nil, nil, err
+		return nil, err
+	}
+
+	if user.KeyRevoked(deviceID) {
+		return nil, errKeyRevoked
+	}
+	device := user.Device(deviceID)
+	if device == nil {
+		return nil, errUnknownDevice
+	} else if device.Revoked {
+		return nil, errDeviceRevoked
 	}
 
 	// Unmarshal public key
-	pubKey, err := util.UnmarshalPublic(user.PublicKey)
+	pubKey, err := util.UnmarshalPublic(device.PublicKey)
 	if err != nil {
 		log.Println(err)
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Generate auth challenge
-	encKey, authKey := GenAuthChallenge(pubKey)
+	sessionID, err := GenSessionID()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 
 	return &User{
 		Username:  username,
-		AuthKey:   authKey,
-		PublicKey: pubKey}, encKey, nil
+		SessionID: sessionID,
+		DeviceID:  device.ID,
+		PublicKey: pubKey,
+		chatRooms: make(map[string]bool)}, nil
 }
 
-// GenAuthChallenge generates a random authentication key, and encrypts it with the given public key
-// returns the encrypted and the original auth key
-func GenAuthChallenge(pubKey *rsa.PublicKey) ([]byte, []byte) {
-	authKey := make([]byte, authKeyLen)
-	rand.Read(authKey)
-	encKey, _ := rsa.EncryptPKCS1v15(rand.Reader, pubKey, authKey)
-	return encKey, authKey
+// GenAuthChallenge generates a random nonce for an auth challenge
+func GenAuthChallenge() ([]byte, error) {
+	nonce := make([]byte, authNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// GenSessionID generates a random session ID, which the other clients use to tell the connections of a user apart
+func GenSessionID() (string, error) {
+	id := make([]byte, sessionIDLen)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
 }
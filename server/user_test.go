@@ -2,9 +2,12 @@ package server
 
 import (
 	"crypto/rsa"
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
 	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +18,7 @@ func TestCreateValidUsers(t *testing.T) {
 		"chris",
 		"mandananla2",
 	} {
-		ws, err := websocket.Dial(wsserver.URL, "", "http://")
+		ws, err := dialServer(wsserver.URL)
 		defer ws.Close()
 		if err != nil {
 			t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
@@ -27,7 +30,7 @@ func TestCreateValidUsers(t *testing.T) {
 }
 
 func TestLoginValidUser(t *testing.T) {
-	ws, err := websocket.Dial(wsserver.URL, "", "http://")
+	ws, err := dialServer(wsserver.URL)
 	defer ws.Close()
 	if err != nil {
 		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
@@ -44,7 +47,7 @@ func TestLoginValidUser(t *testing.T) {
 }
 
 func TestLoginNonexistentUsername(t *testing.T) {
-	ws, err := websocket.Dial(wsserver.URL, "", "http://")
+	ws, err := dialServer(wsserver.URL)
 	defer ws.Close()
 	if err != nil {
 		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
@@ -53,7 +56,7 @@ func TestLoginNonexistentUsername(t *testing.T) {
 	// Send login request to server
 	err = websock.Send(ws, &websock.Message{
 		Type:    websock.LoginUser,
-		Message: "doesnotexist",
+		Message: &websock.LoginUserMessage{Username: "doesnotexist", AuthVersion: websock.AuthVersionSignature},
 	})
 	if err != nil {
 		t.Fatalf("Unable to send message to server: %s\n", err)
@@ -75,44 +78,107 @@ func TestLoginNonexistentUsername(t *testing.T) {
 	}
 }
 
-func TestLoginInvalidKeyUser(t *testing.T) {
-	ws, err := websocket.Dial(wsserver.URL, "", "http://")
-	defer ws.Close()
+// loginWithSignature logs in as a user, signing the auth challenge with the given key and host name.
+// Returns the response of the server to the signature
+func loginWithSignature(t *testing.T, username string, pki *rsa.PrivateKey, host string) *websock.Message {
+	ws, err := dialServer(wsserver.URL)
 	if err != nil {
 		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
 	}
-
-	if err := registerUser(ws, "invalidkeyuser", util.MarshalPublic(pubkey)); err != nil {
-		t.Fatal(err)
-	}
+	defer ws.Close()
 
 	// Send login request to server
 	err = websock.Send(ws, &websock.Message{
 		Type:    websock.LoginUser,
-		Message: "invalidkeyuser",
+		Message: &websock.LoginUserMessage{Username: username, AuthVersion: websock.AuthVersionSignature},
 	})
 	if err != nil {
 		t.Fatalf("Unable to send message to server: %s\n", err)
 	}
 
 	// Receive auth challenge from server
-	msg := new(websock.Message)
-	err = websock.Receive(ws, msg)
+	msg, err := receiveMessage(ws, websock.AuthChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := util.SignLogin(pki, host, username, msg.Message.([]byte))
+	if err != nil {
+		t.Fatalf("Unable to sign auth challenge: %s", err)
+	}
+	err = websock.Send(ws, &websock.Message{Type: websock.AuthChallengeResponse, Message: signature})
 	if err != nil {
+		t.Fatalf("Unable to send message to server: %s\n", err)
+	}
+
+	res := new(websock.Message)
+	if err := websock.Receive(ws, res); err != nil {
 		t.Fatalf("Error when receiving message from server: %s", err)
 	}
-	switch msg.Type {
-	case websock.AuthChallenge:
-	case websock.Error:
-		t.Fatalf("Response of login user was an error: %s", msg.Message.(string))
-	default:
-		t.Fatalf("Response of login user was non-auth-challenge type (%d)", msg.Type)
+	return res
+}
+
+func TestLoginInvalidKeyUser(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
+	}
+	defer ws.Close()
+
+	if err := registerUser(ws, "invalidkeyuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign the auth challenge with the wrong private key
+	host := ws.Config().Location.Host
+	if res := loginWithSignature(t, "invalidkeyuser", sprikey, host); res.Type != websock.Error {
+		t.Fatalf("Was able to log in with the wrong private key (%d)", res.Type)
+	}
+}
+
+func TestLoginWrongHost(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
+	}
+	defer ws.Close()
+
+	if err := registerUser(ws, "wronghostuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A signature made for another server can not be used to log in
+	if res := loginWithSignature(t, "wronghostuser", prikey, "example.com"); res.Type != websock.Error {
+		t.Fatalf("Was able to log in with a signature for another server (%d)", res.Type)
 	}
+	if res := loginWithSignature(t, "wronghostuser", prikey, ws.Config().Location.Host); res.Type != websock.OK {
+		t.Fatalf("Unable to log in with a signature for the server (%d)", res.Type)
+	}
+}
+
+func TestLoginLegacyClient(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
+	}
+	defer ws.Close()
 
-	// Try to decrypt auth challenge
-	_, err = rsa.DecryptPKCS1v15(nil, sprikey, msg.Message.([]byte))
-	if err == nil {
-		t.Fatal("Was able to decrypt auth challenge with wrong private key")
+	if err := registerUser(ws, "legacyuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older clients send the username as a string, and expect a PKCS#1 v1.5 auth challenge,
+	// or expect an RSA-OAEP auth challenge
+	for _, login := range []interface{}{
+		"legacyuser",
+		&websock.LoginUserMessage{Username: "legacyuser", AuthVersion: websock.AuthVersionOAEP}} {
+
+		if err := websock.Send(ws, &websock.Message{Type: websock.LoginUser, Message: login}); err != nil {
+			t.Fatalf("Unable to send message to server: %s\n", err)
+		}
+		if _, err := receiveMessage(ws, websock.Error); err != nil {
+			t.Fatalf("Expected an error when logging in with an older client: %s", err)
+		}
 	}
 }
 
@@ -141,7 +207,7 @@ func TestRegisterInvalidUser(t *testing.T) {
 		{"smalljohn", smallkey},
 	} {
 
-		ws, err := websocket.Dial(wsserver.URL, "", "http://")
+		ws, err := dialServer(wsserver.URL)
 		defer ws.Close()
 		if err != nil {
 			t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
@@ -154,3 +220,124 @@ func TestRegisterInvalidUser(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisterDuplicateUser(t *testing.T) {
+	ws, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s\n", wsserver.URL, err)
+	}
+	defer ws.Close()
+
+	if err := registerUser(ws, "duplicateuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerUser(ws, "duplicateuser", util.MarshalPublic(spubkey)); err == nil {
+		t.Fatal("Got unexpected ok when registering an existing username")
+	}
+}
+
+// dialPolicyServer starts a server with an in-memory store and the given login policy, and registers the user
+// policyuser. Returns the server and a function which connects to it
+func dialPolicyServer(t *testing.T, policy LoginPolicy) (*httptest.Server, func() *websocket.Conn) {
+	policyServer := CreateServer(Config{Keepalive: 100000, LoginPolicy: policy}, mdb.NewMemoryStore())
+	server := httptest.NewServer(policyServer.Handler())
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func() *websocket.Conn {
+		ws, err := dialServer(url)
+		if err != nil {
+			t.Fatalf("Unable to connect to websocket at '%s': %s", url, err)
+		}
+		return ws
+	}
+
+	ws := dial()
+	defer ws.Close()
+	if err := registerUser(ws, "policyuser", util.MarshalPublic(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+	return server, dial
+}
+
+func TestLoginPolicyReject(t *testing.T) {
+	server, dial := dialPolicyServer(t, LoginRejectNew)
+	defer server.Close()
+
+	first := dial()
+	defer first.Close()
+	if err := loginUser(first, "policyuser", prikey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user is already logged in, so the second login is refused
+	second := dial()
+	defer second.Close()
+	if err := loginUser(second, "policyuser", prikey); err == nil {
+		t.Fatalf("Expected an error when logging in as a user who is already logged in")
+	}
+}
+
+func TestLoginPolicyKick(t *testing.T) {
+	server, dial := dialPolicyServer(t, LoginKickOld)
+	defer server.Close()
+
+	first := dial()
+	defer first.Close()
+	if err := loginUser(first, "policyuser", prikey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second login logs out the first connection
+	second := dial()
+	defer second.Close()
+	if err := loginUser(second, "policyuser", prikey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(first, websock.LoggedOut); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginMultipleSessions(t *testing.T) {
+	first, err := setupTestUser("multisession", pubkey, prikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := joinTestRoom(first, "multisessionroom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same user logs in again and joins the chat room, both sessions are listed
+	second, err := dialServer(wsserver.URL)
+	if err != nil {
+		t.Fatalf("Unable to connect to websocket at '%s': %s", wsserver.URL, err)
+	}
+	defer second.Close()
+	if err := loginUser(second, "multisession", prikey); err != nil {
+		t.Fatal(err)
+	}
+	chatInfo, err := joinExistingRoom(second, "multisessionroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatInfo.Users) != 1 || len(chatInfo.Users[0].Sessions) != 2 {
+		t.Fatalf("Expected 1 user with 2 sessions, got %+v", chatInfo.Users)
+	}
+	msg, err := receiveMessage(first, websock.UserJoined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined := msg.Message.(*websock.UserJoinedMessage); joined.Session != chatInfo.MySession {
+		t.Fatalf("Expected the session %s to join, got %s", chatInfo.MySession, joined.Session)
+	}
+
+	// When the second session disconnects, the first session is told which session left
+	second.Close()
+	if msg, err = receiveMessage(first, websock.UserLeft); err != nil {
+		t.Fatal(err)
+	}
+	if left := msg.Message.(*websock.UserLeftMessage); left.Username != "multisession" || left.Session != chatInfo.MySession {
+		t.Fatalf("Expected the session %s to leave, got %+v", chatInfo.MySession, left)
+	}
+}
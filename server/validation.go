@@ -1,14 +1,33 @@
 package server
 
 import (
+	"encoding/hex"
 	"strings"
+	"time"
 	"unicode"
 
+	"github.com/haakonleg/go-e2ee-chat-engine/mdb"
 	"github.com/haakonleg/go-e2ee-chat-engine/util"
 	"github.com/haakonleg/go-e2ee-chat-engine/websock"
 	"golang.org/x/net/websocket"
 )
 
+const (
+	// maxClockSkew is how far the timestamp of a signed chat message may differ from the server time
+	maxClockSkew = 5 * time.Minute
+	// maxHistoryPageSize is the maximum number of chat messages a client can retrieve with GetHistory
+	maxHistoryPageSize = 200
+	// defaultInviteValidity is how long an invite is valid if the client does not say
+	defaultInviteValidity = 24 * time.Hour
+	// maxInviteValidity is the longest an invite can be valid
+	maxInviteValidity = 30 * 24 * time.Hour
+	// maxInviteUses is the maximum number of times an invite can be used
+	maxInviteUses = 1000
+	// maxEncryptedKeySize is the maximum size of a key encrypted for a recipient, the size of RSA-OAEP
+	// ciphertexts of 2048 bit keys
+	maxEncryptedKeySize = 256
+)
+
 // Checks that a string only contains alphanumeric characters
 func isAlphaNumeric(input string) bool {
 	for _, ch := range input {
@@ -20,56 +39,204 @@ func isAlphaNumeric(input string) bool {
 	return true
 }
 
+// invalidField sends an error to the client saying that a field of the message it sent is invalid
+func (s *Server) invalidField(ws *websocket.Conn, field, message string) {
+	s.replyErrorDetails(ws, websock.CodeInvalidMessage, message, map[string]string{"field": field})
+}
+
 // ValidateRegisterUser validates the contents of a request from a client to
 // register a new user. The length of the username and the public key bit-length is validated.
-func ValidateRegisterUser(ws *websocket.Conn, msg *websock.RegisterUserMessage) bool {
+func (s *Server) ValidateRegisterUser(ws *websocket.Conn, msg *websock.RegisterUserMessage) bool {
 	msg.Username = strings.TrimSpace(msg.Username)
 
 	if len(msg.Username) < 3 {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Username must contain at least 3 characters"})
+		s.invalidField(ws, "Username", "Username must contain at least 3 characters")
 		return false
 	} else if len(msg.Username) > 20 {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Username cannot contain more than 20 characters"})
+		s.invalidField(ws, "Username", "Username cannot contain more than 20 characters")
 		return false
 	} else if !isAlphaNumeric(msg.Username) {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Username can only contain alphanumeric characters"})
+		s.invalidField(ws, "Username", "Username can only contain alphanumeric characters")
 		return false
 	}
 
+	return s.validatePublicKey(ws, msg.PublicKey)
+}
+
+// validatePublicKey checks that a public key is valid, and that the bit-length of the key is 2048 bits
+func (s *Server) validatePublicKey(ws *websocket.Conn, publicKey []byte) bool {
 	// Check key length
-	if pubKey, err := util.UnmarshalPublic(msg.PublicKey); err != nil {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Invalid public key"})
+	if pubKey, err := util.UnmarshalPublic(publicKey); err != nil {
+		s.invalidField(ws, "PublicKey", "Invalid public key")
 		return false
 	} else if pubKey.N.BitLen() != 2048 {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Size of public key modulus is not 2048 bits"})
+		s.invalidField(ws, "PublicKey", "Size of public key modulus is not 2048 bits")
 		return false
 	}
 
 	return true
 }
 
+// ValidateRotateKey validates the new public key in a request from a client to change the key of its device
+func (s *Server) ValidateRotateKey(ws *websocket.Conn, msg *websock.RotateKeyMessage) bool {
+	if len(msg.Signature) == 0 {
+		s.replyErrorDetails(ws, websock.CodeInvalidSignature, "The new key must be signed by the old key", map[string]string{"field": "Signature"})
+		return false
+	}
+	return s.validatePublicKey(ws, msg.PublicKey)
+}
+
+// ValidateAddDevice validates the public key of a new device, and that it is signed
+func (s *Server) ValidateAddDevice(ws *websocket.Conn, msg *websock.AddDeviceMessage) bool {
+	if len(msg.Signature) == 0 {
+		s.replyErrorDetails(ws, websock.CodeInvalidSignature, "The new device must be signed by this device", map[string]string{"field": "Signature"})
+		return false
+	}
+	return s.validatePublicKey(ws, msg.PublicKey)
+}
+
 // ValidateCreateChatRoom validates the content of a request from a client to create a new chat room.
 // the name of the chat room is validated. If the chat room has a password, this is also validated.
-func ValidateCreateChatRoom(ws *websocket.Conn, msg *websock.CreateChatRoomMessage) bool {
-	if len(msg.Name) < 3 {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Chat room name must contain at least 3 characters"})
+func (s *Server) ValidateCreateChatRoom(ws *websocket.Conn, msg *websock.CreateChatRoomMessage) bool {
+	return s.validateChatName(ws, "Name", msg.Name) && s.validateChatPassword(ws, msg.Password)
+}
+
+// ValidateRenameChatRoom validates the new name in a request from a client to rename a chat room
+func (s *Server) ValidateRenameChatRoom(ws *websocket.Conn, msg *websock.RenameChatRoomMessage) bool {
+	return s.validateChatName(ws, "NewName", msg.NewName)
+}
+
+// ValidateChangeChatPassword validates the new password in a request from a client to change the
+// password of a chat room. An empty password is valid, and removes the password
+func (s *Server) ValidateChangeChatPassword(ws *websocket.Conn, msg *websock.ChangeChatPasswordMessage) bool {
+	return s.validateChatPassword(ws, msg.Password)
+}
+
+// validateChatName checks the length and characters of a chat room name, which is the field of the message
+func (s *Server) validateChatName(ws *websocket.Conn, field, name string) bool {
+	if len(name) < 3 {
+		s.invalidField(ws, field, "Chat room name must contain at least 3 characters")
 		return false
-	} else if len(msg.Name) > 30 {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Chat room name cannot contain more than 30 characters"})
+	} else if len(name) > 30 {
+		s.invalidField(ws, field, "Chat room name cannot contain more than 30 characters")
 		return false
-	} else if !isAlphaNumeric(msg.Name) {
-		websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Chat room name can only contain alphanumeric characters"})
+	} else if !isAlphaNumeric(name) {
+		s.invalidField(ws, field, "Chat room name can only contain alphanumeric characters")
 		return false
 	}
+	return true
+}
 
-	if len(msg.Password) != 0 {
-		if len(msg.Password) < 6 {
-			websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Password must contain at least 6 characters"})
+// validateChatPassword checks the length of a chat room password, if the chat room has a password
+func (s *Server) validateChatPassword(ws *websocket.Conn, password string) bool {
+	if len(password) != 0 {
+		if len(password) < 6 {
+			s.invalidField(ws, "Password", "Password must contain at least 6 characters")
 			return false
-		} else if len(msg.Password) > 60 {
-			websock.Send(ws, &websock.Message{Type: websock.Error, Message: "Password cannot contain more than 60 characters"})
+		} else if len(password) > 60 {
+			s.invalidField(ws, "Password", "Password cannot contain more than 60 characters")
 			return false
 		}
 	}
 	return true
 }
+
+// ValidateSendChatMessage validates the format of a chat message sent by a client. The contents cannot
+// be validated as they are encrypted, but the message must be in the labeled hybrid format and contain the
+// encrypted message, and the timestamp of a signed message must be close to the server time.
+func (s *Server) ValidateSendChatMessage(ws *websocket.Conn, msg *websock.SendChatMessage) bool {
+	switch msg.Version {
+	case websock.MessageVersionLabeled:
+		if len(msg.Ciphertext) == 0 {
+			s.invalidField(ws, "Ciphertext", "Chat message has no ciphertext")
+			return false
+		}
+	case websock.MessageVersionSenderKey:
+		if len(msg.Ciphertext) == 0 {
+			s.invalidField(ws, "Ciphertext", "Chat message has no ciphertext")
+			return false
+		} else if !validSenderKeyID(msg.SenderKeyID) {
+			s.invalidField(ws, "SenderKeyID", "Invalid sender key ID")
+			return false
+		}
+	case 0, websock.MessageVersionRSA, websock.MessageVersionHybrid:
+		// Messages without a version were sent by older clients
+		s.replyErrorDetails(ws, websock.CodeUnsupported, "Chat message format is no longer supported, please update the client", map[string]string{"field": "Version"})
+		return false
+	default:
+		s.replyErrorDetails(ws, websock.CodeUnsupported, "Unsupported chat message version", map[string]string{"field": "Version"})
+		return false
+	}
+
+	if len(msg.EncryptedContent) == 0 {
+		s.invalidField(ws, "EncryptedContent", "Chat message has no recipients")
+		return false
+	}
+
+	// The timestamp of a signed message is chosen by the client, so it must be close to the server time
+	if len(msg.Signature) != 0 {
+		skew := time.Duration(util.NowMillis()-msg.Timestamp) * time.Millisecond
+		if skew > maxClockSkew || skew < -maxClockSkew {
+			s.invalidField(ws, "Timestamp", "Chat message timestamp is too far from the server time")
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateSendSenderKey validates a sender key distributed by a client. Every recipient must get the encrypted
+// chain key, which is not larger than a message key encrypted with a 2048 bit key
+func (s *Server) ValidateSendSenderKey(ws *websocket.Conn, msg *websock.SendSenderKeyMessage) bool {
+	if !validSenderKeyID(msg.KeyID) {
+		s.invalidField(ws, "KeyID", "Invalid sender key ID")
+		return false
+	}
+	if len(msg.EncryptedKeys) == 0 {
+		s.invalidField(ws, "EncryptedKeys", "Sender key has no recipients")
+		return false
+	}
+	for _, key := range msg.EncryptedKeys {
+		if len(key) == 0 || len(key) > maxEncryptedKeySize {
+			s.invalidField(ws, "EncryptedKeys", "Invalid encrypted sender key")
+			return false
+		}
+	}
+	return true
+}
+
+// validSenderKeyID checks that a sender key ID is the hex encoding of 8 bytes (see util.NewSenderKeyID)
+func validSenderKeyID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 8
+}
+
+// ValidateGetHistory validates a request from a client to retrieve older chat messages. The number of messages
+// cannot be more than maxHistoryPageSize, and the cursor must be a valid message ID
+func (s *Server) ValidateGetHistory(ws *websocket.Conn, msg *websock.GetHistoryMessage) bool {
+	if msg.Limit < 0 || msg.Limit > maxHistoryPageSize {
+		s.invalidField(ws, "Limit", "Invalid number of chat messages")
+		return false
+	}
+	if msg.Before != nil && !mdb.ValidID(msg.Before.ID) {
+		s.invalidField(ws, "Before", "Invalid chat history cursor")
+		return false
+	}
+	return true
+}
+
+// ValidateCreateInvite validates a request from a client to create an invite to a chat room. The invite
+// cannot be valid for longer than maxInviteValidity, and must be usable between 1 and maxInviteUses times
+func (s *Server) ValidateCreateInvite(ws *websocket.Conn, msg *websock.CreateInviteMessage) bool {
+	if msg.ValidFor == 0 {
+		msg.ValidFor = defaultInviteValidity
+	}
+
+	if msg.ValidFor < 0 || msg.ValidFor > maxInviteValidity {
+		s.invalidField(ws, "ValidFor", "Invites cannot be valid for longer than 30 days")
+		return false
+	} else if msg.MaxUses < 1 || msg.MaxUses > maxInviteUses {
+		s.invalidField(ws, "MaxUses", "Invites must be usable between 1 and 1000 times")
+		return false
+	}
+	return true
+}
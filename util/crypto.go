@@ -0,0 +1,244 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MessageKeySize is the size in bytes of the AES-256 key used to encrypt a chat message
+	MessageKeySize = 32
+)
+
+// messageKeyLabel is the RSA-OAEP label of chat message keys. A ciphertext can only be decrypted with the
+// label it was encrypted with, so a message key can not be decrypted for any other use of the users key pair
+var messageKeyLabel = []byte("go-e2ee-chat-engine message key")
+
+// EncryptMessage encrypts a message with AES-256-GCM using a new random key.
+// Returns the ciphertext, with the nonce prepended, and the generated key
+func EncryptMessage(plaintext []byte) (ciphertext []byte, key []byte, err error) {
+	key = make([]byte, MessageKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	ciphertext, err = EncryptMessageWithKey(plaintext, key)
+	return
+}
+
+// EncryptMessageWithKey encrypts a message with AES-256-GCM using the given key, such as a message key derived
+// from a sender key. Returns the ciphertext, with the nonce prepended
+func EncryptMessageWithKey(plaintext []byte, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// DecryptMessage decrypts a message encrypted by EncryptMessage using the given key
+func DecryptMessage(ciphertext []byte, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// WrapKey encrypts a message key with an RSA public key using RSA-OAEP with SHA-256 and the message key label
+func WrapKey(pubKey *rsa.PublicKey, key []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, key, messageKeyLabel)
+}
+
+// UnwrapKey decrypts a message key encrypted by WrapKey
+func UnwrapKey(privKey *rsa.PrivateKey, wrappedKey []byte) ([]byte, error) {
+	return unwrapKey(privKey, wrappedKey, messageKeyLabel)
+}
+
+// UnwrapLegacyKey decrypts a message key of a chat message stored by an older client, which was encrypted
+// with RSA-OAEP without a label
+func UnwrapLegacyKey(privKey *rsa.PrivateKey, wrappedKey []byte) ([]byte, error) {
+	return unwrapKey(privKey, wrappedKey, nil)
+}
+
+func unwrapKey(privKey *rsa.PrivateKey, wrappedKey, label []byte) ([]byte, error) {
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privKey, wrappedKey, label)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != MessageKeySize {
+		return nil, errors.New("Message key has invalid length")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The signature contexts separate the different uses of signatures made with the user's key, so a
+// signature made for one use can never be valid for another
+const (
+	chatSignatureContext   = "go-e2ee-chat-engine chat message signature"
+	loginSignatureContext  = "go-e2ee-chat-engine login signature"
+	deviceSignatureContext = "go-e2ee-chat-engine device signature"
+	keySignatureContext    = "go-e2ee-chat-engine key change signature"
+	renameSignatureContext = "go-e2ee-chat-engine chat room rename signature"
+)
+
+// signatureDigest computes the digest which is signed for the given context and fields. Every field is
+// prefixed by its length, so different field values can never result in the same digest
+func signatureDigest(context string, fields ...[]byte) []byte {
+	h := sha256.New()
+	for _, field := range append([][]byte{[]byte(context)}, fields...) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+// chatMessageDigest computes the digest which is signed for a chat message
+func chatMessageDigest(chatName, sender string, timestamp int64, ciphertext []byte) []byte {
+	return signatureDigest(chatSignatureContext,
+		[]byte(chatName), []byte(sender), []byte(strconv.FormatInt(timestamp, 10)), ciphertext)
+}
+
+// SignChatMessage creates a detached RSA-PSS signature over the ciphertext, chat room name,
+// timestamp and sender of a chat message
+func SignChatMessage(privKey *rsa.PrivateKey, chatName, sender string, timestamp int64, ciphertext []byte) ([]byte, error) {
+	digest := chatMessageDigest(chatName, sender, timestamp, ciphertext)
+	return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, digest, nil)
+}
+
+// VerifyChatMessage verifies a signature created by SignChatMessage using the public key of the sender
+func VerifyChatMessage(pubKey *rsa.PublicKey, chatName, sender string, timestamp int64, ciphertext, signature []byte) error {
+	digest := chatMessageDigest(chatName, sender, timestamp, ciphertext)
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, digest, signature, nil)
+}
+
+// loginDigest computes the digest which is signed to log in. The host name is case insensitive
+func loginDigest(host, username string, nonce []byte) []byte {
+	return signatureDigest(loginSignatureContext, []byte(strings.ToLower(host)), []byte(username), nonce)
+}
+
+// SignLogin creates an RSA-PSS signature over the auth challenge nonce sent by a server, the host name
+// of the server and the username, which proves that the client has the private key of the user.
+// As the host name is included, the signature can not be used to log in to any other server
+func SignLogin(privKey *rsa.PrivateKey, host, username string, nonce []byte) ([]byte, error) {
+	return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, loginDigest(host, username, nonce), nil)
+}
+
+// VerifyLogin verifies a signature created by SignLogin using the public key of the user
+func VerifyLogin(pubKey *rsa.PublicKey, host, username string, nonce, signature []byte) error {
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, loginDigest(host, username, nonce), signature, nil)
+}
+
+// SignDevice creates an RSA-PSS signature over the public key of a new device of a user, made with the
+// private key of an existing device of the user, to add the new device to the account
+func SignDevice(privKey *rsa.PrivateKey, username string, publicKey []byte) ([]byte, error) {
+	digest := signatureDigest(deviceSignatureContext, []byte(username), publicKey)
+	return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, digest, nil)
+}
+
+// VerifyDevice verifies a signature created by SignDevice using the public key of the existing device
+func VerifyDevice(pubKey *rsa.PublicKey, username string, publicKey, signature []byte) error {
+	digest := signatureDigest(deviceSignatureContext, []byte(username), publicKey)
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, digest, signature, nil)
+}
+
+// SignKeyChange creates an RSA-PSS signature over the new public key of a device of a user, made with
+// the private key it replaces, which proves that the key was changed by the owner of the old key
+func SignKeyChange(privKey *rsa.PrivateKey, username string, newPublicKey []byte) ([]byte, error) {
+	digest := signatureDigest(keySignatureContext, []byte(username), newPublicKey)
+	return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, digest, nil)
+}
+
+// VerifyKeyChange verifies a signature created by SignKeyChange using the old public key
+func VerifyKeyChange(pubKey *rsa.PublicKey, username string, newPublicKey, signature []byte) error {
+	digest := signatureDigest(keySignatureContext, []byte(username), newPublicKey)
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, digest, signature, nil)
+}
+
+// SignChatRename creates an RSA-PSS signature over the old and new name of a chat room, made by the owner
+// of the chat room when renaming it, which proves that the chat messages signed with the old name were sent
+// in the chat room
+func SignChatRename(privKey *rsa.PrivateKey, owner, name, newName string) ([]byte, error) {
+	digest := signatureDigest(renameSignatureContext, []byte(owner), []byte(name), []byte(newName))
+	return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, digest, nil)
+}
+
+// VerifyChatRename verifies a signature created by SignChatRename using the public key of the owner
+func VerifyChatRename(pubKey *rsa.PublicKey, owner, name, newName string, signature []byte) error {
+	digest := signatureDigest(renameSignatureContext, []byte(owner), []byte(name), []byte(newName))
+	return rsa.VerifyPSS(pubKey, crypto.SHA256, digest, signature, nil)
+}
+
+// Fingerprint gets the fingerprint of a public key (as marshaled by MarshalPublic), which is the hex
+// encoding of the SHA-256 hash of the key, in groups of four characters
+func Fingerprint(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	encoded := hex.EncodeToString(hash[:])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// safetyNumberContext separates the digest of a safety number from the digests which are signed
+const safetyNumberContext = "go-e2ee-chat-engine safety number"
+
+// SafetyNumber gets the safety number of the public keys of two users, which the users can compare out of band
+// to check that they have each other's keys. It does not depend on the order of the keys, and is 30 digits
+// in groups of five
+func SafetyNumber(publicKey, otherPublicKey []byte) string {
+	keys := [][]byte{publicKey, otherPublicKey}
+	if bytes.Compare(keys[0], keys[1]) > 0 {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	digest := signatureDigest(safetyNumberContext, keys...)
+
+	groups := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		// Every group is five digits from five bytes of the digest
+		group := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, digest[i*5:i*5+5]...)) % 100000
+		groups = append(groups, fmt.Sprintf("%05d", group))
+	}
+	return strings.Join(groups, " ")
+}
+
+// KeyID gets the ID of a public key (as marshaled by MarshalPublic), which is the hex encoding
+// of the first 8 bytes of the SHA-256 hash of the key
+func KeyID(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// inviteContext is prepended to an invite token before it is signed, so the HMAC
+// of an invite can not be mistaken for any other use of the server secret
+const inviteContext = "go-e2ee-chat-engine invite"
+
+// ErrInvalidInvite is returned when an invite token is malformed, or its signature is invalid
+var ErrInvalidInvite = errors.New("Invalid invite")
+
+// InviteToken is the content of an invite to a chat room. The token is signed by the server, which keeps track
+// of how many times the invite has been used, and of the chat room it is for, which can be renamed.
+// ExpiresAt is a timestamp in milliseconds
+type InviteToken struct {
+	ID        string `json:"id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// inviteMAC computes the HMAC-SHA256 of the encoded content of an invite token
+func inviteMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(inviteContext))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// SignInvite encodes an invite token, and signs it with the secret of the server.
+// The token consists of the base64 encoded content and signature, separated by a dot
+func SignInvite(secret []byte, invite *InviteToken) (string, error) {
+	content, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(content)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(inviteMAC(secret, payload)), nil
+}
+
+// parseInvite decodes the content of an invite token without checking the signature
+func parseInvite(token string) (*InviteToken, error) {
+	payload, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidInvite
+	}
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	invite := new(InviteToken)
+	if err := json.Unmarshal(content, invite); err != nil {
+		return nil, ErrInvalidInvite
+	}
+	return invite, nil
+}
+
+// VerifyInvite checks the signature of an invite token using the secret of the server, and decodes its content
+func VerifyInvite(secret []byte, token string) (*InviteToken, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidInvite
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, inviteMAC(secret, payload)) {
+		return nil, ErrInvalidInvite
+	}
+	return parseInvite(token)
+}
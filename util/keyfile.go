@@ -0,0 +1,107 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The format of an encrypted private key file. The file is a PEM block of type keyFileType, containing
+// the version, the scrypt parameters (log2 N, r and p), the salt, the nonce and the AES-256-GCM
+// encrypted PKCS#1 private key. The version, parameters and salt are authenticated as additional data
+const (
+	keyFileType    = "E2EE CHAT PRIVATE KEY"
+	keyFileVersion = 1
+	keyFileSaltLen = 16
+
+	// The scrypt parameters of new key files, the recommended parameters for interactive logins
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// The scrypt parameters of a key file are read from the file, and are limited so that a corrupted file
+	// can not make the client run out of memory or time
+	minScryptLogN = 10
+	maxScryptLogN = 20
+	maxScryptR    = 16
+	maxScryptP    = 4
+)
+
+// ErrWrongPassphrase is returned when a private key file can not be decrypted with the given passphrase
+var ErrWrongPassphrase = errors.New("Wrong passphrase, or the private key file is corrupted")
+
+// EncryptPrivateKey encrypts a private key with a passphrase, and returns the contents of the private key file
+func EncryptPrivateKey(key *rsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	header := make([]byte, 4+keyFileSaltLen)
+	header[0] = keyFileVersion
+	header[1] = scryptLogN
+	header[2] = scryptR
+	header[3] = scryptP
+	if _, err := rand.Read(header[4:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := keyFileAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	data := append(header, nonce...)
+	data = aead.Seal(data, nonce, x509.MarshalPKCS1PrivateKey(key), header)
+	return pem.EncodeToMemory(&pem.Block{Type: keyFileType, Bytes: data}), nil
+}
+
+// DecryptPrivateKey decrypts the contents of a private key file with a passphrase
+func DecryptPrivateKey(keyFile, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyFile)
+	if block == nil || block.Type != keyFileType {
+		return nil, errors.New("Private key file was not in the correct format")
+	}
+
+	data := block.Bytes
+	if len(data) < 4+keyFileSaltLen || data[0] != keyFileVersion {
+		return nil, errors.New("Unsupported private key file version")
+	}
+	header, data := data[:4+keyFileSaltLen], data[4+keyFileSaltLen:]
+
+	aead, err := keyFileAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	der, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// keyFileAEAD derives the key of a private key file from the passphrase, using the scrypt parameters and salt in the header
+func keyFileAEAD(header, passphrase []byte) (cipher.AEAD, error) {
+	logN, r, p, salt := uint(header[1]), int(header[2]), int(header[3]), header[4:]
+	if logN < minScryptLogN || logN > maxScryptLogN || r < 1 || r > maxScryptR || p < 1 || p > maxScryptP {
+		return nil, errors.New("Unsupported private key file parameters")
+	}
+
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
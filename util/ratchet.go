@@ -0,0 +1,135 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+)
+
+const (
+	// SenderKeySize is the size in bytes of the chain key of a sender key, which is wrapped like a message key
+	SenderKeySize = MessageKeySize
+
+	// senderKeyIDSize is the size in bytes of the random ID of a sender key
+	senderKeyIDSize = 8
+
+	// maxSkippedKeys is the number of message keys a receiving chain keeps for messages which have not been
+	// decrypted yet, such as older messages in the chat history
+	maxSkippedKeys = 2000
+)
+
+// The inputs of the hash ratchet, the message key and the next chain key are derived from the chain key
+var (
+	messageKeySeed = []byte{1}
+	chainKeySeed   = []byte{2}
+)
+
+// ErrMessageKeyUnavailable is returned by SenderChain.MessageKey when the message key of an iteration has already
+// been used or discarded, so the message can no longer be decrypted
+var ErrMessageKeyUnavailable = errors.New("The message key is no longer available")
+
+// SenderChain is the symmetric hash ratchet of a sender key. Every chat message is encrypted with a message key
+// derived from the chain key, which is then replaced by the next chain key, so the keys of earlier messages can not
+// be derived from the current state. The sender and every recipient have their own copy of the chain
+//
+// A SenderChain is not threadsafe
+type SenderChain struct {
+	key       []byte
+	iteration uint32
+	skipped   map[uint32][]byte
+}
+
+// NewSenderKeyID creates the random ID of a new sender key
+func NewSenderKeyID() (string, error) {
+	id := make([]byte, senderKeyIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// NewSenderChain creates a sender chain with a new random chain key
+func NewSenderChain() (*SenderChain, error) {
+	key := make([]byte, SenderKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &SenderChain{key: key, skipped: make(map[uint32][]byte)}, nil
+}
+
+// SenderChainFromKey creates a sender chain from the chain key of another chain, at iteration zero
+func SenderChainFromKey(key []byte) (*SenderChain, error) {
+	if len(key) != SenderKeySize {
+		return nil, errors.New("Sender key has invalid length")
+	}
+	return &SenderChain{key: append([]byte(nil), key...), skipped: make(map[uint32][]byte)}, nil
+}
+
+// Key gets the current chain key, which is distributed to the recipients before the first message is sent
+func (c *SenderChain) Key() []byte {
+	return append([]byte(nil), c.key...)
+}
+
+// Next gets the message key of the next message and its iteration, and advances the chain
+func (c *SenderChain) Next() ([]byte, uint32) {
+	iteration := c.iteration
+	return c.advance(), iteration
+}
+
+// MessageKey gets the message key of the message at the iteration. The keys of the messages between the current
+// iteration and the requested one are kept, so they can be decrypted later, but every key can only be used once
+func (c *SenderChain) MessageKey(iteration uint32) ([]byte, error) {
+	if iteration < c.iteration {
+		key, ok := c.skipped[iteration]
+		if !ok {
+			return nil, ErrMessageKeyUnavailable
+		}
+		delete(c.skipped, iteration)
+		return key, nil
+	}
+	if iteration-c.iteration > maxSkippedKeys {
+		return nil, errors.New("Too many messages were skipped in the sender key")
+	}
+
+	for c.iteration < iteration {
+		c.skipped[c.iteration] = c.advance()
+	}
+	c.pruneSkipped()
+	return c.advance(), nil
+}
+
+// advance derives the message key of the current iteration, and replaces the chain key with the next chain key
+func (c *SenderChain) advance() []byte {
+	messageKey := hmacSHA256(c.key, messageKeySeed)
+	next := hmacSHA256(c.key, chainKeySeed)
+	for i := range c.key {
+		c.key[i] = 0
+	}
+	c.key = next
+	c.iteration++
+	return messageKey
+}
+
+// pruneSkipped discards the oldest skipped message keys, so at most maxSkippedKeys are kept
+func (c *SenderChain) pruneSkipped() {
+	if len(c.skipped) <= maxSkippedKeys {
+		return
+	}
+	iterations := make([]int, 0, len(c.skipped))
+	for iteration := range c.skipped {
+		iterations = append(iterations, int(iteration))
+	}
+	sort.Ints(iterations)
+	for _, iteration := range iterations[:len(iterations)-maxSkippedKeys] {
+		delete(c.skipped, uint32(iteration))
+	}
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
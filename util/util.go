@@ -64,3 +64,8 @@ func UnmarshalPublic(pemBlock []byte) (key *rsa.PublicKey, err error) {
 func NowMillis() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
+
+// MillisToTime converts a unix millisecond timestamp to a time
+func MillisToTime(millis int64) time.Time {
+	return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+}
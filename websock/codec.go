@@ -5,55 +5,139 @@ import (
 	"encoding/gob"
 	"errors"
 	"log"
+	"net/http"
+	"strings"
 
 	"golang.org/x/net/websocket"
 )
 
-// codec is the decoder for messages sent over the websocket
-var codec = websocket.Codec{Marshal: marshalMessage, Unmarshal: unmarshalMessage}
+// codecs are the codecs messages can be sent over the websocket with, by name (see HelloMessage)
+var codecs = map[string]websocket.Codec{
+	CodecGob:  {Marshal: marshalMessage, Unmarshal: unmarshalMessage},
+	CodecJSON: {Marshal: marshalJSONMessage, Unmarshal: unmarshalJSONMessage},
+}
+
+// subprotocolPrefix is the prefix of the websocket subprotocols, the subprotocol of a codec is the prefix
+// followed by the name of the codec
+const subprotocolPrefix = "go-e2ee-chat-engine."
+
+// Subprotocol gets the websocket subprotocol a client requests to use the codec
+func Subprotocol(codec string) string {
+	return subprotocolPrefix + codec
+}
+
+// Codec gets the name of the codec of the connection, which is chosen by the websocket subprotocol.
+// Connections without a subprotocol use gob
+func Codec(ws *websocket.Conn) string {
+	if protocols := ws.Config().Protocol; len(protocols) == 1 {
+		if codec, ok := subprotocolCodec(protocols[0]); ok {
+			return codec
+		}
+	}
+	return CodecGob
+}
+
+// subprotocolCodec gets the codec of a websocket subprotocol, ok is false if it is not the subprotocol of a codec
+func subprotocolCodec(protocol string) (codec string, ok bool) {
+	if !strings.HasPrefix(protocol, subprotocolPrefix) {
+		return "", false
+	}
+	codec = strings.TrimPrefix(protocol, subprotocolPrefix)
+	_, ok = codecs[codec]
+	return codec, ok
+}
+
+// Handshake checks the websocket handshake of a client, and chooses the first subprotocol the client requests
+// which is the subprotocol of a codec. Like websocket.Handler, it rejects clients without an Origin header
+func Handshake(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return errors.New("null origin")
+	}
+	config.Origin = origin
+
+	requested := config.Protocol
+	config.Protocol = nil
+	for _, protocol := range requested {
+		if _, ok := subprotocolCodec(protocol); ok {
+			config.Protocol = []string{protocol}
+			break
+		}
+	}
+	return nil
+}
 
-// Send sends a message to the connection synchronously
+// Send sends a message to the connection synchronously, encoded with the codec of the connection
 //
 // NB! This will fail if the given message contains incompatible type and content
 func Send(ws *websocket.Conn, msg *Message) error {
-	return codec.Send(ws, msg)
+	return codecs[Codec(ws)].Send(ws, msg)
 }
 
-// Receive fetches a message from the connection synchronously
+// Receive fetches a message from the connection synchronously, decoded with the codec of the connection
 //
 // NB! This will fail if the received message contains incompatible type and content
 func Receive(ws *websocket.Conn, msg *Message) error {
-	return codec.Receive(ws, msg)
+	return codecs[Codec(ws)].Receive(ws, msg)
 }
 
 // Register types for gob encoding/decoding
 func init() {
 	gob.Register(&RegisterUserMessage{})
+	gob.Register(&LoginUserMessage{})
 	gob.Register(&CreateChatRoomMessage{})
 	gob.Register(&GetChatRoomsResponseMessage{})
 	gob.Register(&JoinChatMessage{})
 	gob.Register(&ChatInfoMessage{})
 	gob.Register(&ChatMessage{})
 	gob.Register(&SendChatMessage{})
+	gob.Register(&UserJoinedMessage{})
+	gob.Register(&UserLeftMessage{})
+	gob.Register(&RenameChatRoomMessage{})
+	gob.Register(&ChangeChatPasswordMessage{})
+	gob.Register(&SetModeratorMessage{})
+	gob.Register(&ModerateUserMessage{})
+	gob.Register(&RemovedFromChatMessage{})
+	gob.Register(&SetRetentionMessage{})
+	gob.Register(&GetHistoryMessage{})
+	gob.Register(&HistoryMessage{})
+	gob.Register(&DirectsResponseMessage{})
+	gob.Register(&CreateInviteMessage{})
+	gob.Register(&InviteMessage{})
+	gob.Register(&SessionMessage{})
+	gob.Register(&ResumeSessionMessage{})
+	gob.Register(&AddDeviceMessage{})
+	gob.Register(&DevicesResponseMessage{})
+	gob.Register(&RotateKeyMessage{})
+	gob.Register(&KeyChangedMessage{})
+	gob.Register(&SendSenderKeyMessage{})
+	gob.Register(&SenderKeyMessage{})
+	gob.Register(&AckSenderKeysMessage{})
+	gob.Register(&HelloMessage{})
+	gob.Register(&ErrorMessage{})
 }
 
+// marshalMessage encodes a message with gob, which is binary, so it is sent in a binary frame
 func marshalMessage(v interface{}) ([]byte, byte, error) {
 	msg, ok := v.(*Message)
 	if !ok {
-		return nil, websocket.TextFrame, errors.New("Input to marshalMessage was not of type *Message")
+		return nil, websocket.BinaryFrame, errors.New("Input to marshalMessage was not of type *Message")
 	}
 
 	if err := checkType(msg.Message, msg.Type); err != nil {
-		return nil, websocket.TextFrame, err
+		return nil, websocket.BinaryFrame, err
 	}
 
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
 	if err := enc.Encode(msg); err != nil {
-		return nil, websocket.TextFrame, err
+		return nil, websocket.BinaryFrame, err
 	}
 
-	return buf.Bytes(), websocket.TextFrame, nil
+	return buf.Bytes(), websocket.BinaryFrame, nil
 }
 
 func unmarshalMessage(data []byte, payloadType byte, v interface{}) error {
@@ -78,11 +162,27 @@ func unmarshalMessage(data []byte, payloadType byte, v interface{}) error {
 
 func checkType(v interface{}, msgType MessageType) error {
 	switch msgType {
-	case Error, OK, LoginUser, UserLeft:
+	case OK, DeleteChatRoom, OpenDirect, RevokeInvite, LoggedOut, RevokeDevice, GetInvite:
 		if _, ok := v.(string); !ok {
 			return errors.New("Expected message type string")
 		}
 
+	case Error:
+		// Clients which are too old to support error codes are sent the error as a string
+		if _, ok := v.(*ErrorMessage); !ok {
+			if _, ok := v.(string); !ok {
+				return errors.New("Expected message type *ErrorMessage or string")
+			}
+		}
+
+	case LoginUser:
+		// Older clients send the username as a string
+		if _, ok := v.(*LoginUserMessage); !ok {
+			if _, ok := v.(string); !ok {
+				return errors.New("Expected message type *LoginUserMessage or string")
+			}
+		}
+
 	case RegisterUser:
 		if _, ok := v.(*RegisterUserMessage); !ok {
 			return errors.New("Expected message type *RegisterUserMessage")
@@ -98,7 +198,7 @@ func checkType(v interface{}, msgType MessageType) error {
 			return errors.New("Expected message type *CreateChatRoomMessage")
 		}
 
-	case GetChatRooms, LeaveChat, Ping, Pong:
+	case GetChatRooms, GetDirects, GetDevices, Ping, Pong:
 		if v != nil {
 			return errors.New("Expected message to be nil")
 		}
@@ -118,7 +218,7 @@ func checkType(v interface{}, msgType MessageType) error {
 			return errors.New("Expected message type *ChatInfoMessage")
 		}
 
-	case SendChat:
+	case SendChat, SendDirect:
 		if _, ok := v.(*SendChatMessage); !ok {
 			return errors.New("Expected message type *SendChatMessage")
 		}
@@ -129,9 +229,126 @@ func checkType(v interface{}, msgType MessageType) error {
 		}
 
 	case UserJoined:
-		if _, ok := v.(*User); !ok {
-			return errors.New("Expected message type *User")
+		if _, ok := v.(*UserJoinedMessage); !ok {
+			return errors.New("Expected message type *UserJoinedMessage")
+		}
+
+	case UserLeft:
+		if _, ok := v.(*UserLeftMessage); !ok {
+			return errors.New("Expected message type *UserLeftMessage")
+		}
+
+	case LeaveChat:
+		// Older clients send nil, which means leaving every chat room
+		if _, ok := v.(string); !ok && v != nil {
+			return errors.New("Expected message type string or nil")
+		}
+
+	case RenameChatRoom, ChatRoomRenamed:
+		if _, ok := v.(*RenameChatRoomMessage); !ok {
+			return errors.New("Expected message type *RenameChatRoomMessage")
+		}
+
+	case ChangeChatPassword:
+		if _, ok := v.(*ChangeChatPasswordMessage); !ok {
+			return errors.New("Expected message type *ChangeChatPasswordMessage")
+		}
+
+	case SetModerator:
+		if _, ok := v.(*SetModeratorMessage); !ok {
+			return errors.New("Expected message type *SetModeratorMessage")
+		}
+
+	case KickUser, BanUser:
+		if _, ok := v.(*ModerateUserMessage); !ok {
+			return errors.New("Expected message type *ModerateUserMessage")
 		}
+
+	case RemovedFromChat:
+		if _, ok := v.(*RemovedFromChatMessage); !ok {
+			return errors.New("Expected message type *RemovedFromChatMessage")
+		}
+
+	case SetRetention:
+		if _, ok := v.(*SetRetentionMessage); !ok {
+			return errors.New("Expected message type *SetRetentionMessage")
+		}
+
+	case GetHistory:
+		if _, ok := v.(*GetHistoryMessage); !ok {
+			return errors.New("Expected message type *GetHistoryMessage")
+		}
+
+	case History:
+		if _, ok := v.(*HistoryMessage); !ok {
+			return errors.New("Expected message type *HistoryMessage")
+		}
+
+	case DirectsResponse:
+		if _, ok := v.(*DirectsResponseMessage); !ok {
+			return errors.New("Expected message type *DirectsResponseMessage")
+		}
+
+	case CreateInvite:
+		if _, ok := v.(*CreateInviteMessage); !ok {
+			return errors.New("Expected message type *CreateInviteMessage")
+		}
+
+	case InviteCreated, InviteInfo:
+		if _, ok := v.(*InviteMessage); !ok {
+			return errors.New("Expected message type *InviteMessage")
+		}
+
+	case SessionStarted:
+		if _, ok := v.(*SessionMessage); !ok {
+			return errors.New("Expected message type *SessionMessage")
+		}
+
+	case ResumeSession:
+		if _, ok := v.(*ResumeSessionMessage); !ok {
+			return errors.New("Expected message type *ResumeSessionMessage")
+		}
+
+	case AddDevice:
+		if _, ok := v.(*AddDeviceMessage); !ok {
+			return errors.New("Expected message type *AddDeviceMessage")
+		}
+
+	case DevicesResponse:
+		if _, ok := v.(*DevicesResponseMessage); !ok {
+			return errors.New("Expected message type *DevicesResponseMessage")
+		}
+
+	case RotateKey:
+		if _, ok := v.(*RotateKeyMessage); !ok {
+			return errors.New("Expected message type *RotateKeyMessage")
+		}
+
+	case KeyChanged:
+		if _, ok := v.(*KeyChangedMessage); !ok {
+			return errors.New("Expected message type *KeyChangedMessage")
+		}
+
+	case SendSenderKey:
+		if _, ok := v.(*SendSenderKeyMessage); !ok {
+			return errors.New("Expected message type *SendSenderKeyMessage")
+		}
+
+	case SenderKeyReceived:
+		if _, ok := v.(*SenderKeyMessage); !ok {
+			return errors.New("Expected message type *SenderKeyMessage")
+		}
+
+	case AckSenderKeys:
+		if _, ok := v.(*AckSenderKeysMessage); !ok {
+			return errors.New("Expected message type *AckSenderKeysMessage")
+		}
+
+	case Hello:
+		if _, ok := v.(*HelloMessage); !ok {
+			return errors.New("Expected message type *HelloMessage")
+		}
+
 	default:
 		return errors.New("Invalid message type")
 	}
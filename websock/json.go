@@ -0,0 +1,163 @@
+package websock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"golang.org/x/net/websocket"
+)
+
+// jsonMessage is a message encoded with the json codec. It is a tagged union, Type is the value of the message type
+// in the registry, and decides how Message is decoded. Structs are encoded as JSON objects with the names of their
+// fields, byte slices as base64 strings, and a message without content as null. ID is left out if it is empty
+type jsonMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    MessageType     `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+func marshalJSONMessage(v interface{}) ([]byte, byte, error) {
+	msg, ok := v.(*Message)
+	if !ok {
+		return nil, websocket.TextFrame, errors.New("Input to marshalJSONMessage was not of type *Message")
+	}
+
+	if err := checkType(msg.Message, msg.Type); err != nil {
+		return nil, websocket.TextFrame, err
+	}
+
+	content, err := json.Marshal(msg.Message)
+	if err != nil {
+		return nil, websocket.TextFrame, err
+	}
+	data, err := json.Marshal(&jsonMessage{ID: msg.ID, Type: msg.Type, Message: content})
+	if err != nil {
+		return nil, websocket.TextFrame, err
+	}
+
+	return data, websocket.TextFrame, nil
+}
+
+func unmarshalJSONMessage(data []byte, payloadType byte, v interface{}) error {
+	msg, ok := v.(*Message)
+	if !ok {
+		return errors.New("Input to unmarshalJSONMessage was not of type *Message")
+	}
+
+	var encoded jsonMessage
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	msg.ID = encoded.ID
+	msg.Type = encoded.Type
+	msg.Message = nil
+	if len(encoded.Message) > 0 && !bytes.Equal(encoded.Message, []byte("null")) {
+		content, err := decodeJSONContent(encoded.Type, encoded.Message)
+		if err != nil {
+			return err
+		}
+		msg.Message = content
+	}
+
+	if err := checkType(msg.Message, msg.Type); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// decodeJSONContent decodes the content of a message of the type, into the type of content checkType expects.
+// Content of messages which should not have any is decoded as is, so checkType rejects it
+func decodeJSONContent(msgType MessageType, data json.RawMessage) (interface{}, error) {
+	var content interface{}
+	switch msgType {
+	case OK, DeleteChatRoom, OpenDirect, RevokeInvite, LoggedOut, RevokeDevice, LeaveChat, GetInvite:
+		var s string
+		err := json.Unmarshal(data, &s)
+		return s, err
+	case Error:
+		// The error is a string if the client is too old to support error codes
+		if data[0] == '"' {
+			var s string
+			err := json.Unmarshal(data, &s)
+			return s, err
+		}
+		content = &ErrorMessage{}
+	case AuthChallenge, AuthChallengeResponse:
+		var b []byte
+		err := json.Unmarshal(data, &b)
+		return b, err
+	case LoginUser:
+		content = &LoginUserMessage{}
+	case RegisterUser:
+		content = &RegisterUserMessage{}
+	case CreateChatRoom:
+		content = &CreateChatRoomMessage{}
+	case GetChatRoomsResponse:
+		content = &GetChatRoomsResponseMessage{}
+	case JoinChat:
+		content = &JoinChatMessage{}
+	case ChatInfo:
+		content = &ChatInfoMessage{}
+	case SendChat, SendDirect:
+		content = &SendChatMessage{}
+	case ChatMessageReceived:
+		content = &ChatMessage{}
+	case UserJoined:
+		content = &UserJoinedMessage{}
+	case UserLeft:
+		content = &UserLeftMessage{}
+	case RenameChatRoom, ChatRoomRenamed:
+		content = &RenameChatRoomMessage{}
+	case ChangeChatPassword:
+		content = &ChangeChatPasswordMessage{}
+	case SetModerator:
+		content = &SetModeratorMessage{}
+	case KickUser, BanUser:
+		content = &ModerateUserMessage{}
+	case RemovedFromChat:
+		content = &RemovedFromChatMessage{}
+	case SetRetention:
+		content = &SetRetentionMessage{}
+	case GetHistory:
+		content = &GetHistoryMessage{}
+	case History:
+		content = &HistoryMessage{}
+	case DirectsResponse:
+		content = &DirectsResponseMessage{}
+	case CreateInvite:
+		content = &CreateInviteMessage{}
+	case InviteCreated, InviteInfo:
+		content = &InviteMessage{}
+	case SessionStarted:
+		content = &SessionMessage{}
+	case ResumeSession:
+		content = &ResumeSessionMessage{}
+	case AddDevice:
+		content = &AddDeviceMessage{}
+	case DevicesResponse:
+		content = &DevicesResponseMessage{}
+	case RotateKey:
+		content = &RotateKeyMessage{}
+	case KeyChanged:
+		content = &KeyChangedMessage{}
+	case SendSenderKey:
+		content = &SendSenderKeyMessage{}
+	case SenderKeyReceived:
+		content = &SenderKeyMessage{}
+	case AckSenderKeys:
+		content = &AckSenderKeysMessage{}
+	case Hello:
+		content = &HelloMessage{}
+	default:
+		// GetChatRooms, GetDirects, GetDevices, Ping, Pong and invalid message types
+		return data, nil
+	}
+
+	err := json.Unmarshal(data, content)
+	return content, err
+}
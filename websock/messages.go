@@ -1,65 +1,151 @@
 package websock
 
-// MessageType enum contains all possible websocket message types
-type MessageType int
+import (
+	"sort"
+	"strings"
+	"time"
+)
 
 const (
-	// Error means that en error occurred
-	Error MessageType = iota
-	// OK means that the action was successful
-	OK
-
-	// RegisterUser is sent when a client wants to register a new user
-	RegisterUser
-	// LoginUser is sent when a client wants to authenticate as a user
-	LoginUser
-	// AuthChallenge is sent by the server when an authentication challenge is initiated
-	AuthChallenge
-	// AuthChallengeResponse is sent by the client in resposne to an authentication challenge
-	AuthChallengeResponse
-
-	// CreateChatRoom is sent when a client wants to create a new chat room
-	CreateChatRoom
-	// GetChatRooms is sent when a client wants to retrieve a list of available chat rooms
-	GetChatRooms
-	// GetChatRoomsResponse is sent by the server in response to a GetChatRooms message
-	GetChatRoomsResponse
-
-	// JoinChat is sent when a clients wants to join a chat session
-	JoinChat
-	// ChatInfo is sent by the server when a client has joined a chat session
-	ChatInfo
-	// SendChat is sent when a client sends a chat message
-	SendChat
-	// ChatMessageReceived is sent by the server when another user in a chat room sends a chat message
-	ChatMessageReceived
-	// UserJoined is sent by the server when a user joins a chat room the client is in
-	UserJoined
-	// UserLeft is sent by the server when a user leaves a chat room the client is in
-	UserLeft
-	// LeaveChat is sent when a client wants to leave a chat room
-	LeaveChat
-
-	// Ping is a keepalive message sent by the server
-	Ping
-	// Pong is sent by the client in response to a Ping message
-	Pong
+	// MessageVersionRSA is the original chat message format, where the whole message is RSA
+	// encrypted (PKCS#1 v1.5) once for every recipient. Messages without a version use this format.
+	// New messages in this format are no longer accepted by the server
+	MessageVersionRSA = 1
+	// MessageVersionHybrid is the chat message format where the message is encrypted once with
+	// a random AES-256-GCM key, and only the key is encrypted (RSA-OAEP) for every recipient.
+	// New messages in this format are no longer accepted by the server
+	MessageVersionHybrid = 2
+	// MessageVersionLabeled is the hybrid chat message format, where the message key is encrypted
+	// with RSA-OAEP using the message key label (see util.WrapKey)
+	MessageVersionLabeled = 3
+	// MessageVersionSenderKey is the chat message format where the message is encrypted with AES-256-GCM using
+	// a message key derived from a sender key of the sender (see util.SenderChain), which has been distributed
+	// to the recipients with SendSenderKey
+	MessageVersionSenderKey = 4
+)
+
+// SenderKeyLifetime is the longest time a client uses a sender key, before it creates a new one. Once a sender key
+// is older than the lifetime and the maximum age of the messages in a chat room, the server deletes it
+const SenderKeyLifetime = 24 * time.Hour
+
+const (
+	// AuthVersionPKCS1 is the original authentication scheme, where the auth challenge is encrypted
+	// with RSA PKCS#1 v1.5. Clients which send the username as a string use this scheme, it is no
+	// longer supported by the server
+	AuthVersionPKCS1 = 1
+	// AuthVersionOAEP is the authentication scheme where the auth challenge is encrypted with RSA-OAEP
+	// using the auth challenge label, it is no longer supported by the server
+	AuthVersionOAEP = 2
+	// AuthVersionSignature is the authentication scheme where the auth challenge is a random nonce,
+	// and the client responds with a signature over the nonce (see util.SignLogin)
+	AuthVersionSignature = 3
+)
+
+const (
+	// ProtocolVersion is the version of the wire protocol, which is sent in Hello. It is increased when a change
+	// to the messages can not be understood by the other side, new messages and fields are announced as features.
+	// In version 2 the content of Error is an ErrorMessage instead of a string
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest version of the wire protocol which is still supported
+	MinProtocolVersion = 2
+)
+
+// The codecs messages can be encoded with, see HelloMessage. The codec of a connection is chosen
+// with the websocket subprotocol (see Subprotocol)
+const (
+	// CodecGob encodes messages with encoding/gob, it is used by connections without a subprotocol
+	CodecGob = "gob"
+	// CodecJSON encodes messages as JSON objects, where "type" is the value of the message type and "message"
+	// is the content of the message (see the json codec)
+	CodecJSON = "json"
+)
+
+// The cipher suites chat messages can be encrypted with, see HelloMessage
+const (
+	// CipherSuiteLabeled is the cipher suite of MessageVersionLabeled
+	CipherSuiteLabeled = "rsa-oaep-sha256+aes-256-gcm"
+	// CipherSuiteSenderKey is the cipher suite of MessageVersionSenderKey
+	CipherSuiteSenderKey = "sender-key-hmac-sha256+aes-256-gcm"
+)
+
+// The optional features of the server, see HelloMessage
+const (
+	// FeatureSessions means that sessions can be resumed on a new connection (see ResumeSession)
+	FeatureSessions = "sessions"
+	// FeatureDevices means that users can log in from several devices (see AddDevice)
+	FeatureDevices = "devices"
+	// FeatureDirects means that users can talk in direct conversations (see OpenDirect)
+	FeatureDirects = "directs"
+	// FeatureInvites means that members of chat rooms can create invites (see CreateInvite)
+	FeatureInvites = "invites"
 )
 
 // Message is the "base" message which is used for all websocket messages
 // Type contains the type of the message (one of the MessageType enums)
 // Message contains the actual content of the message, which can be a string, byte slice, a struct, or nil.
+// ID is the request ID a client sets on a request, which the server sets on its responses to the request (OK,
+// Error or a response message), so the client can match them with the request. Messages the server sends by
+// itself, such as chat events, have no ID
 type Message struct {
+	ID      string
 	Type    MessageType
 	Message interface{}
 }
 
+// HelloMessage is sent by a client when it connects, with the version of the wire protocol and the codecs,
+// cipher suites and features it supports, in order of preference. The server responds with a Hello with its
+// version, the codec which is used for the connection, and the cipher suites and features both sides support,
+// or with an Error and closes the connection if the client is not compatible with the server
+type HelloMessage struct {
+	Version      int
+	Codecs       []string
+	CipherSuites []string
+	Features     []string
+}
+
+// Supports checks if the feature is one of the features in the hello message
+func (h *HelloMessage) Supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorMessage is the content of an Error sent by the server. Code is the stable code of the error, which clients
+// can react to, Message is a description of the error which can be shown to the user, and Details contains more
+// information about some errors (see the error codes). The server sends the error as a string instead to clients
+// which are too old to support error codes, so they can show the message
+type ErrorMessage struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]string
+}
+
+// Error gets the message of the error, so an ErrorMessage can be used as an error
+func (e *ErrorMessage) Error() string {
+	return e.Message
+}
+
 // RegisterUserMessage is the message sent by a client to request user registration
 type RegisterUserMessage struct {
 	Username  string
 	PublicKey []byte
 }
 
+// LoginUserMessage is the message sent by a client to log in as a user. AuthVersion is the
+// authentication scheme the client supports (one of the AuthVersion constants). If Resumable
+// is set, the server responds with SessionStarted instead of OK after a successful login.
+// Device is the ID of the public key of the device the client logs in from (see util.KeyID),
+// older clients do not send it and log in with the device the user registered with
+type LoginUserMessage struct {
+	Username    string
+	AuthVersion int
+	Resumable   bool
+	Device      string
+}
+
 // CreateChatRoomMessage is the message sent by a client to request creation of a new chat room
 type CreateChatRoomMessage struct {
 	Name     string
@@ -80,35 +166,353 @@ type Room struct {
 	OnlineUsers int
 }
 
-// JoinChatMessage is the message sent by a client to request to join a chat room
+// JoinChatMessage is the message sent by a client to request to join a chat room. Invite is an invite token
+// (see InviteMessage), which is used instead of the password, then Name must be the chat room the invite is for
+// (see GetInvite). Hidden chat rooms can only be joined with an invite, unless the user is already a member
 type JoinChatMessage struct {
 	Name     string
 	Password string
+	Invite   string
 }
 
-// ChatInfoMessage is the message sent by the server to a client who joined a chat room
+// ChatInfoMessage is the message sent by the server to a client who joined a chat room, or opened a direct conversation
+// Owner is the username of the owner of the chat room, and Moderators the usernames of the moderators.
+// Messages only contains the newest chat messages, HasMoreHistory is true if there are older messages,
+// which can be retrieved with GetHistory. Direct is true for a direct conversation, where Users are the two users
+// in the conversation, and chat messages are sent with SendDirect. Resumed is true when the chat info is sent
+// because the client resumed its session, then Messages only contains the messages the client missed, and
+// HasMoreHistory is true if the client missed more messages than were sent. MySession is the session of the client,
+// a user can be logged in with several sessions at once. Renames are the renames of the chat room, oldest first
 type ChatInfoMessage struct {
-	Name       string
-	MyUsername string
-	Users      []User
-	Messages   []*ChatMessage
+	Name           string
+	MyUsername     string
+	MySession      string
+	Owner          string
+	Moderators     []string
+	Users          []User
+	Messages       []*ChatMessage
+	HasMoreHistory bool
+	Direct         bool
+	Resumed        bool
+	SenderKeys     []*SenderKeyMessage
+	Renames        []ChatRename
 }
 
-// User is used in ChatInfoMessage, and by the server when notifying a client about a new connected user
+// User is used in ChatInfoMessage, and by the server when notifying a client about a new connected user.
+// ChatInfoMessage lists every member of the chat room, Online is false for members who are not in the chat room
+// at the moment, but chat messages should still be encrypted for them. Sessions are the sessions of the user which
+// are in the chat room, the user is online until every session has left. Devices are every device of the user,
+// every chat message should be encrypted for each of them which is not revoked. The revoked devices are listed so
+// clients can check the signatures of the devices added by them. PublicKey is the key of the device the user
+// registered with, which older clients encrypt chat messages for
 type User struct {
 	Username  string
 	PublicKey []byte
+	Online    bool
+	Sessions  []string
+	Devices   []Device
 }
 
-// ChatMessage is used in ChatInfoMessage, and by the server when notifying a client about a new chat message
-type ChatMessage struct {
-	Sender    string
+// Device is a device of a user with its own key pair, see User. The device the user registered with has an empty ID,
+// the other devices were added by the device SignedBy, and Signature is its signature over the public key of the
+// device (see util.SignDevice). PublicKey is the current key of the device, KeyChanges are the changes from the key
+// which was signed to PublicKey, oldest first. KeyChanges are only set in User
+type Device struct {
+	ID         string
+	PublicKey  []byte
+	Timestamp  int64
+	SignedBy   string
+	Signature  []byte
+	Revoked    bool
+	KeyChanges []KeyChange
+}
+
+// KeyChange is a change of the key of a device, Signature is the signature of OldKey over NewKey
+// (see util.SignKeyChange). Timestamp is the time in milliseconds when the key was changed, the chat messages
+// sent before it were signed with OldKey
+type KeyChange struct {
+	OldKey    []byte
+	NewKey    []byte
+	Signature []byte
 	Timestamp int64
-	Message   []byte
 }
 
-// SendChatMessage is the message sent by the client to the server when a new chat message is sent.
-// The map EncryptedContent contains the message content encrypted by every recipients public key
+// Recipient gets the recipient of a chat message for a device of a user, which is the key in EncryptedContent
+// of SendChatMessage. The recipient of the device the user registered with is the username
+func Recipient(username, deviceID string) string {
+	if deviceID == "" {
+		return username
+	}
+	return username + "/" + deviceID
+}
+
+// RecipientUsername gets the username of a recipient of a chat message, see Recipient
+func RecipientUsername(recipient string) string {
+	if i := strings.Index(recipient, "/"); i >= 0 {
+		return recipient[:i]
+	}
+	return recipient
+}
+
+// UserJoinedMessage is sent by the server when a session of a user joins a chat room the client is in
+type UserJoinedMessage struct {
+	ChatName string
+	User     User
+	Session  string
+}
+
+// UserLeftMessage is sent by the server when a session of a user leaves a chat room the client is in
+// Removed is true if the user was kicked or banned, and is no longer a member of the chat room, then
+// every session of the user has left and Session is empty
+type UserLeftMessage struct {
+	ChatName string
+	Username string
+	Session  string
+	Removed  bool
+}
+
+// RenameChatRoomMessage is sent by the owner of a chat room to rename it, and by the server
+// (as ChatRoomRenamed) to the clients in the chat room when it has been renamed. Signature is the
+// signature of the owner over the old and new name (see util.SignChatRename), Device is the device
+// of the owner which made it, and is set by the server
+type RenameChatRoomMessage struct {
+	Name      string
+	NewName   string
+	Device    string
+	Signature []byte
+}
+
+// ChatRename is a rename of a chat room in ChatInfoMessage, Signature is the signature of the owner over the
+// old and new name made with the key of Device (see util.SignChatRename), and Timestamp is the time in
+// milliseconds when the chat room was renamed. Clients check the signatures of the chat messages sent before
+// the chat room was renamed with the old name
+type ChatRename struct {
+	Name      string
+	NewName   string
+	Device    string
+	Signature []byte
+	Timestamp int64
+}
+
+// ChangeChatPasswordMessage is sent by the owner of a chat room to change its password,
+// an empty password removes the password
+type ChangeChatPasswordMessage struct {
+	Name     string
+	Password string
+}
+
+// SetModeratorMessage is sent by the owner of a chat room to add or remove a moderator
+type SetModeratorMessage struct {
+	ChatName    string
+	Username    string
+	IsModerator bool
+}
+
+// SetRetentionMessage is sent by the owner of a chat room to change how long its messages are kept.
+// Messages older than MaxAge are deleted, and only the MaxMessages newest messages are kept, zero means
+// no limit. The limits cannot be less strict than the limits of the server. If UseDefault is true, the
+// limits of the server are used
+type SetRetentionMessage struct {
+	ChatName    string
+	MaxAge      time.Duration
+	MaxMessages int
+	UseDefault  bool
+}
+
+// ModerateUserMessage is sent by a moderator of a chat room to kick or ban a user
+type ModerateUserMessage struct {
+	ChatName string
+	Username string
+}
+
+// RemovedFromChatMessage is sent by the server when the client has been removed from a chat room
+// Banned is true if the user is not allowed to join the chat room again
+type RemovedFromChatMessage struct {
+	ChatName string
+	Reason   string
+	Banned   bool
+}
+
+// ChatMessage is used in ChatInfoMessage, and by the server when notifying a client about a new chat message.
+// Message contains the content addressed to the recipient: the whole encrypted message for MessageVersionRSA,
+// or the encrypted message key for MessageVersionHybrid and MessageVersionLabeled, in which case Ciphertext
+// contains the encrypted message. For MessageVersionSenderKey, Message is empty, and Ciphertext is encrypted
+// with the message key at Iteration of the sender key SenderKeyID
+//
+// Signature is the senders signature over Ciphertext, ChatName, Timestamp and Sender (see util.SignChatMessage),
+// made with the key of the device SenderDevice, it is empty if the message was not signed. ID identifies the
+// message, together with Timestamp it is the cursor used to retrieve older messages
+type ChatMessage struct {
+	ID           string
+	Version      int
+	ChatName     string
+	Sender       string
+	SenderDevice string
+	Timestamp    int64
+	Message      []byte
+	Ciphertext   []byte
+	Signature    []byte
+	SenderKeyID  string
+	Iteration    uint32
+}
+
+// SendChatMessage is the message sent by the client to the server when a new chat message is sent in the chat room ChatName.
+// For MessageVersionLabeled, Ciphertext contains the AES-GCM encrypted message, and EncryptedContent contains the
+// message key encrypted by the public key of every device of every recipient, by Recipient. For MessageVersionSenderKey,
+// the message key is derived from a sender key (see ChatMessage), and the values of EncryptedContent are empty
+//
+// If Signature is set, it is the senders signature over the message (see ChatMessage), and Timestamp
+// is the timestamp included in the signature. Otherwise the server decides the timestamp
 type SendChatMessage struct {
+	ChatName         string
+	Version          int
+	Timestamp        int64
+	Ciphertext       []byte
 	EncryptedContent map[string][]byte
+	Signature        []byte
+	SenderKeyID      string
+	Iteration        uint32
+}
+
+// HistoryCursor is the position of a chat message in a chat room, see ChatMessage
+type HistoryCursor struct {
+	Timestamp int64
+	ID        string
+}
+
+// GetHistoryMessage is sent by a client to retrieve chat messages in a chat room, up to Limit messages
+// before the cursor Before. If Before is nil the newest messages are retrieved, and if Limit is zero
+// the server decides the number of messages
+type GetHistoryMessage struct {
+	ChatName string
+	Before   *HistoryCursor
+	Limit    int
+}
+
+// HistoryMessage is sent by the server in response to GetHistory, the messages are ordered by timestamp
+// (oldest first). HasMore is true if there are even older messages
+type HistoryMessage struct {
+	ChatName string
+	Messages []*ChatMessage
+	HasMore  bool
+}
+
+// DirectChatName gets the name of the direct conversation between two users. The name does not depend on the
+// order of the usernames, and can never be the name of a chat room, as chat room names are alphanumeric
+func DirectChatName(username, otherUsername string) string {
+	usernames := []string{username, otherUsername}
+	sort.Strings(usernames)
+	return "@" + usernames[0] + ":" + usernames[1]
+}
+
+// IsDirectChatName checks if a chat name is the name of a direct conversation
+func IsDirectChatName(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// DirectsResponseMessage is sent by the server in response to GetDirects, the conversations with the newest
+// messages are listed first
+type DirectsResponseMessage struct {
+	Conversations []Conversation
+}
+
+// Conversation is used in DirectsResponseMessage. Peer is the other user in the direct conversation, Online is
+// true if the other user is logged in, and Unread is the number of messages from the other user the user has not read
+type Conversation struct {
+	Name        string
+	Peer        string
+	Online      bool
+	Unread      int
+	LastMessage int64
+}
+
+// CreateInviteMessage is sent by a client in a chat room to create an invite to the chat room. The invite
+// expires after ValidFor (the server default if it is zero), and can be used to join MaxUses times
+type CreateInviteMessage struct {
+	ChatName string
+	ValidFor time.Duration
+	MaxUses  int
+}
+
+// InviteMessage is sent by the server in response to CreateInvite and GetInvite. Token is the invite token, which
+// other users join the chat room with, and ExpiresAt is the time in milliseconds when the invite expires. ChatName
+// is the current name of the chat room, which is read from the stored invite, so clients can join the chat room
+// with the invite after it has been renamed
+type InviteMessage struct {
+	ChatName  string
+	Token     string
+	ExpiresAt int64
+	MaxUses   int
+}
+
+// SessionMessage is sent by the server when a session has been started or resumed. Token is the resume token,
+// which can be used once to resume the session on a new connection, until ExpiresIn after the connection is lost
+type SessionMessage struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+// ResumeSessionMessage is sent by a client to resume its session on a new connection, instead of logging in.
+// Cursors is the newest chat message the client has received in each chat room it was in, the server sends the
+// chat info of every chat room with the messages after the cursor. The response is SessionStarted
+type ResumeSessionMessage struct {
+	Token   string
+	Cursors map[string]*HistoryCursor
+}
+
+// AddDeviceMessage is sent by a client to add a new device to the account of the user. Signature is the signature
+// of the device the client is logged in from over the public key of the new device (see util.SignDevice)
+type AddDeviceMessage struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// DevicesResponseMessage is sent by the server in response to GetDevices, with every device of the user,
+// also those which are revoked
+type DevicesResponseMessage struct {
+	Devices []Device
+}
+
+// RotateKeyMessage is sent by a client to replace the key of the device it is logged in from. Signature is the
+// signature of the old key over the new public key (see util.SignKeyChange)
+type RotateKeyMessage struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// KeyChangedMessage is sent by the server when a user has changed the key of a device, to every client in the chat
+// rooms the user is a member of. Signature is the signature of the old key of the device over the new PublicKey
+// (see util.SignKeyChange), which the clients can check with the key they had for the device
+type KeyChangedMessage struct {
+	ChatName  string
+	Username  string
+	Device    string
+	PublicKey []byte
+	Signature []byte
+}
+
+// SendSenderKeyMessage is sent by a client to distribute a new sender key in a chat room. EncryptedKeys contains
+// the chain key of the sender key (see util.SenderChain) encrypted by the public key of every device of every
+// recipient, by Recipient (see util.WrapKey)
+type SendSenderKeyMessage struct {
+	ChatName      string
+	KeyID         string
+	EncryptedKeys map[string][]byte
+}
+
+// SenderKeyMessage is a sender key distributed to the recipient, it is sent by the server to the clients in
+// a chat room which are logged in from a device the key was encrypted for, and in ChatInfoMessage until the
+// client has acknowledged it. Key is the chain key encrypted for the device of the recipient
+type SenderKeyMessage struct {
+	ChatName     string
+	Sender       string
+	SenderDevice string
+	KeyID        string
+	Key          []byte
+}
+
+// AckSenderKeysMessage is sent by a client when it has received the sender keys KeyIDs in a chat room
+type AckSenderKeysMessage struct {
+	ChatName string
+	KeyIDs   []string
 }
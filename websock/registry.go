@@ -0,0 +1,300 @@
+package websock
+
+import "strconv"
+
+// MessageType is the type of a websocket message
+//
+// The numeric values of the message types are part of the wire protocol, and are written out so they can never
+// change by accident: a deployed client which does not know about a change would interpret the messages as another
+// type. A new message type gets the next free value, and the value of a removed type is never reused
+type MessageType int
+
+const (
+	// Error means that en error occurred
+	Error MessageType = 0
+	// OK means that the action was successful
+	OK MessageType = 1
+
+	// RegisterUser is sent when a client wants to register a new user
+	RegisterUser MessageType = 2
+	// LoginUser is sent when a client wants to authenticate as a user. Older clients send the username as a string
+	LoginUser MessageType = 3
+	// AuthChallenge is sent by the server when an authentication challenge is initiated, it contains the nonce the client signs
+	AuthChallenge MessageType = 4
+	// AuthChallengeResponse is sent by the client in resposne to an authentication challenge, it contains the signature
+	AuthChallengeResponse MessageType = 5
+
+	// CreateChatRoom is sent when a client wants to create a new chat room
+	CreateChatRoom MessageType = 6
+	// GetChatRooms is sent when a client wants to retrieve a list of available chat rooms
+	GetChatRooms MessageType = 7
+	// GetChatRoomsResponse is sent by the server in response to a GetChatRooms message
+	GetChatRoomsResponse MessageType = 8
+
+	// JoinChat is sent when a clients wants to join a chat session
+	JoinChat MessageType = 9
+	// ChatInfo is sent by the server when a client has joined a chat session
+	ChatInfo MessageType = 10
+	// SendChat is sent when a client sends a chat message
+	SendChat MessageType = 11
+	// ChatMessageReceived is sent by the server when another user in a chat room sends a chat message
+	ChatMessageReceived MessageType = 12
+	// UserJoined is sent by the server when a user joins a chat room the client is in
+	UserJoined MessageType = 13
+	// UserLeft is sent by the server when a user leaves a chat room the client is in
+	UserLeft MessageType = 14
+	// LeaveChat is sent when a client wants to leave a chat room, the message is the name of the chat room
+	LeaveChat MessageType = 15
+
+	// Ping is a keepalive message sent by the server
+	Ping MessageType = 16
+	// Pong is sent by the client in response to a Ping message
+	Pong MessageType = 17
+
+	// RenameChatRoom is sent when the owner of a chat room wants to rename it
+	RenameChatRoom MessageType = 18
+	// DeleteChatRoom is sent when the owner of a chat room wants to delete it, the message is the name of the chat room
+	DeleteChatRoom MessageType = 19
+	// ChangeChatPassword is sent when the owner of a chat room wants to change or remove its password
+	ChangeChatPassword MessageType = 20
+	// SetModerator is sent when the owner of a chat room wants to add or remove a moderator
+	SetModerator MessageType = 21
+	// KickUser is sent when a moderator wants to remove a user from a chat room
+	KickUser MessageType = 22
+	// BanUser is sent when a moderator wants to remove a user from a chat room, and prevent the user from joining again
+	BanUser MessageType = 23
+	// RemovedFromChat is sent by the server when the client was kicked or banned from a chat room, or the chat room was deleted
+	RemovedFromChat MessageType = 24
+	// ChatRoomRenamed is sent by the server when a chat room the client is in has been renamed
+	ChatRoomRenamed MessageType = 25
+	// SetRetention is sent when the owner of a chat room wants to change how long its messages are kept
+	SetRetention MessageType = 26
+	// GetHistory is sent when a client wants to retrieve older chat messages in a chat room
+	GetHistory MessageType = 27
+	// History is sent by the server in response to a GetHistory message
+	History MessageType = 28
+
+	// OpenDirect is sent when a client wants to open the direct conversation with another user
+	OpenDirect MessageType = 29
+	// GetDirects is sent when a client wants to retrieve a list of the direct conversations of the user
+	GetDirects MessageType = 30
+	// DirectsResponse is sent by the server in response to a GetDirects message
+	DirectsResponse MessageType = 31
+	// SendDirect is sent when a client sends a chat message in a direct conversation
+	SendDirect MessageType = 32
+
+	// CreateInvite is sent when a member of a chat room wants to create an invite to the chat room
+	CreateInvite MessageType = 33
+	// InviteCreated is sent by the server in response to a CreateInvite message
+	InviteCreated MessageType = 34
+	// RevokeInvite is sent when a client wants to revoke an invite, so it can no longer be used
+	RevokeInvite MessageType = 35
+
+	// SessionStarted is sent by the server instead of OK when a client which can resume its session logs in,
+	// or has resumed its session
+	SessionStarted MessageType = 36
+	// ResumeSession is sent by a client on a new connection to resume the session of a lost connection
+	ResumeSession MessageType = 37
+
+	// LoggedOut is sent by the server before it closes the connection of a client which was logged out,
+	// because the user logged in on another connection, or the device of the client was revoked
+	LoggedOut MessageType = 38
+
+	// AddDevice is sent when a client adds a new device to the account of the user
+	AddDevice MessageType = 39
+	// GetDevices is sent when a client requests the devices of the user
+	GetDevices MessageType = 40
+	// DevicesResponse is the response to GetDevices
+	DevicesResponse MessageType = 41
+	// RevokeDevice is sent when a client revokes a device of the user, so it can no longer log in
+	RevokeDevice MessageType = 42
+
+	// RotateKey is sent when a client replaces the key of the device it is logged in from
+	RotateKey MessageType = 43
+	// KeyChanged is sent by the server to the clients in a chat room when a member has changed the key of a device
+	KeyChanged MessageType = 44
+
+	// SendSenderKey is sent when a client distributes a new sender key in a chat room
+	SendSenderKey MessageType = 45
+	// SenderKeyReceived is sent by the server to the clients in a chat room when a sender key is distributed to them
+	SenderKeyReceived MessageType = 46
+	// AckSenderKeys is sent by a client when it has received sender keys, so the server can delete them.
+	// The server does not respond to it
+	AckSenderKeys MessageType = 47
+
+	// Hello is sent by a client when it connects, before any other message, and by the server in response
+	Hello MessageType = 48
+
+	// GetInvite is sent when a client wants to know which chat room an invite token is for
+	GetInvite MessageType = 49
+	// InviteInfo is sent by the server in response to a GetInvite message
+	InviteInfo MessageType = 50
+)
+
+// messageTypeNames is the registry of the message types of the wire protocol. As a map literal can not have
+// duplicate keys, two message types can never have the same value
+var messageTypeNames = map[MessageType]string{
+	Error:                 "Error",
+	OK:                    "OK",
+	RegisterUser:          "RegisterUser",
+	LoginUser:             "LoginUser",
+	AuthChallenge:         "AuthChallenge",
+	AuthChallengeResponse: "AuthChallengeResponse",
+	CreateChatRoom:        "CreateChatRoom",
+	GetChatRooms:          "GetChatRooms",
+	GetChatRoomsResponse:  "GetChatRoomsResponse",
+	JoinChat:              "JoinChat",
+	ChatInfo:              "ChatInfo",
+	SendChat:              "SendChat",
+	ChatMessageReceived:   "ChatMessageReceived",
+	UserJoined:            "UserJoined",
+	UserLeft:              "UserLeft",
+	LeaveChat:             "LeaveChat",
+	Ping:                  "Ping",
+	Pong:                  "Pong",
+	RenameChatRoom:        "RenameChatRoom",
+	DeleteChatRoom:        "DeleteChatRoom",
+	ChangeChatPassword:    "ChangeChatPassword",
+	SetModerator:          "SetModerator",
+	KickUser:              "KickUser",
+	BanUser:               "BanUser",
+	RemovedFromChat:       "RemovedFromChat",
+	ChatRoomRenamed:       "ChatRoomRenamed",
+	SetRetention:          "SetRetention",
+	GetHistory:            "GetHistory",
+	History:               "History",
+	OpenDirect:            "OpenDirect",
+	GetDirects:            "GetDirects",
+	DirectsResponse:       "DirectsResponse",
+	SendDirect:            "SendDirect",
+	CreateInvite:          "CreateInvite",
+	InviteCreated:         "InviteCreated",
+	RevokeInvite:          "RevokeInvite",
+	SessionStarted:        "SessionStarted",
+	ResumeSession:         "ResumeSession",
+	LoggedOut:             "LoggedOut",
+	AddDevice:             "AddDevice",
+	GetDevices:            "GetDevices",
+	DevicesResponse:       "DevicesResponse",
+	RevokeDevice:          "RevokeDevice",
+	RotateKey:             "RotateKey",
+	KeyChanged:            "KeyChanged",
+	SendSenderKey:         "SendSenderKey",
+	SenderKeyReceived:     "SenderKeyReceived",
+	AckSenderKeys:         "AckSenderKeys",
+	Hello:                 "Hello",
+	GetInvite:             "GetInvite",
+	InviteInfo:            "InviteInfo",
+}
+
+// String gets the name of the message type, or its value if it is not a known message type
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "MessageType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// ErrorCode is the code of an error sent by the server (see ErrorMessage), which clients can use to react to the
+// error, for example by asking for the password of a chat room. Like the message types, the values of the error
+// codes are part of the wire protocol and must never change
+type ErrorCode int
+
+const (
+	// CodeUnknown is the code of errors without a code, such as the errors of older servers
+	CodeUnknown ErrorCode = 0
+	// CodeInternal means that the server failed to handle the request, for example because the store failed
+	CodeInternal ErrorCode = 1
+	// CodeInvalidMessage means that the content of the request is not valid, Details["field"] is the name of
+	// the invalid field if there is one
+	CodeInvalidMessage ErrorCode = 2
+	// CodeUnsupported means that the client uses a protocol, format or scheme the server does not support,
+	// and must be updated
+	CodeUnsupported ErrorCode = 3
+	// CodeNotLoggedIn means that the request can only be sent by a client which is logged in
+	CodeNotLoggedIn ErrorCode = 4
+	// CodeUserNotFound means that the user does not exist, the client can offer to register the user
+	CodeUserNotFound ErrorCode = 5
+	// CodeUserExists means that a user with the username already exists
+	CodeUserExists ErrorCode = 6
+	// CodeAlreadyLoggedIn means that the user is logged in on another connection, and the server does not allow
+	// the user to log in again
+	CodeAlreadyLoggedIn ErrorCode = 7
+	// CodeAuthFailed means that the response to the auth challenge is not valid
+	CodeAuthFailed ErrorCode = 8
+	// CodeSessionExpired means that the session can not be resumed, and the client must log in again
+	CodeSessionExpired ErrorCode = 9
+	// CodeDeviceNotFound means that the device has not been added to the user
+	CodeDeviceNotFound ErrorCode = 10
+	// CodeDeviceRevoked means that the device, or the key of the device, has been revoked
+	CodeDeviceRevoked ErrorCode = 11
+	// CodeChatNotFound means that the chat room does not exist
+	CodeChatNotFound ErrorCode = 12
+	// CodeChatExists means that a chat room with the name already exists
+	CodeChatExists ErrorCode = 13
+	// CodePasswordRequired means that the chat room has a password, and the client did not send one
+	CodePasswordRequired ErrorCode = 14
+	// CodeInvalidPassword means that the password of the chat room is wrong
+	CodeInvalidPassword ErrorCode = 15
+	// CodeTooManyAttempts means that there were too many failed attempts, Details["retryAfter"] is the
+	// number of seconds until the client can try again
+	CodeTooManyAttempts ErrorCode = 16
+	// CodeNotInChat means that the client is not in the chat room or conversation
+	CodeNotInChat ErrorCode = 17
+	// CodeAlreadyInChat means that the client is already in the chat room or conversation
+	CodeAlreadyInChat ErrorCode = 18
+	// CodeNotMember means that the user is not a member of the chat room
+	CodeNotMember ErrorCode = 19
+	// CodeBanned means that the user is banned from the chat room
+	CodeBanned ErrorCode = 20
+	// CodeForbidden means that the user is not allowed to do this, for example because only the owner
+	// of the chat room can
+	CodeForbidden ErrorCode = 21
+	// CodeInvalidInvite means that the invite is not valid, or has expired, been revoked or used up
+	CodeInvalidInvite ErrorCode = 22
+	// CodeInvalidSignature means that the signature of a new device or key is not valid
+	CodeInvalidSignature ErrorCode = 23
+	// CodeConflict means that the change has already been made, for example the device has already been added
+	CodeConflict ErrorCode = 24
+	// CodeRateLimited means that the client sent too many messages, and must slow down. Details["retryAfter"]
+	// is the number of seconds until the message can be sent again. Clients which keep going are disconnected
+	CodeRateLimited ErrorCode = 25
+)
+
+// errorCodeNames is the registry of the error codes of the wire protocol, see messageTypeNames
+var errorCodeNames = map[ErrorCode]string{
+	CodeUnknown:          "Unknown",
+	CodeInternal:         "Internal",
+	CodeInvalidMessage:   "InvalidMessage",
+	CodeUnsupported:      "Unsupported",
+	CodeNotLoggedIn:      "NotLoggedIn",
+	CodeUserNotFound:     "UserNotFound",
+	CodeUserExists:       "UserExists",
+	CodeAlreadyLoggedIn:  "AlreadyLoggedIn",
+	CodeAuthFailed:       "AuthFailed",
+	CodeSessionExpired:   "SessionExpired",
+	CodeDeviceNotFound:   "DeviceNotFound",
+	CodeDeviceRevoked:    "DeviceRevoked",
+	CodeChatNotFound:     "ChatNotFound",
+	CodeChatExists:       "ChatExists",
+	CodePasswordRequired: "PasswordRequired",
+	CodeInvalidPassword:  "InvalidPassword",
+	CodeTooManyAttempts:  "TooManyAttempts",
+	CodeNotInChat:        "NotInChat",
+	CodeAlreadyInChat:    "AlreadyInChat",
+	CodeNotMember:        "NotMember",
+	CodeBanned:           "Banned",
+	CodeForbidden:        "Forbidden",
+	CodeInvalidInvite:    "InvalidInvite",
+	CodeInvalidSignature: "InvalidSignature",
+	CodeConflict:         "Conflict",
+	CodeRateLimited:      "RateLimited",
+}
+
+// String gets the name of the error code, or its value if it is not a known error code
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return "ErrorCode(" + strconv.Itoa(int(c)) + ")"
+}